@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager returns a certificate manager for serving TLS directly, or
+// nil when ACME_ENABLED isn't set (the usual setup terminates TLS at the
+// ingress). Certificates are issued on demand for the PUBLIC_BASE_URL host,
+// ACME_DOMAINS, and every tenant's registered custom domains; HTTP-01
+// challenges are answered on LISTEN_ADDR and TLS-ALPN-01 on TLS_LISTEN_ADDR.
+func (s *server) newACMEManager() (*autocert.Manager, error) {
+	if envOr("ACME_ENABLED", "0") != "1" {
+		return nil, nil
+	}
+	static := make(map[string]struct{})
+	if s.publicBaseURL != "" {
+		u, err := url.Parse(s.publicBaseURL)
+		if err != nil {
+			return nil, fmt.Errorf("PUBLIC_BASE_URL: %w", err)
+		}
+		if h := u.Hostname(); h != "" {
+			static[strings.ToLower(h)] = struct{}{}
+		}
+	}
+	extra, ok := normalizeDomains(strings.Split(envOr("ACME_DOMAINS", ""), ","))
+	if !ok {
+		return nil, fmt.Errorf("ACME_DOMAINS: invalid domain")
+	}
+	for _, d := range extra {
+		static[d] = struct{}{}
+	}
+
+	cacheDir := s.acmeCacheDir()
+	m := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Email:  envOr("ACME_EMAIL", ""),
+		HostPolicy: func(_ context.Context, host string) error {
+			host = strings.ToLower(host)
+			if _, ok := static[host]; ok {
+				return nil
+			}
+			if _, ok := s.tenants.byDomain(host); ok {
+				return nil
+			}
+			s.logf(logDebug, "acme_host_rejected", "host", host)
+			return fmt.Errorf("acme: host %q not configured", host)
+		},
+	}
+	if cacheDir != "" {
+		m.Cache = autocert.DirCache(cacheDir)
+	} else {
+		s.logf(logInfo, "acme_cache_disabled", "hint", "set DATA_DIR or ACME_CACHE_DIR to keep certificates across restarts")
+	}
+	if dir := envOr("ACME_DIRECTORY_URL", ""); dir != "" {
+		m.Client = &acme.Client{DirectoryURL: dir}
+	}
+	return m, nil
+}
+
+// acmeCacheDir is ACME_CACHE_DIR, defaulting to DATA_DIR/acme.
+func (s *server) acmeCacheDir() string {
+	if dir := envOr("ACME_CACHE_DIR", ""); dir != "" {
+		return dir
+	}
+	if s.store.enabled() {
+		return filepath.Join(s.store.dir, "acme")
+	}
+	return ""
+}
+
+// tlsConfig serves the device wildcard certificate for {id}.DEVICE_DOMAIN
+// and falls back to the on-demand manager for everything else. Either may be
+// nil; the result is nil when both are.
+func tlsConfig(certs *autocert.Manager, wildcard *wildcardCert) *tls.Config {
+	if wildcard == nil {
+		if certs == nil {
+			return nil
+		}
+		return certs.TLSConfig()
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certs != nil {
+		cfg = certs.TLSConfig()
+	}
+	next := cfg.GetCertificate
+	cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if wildcard.matches(hello.ServerName) || next == nil {
+			return wildcard.GetCertificate(hello)
+		}
+		return next(hello)
+	}
+	return cfg
+}
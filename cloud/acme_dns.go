@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// Per-device subdomains: with DEVICE_DOMAIN=devices.example.com, a device is
+// also reachable as {id}.devices.example.com, e.g.
+// wss://abc123.devices.example.com/ws/ui. Serving those names over TLS needs
+// a wildcard certificate, which ACME only issues over DNS-01, so the relay
+// manages it itself through a pluggable DNS provider (ACME_DNS_PROVIDER).
+
+// dnsProvider publishes and removes the _acme-challenge TXT records.
+type dnsProvider interface {
+	Present(ctx context.Context, fqdn, value string) error
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+func newDNSProvider(name string) (dnsProvider, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "exec":
+		hook := os.Getenv("ACME_DNS_HOOK")
+		if hook == "" {
+			return nil, errors.New("ACME_DNS_HOOK is required for the exec provider")
+		}
+		return execDNSProvider{hook: hook}, nil
+	case "cloudflare":
+		p := cloudflareDNSProvider{
+			token:  os.Getenv("CLOUDFLARE_API_TOKEN"),
+			zoneID: os.Getenv("CLOUDFLARE_ZONE_ID"),
+			http:   &http.Client{Timeout: 30 * time.Second},
+		}
+		if p.token == "" || p.zoneID == "" {
+			return nil, errors.New("CLOUDFLARE_API_TOKEN and CLOUDFLARE_ZONE_ID are required for the cloudflare provider")
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("unknown ACME_DNS_PROVIDER %q (want exec or cloudflare)", name)
+	}
+}
+
+// execDNSProvider runs ACME_DNS_HOOK as `hook present|cleanup <fqdn> <value>`,
+// so any DNS API can be scripted without building it into the relay.
+type execDNSProvider struct {
+	hook string
+}
+
+func (p execDNSProvider) run(ctx context.Context, action, fqdn, value string) error {
+	out, err := exec.CommandContext(ctx, p.hook, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", p.hook, action, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (p execDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+func (p execDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+// cloudflareDNSProvider manages TXT records through the Cloudflare v4 API.
+type cloudflareDNSProvider struct {
+	token  string
+	zoneID string
+	http   *http.Client
+}
+
+func (p cloudflareDNSProvider) do(ctx context.Context, method, path string, body any, out any) error {
+	var rd *bytes.Reader
+	if body != nil {
+		rd = bytes.NewReader(mustJSON(body))
+	} else {
+		rd = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "https://api.cloudflare.com/client/v4/zones/"+p.zoneID+path, rd)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var env struct {
+		Success bool            `json:"success"`
+		Errors  []any           `json:"errors"`
+		Result  json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		return fmt.Errorf("cloudflare %s %s: %s", method, path, resp.Status)
+	}
+	if !env.Success {
+		return fmt.Errorf("cloudflare %s %s: %v", method, path, env.Errors)
+	}
+	if out != nil {
+		return json.Unmarshal(env.Result, out)
+	}
+	return nil
+}
+
+func (p cloudflareDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.do(ctx, http.MethodPost, "/dns_records", map[string]any{
+		"type": "TXT", "name": fqdn, "content": value, "ttl": 120,
+	}, nil)
+}
+
+func (p cloudflareDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	var records []struct {
+		ID string `json:"id"`
+	}
+	q := url.Values{"type": {"TXT"}, "name": {fqdn}, "content": {value}}
+	if err := p.do(ctx, http.MethodGet, "/dns_records?"+q.Encode(), nil, &records); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if err := p.do(ctx, http.MethodDelete, "/dns_records/"+rec.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wildcardCert obtains and renews the *.DEVICE_DOMAIN certificate. The
+// account key and certificate live in the ACME cache dir so restarts and
+// replicas sharing the volume reuse them.
+type wildcardCert struct {
+	domain    string
+	email     string
+	dir       string
+	client    *acme.Client
+	provider  dnsProvider
+	propagate time.Duration
+	s         *server
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// newWildcardCert returns nil when DEVICE_DOMAIN or ACME_DNS_PROVIDER is
+// unset.
+func (s *server) newWildcardCert() (*wildcardCert, error) {
+	if s.deviceDomain == "" || os.Getenv("ACME_DNS_PROVIDER") == "" {
+		return nil, nil
+	}
+	provider, err := newDNSProvider(os.Getenv("ACME_DNS_PROVIDER"))
+	if err != nil {
+		return nil, err
+	}
+	dir := s.acmeCacheDir()
+	if dir == "" {
+		return nil, errors.New("wildcard certificates need DATA_DIR or ACME_CACHE_DIR")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	wc := &wildcardCert{
+		domain:    s.deviceDomain,
+		email:     envOr("ACME_EMAIL", ""),
+		dir:       dir,
+		provider:  provider,
+		propagate: envDuration("ACME_DNS_PROPAGATION_WAIT", 30*time.Second),
+		s:         s,
+	}
+	key, err := wc.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	wc.client = &acme.Client{Key: key, DirectoryURL: envOr("ACME_DIRECTORY_URL", acme.LetsEncryptURL)}
+	if cert, err := wc.loadCert(); err == nil {
+		wc.cert = cert
+	}
+	return wc, nil
+}
+
+func (wc *wildcardCert) certFile() string {
+	return filepath.Join(wc.dir, "wildcard."+wc.domain+".pem")
+}
+
+// accountKey loads or creates the ACME account key.
+func (wc *wildcardCert) accountKey() (crypto.Signer, error) {
+	path := filepath.Join(wc.dir, "dns01_account.key")
+	if b, err := os.ReadFile(path); err == nil {
+		if blk, _ := pem.Decode(b); blk != nil {
+			return x509.ParseECPrivateKey(blk.Bytes)
+		}
+		return nil, fmt.Errorf("%s: no PEM key", path)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (wc *wildcardCert) loadCert() (*tls.Certificate, error) {
+	b, err := os.ReadFile(wc.certFile())
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(b, b)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// matches reports whether serverName is covered by the wildcard.
+func (wc *wildcardCert) matches(serverName string) bool {
+	label, ok := strings.CutSuffix(strings.ToLower(serverName), "."+wc.domain)
+	return ok && label != "" && !strings.Contains(label, ".")
+}
+
+func (wc *wildcardCert) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	wc.mu.RLock()
+	defer wc.mu.RUnlock()
+	if wc.cert == nil {
+		return nil, errors.New("wildcard certificate not issued yet")
+	}
+	return wc.cert, nil
+}
+
+func (wc *wildcardCert) needsRenewal() bool {
+	wc.mu.RLock()
+	defer wc.mu.RUnlock()
+	return wc.cert == nil || wc.cert.Leaf == nil || time.Until(wc.cert.Leaf.NotAfter) < 30*24*time.Hour
+}
+
+// Run issues the certificate if needed and re-checks twice a day.
+func (wc *wildcardCert) Run(ctx context.Context) {
+	for {
+		if wc.needsRenewal() {
+			if err := wc.obtain(ctx); err != nil {
+				wc.s.logf(logInfo, "acme_dns01_failed", "domain", "*."+wc.domain, "err", err.Error())
+			} else {
+				wc.s.logf(logInfo, "acme_dns01_issued", "domain", "*."+wc.domain)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(12 * time.Hour):
+		}
+	}
+}
+
+func (wc *wildcardCert) obtain(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	acct := &acme.Account{}
+	if wc.email != "" {
+		acct.Contact = []string{"mailto:" + wc.email}
+	}
+	if _, err := wc.client.Register(ctx, acct, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("register: %w", err)
+	}
+
+	names := []string{"*." + wc.domain, wc.domain}
+	order, err := wc.client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return fmt.Errorf("order: %w", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := wc.authorize(ctx, authzURL); err != nil {
+			return err
+		}
+	}
+	if order, err = wc.client.WaitOrder(ctx, order.URI); err != nil {
+		return fmt.Errorf("wait order: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: names[0]},
+		DNSNames: names,
+	}, key)
+	if err != nil {
+		return err
+	}
+	chain, _, err := wc.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("finalize: %w", err)
+	}
+	return wc.store(key, chain)
+}
+
+// authorize satisfies one authorization with a dns-01 challenge.
+func (wc *wildcardCert) authorize(ctx context.Context, authzURL string) error {
+	authz, err := wc.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no dns-01 challenge for %s", authz.Identifier.Value)
+	}
+	value, err := wc.client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	fqdn := "_acme-challenge." + authz.Identifier.Value
+	if err := wc.provider.Present(ctx, fqdn, value); err != nil {
+		return fmt.Errorf("dns present: %w", err)
+	}
+	defer func() {
+		if err := wc.provider.CleanUp(context.WithoutCancel(ctx), fqdn, value); err != nil {
+			wc.s.logf(logInfo, "acme_dns01_cleanup_failed", "fqdn", fqdn, "err", err.Error())
+		}
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wc.propagate):
+	}
+	if _, err := wc.client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("accept: %w", err)
+	}
+	if _, err := wc.client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("wait authorization: %w", err)
+	}
+	return nil
+}
+
+func (wc *wildcardCert) store(key *ecdsa.PrivateKey, chain [][]byte) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	_ = pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	for _, c := range chain {
+		_ = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: c})
+	}
+	tmp := wc.certFile() + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, wc.certFile()); err != nil {
+		return err
+	}
+	cert, err := wc.loadCert()
+	if err != nil {
+		return err
+	}
+	wc.mu.Lock()
+	wc.cert = cert
+	wc.mu.Unlock()
+	return nil
+}
+
+// deviceSubdomain returns the device id addressed by the request's Host
+// (requestHost) when it is {id}.DEVICE_DOMAIN. Lowercasing the Host loses
+// nothing: device IDs are lowercase (normalizeDeviceID folds every ID, and
+// decodes an xn-- label, when the handler reads it from the rewritten path),
+// so espwifi-ABCD12 is espwifi-abcd12.DEVICE_DOMAIN.
+func (s *server) deviceSubdomain(r *http.Request) string {
+	if s.deviceDomain == "" {
+		return ""
+	}
+	host := strings.ToLower(requestHost(r))
+	if h, _, ok := strings.Cut(host, ":"); ok {
+		host = h
+	}
+	label, ok := strings.CutSuffix(host, "."+s.deviceDomain)
+	if !ok || label == "" || strings.Contains(label, ".") {
+		return ""
+	}
+	return label
+}
+
+// deviceSubdomainRouting maps /ws/ui and /ws/device on {id}.DEVICE_DOMAIN
+// to /ws/ui/{id} and /ws/device/{id}.
+func (s *server) deviceSubdomainRouting(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := s.deviceSubdomain(r); id != "" {
+			switch strings.TrimRight(r.URL.Path, "/") {
+			case "/ws/ui", "/ws/device":
+				r.URL.Path = strings.TrimRight(r.URL.Path, "/") + "/" + id
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The built-in admin dashboard at /admin. The page itself is static and
+// public; everything it shows or does goes through the admin API with the
+// token the operator enters, so it is exactly as gated as the API.
+//
+//go:embed admin/index.html
+var adminPage []byte
+
+type relocateRequest struct {
+	URL string `json:"url"` // ws:// or wss://
+}
+
+type sessionsClosed struct {
+	Closed int `json:"closed"`
+}
+
+type relocateMsg struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+func (s *server) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/admin" && r.URL.Path != "/admin/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+	_, _ = w.Write(adminPage)
+}
+
+// sessionsFor returns the live sessions of deviceID: one tunnel, or all of
+// them when tunnel is nil.
+func (h *hub) sessionsFor(deviceID string, tunnel *string) []*deviceConn {
+	var out []*deviceConn
+	for _, e := range h.shard(deviceID).snapshot() {
+		id, t := splitKey(e.key)
+		if id == deviceID && (tunnel == nil || *tunnel == t) {
+			out = append(out, e.dc)
+		}
+	}
+	return out
+}
+
+// handleDeviceSession acts on a device's live sessions (admin only):
+//
+//	POST /api/devices/{id}/disconnect[?tunnel=]  close them (code 4008 kicked)
+//	POST /api/devices/{id}/relocate[?tunnel=]    {"url":"wss://..."}: tell the
+//	     device to reconnect there, then close (code 4007 relocated)
+//
+// Without ?tunnel every tunnel of the device is affected.
+func (s *server) handleDeviceSession(w http.ResponseWriter, r *http.Request, deviceID, action string) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.requireRole(w, r, roleAdmin) {
+		return
+	}
+	var tunnel *string
+	if r.URL.Query().Has("tunnel") {
+		t := strings.TrimSpace(r.URL.Query().Get("tunnel"))
+		tunnel = &t
+	}
+	var target string
+	if action == "relocate" {
+		var req relocateRequest
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeJSONDecodeError(w, err)
+			return
+		}
+		u, err := url.Parse(strings.TrimSpace(req.URL))
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			writeAPIError(w, http.StatusBadRequest, "invalid_url", "url must be a ws:// or wss:// URL")
+			return
+		}
+		target = u.String()
+	}
+	sessions := s.h.sessionsFor(deviceID, tunnel)
+	if len(sessions) == 0 {
+		writeAPIError(w, http.StatusNotFound, "device_offline", "device offline")
+		return
+	}
+	closeCode := wsCloseKicked
+	if target != "" {
+		closeCode = wsCloseRelocated
+	}
+	for _, dc := range sessions {
+		if target != "" {
+			_ = dc.writeDevice(websocket.TextMessage, mustJSON(relocateMsg{Type: "relocate", URL: target}))
+		}
+		dc.closeWithReason(closeCode, wsCloseDeviceOffline)
+	}
+	writeJSON(w, http.StatusOK, sessionsClosed{Closed: len(sessions)})
+	s.logf(logInfo, "device_"+action+"_by_admin", "remote", clientIP(r), "device_id", deviceID, "sessions", len(sessions), "url", target)
+}
+
+type claimView struct {
+	Code         string    `json:"code"`
+	ID           string    `json:"id,omitempty"`
+	DeviceID     string    `json:"device_id"`
+	Tunnel       string    `json:"tunnel,omitempty"`
+	HasViewToken bool      `json:"has_view_token"`
+	RegisteredAt time.Time `json:"registered_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	MaxUses      int       `json:"max_uses,omitempty"`
+	Uses         int       `json:"uses,omitempty"`
+}
+
+// handleClaims lists pending claim codes (admin only). Tokens are never
+// shown. Devices POST here for a server-generated code; see claims.go.
+// /api/claims/{code}/send is in claimdelivery.go.
+func (s *server) handleClaims(w http.ResponseWriter, r *http.Request) {
+	if rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/claims"), "/"); rest != "" {
+		code, action, _ := strings.Cut(rest, "/")
+		if action != "send" {
+			writeJSONError(w, http.StatusNotFound, "not found")
+			return
+		}
+		s.handleSendClaim(w, r, code)
+		return
+	}
+	if r.Method == http.MethodPost {
+		s.handleCreateClaim(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.requireRole(w, r, roleAdmin) {
+		return
+	}
+	now := time.Now().UTC()
+	s.claimMu.Lock()
+	out := make([]claimView, 0, len(s.claims))
+	for code, c := range s.claims {
+		if now.After(c.ExpiresAt) {
+			continue
+		}
+		out = append(out, claimView{
+			Code:         code,
+			ID:           c.ID,
+			DeviceID:     c.DeviceID,
+			Tunnel:       c.TunnelKey,
+			HasViewToken: c.ViewToken != "",
+			RegisteredAt: c.Registered,
+			ExpiresAt:    c.ExpiresAt,
+			MaxUses:      c.MaxUses,
+			Uses:         c.Uses,
+		})
+	}
+	s.claimMu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ExpiresAt.Before(out[j].ExpiresAt) })
+	writeJSON(w, http.StatusOK, out)
+}
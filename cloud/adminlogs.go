@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// /ws/admin/logs streams the relay's own log events to admins as JSON:
+//
+//	{"ts":"...","level":"info","event":"device_ws_connected","fields":{"device_id":"abc",...}}
+//
+// Filters: ?device_id=abc, ?event=device_ws_*,ui_ws_connected (a trailing *
+// matches a prefix), and ?debug=1 to include debug events regardless of
+// LOG_LEVEL. A subscriber that falls behind loses events rather than slowing
+// the relay; it is told how many with {"event":"log_tail_dropped"}.
+
+type logEvent struct {
+	TS     time.Time         `json:"ts"`
+	Level  string            `json:"level"`
+	Event  string            `json:"event"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+type logSub struct {
+	deviceID string
+	events   []string
+	debug    bool
+
+	ch      chan logEvent
+	dropped atomic.Int64
+}
+
+func (sub *logSub) wants(level logLevel, event string, fields map[string]string) bool {
+	if level == logDebug && !sub.debug {
+		return false
+	}
+	if sub.deviceID != "" && fields["device_id"] != sub.deviceID {
+		return false
+	}
+	if len(sub.events) == 0 {
+		return true
+	}
+	for _, e := range sub.events {
+		if prefix, ok := strings.CutSuffix(e, "*"); (ok && strings.HasPrefix(event, prefix)) || e == event {
+			return true
+		}
+	}
+	return false
+}
+
+type logTail struct {
+	n atomic.Int32 // subscriber count, checked before building events
+
+	mu   sync.Mutex
+	subs map[*logSub]struct{}
+}
+
+func newLogTail() *logTail {
+	return &logTail{subs: make(map[*logSub]struct{})}
+}
+
+func (lt *logTail) active() bool { return lt.n.Load() > 0 }
+
+func (lt *logTail) subscribe(sub *logSub) {
+	lt.mu.Lock()
+	lt.subs[sub] = struct{}{}
+	lt.n.Store(int32(len(lt.subs)))
+	lt.mu.Unlock()
+}
+
+func (lt *logTail) unsubscribe(sub *logSub) {
+	lt.mu.Lock()
+	delete(lt.subs, sub)
+	lt.n.Store(int32(len(lt.subs)))
+	lt.mu.Unlock()
+}
+
+func (lt *logTail) publish(level logLevel, event string, kv []any) {
+	fields := make(map[string]string, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		k, _ := kv[i].(string)
+		if k == "" {
+			continue
+		}
+		if v, ok := kv[i+1].(string); ok && v == "" {
+			fields[k] = "" // fmtAny quotes empty strings for the text log
+		} else {
+			fields[k] = fmtAny(kv[i+1])
+		}
+	}
+	ev := logEvent{TS: time.Now().UTC(), Level: level.String(), Event: event, Fields: fields}
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	for sub := range lt.subs {
+		if !sub.wants(level, event, fields) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+func (s *server) handleAdminLogsWS(w http.ResponseWriter, r *http.Request) {
+	if !s.rbacEnabled() || !s.callerHas(r, roleAdmin) {
+		s.rejectWS(w, r, http.StatusUnauthorized, wsCloseUnauthorized, "admin_logs_ws_unauthorized", "remote", clientIP(r))
+		return
+	}
+	deviceID, ok := deviceIDFilter(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	sub := &logSub{
+		deviceID: deviceID,
+		debug:    q.Get("debug") == "1",
+		ch:       make(chan logEvent, 256),
+	}
+	for _, e := range strings.Split(q.Get("event"), ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			sub.events = append(sub.events, e)
+		}
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	s.logf(logInfo, "admin_logs_ws_connected", "remote", clientIP(r), "filter_device_id", sub.deviceID, "filter_event", q.Get("event"))
+	s.logTail.subscribe(sub)
+	defer s.logTail.unsubscribe(sub)
+
+	// Reader: only to notice the client going away (and answer pings).
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-gone:
+			return
+		case ev := <-sub.ch:
+			if n := sub.dropped.Swap(0); n > 0 {
+				lost := logEvent{TS: time.Now().UTC(), Level: logInfo.String(), Event: "log_tail_dropped", Fields: map[string]string{"count": fmtAny(n)}}
+				if conn.WriteJSON(lost) != nil {
+					return
+				}
+			}
+			if conn.WriteJSON(ev) != nil {
+				return
+			}
+		case <-ticker.C:
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)) != nil {
+				return
+			}
+		}
+	}
+}
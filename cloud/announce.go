@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"runtime/debug"
+	"strings"
+)
+
+// Devices get a registered message after connecting unless they pass
+// ?announce=0 (or ANNOUNCE_DEFAULT=0 makes it opt-in with ?announce=1, for
+// firmware that can't cope with unexpected messages).
+//
+// It always carries the relay version, the protocol version and a bitmap
+// (plus the names) of the features this relay offers the session, so
+// firmware and apps can test for a feature instead of guessing from
+// behaviour. Operators can add their own fields (region, limits, ...) with
+// ANNOUNCE_EXTRA, a JSON object merged into every registered message; it
+// can't override the built-in fields.
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version string
+
+// serverVersion is version, or failing that what the Go toolchain recorded
+// about the build.
+func serverVersion() string {
+	if version != "" {
+		return version
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "dev"
+	}
+	if v := bi.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	for _, st := range bi.Settings {
+		if st.Key == "vcs.revision" && len(st.Value) >= 12 {
+			return "dev-" + st.Value[:12]
+		}
+	}
+	return "dev"
+}
+
+// wantsAnnounce reports whether the device connecting with announce (its
+// ?announce= value) gets a registered message.
+func (s *server) wantsAnnounce(announce string) bool {
+	switch announce {
+	case "1":
+		return true
+	case "0":
+		return false
+	}
+	return s.announceDefault
+}
+
+// protocolFeature is one bit of registeredMsg.Features. Bits are never
+// reused; retired features keep their bit reserved.
+type protocolFeature uint64
+
+const (
+	featChunks        protocolFeature = 1 << iota // chunked messages (chunks.go)
+	featFrameTags                                 // ?frame_tags=1 binary frame headers
+	featFileTransfer                              // file uploads to and pushes from the device
+	featCrashReports                              // POST /api/devices/{id}/crash
+	featLogLevels                                 // log_level control on log tunnels
+	featSerial                                    // serial console on this tunnel
+	featRetryAfter                                // retry_after ahead of closes
+	featRelocate                                  // relocate ahead of a relocated close
+	featCompression                               // permessage-deflate on this session
+	featViewTokens                                // ?view_token= read-only UI tokens
+	featReconnectHint                             // registered.reconnect backoff
+	featP2P                                       // p2p_* signaling and direct handoff
+	featBWTest                                    // bwtest_* bandwidth tests
+	featUIKick                                    // kick_uis from the device
+)
+
+type protocolFeatureDoc struct {
+	Bit         int    `json:"bit"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// protocolFeatures names every bit, in bit order, for /api/protocol.
+var protocolFeatures = []protocolFeatureDoc{
+	{0, "chunks", "Chunked messages are reassembled by the relay."},
+	{1, "frame_tags", "?frame_tags=1: binary frames carry a type header."},
+	{2, "file_transfer", "File uploads to the device and pushes from it (needs a staging area)."},
+	{3, "crash_reports", "Crash reports can be uploaded (needs CRASH_DIR or DATA_DIR)."},
+	{4, "log_levels", "This is a log tunnel: log_level messages may be sent."},
+	{5, "serial", "This is a serial tunnel."},
+	{6, "retry_after", "retry_after precedes quota_exceeded, server_restarting and outside_schedule closes."},
+	{7, "relocate", "relocate precedes a relocated close."},
+	{8, "compression", "permessage-deflate was negotiated for this session."},
+	{9, "view_tokens", "?view_token= sets a read-only UI token."},
+	{10, "reconnect_hint", "registered carries reconnect backoff parameters."},
+	{11, "p2p", "p2p_* signaling between device and ?p2p=1 UIs; ice_servers lists STUN/TURN servers."},
+	{12, "bwtest", "The relay may run bwtest_* bandwidth tests over this session."},
+	{13, "ui_kick", "kick_uis disconnects (and can hold off) the session's UIs."},
+}
+
+// sessionFeatures is the feature bitmap for dc's session on tunnel.
+func (s *server) sessionFeatures(dc *deviceConn, tunnel string) protocolFeature {
+	f := featChunks | featFrameTags | featRetryAfter | featRelocate | featViewTokens | featReconnectHint | featBWTest | featUIKick
+	if s.files.stagingDir != "" {
+		f |= featFileTransfer
+	}
+	if s.crashes.dir != "" {
+		f |= featCrashReports
+	}
+	if s.isLogTunnel(tunnel) {
+		f |= featLogLevels
+	}
+	if s.isSerialTunnel(tunnel) {
+		f |= featSerial
+	}
+	if dc.compression {
+		f |= featCompression
+	}
+	if len(s.iceServers) > 0 {
+		f |= featP2P
+	}
+	return f
+}
+
+// names lists the features set in f.
+func (f protocolFeature) names() []string {
+	out := []string{}
+	for _, pf := range protocolFeatures {
+		if f&(1<<pf.Bit) != 0 {
+			out = append(out, pf.Name)
+		}
+	}
+	return out
+}
+
+// parseAnnounceExtra parses ANNOUNCE_EXTRA, rejecting keys registeredMsg
+// already uses.
+func parseAnnounceExtra(v string) (map[string]json.RawMessage, error) {
+	if strings.TrimSpace(v) == "" {
+		return nil, nil
+	}
+	var extra map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(v), &extra); err != nil {
+		return nil, fmt.Errorf("ANNOUNCE_EXTRA: not a JSON object: %w", err)
+	}
+	t := reflect.TypeOf(registeredMsg{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if _, ok := extra[name]; ok {
+			return nil, fmt.Errorf("ANNOUNCE_EXTRA: %q is a built-in field", name)
+		}
+	}
+	return extra, nil
+}
+
+// announceMessage encodes msg with the operator's extra fields merged in.
+func (s *server) announceMessage(msg registeredMsg) []byte {
+	b := mustJSON(msg)
+	if len(s.announceExtra) == 0 {
+		return b
+	}
+	fields := make(map[string]json.RawMessage, len(s.announceExtra)+16)
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return b
+	}
+	for k, v := range s.announceExtra {
+		fields[k] = v
+	}
+	return mustJSON(fields)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+)
+
+// Every REST error is a JSON envelope:
+//
+//	{"error":{"code":"invalid_device_id","message":"invalid device_id","request_id":"3f9c..."}}
+//
+// code is stable and meant for clients to branch on (the iOS app, the
+// dashboard); message is for people and may change. Where a handler has no
+// more specific code, it is derived from the status (bad_request, not_found,
+// ...). request_id matches the X-Request-ID response header and the access
+// log line, so a user's report can be tied to the relay's logs. A caller (or
+// the ingress) may supply its own X-Request-ID; anything that isn't a short
+// token is replaced.
+
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// okResponse is the body of a success that has nothing else to say.
+type okResponse struct {
+	OK bool `json:"ok"`
+}
+
+// writeAPIError writes an error envelope with the given status and code.
+func writeAPIError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(apiError{Error: apiErrorBody{Code: code, Message: msg, RequestID: w.Header().Get("X-Request-ID")}})
+}
+
+// writeJSONError writes an error envelope whose code follows from status.
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeAPIError(w, status, errorCodeFor(status), msg)
+}
+
+func errorCodeFor(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "bad_request"
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusMethodNotAllowed:
+		return "method_not_allowed"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusRequestEntityTooLarge:
+		return "too_large"
+	case http.StatusTooManyRequests:
+		return "too_many_requests"
+	case http.StatusBadGateway:
+		return "bad_gateway"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	}
+	if status >= 500 {
+		return "internal"
+	}
+	return "error"
+}
+
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// requestIDMiddleware gives every request an X-Request-ID response header.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRe.MatchString(id) {
+			id = randomToken(8)
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The audit trail answers "who turned the heater on at 3am": every command a
+// UI sends a device, and every state-changing /api/ request, with who sent
+// it, when, and a SHA-256 of the payload. AUDIT_PAYLOADS=1 also keeps text
+// payloads (up to 1KiB) with secret-looking JSON fields redacted.
+//
+// Terminal (/ws/serial) keystrokes are left out unless AUDIT_TERMINAL=1: one
+// entry per key says little and drowns everything else.
+//
+// Entries go to a memory ring (AUDIT_RETAIN, 10000) for GET /api/audit and,
+// with DATA_DIR, are appended to DATA_DIR/audit.jsonl (AUDIT_FILE) for
+// long-term retention. Past AUDIT_FILE_MAX_BYTES (64MiB) the file is moved
+// to audit.jsonl.1, replacing the previous one, and a new one started. On
+// startup the ring is refilled from the end of the file. AUDIT=off disables
+// it.
+
+type auditEntry struct {
+	TS       time.Time `json:"ts"`
+	Source   string    `json:"source"` // ui, rest or claim
+	Actor    string    `json:"actor"`
+	Remote   string    `json:"remote,omitempty"`
+	DeviceID string    `json:"device_id,omitempty"`
+	Tunnel   string    `json:"tunnel,omitempty"`
+	// REST: "METHOD /path"; UI: text or binary.
+	Action  string `json:"action"`
+	Status  int    `json:"status,omitempty"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256,omitempty"`
+	Payload string `json:"payload,omitempty"`
+	// Claim redemptions: who redeemed (see claimbind.go).
+	UserAgent string `json:"user_agent,omitempty"`
+	Origin    string `json:"origin,omitempty"`
+}
+
+type auditLog struct {
+	retain   int
+	payloads bool
+	terminal bool
+
+	mu      sync.Mutex
+	entries []auditEntry // ring, oldest at next when full
+	next    int
+	full    bool
+
+	fileCh chan auditEntry // nil without a file
+}
+
+func newAuditLog(retain int, payloads, terminal bool, file string, maxFileBytes int64) (*auditLog, error) {
+	if retain < 100 {
+		retain = 100
+	}
+	al := &auditLog{retain: retain, payloads: payloads, terminal: terminal, entries: make([]auditEntry, 0, min(retain, 1024))}
+	if file == "" {
+		return al, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return nil, err
+	}
+	al.loadTail(file)
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	al.fileCh = make(chan auditEntry, 1024)
+	go al.writeLoop(f, file, maxFileBytes)
+	return al, nil
+}
+
+// loadTail refills the ring from the file so queries survive restarts. It
+// reads back from the end only as far as the ring holds.
+func (al *auditLog) loadTail(file string) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return
+	}
+	var chunks [][]byte
+	end, lines := st.Size(), 0
+	for end > 0 && lines <= al.retain {
+		b := make([]byte, min(end, 64<<10))
+		end -= int64(len(b))
+		if _, err := f.ReadAt(b, end); err != nil {
+			return
+		}
+		chunks = append(chunks, b)
+		lines += bytes.Count(b, []byte{'\n'})
+	}
+	slices.Reverse(chunks)
+	buf := bytes.Join(chunks, nil)
+	if end > 0 {
+		// Starts mid-entry.
+		_, buf, _ = bytes.Cut(buf, []byte{'\n'})
+	}
+	for _, line := range bytes.Split(buf, []byte{'\n'}) {
+		var e auditEntry
+		if json.Unmarshal(line, &e) == nil {
+			al.addLocked(e)
+		}
+	}
+}
+
+// writeLoop appends entries to f, rotating it once it would pass maxBytes
+// (0: never).
+func (al *auditLog) writeLoop(f *os.File, file string, maxBytes int64) {
+	var size int64
+	if st, err := f.Stat(); err == nil {
+		size = st.Size()
+	}
+	w := bufio.NewWriter(f)
+	for e := range al.fileCh {
+		b, _ := json.Marshal(e)
+		b = append(b, '\n')
+		if maxBytes > 0 && size > 0 && size+int64(len(b)) > maxBytes {
+			_ = w.Flush()
+			_ = f.Close()
+			_ = os.Rename(file, file+".1")
+			nf, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+			if err != nil {
+				// Keep trying at each entry; the ring still has them.
+				f, size = nil, maxBytes
+				w.Reset(io.Discard)
+				continue
+			}
+			f, size = nf, 0
+			w.Reset(f)
+		}
+		n, _ := w.Write(b)
+		size += int64(n)
+		if len(al.fileCh) == 0 {
+			_ = w.Flush()
+		}
+	}
+}
+
+func (al *auditLog) addLocked(e auditEntry) {
+	if len(al.entries) < al.retain {
+		al.entries = append(al.entries, e)
+		return
+	}
+	al.entries[al.next] = e
+	al.next = (al.next + 1) % al.retain
+	al.full = true
+}
+
+// record adds e. It never blocks: if the file writer falls behind, the entry
+// still lands in the ring but not the file, and dropped is reported.
+func (al *auditLog) record(e auditEntry) (dropped bool) {
+	if al == nil {
+		return false
+	}
+	al.mu.Lock()
+	al.addLocked(e)
+	al.mu.Unlock()
+	if al.fileCh != nil {
+		select {
+		case al.fileCh <- e:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// recordPayload fills in size, hash and (if enabled) the redacted payload.
+func (al *auditLog) recordPayload(e auditEntry, payload []byte, text bool) bool {
+	if al == nil {
+		return false
+	}
+	sum := sha256.Sum256(payload)
+	e.Size, e.SHA256 = int64(len(payload)), hex.EncodeToString(sum[:])
+	if al.payloads && text {
+		e.Payload = truncate(string(redactJSON(payload)), 1024)
+	}
+	return al.record(e)
+}
+
+type auditQuery struct {
+	deviceID, actor, source string
+	since, until            time.Time
+	limit                   int
+}
+
+// query returns matching entries, newest first.
+func (al *auditLog) query(q auditQuery) []auditEntry {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	out := []auditEntry{}
+	n := len(al.entries)
+	for i := 0; i < n && len(out) < q.limit; i++ {
+		// Walk backwards from the newest entry.
+		idx := n - 1 - i
+		if al.full {
+			idx = (al.next - 1 - i + n) % n
+		}
+		e := al.entries[idx]
+		if (q.deviceID != "" && e.DeviceID != q.deviceID) || (q.actor != "" && e.Actor != q.actor) ||
+			(q.source != "" && e.Source != q.source) ||
+			(!q.since.IsZero() && e.TS.Before(q.since)) || (!q.until.IsZero() && e.TS.After(q.until)) {
+			continue
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+var redactedKeys = []string{"password", "passwd", "psk", "secret", "token", "key", "auth", "credential"}
+
+// redactJSON replaces the values of secret-looking fields in a JSON object
+// or array. Anything else is returned unchanged.
+func redactJSON(msg []byte) []byte {
+	out, _ := redactJSONKeys(msg, redactedKeys)
+	return out
+}
+
+// redactJSONKeys replaces the values of fields whose lowercased name
+// contains one of keys, and reports how many it replaced. msg is returned
+// as is when there are none.
+func redactJSONKeys(msg []byte, keys []string) ([]byte, int) {
+	var v any
+	if json.Unmarshal(msg, &v) != nil {
+		return msg, 0
+	}
+	n := 0
+	var walk func(any) any
+	walk = func(v any) any {
+		switch t := v.(type) {
+		case map[string]any:
+			for k, val := range t {
+				lk := strings.ToLower(k)
+				secret := false
+				for _, s := range keys {
+					if strings.Contains(lk, s) {
+						secret = true
+						break
+					}
+				}
+				if secret {
+					t[k] = "[redacted]"
+					n++
+				} else {
+					t[k] = walk(val)
+				}
+			}
+		case []any:
+			for i := range t {
+				t[i] = walk(t[i])
+			}
+		}
+		return v
+	}
+	v = walk(v)
+	if n == 0 {
+		return msg, 0
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return msg, 0
+	}
+	return b, n
+}
+
+// auditActor names the caller of r: an account, "admin", or "anonymous".
+func (s *server) auditActor(r *http.Request) string {
+	ro, name := s.roleFor(r)
+	switch {
+	case name == "admin_token":
+		return "admin"
+	case ro != roleNone:
+		return name
+	}
+	return "anonymous"
+}
+
+func (s *server) audit(e auditEntry) {
+	if s.auditLog.record(e) {
+		s.auditDropped.Inc()
+	}
+}
+
+// auditUICommand records one UI->device message.
+func (s *server) auditUICommand(dc *deviceConn, tunnel string, opts uiOptions, text bool, msg []byte) {
+	if s.auditLog == nil || opts.terminal && !s.auditLog.terminal {
+		return
+	}
+	deviceID, _ := splitKey(dc.id)
+	action := "binary"
+	if text {
+		action = "text"
+	}
+	e := auditEntry{TS: time.Now().UTC(), Source: "ui", Actor: opts.actor, Remote: opts.remote,
+		DeviceID: deviceID, Tunnel: tunnel, Action: action}
+	if s.auditLog.recordPayload(e, msg, text) {
+		s.auditDropped.Inc()
+	}
+}
+
+type hashingReader struct {
+	r io.ReadCloser
+	h hash.Hash
+	n int64
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	hr.n += int64(n)
+	return n, err
+}
+
+func (hr *hashingReader) Close() error { return hr.r.Close() }
+
+// auditREST records state-changing /api/ requests once they complete,
+// hashing whatever part of the body the handler read.
+func (s *server) auditREST(next http.Handler) http.Handler {
+	if s.auditLog == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") || r.Method == http.MethodGet || r.Method == http.MethodHead ||
+			r.Method == http.MethodOptions || isWebSocketRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		hr := &hashingReader{r: r.Body, h: sha256.New()}
+		r.Body = hr
+		sw := &statusCapturingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		var deviceID string
+		if rest, ok := strings.CutPrefix(r.URL.Path, "/api/devices/"); ok {
+			deviceID, _, _ = strings.Cut(rest, "/")
+		}
+		s.audit(auditEntry{TS: time.Now().UTC(), Source: "rest", Actor: s.auditActor(r), Remote: clientIP(r),
+			DeviceID: deviceID, Tunnel: r.URL.Query().Get("tunnel"), Action: r.Method + " " + r.URL.Path,
+			Status: status, Size: hr.n, SHA256: hex.EncodeToString(hr.h.Sum(nil))})
+	})
+}
+
+// handleAudit serves GET /api/audit (admin):
+//
+//	?device_id=&actor=&source=ui|rest|claim&since=24h|RFC3339&until=RFC3339&limit=100
+func (s *server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.requireRole(w, r, roleAdmin) {
+		return
+	}
+	if s.auditLog == nil {
+		writeAPIError(w, http.StatusNotFound, "not_configured", "audit trail disabled (AUDIT=off)")
+		return
+	}
+	deviceID, ok := deviceIDFilter(w, r)
+	if !ok {
+		return
+	}
+	qs := r.URL.Query()
+	q := auditQuery{deviceID: deviceID, actor: qs.Get("actor"), source: qs.Get("source"), limit: 100}
+	if v := qs.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 10000 {
+			writeAPIError(w, http.StatusBadRequest, "invalid_limit", "limit must be 1-10000")
+			return
+		}
+		q.limit = n
+	}
+	for _, f := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &q.since}, {"until", &q.until}} {
+		v := qs.Get(f.name)
+		if v == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			*f.dst = time.Now().Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, v); err == nil {
+			*f.dst = t
+		} else {
+			writeAPIError(w, http.StatusBadRequest, "invalid_"+f.name, f.name+" must be a duration like 24h or an RFC 3339 time")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, s.auditLog.query(q))
+}
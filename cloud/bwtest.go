@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Bandwidth tests measure round-trip time and throughput in both directions,
+// so "my camera is laggy" can be answered with numbers. There are two legs:
+//
+//   - client: GET /ws/bwtest/{id} tests the caller's own link to the relay
+//     (authorized like a UI for the device).
+//   - device: POST /api/devices/{id}/bwtest[?tunnel=] tests the relay's link
+//     to the device over its live session.
+//
+// Both run the same exchange, with the relay driving and the peer (browser
+// or firmware) answering:
+//
+//	relay  {"type":"bwtest_ping","id":T,"seq":n}        x5
+//	peer   {"type":"bwtest_pong","id":T,"seq":n}
+//	relay  binary 0x06 <filler...>                      for ?seconds= (default 3)
+//	relay  {"type":"bwtest_down_done","id":T,"bytes":N}
+//	peer   {"type":"bwtest_down_ack","id":T,"bytes":received}
+//	relay  {"type":"bwtest_up","id":T,"seconds":S}
+//	peer   binary 0x06 <filler...>                      for S seconds
+//	peer   {"type":"bwtest_up_done","id":T,"bytes":sent}
+//	relay  {"type":"bwtest_result",...}
+//
+// "down" is always relay -> peer. On a device session the test's frames are
+// consumed by the relay and never reach UIs. The last bwtestKeep results per
+// device are kept and listed by GET /api/devices/{id}/bwtest.
+
+const (
+	frameBWTest      byte = 0x06
+	bwtestPings           = 5
+	bwtestFrameSize       = 16 * 1024
+	bwtestMaxSeconds      = 10
+	bwtestKeep            = 20
+	bwtestMaxRunning      = 4
+	// Largest message taken from the client: filler frames of any
+	// reasonable size, far below the 8 MiB a UI may send.
+	bwtestReadLimit = 1 << 20
+)
+
+type bwtestMsg struct {
+	Type    string `json:"type"`
+	ID      string `json:"id"`
+	Seq     int    `json:"seq,omitempty"`
+	Bytes   int64  `json:"bytes,omitempty"`
+	Seconds int    `json:"seconds,omitempty"`
+}
+
+type bwtestResult struct {
+	Type     string    `json:"type,omitempty"` // "bwtest_result" on the wire
+	ID       string    `json:"id"`
+	DeviceID string    `json:"device_id"`
+	Leg      string    `json:"leg"` // client | device
+	Tunnel   string    `json:"tunnel,omitempty"`
+	Remote   string    `json:"remote,omitempty"`
+	By       string    `json:"by,omitempty"`
+	At       time.Time `json:"at"`
+	Seconds  int       `json:"seconds"`
+	RTTMinMS float64   `json:"rtt_min_ms"`
+	RTTAvgMS float64   `json:"rtt_avg_ms"`
+	RTTMaxMS float64   `json:"rtt_max_ms"`
+	// relay -> peer and peer -> relay.
+	DownBytes int64   `json:"down_bytes"`
+	DownMbps  float64 `json:"down_mbps"`
+	UpBytes   int64   `json:"up_bytes"`
+	UpMbps    float64 `json:"up_mbps"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// bwtestRun is one test in progress. The peer's reader feeds it; the
+// relay's side waits on events.
+type bwtestRun struct {
+	id     string
+	events chan bwtestMsg
+	rx     atomic.Int64 // test bytes received from the peer
+}
+
+func newBWTestRun() *bwtestRun {
+	return &bwtestRun{id: randomToken(6), events: make(chan bwtestMsg, 16)}
+}
+
+// feed consumes the peer's test traffic; false for anything else.
+func (run *bwtestRun) feed(mt int, msg []byte) bool {
+	if mt == websocket.BinaryMessage {
+		if len(msg) == 0 || msg[0] != frameBWTest {
+			return false
+		}
+		run.rx.Add(int64(len(msg)))
+		return true
+	}
+	if mt != websocket.TextMessage || !bytes.Contains(msg, []byte(`"bwtest_`)) {
+		return false
+	}
+	var m bwtestMsg
+	if json.Unmarshal(msg, &m) != nil || !strings.HasPrefix(m.Type, "bwtest_") || m.ID != run.id {
+		return false
+	}
+	select {
+	case run.events <- m:
+	default: // a peer flooding answers gets ignored
+	}
+	return true
+}
+
+func (run *bwtestRun) await(ctx context.Context, typ string, seq int, timeout time.Duration) (bwtestMsg, error) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		select {
+		case m := <-run.events:
+			if m.Type == typ && (seq == 0 || m.Seq == seq) {
+				return m, nil
+			}
+		case <-t.C:
+			return bwtestMsg{}, fmt.Errorf("no %s within %s", typ, timeout)
+		case <-ctx.Done():
+			return bwtestMsg{}, errors.New("peer went away")
+		}
+	}
+}
+
+func mbps(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return math.Round(float64(n*8)/d.Seconds()/1e4) / 100
+}
+
+// run drives the exchange over send, filling in res. It stops at the first
+// phase that fails and records why.
+func (run *bwtestRun) run(ctx context.Context, send func(mt int, msg []byte) error, res *bwtestResult) {
+	res.ID = run.id
+	if err := run.drive(ctx, send, res); err != nil {
+		res.Error = err.Error()
+	}
+}
+
+func (run *bwtestRun) drive(ctx context.Context, send func(mt int, msg []byte) error, res *bwtestResult) error {
+	dur := time.Duration(res.Seconds) * time.Second
+
+	var total time.Duration
+	for seq := 1; seq <= bwtestPings; seq++ {
+		start := time.Now()
+		if err := send(websocket.TextMessage, mustJSON(bwtestMsg{Type: "bwtest_ping", ID: run.id, Seq: seq})); err != nil {
+			return err
+		}
+		if _, err := run.await(ctx, "bwtest_pong", seq, 5*time.Second); err != nil {
+			return err
+		}
+		rtt := time.Since(start)
+		ms := float64(rtt.Microseconds()) / 1000
+		if seq == 1 || ms < res.RTTMinMS {
+			res.RTTMinMS = ms
+		}
+		res.RTTMaxMS = max(res.RTTMaxMS, ms)
+		total += rtt
+	}
+	res.RTTAvgMS = float64((total / bwtestPings).Microseconds()) / 1000
+
+	filler := make([]byte, bwtestFrameSize)
+	filler[0] = frameBWTest
+	start := time.Now()
+	var sent int64
+	for time.Since(start) < dur && ctx.Err() == nil {
+		if err := send(websocket.BinaryMessage, filler); err != nil {
+			return err
+		}
+		sent += int64(len(filler))
+	}
+	if err := send(websocket.TextMessage, mustJSON(bwtestMsg{Type: "bwtest_down_done", ID: run.id, Bytes: sent})); err != nil {
+		return err
+	}
+	ack, err := run.await(ctx, "bwtest_down_ack", 0, dur+10*time.Second)
+	if err != nil {
+		return err
+	}
+	res.DownBytes = min(ack.Bytes, sent)
+	res.DownMbps = mbps(res.DownBytes, time.Since(start))
+
+	run.rx.Store(0)
+	start = time.Now()
+	if err := send(websocket.TextMessage, mustJSON(bwtestMsg{Type: "bwtest_up", ID: run.id, Seconds: res.Seconds})); err != nil {
+		return err
+	}
+	if _, err := run.await(ctx, "bwtest_up_done", 0, dur+10*time.Second); err != nil {
+		return err
+	}
+	res.UpBytes = run.rx.Load()
+	res.UpMbps = mbps(res.UpBytes, time.Since(start))
+	return nil
+}
+
+func bwtestSeconds(r *http.Request) (int, bool) {
+	v := r.URL.Query().Get("seconds")
+	if v == "" {
+		return 3, true
+	}
+	n, err := strconv.Atoi(v)
+	return n, err == nil && n >= 1 && n <= bwtestMaxSeconds
+}
+
+func (s *server) acquireBWTest() bool {
+	if s.bwtestRunning.Add(1) > bwtestMaxRunning {
+		s.bwtestRunning.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (s *server) finishBWTest(res bwtestResult) {
+	s.bwtestRunning.Add(-1)
+	if err := s.bwtests.add(res); err != nil {
+		s.logf(logInfo, "bwtest_save_failed", "device_id", res.DeviceID, "error", err.Error())
+	}
+	kv := []any{"device_id", res.DeviceID, "leg", res.Leg, "id", res.ID, "rtt_avg_ms", res.RTTAvgMS,
+		"down_mbps", res.DownMbps, "up_mbps", res.UpMbps}
+	if res.Error != "" {
+		kv = append(kv, "error", res.Error)
+	}
+	s.logf(logInfo, "bwtest_done", kv...)
+}
+
+// handleBWTestWS serves /ws/bwtest/{id}: the client leg.
+func (s *server) handleBWTestWS(w http.ResponseWriter, r *http.Request) {
+	deviceID, ok := normalizeDeviceID(strings.Trim(strings.TrimPrefix(r.URL.Path, "/ws/bwtest/"), "/"))
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "invalid_device_id", "invalid device id")
+		return
+	}
+	seconds, ok := bwtestSeconds(r)
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "invalid_seconds", fmt.Sprintf("seconds must be 1-%d", bwtestMaxSeconds))
+		return
+	}
+	if !s.bwtestAuthorized(r, deviceID) {
+		s.rejectWS(w, r, http.StatusUnauthorized, wsCloseUnauthorized, "bwtest_ws_unauthorized",
+			"remote", clientIP(r), "device_id", deviceID)
+		return
+	}
+	if !s.acquireBWTest() {
+		writeAPIError(w, http.StatusTooManyRequests, "bwtest_busy", "too many bandwidth tests running")
+		return
+	}
+	res := bwtestResult{DeviceID: deviceID, Leg: "client", Remote: clientIP(r), By: s.auditActor(r), At: time.Now().UTC(), Seconds: seconds}
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.bwtestRunning.Add(-1)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(bwtestReadLimit)
+
+	run := newBWTestRun()
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if mt == websocket.BinaryMessage {
+				run.rx.Add(int64(len(msg))) // browsers needn't tag their filler
+				continue
+			}
+			run.feed(mt, msg)
+		}
+	}()
+	run.run(ctx, conn.WriteMessage, &res)
+	s.finishBWTest(res)
+	res.Type = "bwtest_result"
+	_ = conn.WriteMessage(websocket.TextMessage, mustJSON(res))
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
+
+// bwtestAuthorized admits whoever could open a UI for deviceID: an API key
+// with at least viewer role whose account holds the device, or the device's
+// UI or view token.
+func (s *server) bwtestAuthorized(r *http.Request, deviceID string) bool {
+	if (s.uiAuthToken != "" && !authOK(r, s.uiAuthToken)) || !s.hostAllows(r, deviceID) || !s.ownerAllows(r, deviceID) {
+		return false
+	}
+	if ro, _ := s.roleFor(r); ro >= roleViewer && s.accountHolds(r, deviceID) {
+		return true
+	}
+	dc := s.h.getDevice(makeKey(deviceID, ""))
+	if dc == nil {
+		return false
+	}
+	_, ok := dc.scopeFor(extractToken(r))
+	return ok
+}
+
+// handleDeviceBWTest serves /api/devices/{id}/bwtest: GET lists past
+// results, POST runs the device leg and returns its result.
+func (s *server) handleDeviceBWTest(w http.ResponseWriter, r *http.Request, deviceID string) {
+	switch r.Method {
+	case http.MethodGet:
+		if !s.requireRole(w, r, roleViewer) {
+			return
+		}
+		writeJSON(w, http.StatusOK, s.bwtests.list(deviceID))
+	case http.MethodPost:
+		if !s.requireRole(w, r, roleOperator) {
+			return
+		}
+		seconds, ok := bwtestSeconds(r)
+		if !ok {
+			writeAPIError(w, http.StatusBadRequest, "invalid_seconds", fmt.Sprintf("seconds must be 1-%d", bwtestMaxSeconds))
+			return
+		}
+		tunnel := strings.TrimSpace(r.URL.Query().Get("tunnel"))
+		dc := s.h.getDevice(makeKey(deviceID, tunnel))
+		if dc == nil {
+			writeAPIError(w, http.StatusNotFound, "device_offline", "device offline")
+			return
+		}
+		run := newBWTestRun()
+		if !dc.bwtest.CompareAndSwap(nil, run) {
+			writeAPIError(w, http.StatusConflict, "bwtest_busy", "a bandwidth test is already running on this session")
+			return
+		}
+		defer dc.bwtest.Store(nil)
+		if !s.acquireBWTest() {
+			writeAPIError(w, http.StatusTooManyRequests, "bwtest_busy", "too many bandwidth tests running")
+			return
+		}
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-dc.closed:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		res := bwtestResult{DeviceID: deviceID, Leg: "device", Tunnel: tunnel, By: s.auditActor(r), At: time.Now().UTC(), Seconds: seconds}
+		run.run(ctx, dc.writeDevice, &res)
+		s.finishBWTest(res)
+		writeJSON(w, http.StatusOK, res)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// bwtestStore keeps each device's recent results.
+type bwtestStore struct {
+	store *fileStore
+
+	mu      sync.Mutex
+	results map[string][]bwtestResult // oldest first
+}
+
+const bwtestDoc = "bwtests"
+
+func newBWTestStore(store *fileStore) *bwtestStore {
+	return &bwtestStore{store: store, results: make(map[string][]bwtestResult)}
+}
+
+func (bs *bwtestStore) load() error {
+	var list []bwtestResult
+	if err := bs.store.load(bwtestDoc, &list); err != nil {
+		return err
+	}
+	byID := make(map[string][]bwtestResult)
+	for _, res := range list {
+		if res.DeviceID != "" {
+			byID[res.DeviceID] = append(byID[res.DeviceID], res)
+		}
+	}
+	results, moved, dropped := canonicalDeviceKeys(byID)
+	for id, rs := range results {
+		for i := range rs {
+			rs[i].DeviceID = id
+		}
+	}
+	bs.store.noteLegacyIDs(bwtestDoc, moved, dropped)
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.results = results
+	return nil
+}
+
+func (bs *bwtestStore) saveLocked() error {
+	var list []bwtestResult
+	for _, rs := range bs.results {
+		list = append(list, rs...)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].DeviceID != list[j].DeviceID {
+			return list[i].DeviceID < list[j].DeviceID
+		}
+		return list[i].At.Before(list[j].At)
+	})
+	return bs.store.save(bwtestDoc, list)
+}
+
+func (bs *bwtestStore) add(res bwtestResult) error {
+	res.Type = ""
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	rs := append(bs.results[res.DeviceID], res)
+	if len(rs) > bwtestKeep {
+		rs = rs[len(rs)-bwtestKeep:]
+	}
+	bs.results[res.DeviceID] = rs
+	return bs.saveLocked()
+}
+
+// list returns deviceID's results, newest first.
+func (bs *bwtestStore) list(deviceID string) []bwtestResult {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	rs := bs.results[deviceID]
+	out := make([]bwtestResult, len(rs))
+	for i, res := range rs {
+		out[len(rs)-1-i] = res
+	}
+	return out
+}
+
+func (bs *bwtestStore) remove(deviceID string) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if _, ok := bs.results[deviceID]; !ok {
+		return nil
+	}
+	delete(bs.results, deviceID)
+	return bs.saveLocked()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+)
+
+// Devices can say what they can do when they connect, as a JSON object in
+// the X-Device-Capabilities header or the ?capabilities= query parameter:
+//
+//	{"tunnels":["ws_control","ws_camera"],"camera":true,"relays":4,"ota":true}
+//
+// The shape is up to the firmware; the relay only requires an object of at
+// most 4KiB. /api/devices reports each device's capabilities merged across
+// its connected tunnels (the control tunnel wins on conflicting keys, and
+// "tunnels" lists are unioned), so dashboards can render the right controls
+// without probing. ?capability=camera keeps only devices with a truthy
+// "camera".
+
+const maxCapabilitiesBytes = 4 << 10
+
+// parseCapabilities reads the capabilities r declares, if any.
+func parseCapabilities(r *http.Request) (map[string]any, error) {
+	v := r.Header.Get("X-Device-Capabilities")
+	if v == "" {
+		v = r.URL.Query().Get("capabilities")
+	}
+	if v == "" {
+		return nil, nil
+	}
+	if len(v) > maxCapabilitiesBytes {
+		return nil, errors.New("capabilities larger than 4KiB")
+	}
+	var caps map[string]any
+	if err := json.Unmarshal([]byte(v), &caps); err != nil || caps == nil {
+		return nil, errors.New("capabilities must be a JSON object")
+	}
+	return caps, nil
+}
+
+// capabilityDecl is what one session of a device declared.
+type capabilityDecl struct {
+	tunnel string
+	caps   map[string]any
+}
+
+// isControlTunnel reports whether tunnel is a device's control tunnel: the
+// default one or ws_control.
+func isControlTunnel(tunnel string) bool {
+	return tunnel == "" || tunnel == "ws_control"
+}
+
+// mergeCapabilities combines one device's declarations; nil if there are
+// none.
+func mergeCapabilities(decls []capabilityDecl) map[string]any {
+	if len(decls) == 0 {
+		return nil
+	}
+	if len(decls) == 1 {
+		return decls[0].caps
+	}
+	// Apply the control tunnel last so it wins.
+	sort.Slice(decls, func(i, j int) bool {
+		if ci, cj := isControlTunnel(decls[i].tunnel), isControlTunnel(decls[j].tunnel); ci != cj {
+			return cj
+		}
+		return decls[i].tunnel < decls[j].tunnel
+	})
+	out := make(map[string]any)
+	var tunnels []any
+	seen := make(map[string]bool)
+	for _, d := range decls {
+		for k, v := range d.caps {
+			out[k] = v
+		}
+		if list, ok := d.caps["tunnels"].([]any); ok {
+			for _, t := range list {
+				if name, ok := t.(string); ok && !seen[name] {
+					seen[name] = true
+					tunnels = append(tunnels, name)
+				}
+			}
+		}
+	}
+	if tunnels != nil {
+		out["tunnels"] = tunnels
+	}
+	return out
+}
+
+// hasCapability reports whether caps[name] is set to something other than
+// false, 0, "" or null.
+func hasCapability(caps map[string]any, name string) bool {
+	switch v := caps[name].(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	default:
+		return true
+	}
+}
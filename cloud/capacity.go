@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// capacityPolicy decides what happens when a new device session would push
+// the node past MAX_DEVICES.
+type capacityPolicy string
+
+const (
+	// capacityReject refuses the newcomer with a retry hint.
+	capacityReject capacityPolicy = "reject"
+	// capacityEvictIdle disconnects the longest-idle session to make room:
+	// the one with the oldest application message either way. Pings and
+	// pongs don't count, or every healthy session would look busy.
+	capacityEvictIdle capacityPolicy = "evict_idle"
+)
+
+func parseCapacityPolicy(s string) capacityPolicy {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "evict", "evict_idle", "evict-idle":
+		return capacityEvictIdle
+	default:
+		return capacityReject
+	}
+}
+
+// admitDevice installs dc under id, honoring the device limit. Replacing an
+// existing session for the same id never counts against the limit. If the
+// node is full, either nothing is installed (ok=false) or the longest-idle
+// session is removed from the hub and returned as evicted for the caller to
+// close outside the lock.
+func (h *hub) admitDevice(id string, dc *deviceConn, max int, policy capacityPolicy) (old, evicted *deviceConn, ok bool) {
+	// Disconnects only lower the count, so holding admitMu is enough for
+	// the limit to hold.
+	h.admitMu.Lock()
+	defer h.admitMu.Unlock()
+	if max > 0 && h.getDevice(id) == nil && h.count() >= max {
+		if policy != capacityEvictIdle {
+			return nil, nil, false
+		}
+		var victimKey string
+		var victimIdle int64
+		for _, e := range h.entries() {
+			if last := e.dc.lastMessage.Load(); evicted == nil || last < victimIdle {
+				victimKey, victimIdle, evicted = e.key, last, e.dc
+			}
+		}
+		if evicted != nil {
+			// A no-op if it disconnected meanwhile, which frees the slot anyway.
+			h.deleteDevice(victimKey, evicted)
+		}
+	}
+	sh := h.shard(id)
+	sh.mu.Lock()
+	old = sh.devices[id]
+	sh.devices[id] = dc
+	if old == nil {
+		h.n.Add(1)
+		h.sessionAddedLocked(sh, id)
+	}
+	if h.onSession != nil {
+		h.onSession(id, dc, true)
+	}
+	sh.publishLocked()
+	sh.wakeWaitersLocked(id)
+	sh.mu.Unlock()
+	return old, evicted, true
+}
+
+// rejectWSRetry is rejectWS with a retry hint: a Retry-After header for plain
+// HTTP clients, or a {"type":"retry_after"} message ahead of the close frame
+// for WebSocket clients.
+func (s *server) rejectWSRetry(w http.ResponseWriter, r *http.Request, httpStatus int, wc wsClose, retryAfter time.Duration, logKey string, kv ...any) {
+	secs := int(retryAfter / time.Second)
+	if isWSUpgrade(r) {
+		c, err := s.upgrader.Upgrade(w, r, nil)
+		if err == nil && c != nil {
+			_ = c.WriteMessage(websocket.TextMessage, retryAfterMessage(wc, retryAfter))
+			sendClose(c, wc)
+			_ = c.Close()
+			s.logf(logInfo, logKey, kv...)
+			return
+		}
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	writeAPIError(w, httpStatus, wc.Reason, wc.Reason)
+	s.logf(logInfo, logKey, kv...)
+}
+
+func retryAfterMessage(wc wsClose, retryAfter time.Duration) []byte {
+	return mustJSON(retryAfterMsg{Type: "retry_after", Reason: wc.Reason, Seconds: int(retryAfter / time.Second)})
+}
+
+// deviceCapacityFull is a cheap pre-upgrade check so plain HTTP clients get a
+// Retry-After header; admitDevice remains the authoritative check.
+func (s *server) deviceCapacityFull(key string) bool {
+	return s.maxDevices > 0 && s.capacityPolicy == capacityReject &&
+		s.h.getDevice(key) == nil && s.h.count() >= s.maxDevices
+}
+
+func (s *server) registerCapacityMetrics() {
+	s.metrics.newGaugeFunc("espwifi_device_sessions", "Connected device sessions (device_id+tunnel) on this node.", nil,
+		func(emit func(float64, ...string)) { emit(float64(s.h.count())) })
+	s.metrics.newGaugeFunc("espwifi_device_sessions_max", "Configured device session limit (0 = unlimited).", nil,
+		func(emit func(float64, ...string)) { emit(float64(s.maxDevices)) })
+	s.metrics.newGaugeFunc("espwifi_device_capacity_ratio", "Device sessions as a fraction of the limit (0 when unlimited).", nil,
+		func(emit func(float64, ...string)) {
+			if s.maxDevices <= 0 {
+				emit(0)
+				return
+			}
+			emit(float64(s.h.count()) / float64(s.maxDevices))
+		})
+	s.capacityRejected = s.metrics.newCounter("espwifi_device_capacity_rejected_total", "Device sessions refused because the node was full.")
+	s.capacityEvicted = s.metrics.newCounter("espwifi_device_capacity_evicted_total", "Idle device sessions evicted to make room for new ones.")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Chunked messages let a device send payloads larger than it can buffer
+// (filesystem images, long logs) as a sequence of small frames that the relay
+// reassembles and forwards to UIs as one message:
+//
+//	text    {"type":"chunk_begin","id":"fs1","kind":"binary","size":123456}
+//	binary  0x05 <flags> <len(id)> <id> <data...>   (repeated)
+//	text    {"type":"chunk_end","id":"fs1","sha256":"<hex, optional>"}
+//
+// kind is "binary" (default) or "text"; size is optional but, when given,
+// must match. Frames of several transfers may interleave. Failures are
+// reported back to the device as {"type":"error","code":"chunk_invalid"}.
+// On a ?frame_tags=1 session the reassembled binary payload must itself
+// start with a frame header.
+const frameChunk byte = 0x05
+
+type chunkControl struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Kind   string `json:"kind,omitempty"`
+	Size   int    `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+type chunkTransfer struct {
+	mt      int
+	size    int
+	buf     bytes.Buffer
+	started time.Time
+}
+
+// chunkAssembler holds a device session's open transfers. It is only used
+// from the session's reader goroutine, which must not drop chunks the way it
+// drops frames when UIs are slow.
+type chunkAssembler struct {
+	maxBytes int
+	maxOpen  int
+	timeout  time.Duration
+	open     map[string]*chunkTransfer
+}
+
+func newChunkAssembler(maxBytes int) *chunkAssembler {
+	return &chunkAssembler{maxBytes: maxBytes, maxOpen: 4, timeout: 2 * time.Minute, open: make(map[string]*chunkTransfer)}
+}
+
+// feed inspects a device message. consumed is false for ordinary messages.
+// A completed transfer is returned as (mt, out); reply, if set, goes back to
+// the device.
+func (a *chunkAssembler) feed(mt int, msg []byte, now time.Time) (outMT int, out, reply []byte, consumed bool) {
+	switch mt {
+	case websocket.BinaryMessage:
+		if len(a.open) == 0 || len(msg) < 3 || msg[0] != frameChunk {
+			return 0, nil, nil, false
+		}
+		idLen := int(msg[2])
+		if len(msg) < 3+idLen {
+			return 0, nil, nil, false
+		}
+		id := string(msg[3 : 3+idLen])
+		t := a.open[id]
+		if t == nil {
+			return 0, nil, nil, false
+		}
+		if t.buf.Len()+len(msg)-3-idLen > a.maxBytes {
+			delete(a.open, id)
+			return 0, nil, chunkError(id, "transfer exceeds CHUNK_MAX_BYTES"), true
+		}
+		t.buf.Write(msg[3+idLen:])
+		return 0, nil, nil, true
+
+	case websocket.TextMessage:
+		if !bytes.Contains(msg, []byte(`"chunk_`)) {
+			return 0, nil, nil, false
+		}
+		var c chunkControl
+		if json.Unmarshal(msg, &c) != nil || !strings.HasPrefix(c.Type, "chunk_") {
+			return 0, nil, nil, false
+		}
+		if c.ID == "" || len(c.ID) > 255 {
+			return 0, nil, chunkError(c.ID, "missing or oversized id"), true
+		}
+		switch c.Type {
+		case "chunk_begin":
+			a.expire(now)
+			if len(a.open) >= a.maxOpen {
+				return 0, nil, chunkError(c.ID, "too many open transfers"), true
+			}
+			if c.Size > a.maxBytes {
+				return 0, nil, chunkError(c.ID, "transfer exceeds CHUNK_MAX_BYTES"), true
+			}
+			t := &chunkTransfer{mt: websocket.BinaryMessage, size: c.Size, started: now}
+			if c.Kind == "text" {
+				t.mt = websocket.TextMessage
+			}
+			a.open[c.ID] = t
+			return 0, nil, nil, true
+		case "chunk_end":
+			t := a.open[c.ID]
+			if t == nil {
+				return 0, nil, chunkError(c.ID, "unknown transfer"), true
+			}
+			delete(a.open, c.ID)
+			data := t.buf.Bytes()
+			if t.size > 0 && len(data) != t.size {
+				return 0, nil, chunkError(c.ID, "size mismatch"), true
+			}
+			if c.SHA256 != "" {
+				sum := sha256.Sum256(data)
+				if !strings.EqualFold(c.SHA256, hex.EncodeToString(sum[:])) {
+					return 0, nil, chunkError(c.ID, "sha256 mismatch"), true
+				}
+			}
+			return t.mt, data, nil, true
+		}
+	}
+	return 0, nil, nil, false
+}
+
+// expire drops transfers that never finished.
+func (a *chunkAssembler) expire(now time.Time) {
+	for id, t := range a.open {
+		if now.Sub(t.started) > a.timeout {
+			delete(a.open, id)
+		}
+	}
+}
+
+func chunkError(id, message string) []byte {
+	return mustJSON(errorMsg{Type: "error", Code: "chunk_invalid", ID: id, Message: message})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TOTP claim codes let a device derive its claim code from a per-device
+// secret and the current time instead of registering a random code with the
+// relay on every boot. The derivation is RFC 6238 (HMAC-SHA1 over the time
+// step counter) with the RFC 4226 dynamic offset, except that 40 bits are
+// taken instead of 31 and rendered as 8 characters of the same unambiguous
+// alphabet the firmware uses for random claim codes. A TOTP code is only
+// accepted together with the device_id it was derived for:
+//
+//	counter = floor(unix_seconds / step)
+//	h       = HMAC-SHA1(secret, uint64_be(counter))
+//	o       = h[19] & 0x0f
+//	v       = h[o:o+5] as a 40-bit big-endian integer
+//	code    = 8 x 5-bit groups of v, most significant first, as claimAlphabet
+const claimAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// totpClaimCode computes the claim code for secret at the given step counter.
+func totpClaimCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	h := mac.Sum(nil)
+	o := h[len(h)-1] & 0x0f
+	var v uint64
+	for _, b := range h[o : o+5] {
+		v = v<<8 | uint64(b)
+	}
+	var code [8]byte
+	for i := 7; i >= 0; i-- {
+		code[i] = claimAlphabet[v&31]
+		v >>= 5
+	}
+	return string(code[:])
+}
+
+var totpSecretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpClaims tracks which (device, step) codes were already redeemed so a
+// code can't be replayed inside its validity window.
+type totpClaims struct {
+	step time.Duration
+	skew int // steps accepted either side of now
+
+	mu   sync.Mutex
+	used map[string]time.Time // device_id|counter -> expiry
+}
+
+func newTOTPClaims(step time.Duration, skew int) *totpClaims {
+	if step < time.Second {
+		step = 60 * time.Second
+	}
+	return &totpClaims{step: step, skew: skew, used: make(map[string]time.Time)}
+}
+
+// match reports whether code is valid for secret at now and not yet used,
+// consuming it if so.
+func (t *totpClaims) match(deviceID string, secret []byte, code string, now time.Time) bool {
+	cur := uint64(now.Unix()) / uint64(t.step/time.Second)
+	for d := -t.skew; d <= t.skew; d++ {
+		counter := cur + uint64(d)
+		if subtle.ConstantTimeCompare([]byte(totpClaimCode(secret, counter)), []byte(code)) != 1 {
+			continue
+		}
+		key := deviceID + "|" + strconv.FormatUint(counter, 10)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for k, exp := range t.used {
+			if now.After(exp) {
+				delete(t.used, k)
+			}
+		}
+		if _, seen := t.used[key]; seen {
+			return false
+		}
+		t.used[key] = now.Add(time.Duration(2*t.skew+1) * t.step)
+		return true
+	}
+	return false
+}
+
+// redeemTOTPClaim checks code against the TOTP secret of deviceID, which
+// the caller must name: trying every registered device would cost a scan
+// of the registry per guess and let one guess match any of them. The
+// returned entry carries the live session's UI token, so the device must be
+// online on tunnel.
+func (s *server) redeemTOTPClaim(code, deviceID, tunnel string, now time.Time) (claimEntry, bool) {
+	if len(code) != 8 || deviceID == "" {
+		return claimEntry{}, false
+	}
+	d, ok := s.registry.get(deviceID)
+	if !ok || d.ClaimSecret == "" {
+		return claimEntry{}, false
+	}
+	secret, err := totpSecretEncoding.DecodeString(d.ClaimSecret)
+	if err != nil {
+		return claimEntry{}, false
+	}
+	dc := s.h.getDevice(makeKey(d.DeviceID, tunnel))
+	if dc == nil || dc.uiToken == "" {
+		return claimEntry{}, false
+	}
+	if !s.totp.match(d.DeviceID, secret, code, now) {
+		return claimEntry{}, false
+	}
+	return claimEntry{DeviceID: d.DeviceID, TunnelKey: tunnel, Token: dc.uiToken, ViewToken: dc.viewToken}, true
+}
+
+// claimSecretResponse is everything the device needs to show TOTP claim
+// codes; the secret is not shown again.
+type claimSecretResponse struct {
+	DeviceID    string `json:"device_id"`
+	ClaimSecret string `json:"claim_secret"`
+	StepS       int    `json:"step_s"`
+	Alphabet    string `json:"alphabet"`
+}
+
+// handleDeviceClaimSecret provisions a device's TOTP claim secret:
+//
+//	PUT    /api/devices/{id}/claim-secret  generate a new secret (returned once, base32)
+//	DELETE /api/devices/{id}/claim-secret  disable TOTP claims for the device
+func (s *server) handleDeviceClaimSecret(w http.ResponseWriter, r *http.Request, deviceID string) {
+	if !s.requireRole(w, r, roleAdmin) {
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		secret := totpSecretEncoding.EncodeToString(randomBytes(20))
+		if err := s.registry.setClaimSecret(deviceID, secret); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist registry")
+			return
+		}
+		writeJSON(w, http.StatusOK, claimSecretResponse{
+			DeviceID:    deviceID,
+			ClaimSecret: secret,
+			StepS:       int(s.totp.step / time.Second),
+			Alphabet:    claimAlphabet,
+		})
+		s.logf(logInfo, "device_claim_secret_set", "remote", clientIP(r), "device_id", deviceID)
+	case http.MethodDelete:
+		if err := s.registry.setClaimSecret(deviceID, ""); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist registry")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		s.logf(logInfo, "device_claim_secret_removed", "remote", clientIP(r), "device_id", deviceID)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Claim approval: with CLAIM_APPROVAL set, redeeming a code no longer hands
+// out the device's token. It files a request that the device's owner, or an
+// admin, approves or denies; the redeemer polls for the outcome. Anyone who
+// reads a sticker in a shared space can then ask, but not get in.
+//
+//	CLAIM_APPROVAL=owned  devices that have an owner (their owner approves)
+//	CLAIM_APPROVAL=all    every device (admins approve unowned ones)
+//
+//	POST /api/claim                          202 {"pending":true,"request_id","poll_token",...}
+//	GET  /api/claim?request=<poll_token>     202 while pending, 403 once denied, else the claim
+//	GET  /api/claim-requests                 requests the caller may decide
+//	POST /api/claim-requests/{id}/approve
+//	POST /api/claim-requests/{id}/deny
+//
+// The code is used up by the request either way; requests and their
+// outcome are kept for CLAIM_APPROVAL_TTL (1h), in memory only, on the node
+// that filed them (each node sweeps its own), so behind several nodes the
+// poll and the decision must reach that node.
+
+const (
+	claimPending  = "pending"
+	claimApproved = "approved"
+	claimDenied   = "denied"
+)
+
+type pendingClaim struct {
+	ID          string    `json:"id"`
+	DeviceID    string    `json:"device_id"`
+	Tunnel      string    `json:"tunnel,omitempty"`
+	Scope       string    `json:"scope"`
+	Account     string    `json:"account,omitempty"`
+	Remote      string    `json:"remote"`
+	Status      string    `json:"status"`
+	DecidedBy   string    `json:"decided_by,omitempty"`
+	RequestedAt time.Time `json:"requested_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+
+	code     string
+	entry    claimEntry
+	viewOnly bool
+	pollHash string
+}
+
+// claimPendingResponse answers a claim waiting for approval, and polls of
+// it while it waits.
+type claimPendingResponse struct {
+	Pending   bool      `json:"pending"`
+	RequestID string    `json:"request_id"`
+	PollToken string    `json:"poll_token,omitempty"` // only when filed
+	DeviceID  string    `json:"device_id,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type claimApprovals struct {
+	mode string // "", "owned" or "all"
+	ttl  time.Duration
+
+	mu       sync.Mutex
+	requests map[string]*pendingClaim // by ID
+}
+
+func newClaimApprovals(mode string, ttl time.Duration) *claimApprovals {
+	switch mode = strings.ToLower(strings.TrimSpace(mode)); mode {
+	case "", "off", "0":
+		mode = ""
+	case "owned", "all":
+	default:
+		mode = "all"
+	}
+	return &claimApprovals{mode: mode, ttl: ttl, requests: make(map[string]*pendingClaim)}
+}
+
+// claimNeedsApproval reports whether claims on deviceID wait for approval.
+func (s *server) claimNeedsApproval(deviceID string) bool {
+	switch s.claimApprovals.mode {
+	case "all":
+		return true
+	case "owned":
+		d, ok := s.registry.get(deviceID)
+		return ok && d.Owner != ""
+	}
+	return false
+}
+
+// holdClaim files a redeemed code as a request for approval.
+func (s *server) holdClaim(w http.ResponseWriter, r *http.Request, code string, ce claimEntry, tunnel string, viewOnly bool, account string) {
+	ca := s.claimApprovals
+	now := time.Now().UTC()
+	poll := randomToken(24)
+	pc := &pendingClaim{
+		ID:          randomToken(6),
+		DeviceID:    ce.DeviceID,
+		Tunnel:      tunnel,
+		Scope:       uiScopeControl.String(),
+		Account:     account,
+		Remote:      clientIP(r),
+		Status:      claimPending,
+		RequestedAt: now,
+		ExpiresAt:   now.Add(ca.ttl),
+		code:        code,
+		entry:       ce,
+		viewOnly:    viewOnly,
+		pollHash:    hashSecret(poll),
+	}
+	if viewOnly {
+		pc.Scope = uiScopeView.String()
+	}
+	ca.mu.Lock()
+	ca.requests[pc.ID] = pc
+	ca.mu.Unlock()
+
+	writeJSON(w, http.StatusAccepted, claimPendingResponse{
+		Pending:   true,
+		RequestID: pc.ID,
+		PollToken: poll,
+		DeviceID:  pc.DeviceID,
+		ExpiresAt: pc.ExpiresAt,
+	})
+	s.logf(logInfo, "claim_pending", "remote", pc.Remote, "device_id", pc.DeviceID, "tunnel", tunnel,
+		"scope", pc.Scope, "account", account, "request_id", pc.ID)
+}
+
+// pollClaim answers GET /api/claim?request=<poll_token>.
+func (s *server) pollClaim(w http.ResponseWriter, r *http.Request) {
+	ca := s.claimApprovals
+	h := []byte(hashSecret(r.URL.Query().Get("request")))
+	now := time.Now()
+	ca.mu.Lock()
+	var pc *pendingClaim
+	for _, c := range ca.requests {
+		if subtle.ConstantTimeCompare(h, []byte(c.pollHash)) == 1 && now.Before(c.ExpiresAt) {
+			pc = c
+			break
+		}
+	}
+	var got pendingClaim
+	if pc != nil {
+		got = *pc
+		if pc.Status != claimPending {
+			// The outcome is told once.
+			delete(ca.requests, pc.ID)
+		}
+	}
+	ca.mu.Unlock()
+
+	switch {
+	case pc == nil:
+		writeAPIError(w, http.StatusNotFound, "claim_request_not_found", "unknown or expired request")
+	case got.Status == claimPending:
+		writeJSON(w, http.StatusAccepted, claimPendingResponse{Pending: true, RequestID: got.ID, ExpiresAt: got.ExpiresAt})
+	case got.Status == claimDenied:
+		writeAPIError(w, http.StatusForbidden, "claim_denied", "claim denied")
+	default:
+		s.grantClaim(w, r, got.code, got.entry, got.Tunnel, got.viewOnly, got.Account, true)
+	}
+}
+
+// mayDecideClaim: the device's owner, or an admin.
+func (s *server) mayDecideClaim(r *http.Request, deviceID string) bool {
+	account, ro := s.callerAccount(r)
+	if ro >= roleAdmin {
+		return true
+	}
+	d, _ := s.registry.get(deviceID)
+	return d.Owner != "" && account == d.Owner
+}
+
+// handleClaimRequests lists pending claims and approves or denies them.
+func (s *server) handleClaimRequests(w http.ResponseWriter, r *http.Request) {
+	if ro, _ := s.roleFor(r); ro == roleNone {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	ca := s.claimApprovals
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/claim-requests"), "/")
+	if rest == "" {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		now := time.Now()
+		ca.mu.Lock()
+		out := []pendingClaim{}
+		for _, pc := range ca.requests {
+			if pc.Status == claimPending && now.Before(pc.ExpiresAt) {
+				out = append(out, *pc)
+			}
+		}
+		ca.mu.Unlock()
+		visible := out[:0]
+		for _, pc := range out {
+			if s.mayDecideClaim(r, pc.DeviceID) {
+				visible = append(visible, pc)
+			}
+		}
+		sort.Slice(visible, func(i, j int) bool { return visible[i].RequestedAt.Before(visible[j].RequestedAt) })
+		writeJSON(w, http.StatusOK, visible)
+		return
+	}
+
+	id, action, _ := strings.Cut(rest, "/")
+	status := map[string]string{"approve": claimApproved, "deny": claimDenied}[action]
+	if status == "" || strings.Contains(id, "/") {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	ca.mu.Lock()
+	pc := ca.requests[id]
+	if pc == nil || pc.Status != claimPending || time.Now().After(pc.ExpiresAt) || !s.mayDecideClaim(r, pc.DeviceID) {
+		ca.mu.Unlock()
+		writeAPIError(w, http.StatusNotFound, "claim_request_not_found", "no such pending request")
+		return
+	}
+	decidedBy := s.auditActor(r)
+	pc.Status, pc.DecidedBy = status, decidedBy
+	out := *pc
+	ca.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, out)
+	s.logf(logInfo, "claim_"+status, "remote", clientIP(r), "device_id", out.DeviceID, "request_id", out.ID,
+		"account", out.Account, "decided_by", decidedBy)
+}
+
+// sweep drops requests past their expiry.
+func (ca *claimApprovals) sweep(now time.Time) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	for id, pc := range ca.requests {
+		if now.After(pc.ExpiresAt) {
+			delete(ca.requests, id)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Claim binding makes a stolen claim code less useful: for CLAIM_BIND_WINDOW
+// (15m) after a redemption, UI connections presenting the token it released
+// must come from the redeemer's context. While it is on, every redemption
+// releases a share token of its own (redeemClaimShare), so only that one
+// redeemer's credential is bound; the device's UI token, which its owner
+// and other clients share, never is.
+//
+//	CLAIM_BIND=ip,user_agent,origin   any subset; empty (default) disables
+//
+// Every redemption is also recorded in the audit trail (source "claim")
+// with the redeemer's address, User-Agent and Origin, and so is every
+// connection refused for not matching.
+
+type claimBinding struct {
+	ip, userAgent, origin string
+	until                 time.Time
+}
+
+type claimBindings struct {
+	ip, userAgent, origin bool
+	window                time.Duration
+
+	mu      sync.Mutex
+	byToken map[string]claimBinding // by token hash
+}
+
+func parseClaimBindings(spec string, window time.Duration) (*claimBindings, error) {
+	cb := &claimBindings{window: window, byToken: make(map[string]claimBinding)}
+	for _, attr := range strings.Split(spec, ",") {
+		switch strings.ToLower(strings.TrimSpace(attr)) {
+		case "":
+		case "ip":
+			cb.ip = true
+		case "user_agent", "ua":
+			cb.userAgent = true
+		case "origin":
+			cb.origin = true
+		default:
+			return nil, fmt.Errorf("CLAIM_BIND: unknown attribute %q (want ip, user_agent, origin)", attr)
+		}
+	}
+	return cb, nil
+}
+
+func (cb *claimBindings) enabled() bool {
+	return (cb.ip || cb.userAgent || cb.origin) && cb.window > 0
+}
+
+// bind ties token to the context of r, the redemption.
+func (cb *claimBindings) bind(token string, r *http.Request, now time.Time) {
+	if !cb.enabled() || token == "" {
+		return
+	}
+	b := claimBinding{until: now.Add(cb.window)}
+	if cb.ip {
+		b.ip = clientIP(r)
+	}
+	if cb.userAgent {
+		b.userAgent = r.UserAgent()
+	}
+	if cb.origin {
+		b.origin = r.Header.Get("Origin")
+	}
+	cb.mu.Lock()
+	cb.byToken[hashSecret(token)] = b
+	cb.mu.Unlock()
+}
+
+// mismatch names the bound attributes r doesn't match, if token is bound.
+func (cb *claimBindings) mismatch(token string, r *http.Request, now time.Time) []string {
+	if !cb.enabled() || token == "" {
+		return nil
+	}
+	h := hashSecret(token)
+	cb.mu.Lock()
+	b, ok := cb.byToken[h]
+	if ok && now.After(b.until) {
+		delete(cb.byToken, h)
+		ok = false
+	}
+	cb.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	var bad []string
+	if cb.ip && clientIP(r) != b.ip {
+		bad = append(bad, "ip")
+	}
+	if cb.userAgent && r.UserAgent() != b.userAgent {
+		bad = append(bad, "user_agent")
+	}
+	if cb.origin && r.Header.Get("Origin") != b.origin {
+		bad = append(bad, "origin")
+	}
+	return bad
+}
+
+func (cb *claimBindings) sweep(now time.Time) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	for h, b := range cb.byToken {
+		if now.After(b.until) {
+			delete(cb.byToken, h)
+		}
+	}
+}
+
+// noteClaimRedeemed audits a redemption and binds the share token it
+// released, if any, to the redeemer.
+func (s *server) noteClaimRedeemed(r *http.Request, deviceID, tunnel, scope, share string) {
+	now := time.Now().UTC()
+	s.claimBinds.bind(share, r, now)
+	s.audit(auditEntry{TS: now, Source: "claim", Actor: s.auditActor(r), Remote: clientIP(r),
+		DeviceID: deviceID, Tunnel: tunnel, Action: "redeem " + scope,
+		UserAgent: r.UserAgent(), Origin: r.Header.Get("Origin")})
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Claim delivery sends a pending claim code, as a link, straight to the end
+// user's email or phone, for installs where the installer isn't the one who
+// will own the device:
+//
+//	POST /api/claims/{code}/send  {"email":"a@example.com"} or {"phone":"+15551234567"}
+//
+// It takes an operator who may use the device (its owner's account, on a
+// host of its tenant), or the device itself with its own key or session
+// token, as for POST /api/claims. The
+// link is CLAIM_LINK_URL with {code} filled in. Each channel has one
+// provider, picked from what is configured:
+//
+//	email  SMTP (SMTP_ADDR, SMTP_FROM, SMTP_USERNAME/SMTP_PASSWORD, shared with
+//	       the digest), else CLAIM_DELIVERY_WEBHOOK_URL
+//	sms    Twilio (TWILIO_ACCOUNT_SID, TWILIO_AUTH_TOKEN, TWILIO_FROM), else
+//	       CLAIM_DELIVERY_WEBHOOK_URL
+//
+// The webhook gets the message as JSON and is where other providers plug
+// in. A code can be sent at most claimMaxSends times; failed deliveries
+// don't count. During the device's quiet hours (quiethours.go) sends are
+// refused with 409 quiet_hours unless the request says "critical":true.
+
+const claimMaxSends = 5
+
+// claimMessage is one claim code on its way to a person.
+type claimMessage struct {
+	Channel   string    `json:"channel"` // email or sms
+	To        string    `json:"to"`
+	DeviceID  string    `json:"device_id"`
+	Code      string    `json:"code"`
+	Link      string    `json:"link"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Text      string    `json:"text"`
+}
+
+// claimSender delivers claim messages on one channel.
+type claimSender interface {
+	provider() string
+	send(ctx context.Context, m claimMessage) error
+}
+
+type claimDelivery struct {
+	linkURL string
+	senders map[string]claimSender // by channel
+}
+
+func newClaimDelivery(smtpCfg digestConfig) claimDelivery {
+	cd := claimDelivery{
+		linkURL: envOr("CLAIM_LINK_URL", "https://espwifi.io/claim?code={code}"),
+		senders: make(map[string]claimSender),
+	}
+	hook := strings.TrimSpace(os.Getenv("CLAIM_DELIVERY_WEBHOOK_URL"))
+	if smtpCfg.smtpAddr != "" && smtpCfg.smtpFrom != "" {
+		cd.senders["email"] = smtpClaimSender{cfg: smtpCfg}
+	} else if hook != "" {
+		cd.senders["email"] = webhookClaimSender{url: hook}
+	}
+	if sid := strings.TrimSpace(os.Getenv("TWILIO_ACCOUNT_SID")); sid != "" {
+		cd.senders["sms"] = twilioClaimSender{sid: sid, token: os.Getenv("TWILIO_AUTH_TOKEN"), from: os.Getenv("TWILIO_FROM")}
+	} else if hook != "" {
+		cd.senders["sms"] = webhookClaimSender{url: hook}
+	}
+	return cd
+}
+
+func (cd claimDelivery) link(code string) string {
+	return strings.ReplaceAll(cd.linkURL, "{code}", url.QueryEscape(code))
+}
+
+type smtpClaimSender struct{ cfg digestConfig }
+
+func (smtpClaimSender) provider() string { return "smtp" }
+
+func (ss smtpClaimSender) send(_ context.Context, m claimMessage) error {
+	cfg := ss.cfg
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\nTo: %s\nSubject: Claim your ESPWiFi device %s\n", cfg.smtpFrom, m.To, m.DeviceID)
+	b.WriteString("Content-Type: text/plain; charset=utf-8\n\n")
+	b.WriteString(m.Text + "\n")
+	var auth smtp.Auth
+	if cfg.smtpUser != "" {
+		host, _, _ := strings.Cut(cfg.smtpAddr, ":")
+		auth = smtp.PlainAuth("", cfg.smtpUser, cfg.smtpPass, host)
+	}
+	return smtp.SendMail(cfg.smtpAddr, auth, cfg.smtpFrom, []string{m.To}, []byte(strings.ReplaceAll(b.String(), "\n", "\r\n")))
+}
+
+type twilioClaimSender struct{ sid, token, from string }
+
+func (twilioClaimSender) provider() string { return "twilio" }
+
+func (ts twilioClaimSender) send(ctx context.Context, m claimMessage) error {
+	form := url.Values{"To": {m.To}, "From": {ts.from}, "Body": {m.Text}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		"https://api.twilio.com/2010-04-01/Accounts/"+url.PathEscape(ts.sid)+"/Messages.json", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(ts.sid, ts.token)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doClaimDelivery(req, "twilio")
+}
+
+type webhookClaimSender struct{ url string }
+
+func (webhookClaimSender) provider() string { return "webhook" }
+
+func (ws webhookClaimSender) send(ctx context.Context, m claimMessage) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ws.url, bytes.NewReader(mustJSON(m)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doClaimDelivery(req, "webhook")
+}
+
+func doClaimDelivery(req *http.Request, what string) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", what, resp.Status)
+	}
+	return nil
+}
+
+// claimSendRequest names one recipient.
+type claimSendRequest struct {
+	Email string `json:"email,omitempty"`
+	Phone string `json:"phone,omitempty"` // E.164
+	// Send even during the device's quiet hours.
+	Critical bool `json:"critical,omitempty"`
+}
+
+type claimSendResponse struct {
+	Sent     bool   `json:"sent"`
+	Channel  string `json:"channel"`
+	Provider string `json:"provider"`
+}
+
+var (
+	claimEmailRe = regexp.MustCompile(`^[^\s@<>,;"]+@[^\s@<>,;"]+\.[^\s@<>,;"]+$`)
+	claimPhoneRe = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+)
+
+// handleSendClaim serves POST /api/claims/{code}/send.
+func (s *server) handleSendClaim(w http.ResponseWriter, r *http.Request, code string) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req claimSendRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeJSONDecodeError(w, err)
+		return
+	}
+	m := claimMessage{Code: strings.ToUpper(strings.TrimSpace(code))}
+	switch email, phone := strings.TrimSpace(req.Email), strings.TrimSpace(req.Phone); {
+	case email != "" && phone == "" && claimEmailRe.MatchString(email):
+		m.Channel, m.To = "email", email
+	case phone != "" && email == "" && claimPhoneRe.MatchString(phone):
+		m.Channel, m.To = "sms", phone
+	default:
+		writeAPIError(w, http.StatusBadRequest, "invalid_recipient", "give one of email or phone (E.164, e.g. +15551234567)")
+		return
+	}
+	sender := s.claimDelivery.senders[m.Channel]
+	if sender == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "not_configured", "no "+m.Channel+" provider configured")
+		return
+	}
+
+	now := time.Now().UTC()
+	s.claimMu.Lock()
+	ce, ok := s.claims[m.Code]
+	if ok && now.After(ce.ExpiresAt) {
+		ok = false
+	}
+	s.claimMu.Unlock()
+	// Operators who may use the device, or the device itself with its own
+	// credential; others can't tell whether the code exists.
+	operator := ok && s.callerHas(r, roleOperator) && s.hostAllows(r, ce.DeviceID) && s.ownerAllows(r, ce.DeviceID)
+	if !operator && !(ok && s.deviceOwnCredential(r, ce.DeviceID, &ce.TunnelKey)) {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "invalid_code", "invalid or expired code")
+		return
+	}
+	if quiet, retry := s.quietFor(ce.DeviceID); quiet && !req.Critical {
+		if retry > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())))
+		}
+		writeAPIError(w, http.StatusConflict, "quiet_hours", "the device is in quiet hours; retry later or send as critical")
+		return
+	}
+	s.claimMu.Lock()
+	ce, ok = s.claims[m.Code]
+	if ok && ce.Sent >= claimMaxSends {
+		s.claimMu.Unlock()
+		writeAPIError(w, http.StatusTooManyRequests, "send_limit_reached", fmt.Sprintf("code already sent %d times", claimMaxSends))
+		return
+	}
+	if ok {
+		// Held while sending, so concurrent sends can't pass the limit;
+		// given back if delivery fails.
+		ce.Sent++
+		s.claims[m.Code] = ce
+	}
+	s.claimMu.Unlock()
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "invalid_code", "invalid or expired code")
+		return
+	}
+
+	m.DeviceID, m.ExpiresAt, m.Link = ce.DeviceID, ce.ExpiresAt, s.claimDelivery.link(m.Code)
+	m.Text = fmt.Sprintf("Your ESPWiFi device %s is ready. Claim it at %s or enter code %s. The code expires %s.",
+		m.DeviceID, m.Link, m.Code, m.ExpiresAt.Format(time.RFC1123))
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+	err := sender.send(ctx, m)
+	s.claimMu.Lock()
+	if ce, ok := s.claims[m.Code]; ok {
+		if err != nil {
+			ce.Sent--
+			s.claims[m.Code] = ce
+		} else {
+			s.saveClaimsLocked()
+		}
+	}
+	s.claimMu.Unlock()
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, "delivery_failed", "delivery failed")
+		s.logf(logInfo, "claim_delivery_failed", "device_id", m.DeviceID, "channel", m.Channel,
+			"provider", sender.provider(), "error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, claimSendResponse{Sent: true, Channel: m.Channel, Provider: sender.provider()})
+	// The recipient is personal data; only the channel is logged.
+	s.logf(logInfo, "claim_delivered", "remote", clientIP(r), "device_id", m.DeviceID, "channel", m.Channel,
+		"provider", sender.provider(), "critical", req.Critical)
+}
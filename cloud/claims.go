@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// claimCodeTTL is how long a pending claim code stays redeemable.
+const claimCodeTTL = 10 * time.Minute
+
+// serverClaimCodeLen is the length of server-generated claim codes: 10
+// characters of claimAlphabet carry 50 bits, against the firmware's 6.
+const serverClaimCodeLen = 10
+
+// newClaimCode returns a random code over claimAlphabet.
+func newClaimCode() string {
+	b := randomBytes(serverClaimCodeLen)
+	for i := range b {
+		b[i] = claimAlphabet[b[i]&31]
+	}
+	return string(b)
+}
+
+// claimResponse is what a redemption releases (POST /api/claim).
+type claimResponse struct {
+	OK        bool   `json:"ok"`
+	Code      string `json:"code"`
+	DeviceID  string `json:"device_id"`
+	Tunnel    string `json:"tunnel"`
+	UIWSURL   string `json:"ui_ws_url"`
+	Token     string `json:"token"`
+	Scope     string `json:"scope"`
+	UIWSToken string `json:"ui_ws_token"`
+	// Control claims also get the read-only token, to share viewing.
+	ViewToken  string `json:"view_token,omitempty"`
+	LocalWSURL string `json:"local_ws_url,omitempty"`
+	// Multi-use codes: the share link this redemption got.
+	ShareID   string     `json:"share_id,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	UsesLeft  *int       `json:"uses_left,omitempty"`
+}
+
+type createClaimResponse struct {
+	Code      string    `json:"code"`
+	DeviceID  string    `json:"device_id"`
+	Tunnel    string    `json:"tunnel"`
+	ExpiresAt time.Time `json:"expires_at"`
+	MaxUses   int       `json:"max_uses"`
+}
+
+type createClaimRequest struct {
+	DeviceID string `json:"device_id"`
+	Tunnel   string `json:"tunnel,omitempty"`
+	// Optional; a multi-use code can be redeemed up to CLAIM_MAX_USES times
+	// within CLAIM_MAX_TTL.
+	MaxUses int    `json:"max_uses,omitempty"`
+	TTL     string `json:"ttl,omitempty"`
+}
+
+// multiUse reports whether redeeming the code hands out a share token of
+// its own rather than the device's UI token. Such codes don't claim
+// ownership, so several people (a household during setup week) can pair
+// from one printed code and be revoked one by one.
+func (ce claimEntry) multiUse() bool { return ce.MaxUses > 1 }
+
+// handleCreateClaim has the server generate a claim code for the device to
+// display, rather than trusting one the firmware made up:
+//
+//	POST /api/claims  {"device_id":"...","tunnel":"ws_control"}
+//
+// The device authenticates with its own credential, its device key or its
+// session's UI token; DEVICE_AUTH_TOKEN, which every device shares, isn't
+// enough. It must be connected on the tunnel, whose UI token the code
+// releases. A new code replaces the device's pending codes
+// on that tunnel. With max_uses and ttl it is a multi-use code.
+func (s *server) handleCreateClaim(w http.ResponseWriter, r *http.Request) {
+	var req createClaimRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeJSONDecodeError(w, err)
+		return
+	}
+	deviceID, ok := normalizeDeviceID(req.DeviceID)
+	tunnel := strings.TrimSpace(req.Tunnel)
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "invalid_device_id", "invalid device_id")
+		return
+	}
+	if strings.Contains(tunnel, "/") {
+		writeAPIError(w, http.StatusBadRequest, "invalid_tunnel", "invalid tunnel")
+		return
+	}
+	if req.MaxUses < 0 || req.MaxUses > s.claimMaxUses {
+		writeAPIError(w, http.StatusBadRequest, "invalid_max_uses", fmt.Sprintf("max_uses must be at most %d", s.claimMaxUses))
+		return
+	}
+	ttl := claimCodeTTL
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 || d > max(s.claimMaxTTL, claimCodeTTL) {
+			writeAPIError(w, http.StatusBadRequest, "invalid_ttl", "ttl must be a duration up to "+max(s.claimMaxTTL, claimCodeTTL).String())
+			return
+		}
+		ttl = d
+	}
+	if !s.deviceOwnCredential(r, deviceID, &tunnel) {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		s.logf(logInfo, "claim_create_unauthorized", "remote", clientIP(r), "device_id", deviceID)
+		return
+	}
+	dc := s.h.getDevice(makeKey(deviceID, tunnel))
+	if dc == nil || dc.uiToken == "" {
+		writeAPIError(w, http.StatusConflict, "device_offline", "device is not connected on this tunnel with a UI token")
+		return
+	}
+
+	now := time.Now().UTC()
+	ce := claimEntry{
+		ID:         randomToken(6),
+		DeviceID:   deviceID,
+		TunnelKey:  tunnel,
+		Token:      dc.uiToken,
+		ViewToken:  dc.viewToken,
+		ExpiresAt:  now.Add(ttl),
+		Registered: now,
+		MaxUses:    req.MaxUses,
+	}
+	s.claimMu.Lock()
+	for code, old := range s.claims {
+		if old.DeviceID == deviceID && old.TunnelKey == tunnel {
+			delete(s.claims, code)
+		}
+	}
+	code := newClaimCode()
+	for _, taken := s.claims[code]; taken; _, taken = s.claims[code] {
+		code = newClaimCode()
+	}
+	s.claims[code] = ce
+	s.saveClaimsLocked()
+	s.claimMu.Unlock()
+
+	writeJSON(w, http.StatusCreated, createClaimResponse{
+		Code:      code,
+		DeviceID:  deviceID,
+		Tunnel:    tunnel,
+		ExpiresAt: ce.ExpiresAt,
+		MaxUses:   max(ce.MaxUses, 1),
+	})
+	s.logf(logInfo, "device_claim_issued", "remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel, "max_uses", max(ce.MaxUses, 1))
+}
+
+// redeemClaimShare answers a redemption (already counted) with a share link
+// of its own, valid for SHARE_MAX_TTL. Multi-use codes always redeem this
+// way, and so does every code while CLAIM_BIND is on: the binding then
+// covers a credential only this redeemer holds, never the device's UI
+// token, which its owner and other clients keep using.
+func (s *server) redeemClaimShare(w http.ResponseWriter, r *http.Request, code string, ce claimEntry, tunnel string, viewOnly bool, account string) {
+	scope := uiScopeControl
+	if viewOnly {
+		scope = uiScopeView
+	}
+	// Labelled by the claim's ID: shares are listed to whoever manages
+	// them, and a multi-use code stays redeemable.
+	label := fmt.Sprintf("claim #%d", ce.Uses)
+	if ce.ID != "" {
+		label = fmt.Sprintf("claim %s #%d", ce.ID, ce.Uses)
+	}
+	now := time.Now().UTC()
+	sl, token, err := s.shares.create(shareLink{
+		DeviceID:  ce.DeviceID,
+		Tunnel:    tunnel,
+		Scope:     scope.String(),
+		Label:     label,
+		CreatedBy: account,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.shares.maxTTL),
+	})
+	if err != nil {
+		s.releaseClaimUse(code, ce)
+		writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist shares")
+		return
+	}
+	ui, _ := wsURLs(s.publicBaseFor(r, ce.DeviceID), ce.DeviceID, tunnel)
+	sep := "?"
+	if strings.Contains(ui, "?") {
+		sep = "&"
+	}
+	var usesLeft *int
+	if ce.multiUse() {
+		n := ce.MaxUses - ce.Uses
+		usesLeft = &n
+	}
+	writeJSON(w, http.StatusOK, claimResponse{
+		OK:        true,
+		Code:      code,
+		DeviceID:  ce.DeviceID,
+		Tunnel:    tunnel,
+		UIWSURL:   ui,
+		Token:     token,
+		Scope:     scope.String(),
+		UIWSToken: ui + sep + "share=" + urlQueryEscape(token),
+		ShareID:   sl.ID,
+		ExpiresAt: &sl.ExpiresAt,
+		UsesLeft:  usesLeft,
+	})
+	s.noteClaimRedeemed(r, ce.DeviceID, tunnel, scope.String(), token)
+	s.logf(logInfo, "claim_redeemed",
+		"remote", clientIP(r),
+		"device_id", ce.DeviceID,
+		"tunnel", tunnel,
+		"scope", scope.String(),
+		"account", account,
+		"share_id", sl.ID,
+		"uses", ce.Uses,
+	)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsClose is a WebSocket close code paired with its machine-readable reason.
+// Firmware and dashboards should branch on the code (or the reason string)
+// rather than on free-form text.
+type wsClose struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// Close codes emitted by the relay. They live in the 4000-4999 private-use
+// range so they never collide with the RFC 6455 codes a proxy might send.
+var (
+	wsCloseUnauthorized  = wsClose{4001, "unauthorized"}
+	wsCloseReplaced      = wsClose{4002, "replaced"}
+	wsCloseDraining      = wsClose{4003, "draining"}
+	wsCloseDeviceOffline = wsClose{4004, "device_offline"}
+	wsCloseQuotaExceeded = wsClose{4005, "quota_exceeded"}
+	wsCloseIdleTimeout   = wsClose{4006, "idle_timeout"}
+	wsCloseRelocated     = wsClose{4007, "relocated"}
+	wsCloseKicked        = wsClose{4008, "kicked"}
+	wsCloseDeregistered  = wsClose{4009, "deregistered"}
+	wsCloseShareExpired  = wsClose{4010, "share_expired"}
+	wsCloseUILimit       = wsClose{4011, "ui_limit"}
+	// Sent to everyone on SIGTERM, after a retry_after hint (shutdown.go).
+	wsCloseServerRestarting = wsClose{4012, "server_restarting"}
+	// A media tunnel outside the device's streaming windows (streaming.go).
+	wsCloseOutsideSchedule = wsClose{4013, "outside_schedule"}
+)
+
+// wsCloseCodes lists every relay close code, in code order.
+var wsCloseCodes = []wsClose{
+	wsCloseUnauthorized,
+	wsCloseReplaced,
+	wsCloseDraining,
+	wsCloseDeviceOffline,
+	wsCloseQuotaExceeded,
+	wsCloseIdleTimeout,
+	wsCloseRelocated,
+	wsCloseKicked,
+	wsCloseDeregistered,
+	wsCloseShareExpired,
+	wsCloseUILimit,
+	wsCloseServerRestarting,
+	wsCloseOutsideSchedule,
+}
+
+func (c wsClose) message() []byte {
+	return websocket.FormatCloseMessage(c.Code, c.Reason)
+}
+
+// controlWriter is the part of a websocket connection sendClose needs; both
+// *websocket.Conn and deviceSocket have it.
+type controlWriter interface {
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+}
+
+// sendClose writes a close frame without taking any locks; callers must
+// serialize it with other writes on conn.
+func sendClose(conn controlWriter, c wsClose) {
+	_ = conn.WriteControl(websocket.CloseMessage, c.message(), time.Now().Add(3*time.Second))
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Conformance mode (-conformance or CONFORMANCE=1) turns the relay into a
+// test bench for firmware WebSocket clients. Devices connecting to
+// /ws/device/{id} aren't relayed; instead each one is run through these
+// cases, reconnecting between some of them:
+//
+//	ping_pong          three pings must each be answered within 5s
+//	oversized_frame    a CONFORMANCE_OVERSIZED_BYTES (256KiB) binary frame
+//	                   must be survived, or refused with a close frame
+//	                   (1009 ideally), not a dropped connection
+//	silent_relay       the relay stops answering pings and sending; the
+//	                   device must notice and drop the connection within
+//	                   CONFORMANCE_SILENT_TIMEOUT (3m)
+//	replaced           after a 4002 close, no reconnect sooner than the
+//	                   registered reconnect backoff allows
+//	server_restarting  after retry_after and a 4012 close, no reconnect
+//	                   before the retry_after delay
+//	unauthorized       after a 4001 close, no reconnect sooner than the
+//	                   backoff allows
+//
+// A device that doesn't come back within CONFORMANCE_RECONNECT_TIMEOUT (2m)
+// fails the pending case and ends its run. Each result is logged as
+// conformance_case, and GET /api/conformance lists every device's latest
+// run. A second connection while a run's connection is still up is refused
+// with quota_exceeded (4005). After the last case the connection is left
+// open and idle; the next connection starts a new run.
+
+type conformanceResult struct {
+	Case   string    `json:"case"`
+	Pass   bool      `json:"pass"`
+	Detail string    `json:"detail"`
+	At     time.Time `json:"at"`
+}
+
+type conformanceRun struct {
+	DeviceID string              `json:"device_id"`
+	Started  time.Time           `json:"started"`
+	Finished *time.Time          `json:"finished,omitempty"`
+	Passed   int                 `json:"passed"`
+	Failed   int                 `json:"failed"`
+	Results  []conformanceResult `json:"results"`
+
+	next    int                   // index into conformanceCases
+	pending *conformanceReconnect // what the next connection is checked against
+	active  bool                  // a connection is running the cases
+}
+
+// conformanceReconnect is a case waiting to see when the device reconnects.
+// An empty name just resumes the run.
+type conformanceReconnect struct {
+	name     string
+	closedAt time.Time
+	min      time.Duration
+	timer    *time.Timer
+}
+
+type conformanceSuite struct {
+	s                *server
+	oversized        int
+	silentTimeout    time.Duration
+	reconnectTimeout time.Duration
+
+	mu   sync.Mutex
+	runs map[string]*conformanceRun
+}
+
+func loadConformanceSuite(s *server) (*conformanceSuite, error) {
+	oversized, err := parseByteSize(envOr("CONFORMANCE_OVERSIZED_BYTES", "256KiB"))
+	if err != nil || oversized <= 0 {
+		return nil, fmt.Errorf("CONFORMANCE_OVERSIZED_BYTES: %q is not a size", envOr("CONFORMANCE_OVERSIZED_BYTES", ""))
+	}
+	return &conformanceSuite{
+		s:                s,
+		oversized:        int(oversized),
+		silentTimeout:    envDuration("CONFORMANCE_SILENT_TIMEOUT", 3*time.Minute),
+		reconnectTimeout: envDuration("CONFORMANCE_RECONNECT_TIMEOUT", 2*time.Minute),
+		runs:             make(map[string]*conformanceRun),
+	}, nil
+}
+
+// conformanceConn is one device connection under test. A reader goroutine
+// feeds pongs and the connection's end to the case running on it.
+type conformanceConn struct {
+	conn   *websocket.Conn
+	pongs  chan []byte
+	done   chan struct{} // closed when reading fails
+	err    error         // why; valid once done is closed
+	silent atomic.Bool   // ignore the device's pings
+}
+
+func newConformanceConn(conn *websocket.Conn) *conformanceConn {
+	cc := &conformanceConn{conn: conn, pongs: make(chan []byte, 8), done: make(chan struct{})}
+	conn.SetPongHandler(func(data string) error {
+		select {
+		case cc.pongs <- []byte(data):
+		default:
+		}
+		return nil
+	})
+	conn.SetPingHandler(func(data string) error {
+		if cc.silent.Load() {
+			return nil
+		}
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+		return err
+	})
+	go func() {
+		defer close(cc.done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				cc.err = err
+				return
+			}
+		}
+	}()
+	return cc
+}
+
+// closeCode reports how the connection ended: the device's close code, or
+// 1006 if it dropped without a close frame.
+func (cc *conformanceConn) closeCode() int {
+	var ce *websocket.CloseError
+	if errors.As(cc.err, &ce) {
+		return ce.Code
+	}
+	return websocket.CloseAbnormalClosure
+}
+
+// ping sends a ping and waits for the matching pong.
+func (cc *conformanceConn) ping(payload string, timeout time.Duration) error {
+	if err := cc.conn.WriteControl(websocket.PingMessage, []byte(payload), time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		select {
+		case p := <-cc.pongs:
+			if bytes.Equal(p, []byte(payload)) {
+				return nil
+			}
+		case <-cc.done:
+			return fmt.Errorf("connection closed (%d)", cc.closeCode())
+		case <-t.C:
+			return fmt.Errorf("no pong within %s", timeout)
+		}
+	}
+}
+
+// A case either finishes on the connection (cont true: run the next case on
+// it) or ends it, leaving reconnect to be checked by the next connection.
+type conformanceCase struct {
+	name string
+	run  func(cs *conformanceSuite, cc *conformanceConn) (res conformanceResult, cont bool, reconnect *conformanceReconnect)
+}
+
+var conformanceCases = []conformanceCase{
+	{"ping_pong", conformancePingPong},
+	{"oversized_frame", conformanceOversized},
+	{"silent_relay", conformanceSilent},
+	{"replaced", conformanceCloseCase(wsCloseReplaced, 0)},
+	{"server_restarting", conformanceCloseCase(wsCloseServerRestarting, 3)},
+	{"unauthorized", conformanceCloseCase(wsCloseUnauthorized, 0)},
+}
+
+func conformancePingPong(_ *conformanceSuite, cc *conformanceConn) (conformanceResult, bool, *conformanceReconnect) {
+	var slowest time.Duration
+	for i := 1; i <= 3; i++ {
+		start := time.Now()
+		if err := cc.ping(fmt.Sprintf("conformance-%d", i), 5*time.Second); err != nil {
+			return conformanceResult{Detail: fmt.Sprintf("ping %d: %v", i, err)}, false, &conformanceReconnect{}
+		}
+		slowest = max(slowest, time.Since(start))
+	}
+	return conformanceResult{Pass: true, Detail: fmt.Sprintf("3 pongs, slowest in %s", slowest.Round(time.Microsecond))}, true, nil
+}
+
+func conformanceOversized(cs *conformanceSuite, cc *conformanceConn) (conformanceResult, bool, *conformanceReconnect) {
+	frame := make([]byte, cs.oversized)
+	if err := cc.conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		return conformanceResult{Detail: "write failed: " + err.Error()}, false, &conformanceReconnect{}
+	}
+	select {
+	case <-cc.done:
+	case <-time.After(3 * time.Second):
+		if err := cc.ping("conformance-oversized", 5*time.Second); err == nil {
+			return conformanceResult{Pass: true, Detail: fmt.Sprintf("survived a %d byte frame", cs.oversized)}, true, nil
+		}
+	}
+	select {
+	case <-cc.done:
+	case <-time.After(time.Second):
+		return conformanceResult{Detail: "stopped answering pings after the frame"}, false, &conformanceReconnect{}
+	}
+	code := cc.closeCode()
+	if code == websocket.CloseAbnormalClosure {
+		return conformanceResult{Detail: "dropped the connection without a close frame"}, false, &conformanceReconnect{}
+	}
+	detail := fmt.Sprintf("refused with close %d", code)
+	if code != websocket.CloseMessageTooBig {
+		detail += " (1009 is the usual code)"
+	}
+	return conformanceResult{Pass: true, Detail: detail}, false, &conformanceReconnect{}
+}
+
+func conformanceSilent(cs *conformanceSuite, cc *conformanceConn) (conformanceResult, bool, *conformanceReconnect) {
+	cc.silent.Store(true)
+	start := time.Now()
+	select {
+	case <-cc.done:
+		return conformanceResult{Pass: true, Detail: fmt.Sprintf("dropped the silent connection after %s", time.Since(start).Round(time.Second))},
+			false, &conformanceReconnect{}
+	case <-time.After(cs.silentTimeout):
+		sendClose(cc.conn, wsCloseIdleTimeout)
+		return conformanceResult{Detail: fmt.Sprintf("still connected after %s of silence", cs.silentTimeout)}, false, &conformanceReconnect{}
+	}
+}
+
+// conformanceCloseCase closes with c (after a retry_after of retrySeconds,
+// if set) and expects no reconnect sooner than that, or than the shortest
+// wait the registered backoff allows.
+func conformanceCloseCase(c wsClose, retrySeconds int) func(*conformanceSuite, *conformanceConn) (conformanceResult, bool, *conformanceReconnect) {
+	return func(cs *conformanceSuite, cc *conformanceConn) (conformanceResult, bool, *conformanceReconnect) {
+		hint := cs.s.reconnectHint
+		wait := time.Duration(float64(hint.BaseMs)*(1-hint.Jitter)) * time.Millisecond
+		if retrySeconds > 0 {
+			wait = time.Duration(retrySeconds) * time.Second
+			_ = cc.conn.WriteMessage(websocket.TextMessage, mustJSON(retryAfterMsg{Type: "retry_after", Reason: c.Reason, Seconds: retrySeconds}))
+		}
+		sendClose(cc.conn, c)
+		return conformanceResult{}, false, &conformanceReconnect{min: wait}
+	}
+}
+
+// handle serves /ws/device/{id} in conformance mode.
+func (cs *conformanceSuite) handle(w http.ResponseWriter, r *http.Request) {
+	s := cs.s
+	deviceID, ok := normalizeDeviceID(strings.Trim(strings.TrimPrefix(r.URL.Path, "/ws/device/"), "/"))
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "invalid_device_id", "invalid device id")
+		return
+	}
+	if s.deviceAuthToken != "" && !authOK(r, s.deviceAuthToken) {
+		s.rejectWS(w, r, http.StatusUnauthorized, wsCloseUnauthorized, "conformance_unauthorized",
+			"remote", clientIP(r), "device_id", deviceID)
+		return
+	}
+	run, ok := cs.begin(deviceID, time.Now().UTC())
+	if !ok {
+		s.rejectWS(w, r, http.StatusConflict, wsCloseQuotaExceeded, "conformance_busy",
+			"remote", clientIP(r), "device_id", deviceID)
+		return
+	}
+	conn, err := s.deviceUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		cs.release(run)
+		return
+	}
+	defer conn.Close()
+	ui, dev := wsURLs(s.publicBase(r), deviceID, "")
+	features := featChunks | featRetryAfter | featReconnectHint
+	_ = conn.WriteMessage(websocket.TextMessage, mustJSON(registeredMsg{
+		Type: "registered", DeviceID: deviceID, UIWSURL: ui, DeviceWSURL: dev,
+		Reconnect: s.reconnectHint, Protocol: protocolVersion, Features: features,
+		EnabledFeatures: features.names(), ServerVersion: serverVersion(),
+	}))
+	cc := newConformanceConn(conn)
+
+	for {
+		c, ok := cs.nextCase(run)
+		if !ok {
+			break
+		}
+		s.logf(logDebug, "conformance_case_started", "device_id", deviceID, "case", c.name)
+		res, cont, reconnect := c.run(cs, cc)
+		if reconnect == nil || res.Detail != "" {
+			res.Case = c.name
+			cs.record(run, res)
+		}
+		if !cont {
+			if res.Detail == "" {
+				reconnect.name = c.name
+			}
+			select {
+			case <-cc.done:
+			default:
+				sendClose(conn, wsCloseIdleTimeout) // a failed case; no-op after a case's own close
+			}
+			cs.awaitReconnect(run, reconnect)
+			return
+		}
+	}
+	<-cc.done // finished: stay connected until the device leaves
+	cs.release(run)
+}
+
+// begin returns deviceID's run, resolving the reconnect its last connection
+// left pending, or starts a new one. ok is false while another connection
+// is running deviceID's cases.
+func (cs *conformanceSuite) begin(deviceID string, now time.Time) (run *conformanceRun, ok bool) {
+	cs.mu.Lock()
+	run = cs.runs[deviceID]
+	if run == nil || run.Finished != nil {
+		run = &conformanceRun{DeviceID: deviceID, Started: now, Results: []conformanceResult{}, active: true}
+		cs.runs[deviceID] = run
+		cs.mu.Unlock()
+		cs.s.logf(logInfo, "conformance_started", "device_id", deviceID)
+		return run, true
+	}
+	if run.active {
+		cs.mu.Unlock()
+		return nil, false
+	}
+	run.active = true
+	p := run.pending
+	run.pending = nil
+	cs.mu.Unlock()
+	if p == nil {
+		return run, true
+	}
+	p.timer.Stop()
+	if p.name != "" {
+		waited := now.Sub(p.closedAt)
+		res := conformanceResult{Case: p.name, Pass: waited >= p.min,
+			Detail: fmt.Sprintf("reconnected after %s", waited.Round(time.Millisecond))}
+		if !res.Pass {
+			res.Detail += fmt.Sprintf(", sooner than %s", p.min)
+		}
+		cs.record(run, res)
+	}
+	return run, true
+}
+
+// release marks run's connection gone.
+func (cs *conformanceSuite) release(run *conformanceRun) {
+	cs.mu.Lock()
+	run.active = false
+	cs.mu.Unlock()
+}
+
+func (cs *conformanceSuite) nextCase(run *conformanceRun) (conformanceCase, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if run.next >= len(conformanceCases) {
+		cs.finishLocked(run)
+		return conformanceCase{}, false
+	}
+	c := conformanceCases[run.next]
+	run.next++
+	return c, true
+}
+
+func (cs *conformanceSuite) awaitReconnect(run *conformanceRun, p *conformanceReconnect) {
+	p.closedAt = time.Now()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	run.active = false
+	run.pending = p
+	p.timer = time.AfterFunc(cs.reconnectTimeout, func() {
+		cs.mu.Lock()
+		defer cs.mu.Unlock()
+		if run.pending != p {
+			return
+		}
+		run.pending = nil
+		if p.name != "" {
+			cs.recordLocked(run, conformanceResult{Case: p.name, Pass: false, Detail: fmt.Sprintf("did not reconnect within %s", cs.reconnectTimeout)})
+		}
+		cs.finishLocked(run)
+	})
+}
+
+func (cs *conformanceSuite) record(run *conformanceRun, res conformanceResult) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.recordLocked(run, res)
+}
+
+func (cs *conformanceSuite) recordLocked(run *conformanceRun, res conformanceResult) {
+	res.At = time.Now().UTC()
+	run.Results = append(run.Results, res)
+	result := "fail"
+	if res.Pass {
+		run.Passed++
+		result = "pass"
+	} else {
+		run.Failed++
+	}
+	cs.s.logf(logInfo, "conformance_case", "device_id", run.DeviceID, "case", res.Case, "result", result, "detail", res.Detail)
+}
+
+func (cs *conformanceSuite) finishLocked(run *conformanceRun) {
+	if run.Finished != nil {
+		return
+	}
+	now := time.Now().UTC()
+	run.Finished = &now
+	cs.s.logf(logInfo, "conformance_done", "device_id", run.DeviceID, "passed", run.Passed, "failed", run.Failed,
+		"skipped", len(conformanceCases)-run.Passed-run.Failed)
+}
+
+// handleConformance serves GET /api/conformance[?device_id=]: the latest
+// run per device.
+func (s *server) handleConformance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.requireRole(w, r, roleViewer) {
+		return
+	}
+	cs := s.conformance
+	if cs == nil {
+		writeAPIError(w, http.StatusNotFound, "not_configured", "conformance mode is off")
+		return
+	}
+	want, ok := deviceIDFilter(w, r)
+	if !ok {
+		return
+	}
+	cs.mu.Lock()
+	out := make([]conformanceRun, 0, len(cs.runs))
+	for id, run := range cs.runs {
+		if want == "" || id == want {
+			cp := *run
+			cp.Results = append([]conformanceResult(nil), run.Results...)
+			out = append(out, cp)
+		}
+	}
+	cs.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].DeviceID < out[j].DeviceID })
+	writeJSON(w, http.StatusOK, out)
+}
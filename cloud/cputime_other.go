@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "time"
+
+// processCPUTime isn't available here, so SHED_CPU never triggers.
+func processCPUTime() (time.Duration, bool) { return 0, false }
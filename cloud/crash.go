@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Crash reports: devices POST coredumps or panic backtraces to
+// /api/devices/{id}/crash after they come back up, and operators list and
+// download them per device. Reports are kept under CRASH_DIR (default
+// DATA_DIR/crashes), newest CRASH_KEEP per device.
+
+type crashReport struct {
+	ID         string    `json:"id"`
+	DeviceID   string    `json:"device_id"`
+	Kind       string    `json:"kind"` // coredump | backtrace
+	Firmware   string    `json:"firmware_version,omitempty"`
+	ELFSHA256  string    `json:"elf_sha256,omitempty"`
+	Reason     string    `json:"reset_reason,omitempty"`
+	Size       int64     `json:"size"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+var errEmptyReport = errors.New("empty report")
+
+type crashStore struct {
+	dir      string // "" disables uploads
+	maxBytes int64
+	keep     int
+}
+
+func (cs *crashStore) deviceDir(deviceID string) string {
+	return filepath.Join(cs.dir, hex.EncodeToString([]byte(deviceID)))
+}
+
+func (cs *crashStore) list(deviceID string) []crashReport {
+	out := []crashReport{}
+	if cs.dir == "" {
+		return out
+	}
+	metas, _ := filepath.Glob(filepath.Join(cs.deviceDir(deviceID), "*.json"))
+	for _, p := range metas {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		var cr crashReport
+		if json.Unmarshal(b, &cr) == nil {
+			out = append(out, cr)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ReceivedAt.After(out[j].ReceivedAt) })
+	return out
+}
+
+func (cs *crashStore) remove(deviceID, id string) error {
+	dir := cs.deviceDir(deviceID)
+	if err := os.Remove(filepath.Join(dir, id+".json")); err != nil {
+		return err
+	}
+	_ = os.Remove(filepath.Join(dir, id+".bin"))
+	return nil
+}
+
+// migrate moves report directories saved under a device ID that is no
+// longer canonical (see canonicalDeviceKeys) to the canonical one. A
+// directory whose ID no longer validates, or whose canonical directory
+// already exists, is left where it is and returned in dropped.
+func (cs *crashStore) migrate() (moved int, dropped []string) {
+	if cs.dir == "" {
+		return 0, nil
+	}
+	entries, _ := os.ReadDir(cs.dir)
+	for _, e := range entries {
+		raw, err := hex.DecodeString(e.Name())
+		if !e.IsDir() || err != nil {
+			continue
+		}
+		id, ok := normalizeDeviceID(string(raw))
+		switch {
+		case ok && id == string(raw):
+			continue
+		case !ok:
+			dropped = append(dropped, string(raw))
+			continue
+		}
+		dst := cs.deviceDir(id)
+		if _, err := os.Stat(dst); err == nil || os.Rename(filepath.Join(cs.dir, e.Name()), dst) != nil {
+			dropped = append(dropped, string(raw))
+			continue
+		}
+		for _, cr := range cs.list(id) {
+			cr.DeviceID = id
+			_ = os.WriteFile(filepath.Join(dst, cr.ID+".json"), mustJSON(cr), 0o600)
+		}
+		moved++
+	}
+	return moved, dropped
+}
+
+// save stores a report and prunes the device's oldest beyond keep.
+func (cs *crashStore) save(cr crashReport, body io.Reader) (crashReport, error) {
+	dir := cs.deviceDir(cr.DeviceID)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return cr, err
+	}
+	f, err := os.CreateTemp(dir, "upload-*")
+	if err != nil {
+		return cr, err
+	}
+	defer os.Remove(f.Name())
+	n, err := io.Copy(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return cr, err
+	}
+	if n == 0 {
+		return cr, errEmptyReport
+	}
+	cr.Size = n
+	if err := os.Rename(f.Name(), filepath.Join(dir, cr.ID+".bin")); err != nil {
+		return cr, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, cr.ID+".json"), mustJSON(cr), 0o600); err != nil {
+		return cr, err
+	}
+	if all := cs.list(cr.DeviceID); len(all) > cs.keep {
+		for _, old := range all[cs.keep:] {
+			_ = cs.remove(cr.DeviceID, old.ID)
+		}
+	}
+	return cr, nil
+}
+
+// deviceRequestAuthorized applies the device WebSocket's credential rules to
+// an HTTP request from the device: its registry key if it has one, else
+// DEVICE_AUTH_TOKEN, else the token of its live session on tunnel (of any of
+// its sessions when tunnel is nil). Tokens registered with
+// ?token_scope=tunnel never count.
+func (s *server) deviceRequestAuthorized(r *http.Request, deviceID string, tunnel *string) bool {
+	return s.deviceCredential(r, deviceID, tunnel, true)
+}
+
+// deviceOwnCredential is deviceRequestAuthorized without DEVICE_AUTH_TOKEN:
+// only the device's registry key or its own session token count. Requests
+// that release the session's UI token (claim codes) use it, so holding the
+// fleet-wide token isn't enough to take over a device.
+func (s *server) deviceOwnCredential(r *http.Request, deviceID string, tunnel *string) bool {
+	return s.deviceCredential(r, deviceID, tunnel, false)
+}
+
+func (s *server) deviceCredential(r *http.Request, deviceID string, tunnel *string, fleet bool) bool {
+	if hasKey, ok := s.registry.verifyKey(deviceID, extractDeviceKey(r)); hasKey {
+		return ok
+	}
+	if s.requireDeviceKeys {
+		return false
+	}
+	if fleet && s.deviceAuthToken != "" {
+		return authOK(r, s.deviceAuthToken)
+	}
+	tok := extractToken(r)
+	if tok == "" {
+		return false
+	}
+	for _, dc := range s.h.sessionsFor(deviceID, tunnel) {
+		if dc.uiToken != "" && !dc.tunnelToken && subtle.ConstantTimeCompare([]byte(tok), []byte(dc.uiToken)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// handleDeviceCrash serves crash reports:
+//
+//	POST   /api/devices/{id}/crash        upload (device credentials)
+//	GET    /api/devices/{id}/crash        list, newest first
+//	GET    /api/devices/{id}/crash/{cid}  download the raw report
+//	DELETE /api/devices/{id}/crash/{cid}  delete
+//
+// Uploads take metadata from headers or query parameters:
+// X-Firmware-Version / ?firmware_version=, X-ELF-SHA256 / ?elf_sha256=,
+// X-Reset-Reason / ?reset_reason= and ?kind=coredump|backtrace (default:
+// backtrace for text bodies, coredump otherwise).
+func (s *server) handleDeviceCrash(w http.ResponseWriter, r *http.Request, deviceID, crashID string) {
+	if s.crashes.dir == "" {
+		writeAPIError(w, http.StatusServiceUnavailable, "crash_storage_disabled", "crash storage disabled (set DATA_DIR or CRASH_DIR)")
+		return
+	}
+	if crashID == "" {
+		switch r.Method {
+		case http.MethodGet:
+			if !s.requireRole(w, r, roleViewer) {
+				return
+			}
+			writeJSON(w, http.StatusOK, s.crashes.list(deviceID))
+		case http.MethodPost:
+			s.uploadCrash(w, r, deviceID)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+	if !validFileID(crashID) {
+		writeAPIError(w, http.StatusNotFound, "report_not_found", "no such report")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if !s.requireRole(w, r, roleViewer) {
+			return
+		}
+		f, err := os.Open(filepath.Join(s.crashes.deviceDir(deviceID), crashID+".bin"))
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, "report_not_found", "no such report")
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", crashID+".bin"))
+		http.ServeContent(w, r, "", time.Time{}, f)
+	case http.MethodDelete:
+		if !s.requireRole(w, r, roleOperator) {
+			return
+		}
+		if err := s.crashes.remove(deviceID, crashID); err != nil {
+			writeAPIError(w, http.StatusNotFound, "report_not_found", "no such report")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		s.logf(logInfo, "crash_report_removed", "remote", clientIP(r), "device_id", deviceID, "crash_id", crashID)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *server) uploadCrash(w http.ResponseWriter, r *http.Request, deviceID string) {
+	var tunnel *string
+	if r.URL.Query().Has("tunnel") {
+		t := strings.TrimSpace(r.URL.Query().Get("tunnel"))
+		tunnel = &t
+	}
+	if !s.deviceRequestAuthorized(r, deviceID, tunnel) {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		s.logf(logInfo, "crash_upload_unauthorized", "remote", clientIP(r), "device_id", deviceID)
+		return
+	}
+	meta := func(header, param string) string {
+		if v := strings.TrimSpace(r.Header.Get(header)); v != "" {
+			return v
+		}
+		return strings.TrimSpace(r.URL.Query().Get(param))
+	}
+	kind := meta("X-Crash-Kind", "kind")
+	switch kind {
+	case "coredump", "backtrace":
+	case "":
+		kind = "coredump"
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "text/") {
+			kind = "backtrace"
+		}
+	default:
+		writeAPIError(w, http.StatusBadRequest, "invalid_kind", "kind must be coredump or backtrace")
+		return
+	}
+	cr := crashReport{
+		ID:         randomToken(9),
+		DeviceID:   deviceID,
+		Kind:       kind,
+		Firmware:   truncate(meta("X-Firmware-Version", "firmware_version"), 64),
+		ELFSHA256:  truncate(meta("X-ELF-SHA256", "elf_sha256"), 64),
+		Reason:     truncate(meta("X-Reset-Reason", "reset_reason"), 64),
+		ReceivedAt: time.Now().UTC(),
+	}
+	cr, err := s.crashes.save(cr, http.MaxBytesReader(w, r.Body, s.crashes.maxBytes))
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooBig):
+			writeAPIError(w, http.StatusRequestEntityTooLarge, "too_large", "report exceeds CRASH_MAX_BYTES")
+		case errors.Is(err, errEmptyReport):
+			writeAPIError(w, http.StatusBadRequest, "empty_body", "empty report")
+		default:
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to store report")
+			s.logf(logInfo, "crash_save_failed", "device_id", deviceID, "err", err.Error())
+		}
+		return
+	}
+	writeJSON(w, http.StatusCreated, cr)
+	s.logf(logInfo, "crash_report_received", "remote", clientIP(r), "device_id", deviceID,
+		"crash_id", cr.ID, "kind", cr.Kind, "firmware_version", cr.Firmware, "size", cr.Size)
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// dedupWindow suppresses UI->device text messages seen within the window, so
+// double-taps and browser retry storms don't reach the device twice. It is
+// shared by all UIs of a device session. A message is identified by its "id"
+// or "msg_id" field when it's a JSON object carrying one, and by a hash of
+// its content otherwise.
+type dedupWindow struct {
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time // key -> expiry
+}
+
+func newDedupWindow(window time.Duration) *dedupWindow {
+	if window <= 0 {
+		return nil
+	}
+	return &dedupWindow{window: window, seen: make(map[string]time.Time)}
+}
+
+// duplicate records msg and reports whether it was already seen within the
+// window. A nil window never reports duplicates.
+func (d *dedupWindow) duplicate(msg []byte, now time.Time) (key string, dup bool) {
+	if d == nil {
+		return "", false
+	}
+	key = dedupKey(msg)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.seen) > 64 {
+		for k, exp := range d.seen {
+			if now.After(exp) {
+				delete(d.seen, k)
+			}
+		}
+	}
+	if exp, ok := d.seen[key]; ok && !now.After(exp) {
+		return key, true
+	}
+	d.seen[key] = now.Add(d.window)
+	return key, false
+}
+
+func dedupKey(msg []byte) string {
+	if trimmed := bytes.TrimSpace(msg); len(trimmed) > 0 && trimmed[0] == '{' {
+		var ids struct {
+			ID    json.RawMessage `json:"id"`
+			MsgID json.RawMessage `json:"msg_id"`
+		}
+		if json.Unmarshal(trimmed, &ids) == nil {
+			if len(ids.ID) > 0 && string(ids.ID) != "null" {
+				return "id:" + string(ids.ID)
+			}
+			if len(ids.MsgID) > 0 && string(ids.MsgID) != "null" {
+				return "id:" + string(ids.MsgID)
+			}
+		}
+	}
+	sum := sha256.Sum256(msg)
+	return "h:" + hex.EncodeToString(sum[:16])
+}
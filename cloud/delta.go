@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+)
+
+// Delta mode (?delta=1 on /ws/ui) cuts bandwidth for devices that resend
+// near-identical state every few seconds. Device JSON objects with a string
+// "type" are tracked per type; after the first full message the UI receives
+//
+//	{"type":"delta","of":"<type>","patch":{...}}
+//
+// where patch is an RFC 7396 JSON Merge Patch against the previous message of
+// that type. Every DELTA_FULL_EVERY messages (and whenever a patch couldn't
+// express the change or wouldn't be smaller) the original message is sent
+// again as a full snapshot. Everything else passes through untouched.
+
+// deltaEncoder holds one UI connection's view of the device state. It is only
+// used from the device session's forwarding loop.
+type deltaEncoder struct {
+	fullEvery int
+	last      map[string]map[string]any
+	sinceFull map[string]int
+}
+
+func newDeltaEncoder(fullEvery int) *deltaEncoder {
+	if fullEvery < 1 {
+		fullEvery = 1
+	}
+	return &deltaEncoder{fullEvery: fullEvery, last: make(map[string]map[string]any), sinceFull: make(map[string]int)}
+}
+
+// encode returns what to send for msg; patched is false when that is msg
+// itself.
+func (d *deltaEncoder) encode(msg []byte) (out []byte, patched bool) {
+	cur, typ, ok := decodeStateMessage(msg)
+	if !ok {
+		return msg, false
+	}
+	prev, havePrev := d.last[typ]
+	d.last[typ] = cur
+	if !havePrev || d.sinceFull[typ]+1 >= d.fullEvery || containsNull(cur) {
+		d.sinceFull[typ] = 0
+		return msg, false
+	}
+	out = mustJSON(deltaMsg{Type: "delta", Of: typ, Patch: mergePatch(prev, cur)})
+	if len(out) >= len(msg) {
+		d.sinceFull[typ] = 0
+		return msg, false
+	}
+	d.sinceFull[typ]++
+	return out, true
+}
+
+func decodeStateMessage(msg []byte) (map[string]any, string, bool) {
+	trimmed := bytes.TrimSpace(msg)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, "", false
+	}
+	dec := json.NewDecoder(bytes.NewReader(trimmed))
+	dec.UseNumber() // keep numbers byte-exact when re-encoding
+	var obj map[string]any
+	if err := dec.Decode(&obj); err != nil {
+		return nil, "", false
+	}
+	typ, ok := obj["type"].(string)
+	if !ok || typ == "" || typ == "delta" {
+		return nil, "", false
+	}
+	return obj, typ, true
+}
+
+// mergePatch returns the RFC 7396 patch turning prev into cur. cur must not
+// contain nulls (a null in a merge patch means "delete").
+func mergePatch(prev, cur map[string]any) map[string]any {
+	patch := make(map[string]any)
+	for k := range prev {
+		if _, ok := cur[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	for k, cv := range cur {
+		pv, ok := prev[k]
+		if ok && reflect.DeepEqual(pv, cv) {
+			continue
+		}
+		pm, pIsObj := pv.(map[string]any)
+		cm, cIsObj := cv.(map[string]any)
+		if ok && pIsObj && cIsObj {
+			patch[k] = mergePatch(pm, cm)
+			continue
+		}
+		patch[k] = cv
+	}
+	return patch
+}
+
+func containsNull(v any) bool {
+	switch x := v.(type) {
+	case nil:
+		return true
+	case map[string]any:
+		for _, e := range x {
+			if containsNull(e) {
+				return true
+			}
+		}
+	case []any:
+		// Arrays are replaced wholesale, so nulls inside them are fine.
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"os"
+)
+
+// remove drops id from the registry, revoking its key and TOTP seed.
+func (reg *deviceRegistry) remove(id string) (bool, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.devices[id]; !ok {
+		return false, nil
+	}
+	delete(reg.devices, id)
+	return true, reg.saveLocked()
+}
+
+// revokeClaims drops every pending claim code for deviceID.
+func (s *server) revokeClaims(deviceID string) int {
+	s.claimMu.Lock()
+	defer s.claimMu.Unlock()
+	n := 0
+	for code, ce := range s.claims {
+		if ce.DeviceID == deviceID {
+			delete(s.claims, code)
+			n++
+		}
+	}
+	if n > 0 {
+		s.saveClaimsLocked()
+	}
+	return n
+}
+
+func (lrs *logRings) dropDevice(deviceID string) {
+	lrs.mu.Lock()
+	defer lrs.mu.Unlock()
+	for k := range lrs.rings {
+		if id, _ := splitKey(k); id == deviceID {
+			delete(lrs.rings, k)
+		}
+	}
+}
+
+func (sc *serialConsoles) dropDevice(deviceID string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for k := range sc.consoles {
+		if id, _ := splitKey(k); id == deviceID {
+			delete(sc.consoles, k)
+		}
+	}
+}
+
+type deregistered struct {
+	Registered     bool `json:"registered"`
+	ClaimsRevoked  int  `json:"claims_revoked"`
+	SessionsClosed int  `json:"sessions_closed"`
+}
+
+// handleDeviceDeregister serves POST /api/devices/{id}/deregister (admin):
+// for decommissioned or resold hardware. It removes the registry entry (key,
+// TOTP seed, tenant, metadata, owner), revokes pending claim and transfer
+// codes and share links, closes live sessions with 4009 deregistered, and
+// forgets what the relay kept about the device: log level, retained logs and
+// serial scrollback, uptime history, crash reports and staged files, so none
+// of it reaches the next owner.
+func (s *server) handleDeviceDeregister(w http.ResponseWriter, r *http.Request, deviceID string) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.requireRole(w, r, roleAdmin) {
+		return
+	}
+	registered, err := s.registry.remove(deviceID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	claims := s.revokeClaims(deviceID)
+	s.transfers.cancel(deviceID)
+	if _, err := s.shares.revokeDevice(deviceID); err != nil {
+		s.logf(logInfo, "device_shares_revoke_failed", "device_id", deviceID, "error", err.Error())
+	}
+	sessions := s.h.sessionsFor(deviceID, nil)
+	for _, dc := range sessions {
+		dc.closeWithReason(wsCloseDeregistered, wsCloseDeviceOffline)
+	}
+	if !registered && claims == 0 && len(sessions) == 0 {
+		writeAPIError(w, http.StatusNotFound, "device_not_found", "unknown device")
+		return
+	}
+
+	if _, err := s.logLevels.remove(deviceID); err != nil {
+		s.logf(logInfo, "device_deregister_cleanup_failed", "device_id", deviceID, "what", "log_level", "error", err.Error())
+	}
+	if _, err := s.maintenance.remove(deviceID); err != nil {
+		s.logf(logInfo, "device_deregister_cleanup_failed", "device_id", deviceID, "what", "maintenance", "error", err.Error())
+	}
+	if err := s.bwtests.remove(deviceID); err != nil {
+		s.logf(logInfo, "device_deregister_cleanup_failed", "device_id", deviceID, "what", "bwtests", "error", err.Error())
+	}
+	s.debug.remove(deviceID)
+	s.logs.dropDevice(deviceID)
+	s.serial.dropDevice(deviceID)
+	s.uptime.remove(deviceID)
+	s.disconnects.remove(deviceID)
+	if s.crashes.dir != "" {
+		if err := os.RemoveAll(s.crashes.deviceDir(deviceID)); err != nil {
+			s.logf(logInfo, "device_deregister_cleanup_failed", "device_id", deviceID, "what", "crashes", "error", err.Error())
+		}
+	}
+	if s.files.stagingDir != "" {
+		if err := os.RemoveAll(s.files.deviceDir(deviceID)); err != nil {
+			s.logf(logInfo, "device_deregister_cleanup_failed", "device_id", deviceID, "what", "files", "error", err.Error())
+		}
+	}
+
+	writeJSON(w, http.StatusOK, deregistered{Registered: registered, ClaimsRevoked: claims, SessionsClosed: len(sessions)})
+	s.logf(logInfo, "device_deregistered", "remote", clientIP(r), "device_id", deviceID,
+		"registered", registered, "claims_revoked", claims, "sessions_closed", len(sessions))
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Per-device debug logging. Turning on LOG_LEVEL=debug relay-wide is far too
+// noisy on a real fleet, so it can be switched on for one device instead:
+//
+//	PUT /api/devices/{id}/debug {"ttl":"15m","previews":true,"preview_bytes":120}
+//
+// While it is on, every debug event naming the device is logged, and so is
+// each frame on its sessions (debug_frame: direction, tunnel, text or
+// binary, size, frame tag), with an optional preview of text payloads with
+// secret-looking fields redacted. An admin can also ask for a hexdump of
+// the first bytes of each binary frame on one tunnel, for camera encoder
+// and framing problems:
+//
+//	{"ttl":"10m","hexdump":{"tunnel":"camera","bytes":64}}
+//
+// It switches itself off after ttl (default 15m, at most 24h). The setting
+// lives on the node that received the request and isn't persisted.
+
+const (
+	deviceDebugDefaultTTL = 15 * time.Minute
+	deviceDebugMaxTTL     = 24 * time.Hour
+	deviceDebugMaxPreview = 256
+	deviceDebugMaxHexdump = 256
+)
+
+type deviceDebug struct {
+	DeviceID     string         `json:"device_id"`
+	Until        time.Time      `json:"until"`
+	Previews     bool           `json:"previews"`
+	PreviewBytes int            `json:"preview_bytes,omitempty"`
+	Hexdump      *hexdumpTarget `json:"hexdump,omitempty"`
+	SetBy        string         `json:"set_by"`
+	SetAt        time.Time      `json:"set_at"`
+}
+
+// hexdumpTarget picks the tunnel whose binary frames are dumped, and how
+// many leading bytes of each.
+type hexdumpTarget struct {
+	Tunnel string `json:"tunnel"`
+	Bytes  int    `json:"bytes"`
+}
+
+// hexPreview logs as grouped hex ("ffd8ffe0 00104a46 ..."). It isn't a
+// string, so logf doesn't shorten it.
+type hexPreview []byte
+
+const hexDigits = "0123456789abcdef"
+
+func (h hexPreview) String() string {
+	var b strings.Builder
+	b.Grow(len(h) * 9 / 4)
+	for i, c := range h {
+		if i > 0 && i%4 == 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteByte(hexDigits[c>>4])
+		b.WriteByte(hexDigits[c&0x0f])
+	}
+	return b.String()
+}
+
+type debugSet struct {
+	active atomic.Int32 // len(devices), for a lock-free fast path
+
+	mu      sync.RWMutex
+	devices map[string]*deviceDebug
+}
+
+func newDebugSet() *debugSet {
+	return &debugSet{devices: make(map[string]*deviceDebug)}
+}
+
+// get returns deviceID's debug setting if it is on.
+func (ds *debugSet) get(deviceID string) *deviceDebug {
+	if ds.active.Load() == 0 {
+		return nil
+	}
+	ds.mu.RLock()
+	d := ds.devices[deviceID]
+	ds.mu.RUnlock()
+	if d == nil || time.Now().Before(d.Until) {
+		return d
+	}
+	ds.mu.Lock()
+	if ds.devices[deviceID] == d {
+		delete(ds.devices, deviceID)
+		ds.active.Store(int32(len(ds.devices)))
+	}
+	ds.mu.Unlock()
+	return nil
+}
+
+func (ds *debugSet) set(d *deviceDebug) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.devices[d.DeviceID] = d
+	ds.active.Store(int32(len(ds.devices)))
+}
+
+func (ds *debugSet) remove(deviceID string) bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	d, ok := ds.devices[deviceID]
+	delete(ds.devices, deviceID)
+	ds.active.Store(int32(len(ds.devices)))
+	return ok && time.Now().Before(d.Until)
+}
+
+// debugging reports whether kv names a device with debug logging on.
+func (s *server) debugging(kv []any) bool {
+	if s.debug == nil || s.debug.active.Load() == 0 {
+		return false
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		if k, _ := kv[i].(string); k == "device_id" {
+			id, _ := kv[i+1].(string)
+			return s.debug.get(id) != nil
+		}
+	}
+	return false
+}
+
+// debugFrame logs one frame on a debugged device's session.
+func (s *server) debugFrame(d *deviceDebug, dir, tunnel string, mt int, msg []byte, frameTags bool) {
+	kv := []any{"device_id", d.DeviceID, "tunnel", tunnel, "dir", dir, "bytes", len(msg)}
+	if mt == websocket.BinaryMessage {
+		kv = append(kv, "kind", "binary")
+		if frameTags && dir == "device_to_relay" {
+			if typ, flags, _, ok := parseFrameTag(msg); ok {
+				kv = append(kv, "frame", frameTypeName(typ), "flags", int(flags))
+			}
+		}
+		if h := d.Hexdump; h != nil && h.Tunnel == tunnel {
+			kv = append(kv, "hex", hexPreview(msg[:min(len(msg), h.Bytes)]))
+		}
+	} else {
+		kv = append(kv, "kind", "text")
+		if d.Previews {
+			kv = append(kv, "preview", truncate(string(redactJSON(msg)), d.PreviewBytes))
+		}
+	}
+	s.logf(logDebug, "debug_frame", kv...)
+}
+
+type setDeviceDebugRequest struct {
+	TTL          string `json:"ttl,omitempty"`
+	Previews     bool   `json:"previews,omitempty"`
+	PreviewBytes int    `json:"preview_bytes,omitempty"`
+	// Admin only.
+	Hexdump *hexdumpTarget `json:"hexdump,omitempty"`
+}
+
+// handleDeviceDebug manages a device's debug logging:
+//
+//	GET    /api/devices/{id}/debug
+//	PUT    /api/devices/{id}/debug  {"ttl":"15m","previews":true}
+//	DELETE /api/devices/{id}/debug
+func (s *server) handleDeviceDebug(w http.ResponseWriter, r *http.Request, deviceID string) {
+	switch r.Method {
+	case http.MethodGet:
+		if !s.requireRole(w, r, roleViewer) {
+			return
+		}
+		d := s.debug.get(deviceID)
+		if d == nil {
+			writeAPIError(w, http.StatusNotFound, "debug_off", "debug logging is off")
+			return
+		}
+		writeJSON(w, http.StatusOK, d)
+	case http.MethodPut:
+		if !s.requireRole(w, r, roleOperator) {
+			return
+		}
+		var req setDeviceDebugRequest
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeJSONDecodeError(w, err)
+			return
+		}
+		ttl := deviceDebugDefaultTTL
+		if req.TTL != "" {
+			d, err := time.ParseDuration(req.TTL)
+			if err != nil || d <= 0 || d > deviceDebugMaxTTL {
+				writeAPIError(w, http.StatusBadRequest, "invalid_ttl", "ttl must be a positive duration up to 24h")
+				return
+			}
+			ttl = d
+		}
+		if req.PreviewBytes < 0 || req.PreviewBytes > deviceDebugMaxPreview {
+			writeAPIError(w, http.StatusBadRequest, "invalid_preview_bytes", "preview_bytes must be 0-256")
+			return
+		}
+		if req.Previews && req.PreviewBytes == 0 {
+			req.PreviewBytes = 120
+		}
+		if req.Hexdump != nil {
+			if !s.requireRole(w, r, roleAdmin) {
+				return
+			}
+			if req.Hexdump.Bytes == 0 {
+				req.Hexdump.Bytes = 64
+			}
+			if req.Hexdump.Bytes < 0 || req.Hexdump.Bytes > deviceDebugMaxHexdump {
+				writeAPIError(w, http.StatusBadRequest, "invalid_hexdump_bytes", "hexdump.bytes must be 1-256")
+				return
+			}
+		}
+		now := time.Now().UTC()
+		d := &deviceDebug{DeviceID: deviceID, Until: now.Add(ttl), Previews: req.Previews, PreviewBytes: req.PreviewBytes,
+			Hexdump: req.Hexdump, SetBy: s.auditActor(r), SetAt: now}
+		s.debug.set(d)
+		writeJSON(w, http.StatusOK, d)
+		s.logf(logInfo, "device_debug_on", "remote", clientIP(r), "device_id", deviceID, "by", d.SetBy,
+			"until", d.Until.Format(time.RFC3339), "previews", d.Previews, "hexdump", d.Hexdump != nil)
+	case http.MethodDelete:
+		if !s.requireRole(w, r, roleOperator) {
+			return
+		}
+		if !s.debug.remove(deviceID) {
+			writeAPIError(w, http.StatusNotFound, "debug_off", "debug logging is off")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		s.logf(logInfo, "device_debug_off", "remote", clientIP(r), "device_id", deviceID)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
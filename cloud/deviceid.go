@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Device IDs are often hostnames the user chose, so they may be Unicode
+// ("Küche-cam"). Every ID that enters the relay, from a path, a query or a
+// request body, goes through normalizeDeviceID first, and only its result is
+// used as a registry, hub or stats key:
+//
+//   - surrounding spaces are trimmed;
+//   - punycode labels (xn--kche-cam-65a) are decoded, so the ACE and Unicode
+//     spellings of a hostname are the same device;
+//   - the ID is lowercased. Decoded labels and Host headers
+//     (deviceSubdomain) only come lowercase, so Küche-cam has to fold for
+//     its ACE and subdomain forms to reach it;
+//   - the result is NFC, so a precomposed ü and u followed by U+0308 match.
+//
+// IDs then compare byte for byte. An ID that isn't valid UTF-8, is longer than
+// maxDeviceIDBytes, or contains control or format characters (bidi
+// overrides, zero-width joiners), '/' or '|' is refused with
+// invalid_device_id. Paths carry IDs percent-encoded as UTF-8
+// (/ws/ui/K%C3%BCche-cam); URLs the relay builds use deviceIDPath.
+
+const maxDeviceIDBytes = 128
+
+// normalizeDeviceID returns raw's canonical form; ok is false if raw isn't a
+// valid device ID.
+func normalizeDeviceID(raw string) (id string, ok bool) {
+	id = strings.TrimSpace(raw)
+	if id == "" || !utf8.ValidString(id) {
+		return "", false
+	}
+	if strings.Contains(strings.ToLower(id), "xn--") {
+		labels := strings.Split(id, ".")
+		for i, l := range labels {
+			if len(l) < 4 || !strings.EqualFold(l[:4], "xn--") {
+				continue
+			}
+			u, err := idna.Punycode.ToUnicode(strings.ToLower(l))
+			if err != nil || u == "" {
+				return "", false
+			}
+			labels[i] = u
+		}
+		id = strings.Join(labels, ".")
+	}
+	id = norm.NFC.String(strings.ToLower(id))
+	if len(id) > maxDeviceIDBytes {
+		return "", false
+	}
+	for _, c := range id {
+		if c == '/' || c == '|' || c == utf8.RuneError || unicode.IsControl(c) || unicode.Is(unicode.Cf, c) {
+			return "", false
+		}
+	}
+	return id, true
+}
+
+// Documents saved before IDs were normalized, or lowercased, can hold IDs
+// no lookup produces any more. Every store keyed by device ID re-keys its
+// entries when it loads, with canonicalDeviceKeys (or normalizeDeviceID
+// where the ID is just a field), and notes what it couldn't place with
+// fileStore.noteLegacyIDs. The relay logs that as legacy_device_ids with
+// the raw IDs, so an operator can re-create those entries; the store's next
+// save rewrites the document without them.
+
+// canonicalDeviceKeys re-keys in by canonical device ID. Keys that are
+// already canonical win a collision; the other colliding keys, and keys
+// that no longer validate, are left out and returned in dropped.
+func canonicalDeviceKeys[T any](in map[string]T) (out map[string]T, moved int, dropped []string) {
+	keys := make([]string, 0, len(in))
+	for k := range in {
+		if k != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	out = make(map[string]T, len(in))
+	var legacy []string
+	for _, k := range keys {
+		switch id, ok := normalizeDeviceID(k); {
+		case !ok:
+			dropped = append(dropped, k)
+		case id == k:
+			out[id] = in[k]
+		default:
+			legacy = append(legacy, k)
+		}
+	}
+	for _, k := range legacy {
+		id, _ := normalizeDeviceID(k)
+		if _, taken := out[id]; taken {
+			dropped = append(dropped, k)
+			continue
+		}
+		out[id] = in[k]
+		moved++
+	}
+	return out, moved, dropped
+}
+
+// reportLegacyIDs logs what the stores' loads noted about legacy device IDs.
+func (s *server) reportLegacyIDs() {
+	for _, n := range s.store.takeLegacyIDs() {
+		s.logf(logInfo, "legacy_device_ids", "doc", n.doc, "moved", n.moved, "dropped", len(n.dropped),
+			"dropped_ids", strings.Join(n.dropped, ","))
+	}
+}
+
+// deviceIDPath escapes a device ID for use as a URL path segment.
+func deviceIDPath(deviceID string) string {
+	return url.PathEscape(deviceID)
+}
+
+// deviceIDFilter reads an optional ?device_id= filter, normalized; false if
+// it answered r with 400.
+func deviceIDFilter(w http.ResponseWriter, r *http.Request) (string, bool) {
+	raw := r.URL.Query().Get("device_id")
+	if strings.TrimSpace(raw) == "" {
+		return "", true
+	}
+	id, ok := normalizeDeviceID(raw)
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "invalid_device_id", "invalid device_id")
+	}
+	return id, ok
+}
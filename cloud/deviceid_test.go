@@ -0,0 +1,93 @@
+package main
+
+import (
+	"maps"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeDeviceID(t *testing.T) {
+	tests := []struct {
+		name, raw, want string
+		ok              bool
+	}{
+		{"ascii", "espwifi-abcd12", "espwifi-abcd12", true},
+		{"upper case folds", "espwifi-ABCD12", "espwifi-abcd12", true},
+		{"spaces trimmed", "  cam-1 ", "cam-1", true},
+		{"nfc", "Küche-cam", "küche-cam", true},
+		{"nfd composes", "Ku\u0308che-cam", "küche-cam", true},
+		{"ace", "xn--kche-cam-65a", "küche-cam", true},
+		{"ace upper case", "XN--KCHE-CAM-65A", "küche-cam", true},
+		{"ace label among others", "Garage.xn--kche-cam-65a", "garage.küche-cam", true},
+		{"bad ace", "xn--", "", false},
+		{"empty", "", "", false},
+		{"blank", "   ", "", false},
+		{"not utf-8", "cam\xff", "", false},
+		{"bidi override", "cam\u202egnp", "", false},
+		{"bidi isolate", "cam\u2067x", "", false},
+		{"zero-width joiner", "ca\u200dm", "", false},
+		{"zero-width space", "ca\u200bm", "", false},
+		{"control", "ca\x00m", "", false},
+		{"slash", "a/b", "", false},
+		{"pipe", "a|b", "", false},
+		{"128 bytes", strings.Repeat("a", 128), strings.Repeat("a", 128), true},
+		{"129 bytes", strings.Repeat("a", 129), "", false},
+		{"128 bytes of two-byte runes", strings.Repeat("ü", 64), strings.Repeat("ü", 64), true},
+		{"length counts after nfc", strings.Repeat("u\u0308", 64), strings.Repeat("ü", 64), true},
+		{"130 bytes of two-byte runes", strings.Repeat("ü", 65), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := normalizeDeviceID(tt.raw)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("normalizeDeviceID(%q) = %q, %v; want %q, %v", tt.raw, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCanonicalDeviceKeys(t *testing.T) {
+	in := map[string]int{"Cam": 1, "cam": 2, "Dog": 3, "a/b": 4, "": 5}
+	out, moved, dropped := canonicalDeviceKeys(in)
+	if want := map[string]int{"cam": 2, "dog": 3}; !maps.Equal(out, want) {
+		t.Errorf("out = %v, want %v", out, want)
+	}
+	if moved != 1 {
+		t.Errorf("moved = %d, want 1", moved)
+	}
+	if want := []string{"a/b", "Cam"}; !slices.Equal(dropped, want) {
+		t.Errorf("dropped = %q, want %q", dropped, want)
+	}
+}
+
+// Subdomains reach devices whatever case the ID was registered in: both
+// sides end up as the lowercase canonical ID.
+func TestDeviceSubdomainID(t *testing.T) {
+	s := &server{deviceDomain: "devices.example.com"}
+	tests := []struct{ host, registered, want string }{
+		{"espwifi-abcd12.devices.example.com", "espwifi-ABCD12", "espwifi-abcd12"},
+		{"ESPWIFI-ABCD12.Devices.Example.com:443", "espwifi-abcd12", "espwifi-abcd12"},
+		{"xn--kche-cam-65a.devices.example.com", "Küche-cam", "küche-cam"},
+		{"a.b.devices.example.com", "", ""},
+		{"devices.example.com", "", ""},
+		{"espwifi-abcd12.example.com", "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/ws/ui", nil)
+		r.Host = tt.host
+		label := s.deviceSubdomain(r)
+		if tt.want == "" {
+			if label != "" {
+				t.Errorf("deviceSubdomain(%s) = %q, want none", tt.host, label)
+			}
+			continue
+		}
+		got, _ := normalizeDeviceID(label)
+		reg, _ := normalizeDeviceID(tt.registered)
+		if got != tt.want || reg != tt.want {
+			t.Errorf("%s: subdomain ID %q, registered ID %q; want %q", tt.host, got, reg, tt.want)
+		}
+	}
+}
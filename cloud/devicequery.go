@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// deviceQuery is the filtering and ordering /api/devices accepts:
+//
+//	?sort=device_id|connected_at|last_seen|last_message|ui_clients|bytes
+//	&order=asc|desc   (default asc; desc for the time fields)
+//	?seen_since=15m   last seen within the window
+//	?silent_for=10m   no application message for at least this long
+//	?capability=ota   declared a truthy "ota" capability
+//	?group=device     one entry per device with its tunnels nested
+//
+// so tooling can ask e.g. for sessions that went quiet
+// (?silent_for=10m&sort=last_message) without post-processing everything.
+type deviceQuery struct {
+	sort       string
+	desc       bool
+	seenSince  time.Duration
+	silentFor  time.Duration
+	capability string
+	group      bool
+}
+
+var deviceSortKeys = map[string]func(a, b deviceInfo) bool{
+	"device_id": func(a, b deviceInfo) bool {
+		if a.DeviceID != b.DeviceID {
+			return a.DeviceID < b.DeviceID
+		}
+		return a.TunnelKey < b.TunnelKey
+	},
+	"connected_at": func(a, b deviceInfo) bool { return a.ConnectedAt.Before(b.ConnectedAt) },
+	"last_seen":    func(a, b deviceInfo) bool { return a.LastSeen.Before(b.LastSeen) },
+	"last_message": func(a, b deviceInfo) bool { return a.LastMessageAt.Before(b.LastMessageAt) },
+	"ui_clients":   func(a, b deviceInfo) bool { return a.UIClients < b.UIClients },
+	"bytes": func(a, b deviceInfo) bool {
+		return a.BytesFromDevice+a.BytesToDevice < b.BytesFromDevice+b.BytesToDevice
+	},
+}
+
+func parseDeviceQuery(r *http.Request) (deviceQuery, error) {
+	q := r.URL.Query()
+	var dq deviceQuery
+	if v := strings.TrimSpace(q.Get("sort")); v != "" {
+		if _, ok := deviceSortKeys[v]; !ok {
+			return dq, errors.New("sort must be one of device_id, connected_at, last_seen, last_message, ui_clients, bytes")
+		}
+		dq.sort = v
+		dq.desc = v == "connected_at" || v == "last_seen" || v == "last_message"
+	}
+	switch q.Get("order") {
+	case "":
+	case "asc":
+		dq.desc = false
+	case "desc":
+		dq.desc = true
+	default:
+		return dq, errors.New("order must be asc or desc")
+	}
+	for _, f := range []struct {
+		name string
+		dst  *time.Duration
+	}{{"seen_since", &dq.seenSince}, {"silent_for", &dq.silentFor}} {
+		v := q.Get(f.name)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return dq, errors.New(f.name + " must be a positive duration like 15m")
+		}
+		*f.dst = d
+	}
+	dq.capability = strings.TrimSpace(q.Get("capability"))
+	switch q.Get("group") {
+	case "":
+	case "device":
+		dq.group = true
+	default:
+		return dq, errors.New("group must be device")
+	}
+	return dq, nil
+}
+
+func (dq deviceQuery) apply(devices []deviceInfo, now time.Time) []deviceInfo {
+	if dq.seenSince > 0 || dq.silentFor > 0 || dq.capability != "" {
+		kept := devices[:0]
+		for _, d := range devices {
+			if dq.seenSince > 0 && now.Sub(d.LastSeen) > dq.seenSince {
+				continue
+			}
+			if dq.silentFor > 0 && d.SilentFor < dq.silentFor.Seconds() {
+				continue
+			}
+			if dq.capability != "" && !hasCapability(d.Capabilities, dq.capability) {
+				continue
+			}
+			kept = append(kept, d)
+		}
+		devices = kept
+	}
+	if less := deviceSortKeys[dq.sort]; less != nil {
+		sort.SliceStable(devices, func(i, j int) bool {
+			if dq.desc {
+				return less(devices[j], devices[i])
+			}
+			return less(devices[i], devices[j])
+		})
+	}
+	return devices
+}
+
+// deviceGroup is one device with all of its tunnel sessions, for
+// ?group=device. Totals and status are aggregated over the sessions.
+type deviceGroup struct {
+	DeviceID string `json:"device_id"`
+	// Any tunnel connected / stale; reconnect expected on every tunnel.
+	Connected         bool               `json:"connected"`
+	Stale             bool               `json:"stale"`
+	ReconnectExpected bool               `json:"reconnect_expected,omitempty"`
+	LastSeen          time.Time          `json:"last_seen,omitempty"`
+	LastMessageAt     time.Time          `json:"last_message_at,omitempty"`
+	UIClients         int                `json:"ui_clients"`
+	BytesFromDevice   uint64             `json:"bytes_from_device"`
+	BytesToDevice     uint64             `json:"bytes_to_device"`
+	Capabilities      map[string]any     `json:"capabilities,omitempty"`
+	Maintenance       *maintenanceWindow `json:"maintenance,omitempty"`
+	Region            string             `json:"region,omitempty"`
+	Tunnels           []deviceInfo       `json:"tunnels"`
+}
+
+// groupByDevice nests sessions under their device. Devices keep the order
+// of their first session, so ?sort= still applies.
+func groupByDevice(devices []deviceInfo) []deviceGroup {
+	out := []deviceGroup{}
+	idx := make(map[string]int)
+	for _, d := range devices {
+		i, ok := idx[d.DeviceID]
+		if !ok {
+			i = len(out)
+			idx[d.DeviceID] = i
+			out = append(out, deviceGroup{DeviceID: d.DeviceID, ReconnectExpected: true, Region: d.Region})
+		}
+		g := &out[i]
+		g.Connected = g.Connected || d.Connected
+		g.Stale = g.Stale || d.Stale
+		g.ReconnectExpected = g.ReconnectExpected && d.ReconnectExpected
+		if d.LastSeen.After(g.LastSeen) {
+			g.LastSeen = d.LastSeen
+		}
+		if d.LastMessageAt.After(g.LastMessageAt) {
+			g.LastMessageAt = d.LastMessageAt
+		}
+		g.UIClients += d.UIClients
+		g.BytesFromDevice += d.BytesFromDevice
+		g.BytesToDevice += d.BytesToDevice
+		if g.Capabilities == nil {
+			g.Capabilities = d.Capabilities
+		}
+		if d.Maintenance != nil {
+			g.Maintenance = d.Maintenance
+		}
+		g.Tunnels = append(g.Tunnels, d)
+	}
+	return out
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsMsg is one device message on its way to the UIs.
+type wsMsg struct {
+	mt  int
+	msg []byte
+	at  time.Time
+	seq uint64
+}
+
+// deviceSession is the per-session state between a device's socket and its
+// UIs. The reader side (ingest) turns frames into messages; the forwarder
+// side (forward) fans them out. Every engine runs ingest on whatever reads
+// the socket and hands messages to out, whose writer goroutine runs forward
+// (see forwarder.go), so the two sides share no fields.
+type deviceSession struct {
+	s                     *server
+	dc                    *deviceConn
+	deviceID, tunnel, key string
+
+	// Reader side.
+	seq    uint64
+	chunks *chunkAssembler
+	pushes *filePushes
+
+	// Forwarder side: per-UI delta state and frame policies.
+	deltas map[*websocket.Conn]*deltaEncoder
+	frames *frameGate
+	rec    *frameRecording // nil unless a policy records
+	// Media tunnels: how far each UI lags. A UI lagging more than
+	// MEDIA_MAX_LAG only gets a frame when no newer one is queued behind it
+	// (latest wins), so live video doesn't drift behind.
+	lag map[*websocket.Conn]*uiMediaLag
+	// Messages queued behind the one being forwarded.
+	queued int
+	out    *forwardQueue
+	// Serial tunnels keep scrollback and flush partial lines when idle;
+	// log tunnels keep a ring of recent lines.
+	serial  *serialConsole
+	logRing *logRing
+}
+
+// uiMediaLag is one UI's lag on a media tunnel: the time its own socket
+// took to take its last frame, plus its share of the time the frame waited
+// in the queue. The wait is shared out by each UI's recent write time
+// (cost), since the UIs that were slow to write are the ones that backed
+// the queue up. Writes to other UIs are never charged to it, so a fast UI
+// listed after a slow one doesn't skip frames on its account.
+type uiMediaLag struct {
+	lag  time.Duration
+	cost time.Duration // moving average of its write time
+}
+
+// noteMediaWrites updates the lag of the UIs a media frame was written to;
+// took[i] is uis[i]'s write time, 0 if it was skipped.
+func (ds *deviceSession) noteMediaWrites(uis []*websocket.Conn, took []time.Duration, waited time.Duration) {
+	var total time.Duration
+	for i, d := range took {
+		if d == 0 {
+			continue
+		}
+		ml := ds.lag[uis[i]]
+		if ml == nil {
+			ml = &uiMediaLag{cost: d}
+			ds.lag[uis[i]] = ml
+		}
+		ml.cost = (7*ml.cost + d) / 8
+		total += ml.cost
+	}
+	for i, d := range took {
+		if d > 0 {
+			ml := ds.lag[uis[i]]
+			ml.lag = d + time.Duration(float64(waited)*float64(ml.cost)/float64(total))
+		}
+	}
+}
+
+func (s *server) newDeviceSession(dc *deviceConn, deviceID, tunnel string) *deviceSession {
+	ds := &deviceSession{
+		s:        s,
+		dc:       dc,
+		deviceID: deviceID,
+		tunnel:   tunnel,
+		key:      makeKey(deviceID, tunnel),
+		chunks:   newChunkAssembler(s.chunkMaxBytes),
+		pushes:   s.files.newFilePushes(deviceID, tunnel),
+		deltas:   make(map[*websocket.Conn]*deltaEncoder),
+		frames:   newFrameGate(s.framePolicies),
+		rec:      s.recorder.session(deviceID, tunnel),
+	}
+	ds.out = newForwardQueue(ds, s.forwardQueueMax)
+	if s.isSerialTunnel(tunnel) {
+		ds.serial = s.serial.get(ds.key)
+	}
+	if s.isLogTunnel(tunnel) {
+		ds.logRing = s.logs.get(ds.key)
+	}
+	if s.isMediaTunnel(tunnel) && s.mediaMaxLag > 0 {
+		ds.lag = make(map[*websocket.Conn]*uiMediaLag)
+	}
+	return ds
+}
+
+// ingest accounts for one message read from the device and returns what to
+// forward, if anything. must is set for reassembled chunked messages: they
+// cost the device real effort, so the queue gives them extra room.
+func (ds *deviceSession) ingest(mt int, msg []byte) (m wsMsg, ok, must bool) {
+	dc := ds.dc
+	dc.lastMessage.Store(time.Now().UTC().UnixNano())
+	dc.bytesFromDevice.Add(uint64(len(msg)))
+	if run := dc.bwtest.Load(); run != nil && run.feed(mt, msg) {
+		return m, false, false
+	}
+	if d := ds.s.debug.get(ds.deviceID); d != nil {
+		ds.s.debugFrame(d, "device_to_relay", ds.tunnel, mt, msg, dc.frameTags)
+	}
+	if admitted, notice := dc.deviceLimit.admit(time.Now(), len(msg)); !admitted || notice != nil {
+		if notice != nil {
+			_ = dc.writeDevice(websocket.TextMessage, notice)
+		}
+		if !admitted {
+			ds.s.tunnelRateLimited.Inc(dirDeviceToUI, ds.s.tunnelLabel(ds.tunnel))
+			return m, false, false
+		}
+	}
+	if outMT, out, reply, consumed := ds.chunks.feed(mt, msg, time.Now()); consumed {
+		if reply != nil {
+			_ = dc.writeDevice(websocket.TextMessage, reply)
+		}
+		if out == nil {
+			return m, false, false
+		}
+		ds.seq++
+		return wsMsg{mt: outMT, msg: out, at: time.Now(), seq: ds.seq}, true, true
+	}
+	if reply, progress, consumed := ds.pushes.feed(mt, msg); consumed {
+		if reply != nil {
+			_ = dc.writeDevice(websocket.TextMessage, reply)
+		}
+		if progress == nil {
+			return m, false, false
+		}
+		return wsMsg{mt: websocket.TextMessage, msg: progress, at: time.Now()}, true, false
+	}
+	if ds.deviceKick(mt, msg) {
+		return m, false, false
+	}
+	// Numbered before delivery so envelope UIs see drops as gaps.
+	ds.seq++
+	return wsMsg{mt: mt, msg: msg, at: time.Now(), seq: ds.seq}, true, false
+}
+
+// forward delivers m to the session's UIs. On serial tunnels it reports
+// whether a partial line is waiting for the idle flush.
+func (ds *deviceSession) forward(m wsMsg) (serialPending bool) {
+	s, dc, tunnel := ds.s, ds.dc, ds.tunnel
+	s.shed.noteQueueDelay(time.Since(m.at))
+	if m.msg = s.filterDevice(tunnel, m.msg); m.msg == nil {
+		return false
+	}
+	if s.upstream != nil {
+		s.upstream.forward(ds.key, m)
+	}
+	if m.mt == websocket.TextMessage && len(s.iceServers) > 0 && ds.deviceP2PSignal(m.msg) {
+		return false
+	}
+	if m.mt == websocket.BinaryMessage && s.mem.Shedding() && s.isMediaTunnel(tunnel) {
+		s.memShedFrames.Inc()
+		return false
+	}
+	if class, shed := s.sheds(tunnel, m.mt); shed {
+		s.shedMessages.Inc(class)
+		return false
+	}
+	tagged := false // m.msg carries a frame header
+	if m.mt == websocket.BinaryMessage && dc.frameTags {
+		typ, _, _, ok := parseFrameTag(m.msg)
+		if !ok {
+			s.framesDropped.Inc("invalid", "malformed")
+			return false
+		}
+		s.framesReceived.Inc(frameTypeName(typ))
+		if admit, reason := ds.frames.admit(typ, m.at); !admit {
+			s.framesDropped.Inc(frameTypeName(typ), reason)
+			return false
+		}
+		if ds.rec != nil && ds.frames.records(typ) {
+			if err := ds.rec.write(typ, m.msg, m.at); err != nil && !ds.rec.failed {
+				ds.rec.failed = true
+				s.logf(logInfo, "frame_record_failed", "device_id", ds.deviceID, "tunnel", tunnel, "error", err.Error())
+			}
+		}
+		tagged = true
+	}
+	if ds.serial != nil {
+		data := m.msg
+		if tagged {
+			data = data[frameHeaderLen:]
+		}
+		pending := s.forwardSerial(dc, ds.serial, data, m.at)
+		s.observeForward(dirDeviceToUI, tunnel, len(m.msg), m.at)
+		return pending
+	}
+	if ds.logRing != nil && m.mt == websocket.TextMessage {
+		ds.logRing.add(m.msg, m.at)
+		if st, ok := s.logLevels.get(ds.deviceID); ok {
+			out, dropped, keep := filterLogLines(m.msg, st.level)
+			if dropped > 0 {
+				s.logLinesFiltered.Add(uint64(dropped))
+			}
+			if !keep {
+				return false
+			}
+			m.msg = out
+		}
+	}
+	// Forward device payload to any connected UI clients.
+	dc.uiMu.Lock()
+	uis := make([]*websocket.Conn, 0, len(dc.uiConns))
+	uiOpts := make([]uiOptions, 0, len(dc.uiConns))
+	for c, opts := range dc.uiConns {
+		uis = append(uis, c)
+		uiOpts = append(uiOpts, opts)
+	}
+	dc.uiMu.Unlock()
+	if len(ds.deltas) > len(uis) || len(ds.lag) > len(uis) {
+		live := make(map[*websocket.Conn]bool, len(uis))
+		for _, c := range uis {
+			live[c] = true
+		}
+		for c := range ds.deltas {
+			if !live[c] {
+				delete(ds.deltas, c)
+			}
+		}
+		for c := range ds.lag {
+			if !live[c] {
+				delete(ds.lag, c)
+			}
+		}
+	}
+	if len(uis) == 0 {
+		return false
+	}
+	var wrapped []byte // envelope of the unmodified message, shared
+	media := m.mt == websocket.BinaryMessage && ds.lag != nil
+	dc.uiWriteMu.Lock()
+	waited := time.Since(m.at)
+	var took []time.Duration // media: each UI's write, by index in uis
+	if media {
+		took = make([]time.Duration, len(uis))
+	}
+	for i, uiConn := range uis {
+		if m.mt == websocket.BinaryMessage && uiOpts[i].p2p != nil && uiOpts[i].p2p.direct.Load() {
+			s.p2pFramesSkipped.Inc(s.tunnelLabel(tunnel))
+			continue
+		}
+		out, patched := m.msg, false
+		if tagged && !uiOpts[i].frameTags {
+			out = m.msg[frameHeaderLen:]
+		}
+		if m.mt == websocket.BinaryMessage && uiOpts[i].maxFrame > 0 && len(out) > uiOpts[i].maxFrame {
+			s.oversizeSkipped.Inc(s.tunnelLabel(tunnel))
+			continue
+		}
+		if ml := ds.lag[uiConn]; media && ds.queued > 0 && ml != nil && ml.lag > s.mediaMaxLag {
+			s.mediaFramesSkipped.Inc(s.tunnelLabel(tunnel))
+			continue
+		}
+		if m.mt == websocket.TextMessage {
+			if uiOpts[i].delta {
+				enc := ds.deltas[uiConn]
+				if enc == nil {
+					enc = newDeltaEncoder(s.deltaFullEvery)
+					ds.deltas[uiConn] = enc
+				}
+				out, patched = enc.encode(m.msg)
+			}
+			switch {
+			case !uiOpts[i].envelope:
+			case patched:
+				out = envelopeMessage(out, m.at, m.seq)
+			default:
+				if wrapped == nil {
+					wrapped = envelopeMessage(m.msg, m.at, m.seq)
+				}
+				out = wrapped
+			}
+		}
+		wrote := time.Now()
+		_ = dc.writeUI(uiConn, m.mt, out)
+		if media {
+			took[i] = max(time.Since(wrote), 1)
+		}
+	}
+	dc.uiWriteMu.Unlock()
+	ds.noteMediaWrites(uis, took, waited)
+	s.observeForward(dirDeviceToUI, tunnel, len(m.msg), m.at)
+	return false
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// /ws/admin/devices streams the device list: a full snapshot on connect,
+// then only what changed.
+//
+//	{"type":"snapshot","devices":[...]}
+//	{"type":"added","device":{...}}
+//	{"type":"changed","device":{...}}
+//	{"type":"removed","device_id":"abc","tunnel":"ws_control"}
+//
+// Devices are the same objects /api/devices returns. Byte counters and
+// silence timers tick constantly, so they only trigger "changed" with
+// ?stats=1; otherwise a device changes when it (re)connects, its UI count
+// changes, or its URLs move.
+//
+// One snapshot of the hub per DEVICE_WATCH_INTERVAL serves every
+// subscriber, taken only while there are any; each subscriber filters it to
+// what it may see, fills in its URLs and diffs against what it sent.
+
+type deviceListEvent struct {
+	Type     string      `json:"type"`
+	Device   *deviceInfo `json:"device,omitempty"`
+	DeviceID string      `json:"device_id,omitempty"`
+	Tunnel   string      `json:"tunnel,omitempty"`
+}
+
+type deviceListSnapshot struct {
+	Type    string       `json:"type"` // "snapshot"
+	Devices []deviceInfo `json:"devices"`
+}
+
+// deviceWatch hands the latest hub snapshot to each subscriber.
+type deviceWatch struct {
+	mu   sync.Mutex
+	subs map[chan []deviceInfo]bool
+	done chan struct{} // closed when the last subscriber leaves
+}
+
+// watchDevices subscribes to the shared snapshots. A subscriber that falls
+// behind gets only the newest one.
+func (s *server) watchDevices() (<-chan []deviceInfo, func()) {
+	dw := &s.deviceWatch
+	ch := make(chan []deviceInfo, 1)
+	dw.mu.Lock()
+	if dw.subs == nil {
+		dw.subs = make(map[chan []deviceInfo]bool)
+	}
+	dw.subs[ch] = true
+	if len(dw.subs) == 1 {
+		dw.done = make(chan struct{})
+		go s.runDeviceWatch(dw.done)
+	}
+	dw.mu.Unlock()
+	return ch, func() {
+		dw.mu.Lock()
+		delete(dw.subs, ch)
+		if len(dw.subs) == 0 {
+			close(dw.done)
+		}
+		dw.mu.Unlock()
+	}
+}
+
+func (s *server) runDeviceWatch(done chan struct{}) {
+	dw := &s.deviceWatch
+	t := time.NewTicker(s.deviceWatchInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		// URLs depend on who asks; subscribers fill them in.
+		snap := s.h.snapshot(func(string) string { return "" })
+		dw.mu.Lock()
+		for ch := range dw.subs {
+			select {
+			case <-ch: // not taken yet: replace it
+			default:
+			}
+			select {
+			case ch <- snap:
+			default:
+			}
+		}
+		dw.mu.Unlock()
+	}
+}
+
+func deviceChanged(a, b deviceInfo, stats bool) bool {
+	if a.Connected != b.Connected || !a.ConnectedAt.Equal(b.ConnectedAt) || a.UIClients != b.UIClients ||
+		a.Compression != b.Compression || a.Stale != b.Stale || a.UIWSURL != b.UIWSURL || a.DeviceWSURL != b.DeviceWSURL {
+		return true
+	}
+	return stats && (a.BytesFromDevice != b.BytesFromDevice || a.BytesToDevice != b.BytesToDevice ||
+		!a.LastMessageAt.Equal(b.LastMessageAt))
+}
+
+func (s *server) handleDeviceWatchWS(w http.ResponseWriter, r *http.Request) {
+	if !s.callerHas(r, roleViewer) {
+		s.rejectWS(w, r, http.StatusUnauthorized, wsCloseUnauthorized, "device_watch_ws_unauthorized", "remote", clientIP(r))
+		return
+	}
+	stats := r.URL.Query().Get("stats") == "1"
+	// view is what this caller sees of a snapshot, as /api/devices shows it.
+	view := func(snap []deviceInfo) map[string]deviceInfo {
+		out := make(map[string]deviceInfo, len(snap))
+		for _, d := range snap {
+			if s.hostAllows(r, d.DeviceID) && s.ownerAllows(r, d.DeviceID) {
+				d.UIWSURL, d.DeviceWSURL = wsURLs(s.publicBaseFor(r, d.DeviceID), d.DeviceID, d.TunnelKey)
+				out[makeKey(d.DeviceID, d.TunnelKey)] = d
+			}
+		}
+		return out
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	s.logf(logInfo, "device_watch_ws_connected", "remote", clientIP(r))
+
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	snaps, unsubscribe := s.watchDevices()
+	defer unsubscribe()
+	prev := view(s.h.snapshot(func(string) string { return "" }))
+	initial := deviceListSnapshot{Type: "snapshot", Devices: make([]deviceInfo, 0, len(prev))}
+	for _, d := range prev {
+		initial.Devices = append(initial.Devices, d)
+	}
+	if conn.WriteJSON(initial) != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		var snap []deviceInfo
+		select {
+		case <-gone:
+			return
+		case <-keepalive.C:
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)) != nil {
+				return
+			}
+			continue
+		case snap = <-snaps:
+		}
+		cur := view(snap)
+		var events []deviceListEvent
+		for k, d := range cur {
+			d := d
+			old, ok := prev[k]
+			switch {
+			case !ok:
+				events = append(events, deviceListEvent{Type: "added", Device: &d})
+			case deviceChanged(old, d, stats):
+				events = append(events, deviceListEvent{Type: "changed", Device: &d})
+			default:
+				cur[k] = old // keep the baseline for fields that don't count
+			}
+		}
+		for k, d := range prev {
+			if _, ok := cur[k]; !ok {
+				events = append(events, deviceListEvent{Type: "removed", DeviceID: d.DeviceID, Tunnel: d.TunnelKey})
+			}
+		}
+		prev = cur
+		for _, ev := range events {
+			if conn.WriteJSON(ev) != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The offline digest is a once-a-day summary for fleets too small to justify
+// a monitoring stack: which known devices (registered, or seen in the last
+// 30 days) are offline right now, and which started flapping
+// (DIGEST_FLAP_THRESHOLD disconnects in 24h). It goes out at DIGEST_AT
+// (HH:MM UTC, default 08:00) to DIGEST_WEBHOOK_URL as JSON and/or to
+// DIGEST_EMAIL_TO through SMTP_ADDR; it is only scheduled when one of them
+// is set. GET /api/digest previews it. DIGEST_SKIP_EMPTY=1 stays quiet on
+// days with nothing to report. Devices in maintenance are only counted.
+//
+// Uptime history is each node's own, so with leader election every node
+// sends its own digest, named after the node, covering the devices that
+// connected to it. Registered devices are added by the leader only (on a
+// single node, that node), so each is listed once; one the leader has no
+// history for is offline there, without down_since, though it may be
+// connected to another node.
+
+type digestConfig struct {
+	at            time.Duration // after midnight UTC
+	webhookURL    string
+	emailTo       []string
+	smtpAddr      string
+	smtpFrom      string
+	smtpUser      string
+	smtpPass      string
+	flapThreshold int
+	skipEmpty     bool
+}
+
+func loadDigestConfig() (digestConfig, error) {
+	dc := digestConfig{
+		webhookURL:    strings.TrimSpace(envOr("DIGEST_WEBHOOK_URL", "")),
+		smtpAddr:      strings.TrimSpace(envOr("SMTP_ADDR", "")),
+		smtpFrom:      strings.TrimSpace(envOr("SMTP_FROM", "")),
+		smtpUser:      envOr("SMTP_USERNAME", ""),
+		smtpPass:      envOr("SMTP_PASSWORD", ""),
+		flapThreshold: envInt("DIGEST_FLAP_THRESHOLD", 5),
+		skipEmpty:     envOr("DIGEST_SKIP_EMPTY", "0") == "1",
+	}
+	for _, to := range strings.Split(envOr("DIGEST_EMAIL_TO", ""), ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			dc.emailTo = append(dc.emailTo, to)
+		}
+	}
+	at, err := time.Parse("15:04", envOr("DIGEST_AT", "08:00"))
+	if err != nil {
+		return dc, fmt.Errorf("DIGEST_AT: %q is not HH:MM", envOr("DIGEST_AT", ""))
+	}
+	dc.at = time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute
+	if len(dc.emailTo) > 0 && (dc.smtpAddr == "" || dc.smtpFrom == "") {
+		return dc, errors.New("DIGEST_EMAIL_TO needs SMTP_ADDR and SMTP_FROM")
+	}
+	if dc.flapThreshold < 1 {
+		dc.flapThreshold = 1
+	}
+	return dc, nil
+}
+
+func (dc digestConfig) enabled() bool { return dc.webhookURL != "" || len(dc.emailTo) > 0 }
+
+type digestDevice struct {
+	DeviceID string `json:"device_id"`
+	// Offline: when it dropped; nil if it has never connected.
+	DownSince *time.Time `json:"down_since,omitempty"`
+	// Flapping: disconnects in the last 24h.
+	Disconnects int `json:"disconnects,omitempty"`
+}
+
+type offlineDigest struct {
+	Node        string         `json:"node,omitempty"`
+	GeneratedAt time.Time      `json:"generated_at"`
+	Known       int            `json:"known"`
+	Online      int            `json:"online"`
+	Maintenance int            `json:"maintenance"`
+	Offline     []digestDevice `json:"offline"`
+	Flapping    []digestDevice `json:"newly_flapping"`
+}
+
+func (d offlineDigest) empty() bool { return len(d.Offline) == 0 && len(d.Flapping) == 0 }
+
+// digestState remembers who was flapping at the last digest, so only new
+// flappers are reported.
+type digestState struct {
+	mu       sync.Mutex
+	next     time.Time
+	flapping map[string]bool
+}
+
+// buildDigest summarizes the fleet. With commit, the flapping set is
+// remembered for the next digest; previews leave it alone.
+func (s *server) buildDigest(now time.Time, commit bool) offlineDigest {
+	d := offlineDigest{Node: s.nodeName(), GeneratedAt: now, Offline: []digestDevice{}, Flapping: []digestDevice{}}
+	known := make(map[string]bool)
+	if s.leader.IsLeader() {
+		for _, rd := range s.registry.list() {
+			known[rd.DeviceID] = true
+		}
+	}
+	for _, id := range s.uptime.ids() {
+		known[id] = true
+	}
+	ids := make([]string, 0, len(known))
+	for id := range known {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	flapping := make(map[string]bool)
+	s.digest.mu.Lock()
+	prev := s.digest.flapping
+	s.digest.mu.Unlock()
+	windows := s.maintenance.all()
+	for _, id := range ids {
+		if _, ok := windows[id]; ok {
+			d.Maintenance++
+			continue
+		}
+		rep, ok := s.uptime.report(id, now)
+		if ok && rep.Connected {
+			d.Online++
+		} else {
+			dd := digestDevice{DeviceID: id}
+			if ok {
+				dd.DownSince = rep.DownSince
+			}
+			d.Offline = append(d.Offline, dd)
+		}
+		if n := rep.Windows["24h"].Disconnects; ok && n >= s.digestCfg.flapThreshold {
+			flapping[id] = true
+			if !prev[id] {
+				d.Flapping = append(d.Flapping, digestDevice{DeviceID: id, Disconnects: n})
+			}
+		}
+	}
+	d.Known = len(ids)
+	if commit {
+		s.digest.mu.Lock()
+		s.digest.flapping = flapping
+		s.digest.mu.Unlock()
+	}
+	return d
+}
+
+// maybeSendDigest runs every minute on every node and sends the digest once
+// DIGEST_AT has passed. A hot standby has nothing to report.
+func (s *server) maybeSendDigest(now time.Time) {
+	if s.ha.standby() {
+		return
+	}
+	now = now.UTC()
+	s.digest.mu.Lock()
+	if s.digest.next.IsZero() {
+		s.digest.next = nextDigestAt(now, s.digestCfg.at)
+	}
+	due := !now.Before(s.digest.next)
+	if due {
+		s.digest.next = nextDigestAt(now, s.digestCfg.at)
+	}
+	s.digest.mu.Unlock()
+	if !due {
+		return
+	}
+	d := s.buildDigest(now, true)
+	if d.empty() && s.digestCfg.skipEmpty {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if s.digestCfg.webhookURL != "" {
+		if err := s.postDigest(ctx, d); err != nil {
+			s.logf(logInfo, "digest_webhook_failed", "error", err.Error())
+		}
+	}
+	if len(s.digestCfg.emailTo) > 0 {
+		if err := s.mailDigest(d); err != nil {
+			s.logf(logInfo, "digest_email_failed", "error", err.Error())
+		}
+	}
+	s.logf(logInfo, "digest_sent", "offline", len(d.Offline), "newly_flapping", len(d.Flapping))
+}
+
+// nextDigestAt is the first time of day at after now.
+func nextDigestAt(now time.Time, at time.Duration) time.Time {
+	t := now.Truncate(24 * time.Hour).Add(at)
+	if !t.After(now) {
+		t = t.Add(24 * time.Hour)
+	}
+	return t
+}
+
+func (s *server) postDigest(ctx context.Context, d offlineDigest) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.digestCfg.webhookURL, bytes.NewReader(mustJSON(d)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *server) mailDigest(d offlineDigest) error {
+	cfg := s.digestCfg
+	var b strings.Builder
+	node := ""
+	if d.Node != "" {
+		node = " (" + d.Node + ")"
+	}
+	fmt.Fprintf(&b, "From: %s\nTo: %s\nSubject: ESPWiFi daily digest%s: %d offline, %d newly flapping\n",
+		cfg.smtpFrom, strings.Join(cfg.emailTo, ", "), node, len(d.Offline), len(d.Flapping))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\n\n")
+	b.WriteString(d.text())
+	var auth smtp.Auth
+	if cfg.smtpUser != "" {
+		host, _, _ := strings.Cut(cfg.smtpAddr, ":")
+		auth = smtp.PlainAuth("", cfg.smtpUser, cfg.smtpPass, host)
+	}
+	return smtp.SendMail(cfg.smtpAddr, auth, cfg.smtpFrom, cfg.emailTo, []byte(strings.ReplaceAll(b.String(), "\n", "\r\n")))
+}
+
+// text renders the digest for email, capping each list.
+func (d offlineDigest) text() string {
+	const maxLines = 200
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d of %d known devices online at %s.\n", d.Online, d.Known, d.GeneratedAt.Format(time.RFC1123))
+	if d.Node != "" {
+		fmt.Fprintf(&b, "Devices that connected to node %s.\n", d.Node)
+	}
+	if d.Maintenance > 0 {
+		fmt.Fprintf(&b, "%d in maintenance.\n", d.Maintenance)
+	}
+	if d.empty() {
+		b.WriteString("\nNothing to report.\n")
+		return b.String()
+	}
+	if len(d.Offline) > 0 {
+		fmt.Fprintf(&b, "\nOffline (%d):\n", len(d.Offline))
+		for i, dd := range d.Offline {
+			if i == maxLines {
+				fmt.Fprintf(&b, "  ... and %d more\n", len(d.Offline)-maxLines)
+				break
+			}
+			since := "never connected"
+			if dd.DownSince != nil {
+				since = "since " + dd.DownSince.Format(time.RFC3339)
+			}
+			fmt.Fprintf(&b, "  %s (%s)\n", dd.DeviceID, since)
+		}
+	}
+	if len(d.Flapping) > 0 {
+		fmt.Fprintf(&b, "\nNewly flapping (%d):\n", len(d.Flapping))
+		for i, dd := range d.Flapping {
+			if i == maxLines {
+				fmt.Fprintf(&b, "  ... and %d more\n", len(d.Flapping)-maxLines)
+				break
+			}
+			fmt.Fprintf(&b, "  %s (%d disconnects in 24h)\n", dd.DeviceID, dd.Disconnects)
+		}
+	}
+	return b.String()
+}
+
+// handleDigest serves GET /api/digest (admin): the digest as it would be
+// sent now. ?format=text renders the email body.
+func (s *server) handleDigest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.requireRole(w, r, roleAdmin) {
+		return
+	}
+	d := s.buildDigest(time.Now().UTC(), false)
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(d.text()))
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Disconnect analytics: every device session that ends is counted under a
+// reason, so it's possible to tell firmware bugs from flaky networks and
+// relay restarts. The reason is whatever ended the session first: a close
+// the relay sent (replaced, kicked, server_restarting, ...) or the device's
+// read error, normalized. Each reason belongs to one cause:
+//
+//	device    closed_normally, device_restarting, closed_other, replaced
+//	firmware  protocol_error, policy_violation, message_too_big, internal_error
+//	network   read_timeout, abnormal_closure, connection_reset
+//	relay     draining, server_restarting, relocated, quota_exceeded
+//	operator  kicked, deregistered, outside_schedule
+//	unknown   other
+//
+// GET /api/disconnects ranks devices by disconnects with fleet-wide totals;
+// GET /api/devices/{id}/disconnects has one device's counts and its last
+// disconnect. Counts run from since and, with DATA_DIR, survive restarts:
+// they are saved with the uptime counters. espwifi_device_disconnects_total
+// has the same by reason and cause. Sessions carried over /ws/upstream are
+// counted by the relay the device is connected to.
+
+const disconnectsDoc = "disconnects"
+
+var disconnectCauses = map[string]string{
+	"closed_normally":   "device",
+	"device_restarting": "device",
+	"closed_other":      "device",
+	"replaced":          "device",
+	"protocol_error":    "firmware",
+	"policy_violation":  "firmware",
+	"message_too_big":   "firmware",
+	"internal_error":    "firmware",
+	"read_timeout":      "network",
+	"idle_timeout":      "network",
+	"abnormal_closure":  "network",
+	"connection_reset":  "network",
+	"draining":          "relay",
+	"server_restarting": "relay",
+	"relocated":         "relay",
+	"quota_exceeded":    "relay",
+	"kicked":            "operator",
+	"deregistered":      "operator",
+	"outside_schedule":  "operator",
+}
+
+func disconnectCause(reason string) string {
+	if c, ok := disconnectCauses[reason]; ok {
+		return c
+	}
+	return "unknown"
+}
+
+// classifyDisconnect names the read error that ended a device session.
+func classifyDisconnect(err error) string {
+	var ce *websocket.CloseError
+	var ne net.Error
+	switch {
+	case err == nil:
+		return "other"
+	case errors.As(err, &ce):
+		switch ce.Code {
+		case websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived:
+			return "closed_normally"
+		case websocket.CloseAbnormalClosure:
+			return "abnormal_closure"
+		case websocket.CloseProtocolError, websocket.CloseUnsupportedData, websocket.CloseInvalidFramePayloadData,
+			websocket.CloseMandatoryExtension:
+			return "protocol_error"
+		case websocket.ClosePolicyViolation:
+			return "policy_violation"
+		case websocket.CloseMessageTooBig:
+			return "message_too_big"
+		case websocket.CloseInternalServerErr:
+			return "internal_error"
+		case websocket.CloseServiceRestart, websocket.CloseTryAgainLater:
+			return "device_restarting"
+		}
+		return "closed_other"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "read_timeout"
+	case errors.Is(err, websocket.ErrReadLimit):
+		return "message_too_big"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "abnormal_closure"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, syscall.ETIMEDOUT), errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH),
+		strings.Contains(err.Error(), "connection reset"):
+		return "connection_reset"
+	case strings.HasPrefix(err.Error(), "websocket"):
+		// gorilla's frame errors ("websocket: bad opcode 3", ...) and the
+		// epoll engine's errPolledProtocol.
+		return "protocol_error"
+	}
+	return "other"
+}
+
+// noteEnd records why dc ended; the first reason sticks, so a relay close
+// isn't overwritten by the read error it causes.
+func (dc *deviceConn) noteEnd(reason string) {
+	dc.endReason.CompareAndSwap(nil, &reason)
+}
+
+type disconnectRecord struct {
+	At     time.Time `json:"at"`
+	Tunnel string    `json:"tunnel,omitempty"`
+	Reason string    `json:"reason"`
+	Cause  string    `json:"cause"`
+	// The read error, without the connection's addresses.
+	Error string `json:"error,omitempty"`
+}
+
+type deviceDisconnects struct {
+	Total   uint64            `json:"total"`
+	Reasons map[string]uint64 `json:"reasons"`
+	Last    *disconnectRecord `json:"last,omitempty"`
+}
+
+type disconnectStats struct {
+	store *fileStore
+
+	mu      sync.Mutex
+	since   time.Time
+	devices map[string]*deviceDisconnects
+}
+
+type disconnectsFile struct {
+	Since   time.Time                     `json:"since"`
+	Devices map[string]*deviceDisconnects `json:"devices"`
+}
+
+func newDisconnectStats(store *fileStore) *disconnectStats {
+	return &disconnectStats{store: store, since: time.Now().UTC(), devices: make(map[string]*deviceDisconnects)}
+}
+
+func (ds *disconnectStats) load() error {
+	var f disconnectsFile
+	if err := ds.store.load(disconnectsDoc, &f); err != nil {
+		return err
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if !f.Since.IsZero() {
+		ds.since = f.Since
+	}
+	devices, moved, dropped := canonicalDeviceKeys(f.Devices)
+	ds.store.noteLegacyIDs(disconnectsDoc, moved, dropped)
+	for id, d := range devices {
+		if d != nil && d.Reasons != nil {
+			ds.devices[id] = d
+		}
+	}
+	return nil
+}
+
+// save persists the counts, dropping devices that haven't disconnected for
+// 30 days.
+func (ds *disconnectStats) save() error {
+	if !ds.store.enabled() {
+		return nil
+	}
+	cutoff := time.Now().Add(-uptimeDays * 24 * time.Hour)
+	ds.mu.Lock()
+	f := disconnectsFile{Since: ds.since, Devices: make(map[string]*deviceDisconnects, len(ds.devices))}
+	for id, d := range ds.devices {
+		if d.Last != nil && d.Last.At.Before(cutoff) {
+			delete(ds.devices, id)
+			continue
+		}
+		f.Devices[id] = d.clone()
+	}
+	ds.mu.Unlock()
+	return ds.store.save(disconnectsDoc, f)
+}
+
+func (d *deviceDisconnects) clone() *deviceDisconnects {
+	cp := &deviceDisconnects{Total: d.Total, Reasons: make(map[string]uint64, len(d.Reasons))}
+	for k, v := range d.Reasons {
+		cp.Reasons[k] = v
+	}
+	if d.Last != nil {
+		last := *d.Last
+		cp.Last = &last
+	}
+	return cp
+}
+
+func (ds *disconnectStats) remove(deviceID string) {
+	ds.mu.Lock()
+	delete(ds.devices, deviceID)
+	ds.mu.Unlock()
+}
+
+// recordDisconnect counts the end of dc's session; err is the read error,
+// if any.
+func (s *server) recordDisconnect(deviceID, tunnel string, dc *deviceConn, err error) string {
+	if err != nil {
+		dc.noteEnd(classifyDisconnect(err))
+	}
+	reason := "other"
+	if p := dc.endReason.Load(); p != nil {
+		reason = *p
+	}
+	rec := disconnectRecord{At: time.Now().UTC(), Tunnel: tunnel, Reason: reason, Cause: disconnectCause(reason)}
+	if err != nil {
+		rec.Error = truncate(disconnectErrorText(err), 200)
+	}
+	ds := s.disconnects
+	ds.mu.Lock()
+	d := ds.devices[deviceID]
+	if d == nil {
+		d = &deviceDisconnects{Reasons: make(map[string]uint64)}
+		ds.devices[deviceID] = d
+	}
+	d.Total++
+	d.Reasons[reason]++
+	d.Last = &rec
+	ds.mu.Unlock()
+	s.disconnectsTotal.Inc(reason, rec.Cause)
+	return reason
+}
+
+// disconnectErrorText is err's text with any socket addresses left out
+// ("read tcp 10.0.0.1:443->...: i/o timeout" becomes "i/o timeout"),
+// since the record is shown to everyone who may see the device.
+func disconnectErrorText(err error) string {
+	text := err.Error()
+	var op *net.OpError
+	if errors.As(err, &op) && op.Err != nil {
+		text = strings.Replace(text, op.Error(), op.Err.Error(), 1)
+	}
+	return text
+}
+
+func (s *server) registerDisconnectMetrics() {
+	s.disconnectsTotal = s.metrics.newCounter("espwifi_device_disconnects_total",
+		"Device sessions ended, by reason and cause (device, firmware, network, relay, operator, unknown).", "reason", "cause")
+}
+
+// disconnectSummary is a set of counts by reason and by cause.
+type disconnectSummary struct {
+	Total   uint64            `json:"total"`
+	Causes  map[string]uint64 `json:"causes"`
+	Reasons map[string]uint64 `json:"reasons"`
+}
+
+func (sum *disconnectSummary) add(d *deviceDisconnects) {
+	if sum.Causes == nil {
+		sum.Causes, sum.Reasons = make(map[string]uint64), make(map[string]uint64)
+	}
+	sum.Total += d.Total
+	for reason, n := range d.Reasons {
+		sum.Reasons[reason] += n
+		sum.Causes[disconnectCause(reason)] += n
+	}
+}
+
+type deviceDisconnectView struct {
+	DeviceID string    `json:"device_id"`
+	Since    time.Time `json:"since"`
+	disconnectSummary
+	Last *disconnectRecord `json:"last,omitempty"`
+}
+
+type fleetDisconnectView struct {
+	Since time.Time `json:"since"`
+	disconnectSummary
+	Devices []deviceDisconnectView `json:"devices"`
+}
+
+// handleDeviceDisconnects serves GET /api/devices/{id}/disconnects.
+func (s *server) handleDeviceDisconnects(w http.ResponseWriter, r *http.Request, deviceID string) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.requireRole(w, r, roleViewer) {
+		return
+	}
+	ds := s.disconnects
+	ds.mu.Lock()
+	v := deviceDisconnectView{DeviceID: deviceID, Since: ds.since}
+	v.add(&deviceDisconnects{})
+	if d := ds.devices[deviceID]; d != nil {
+		d = d.clone()
+		v.add(d)
+		v.Last = d.Last
+	}
+	ds.mu.Unlock()
+	writeJSON(w, http.StatusOK, v)
+}
+
+// handleDisconnects serves GET /api/disconnects?limit=20&cause=: totals over
+// the devices r may see, and those devices with the most disconnects (of
+// cause, if given).
+func (s *server) handleDisconnects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.requireRole(w, r, roleViewer) {
+		return
+	}
+	q := r.URL.Query()
+	limit := 20
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 1000 {
+			writeAPIError(w, http.StatusBadRequest, "invalid_limit", "limit must be 0 to 1000")
+			return
+		}
+		limit = n
+	}
+	cause := q.Get("cause")
+
+	ds := s.disconnects
+	ds.mu.Lock()
+	out := fleetDisconnectView{Since: ds.since, Devices: []deviceDisconnectView{}}
+	out.add(&deviceDisconnects{})
+	for id, d := range ds.devices {
+		if !s.hostAllows(r, id) {
+			continue
+		}
+		d = d.clone()
+		out.add(d)
+		v := deviceDisconnectView{DeviceID: id, Since: ds.since, Last: d.Last}
+		v.add(d)
+		out.Devices = append(out.Devices, v)
+	}
+	ds.mu.Unlock()
+
+	count := func(v deviceDisconnectView) uint64 {
+		if cause != "" {
+			return v.Causes[cause]
+		}
+		return v.Total
+	}
+	sort.Slice(out.Devices, func(i, j int) bool {
+		a, b := count(out.Devices[i]), count(out.Devices[j])
+		if a != b {
+			return a > b
+		}
+		return out.Devices[i].DeviceID < out.Devices[j].DeviceID
+	})
+	for len(out.Devices) > 0 && count(out.Devices[len(out.Devices)-1]) == 0 {
+		out.Devices = out.Devices[:len(out.Devices)-1]
+	}
+	if len(out.Devices) > limit {
+		out.Devices = out.Devices[:limit]
+	}
+	writeJSON(w, http.StatusOK, out)
+}
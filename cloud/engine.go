@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Device connection engines. The default (gorilla) spends a handler and a
+// reader goroutine plus 64KiB of buffers on every device session, idle or
+// not. DEVICE_ENGINE=epoll (Linux) instead parks idle device sockets in an
+// epoll set with no goroutine or buffer behind them; a small worker pool
+// (DEVICE_ENGINE_WORKERS, 4 per CPU) reads a frame when one arrives. That
+// takes a mostly-idle fleet of 100k devices from gigabytes to a fraction.
+//
+// UIs stay on gorilla, as do media tunnels (MEDIA_TUNNELS: never idle, so
+// nothing to save) and connections the relay terminates TLS for itself
+// (crypto/tls buffers records, which epoll can't see). Epoll sessions don't
+// negotiate permessage-deflate.
+
+// deviceSocket is what a deviceConn needs from the device's websocket.
+// *websocket.Conn implements it; so does the epoll engine's polledConn.
+// Writes must be serialized by dc.writeMu.
+type deviceSocket interface {
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	Close() error
+}
+
+func (s *server) startDeviceEngine() error {
+	switch engine := strings.ToLower(strings.TrimSpace(envOr("DEVICE_ENGINE", "gorilla"))); engine {
+	case "", "gorilla":
+		return nil
+	case "epoll":
+		workers := envInt("DEVICE_ENGINE_WORKERS", 4*runtime.NumCPU())
+		if workers < 1 {
+			workers = 1
+		}
+		p, err := newDevicePoller(s, workers)
+		if err != nil {
+			return fmt.Errorf("DEVICE_ENGINE=epoll: %w", err)
+		}
+		s.poller = p
+		s.metrics.newGaugeFunc("espwifi_epoll_devices", "Device sessions parked in the epoll engine.", nil,
+			func(emit func(float64, ...string)) { emit(float64(p.count())) })
+		s.logf(logInfo, "device_engine", "engine", "epoll", "workers", workers)
+		return nil
+	default:
+		return fmt.Errorf("DEVICE_ENGINE: %q is not gorilla or epoll", engine)
+	}
+}
+
+// usePoller reports whether the device connecting with r goes to the epoll
+// engine.
+func (s *server) usePoller(r *http.Request, tunnel string) bool {
+	return s.poller != nil && r.TLS == nil && !s.isMediaTunnel(tunnel)
+}
@@ -0,0 +1,455 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// A frame that starts arriving must finish within this long (checked at
+	// each ping). It holds no worker meanwhile, only its bytes so far.
+	polledFrameTimeout = 10 * time.Second
+	polledReadLimit    = 8 << 20  // same as the gorilla engine's SetReadLimit
+	polledReadChunk    = 32 << 10 // read per wakeup, so one sender can't hog a worker
+)
+
+var errPolledProtocol = errors.New("websocket protocol error")
+
+var polledReadBufs = sync.Pool{New: func() any { b := make([]byte, polledReadChunk); return &b }}
+
+type devicePoller struct {
+	s    *server
+	epfd int
+	jobs chan *polledConn
+
+	mu    sync.Mutex
+	conns map[int]*polledConn // by fd
+}
+
+func newDevicePoller(s *server, workers int) (*devicePoller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	p := &devicePoller{s: s, epfd: epfd, jobs: make(chan *polledConn, workers), conns: make(map[int]*polledConn)}
+	go p.wait()
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	go p.keepalive()
+	return p, nil
+}
+
+func (p *devicePoller) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+// polledConn is a device websocket owned by the poller. It implements
+// deviceSocket; Close ends the session.
+type polledConn struct {
+	p    *devicePoller
+	conn net.Conn
+	fd   int
+	ds   *deviceSession
+
+	// Bytes the client sent right behind the handshake, read before conn.
+	early *bytes.Reader
+
+	// A frame still arriving, and when it started (unix nanos, 0 if none).
+	// Workers take what the socket has and leave the rest for the next
+	// wakeup.
+	in      []byte
+	inSince atomic.Int64
+
+	// A fragmented message being reassembled (touched by one worker at a
+	// time: the fd is armed one-shot).
+	fragOp ws.OpCode
+	frag   []byte
+
+	lastPong  atomic.Int64 // unix nanos
+	err       atomic.Pointer[error]
+	closeOnce sync.Once
+}
+
+// upgrade completes the handshake and hands back the raw connection; add
+// starts polling it once the session is set up.
+func (p *devicePoller) upgrade(w http.ResponseWriter, r *http.Request) (*polledConn, error) {
+	conn, rw, _, err := ws.UpgradeHTTP(r, w)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := connFD(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	pc := &polledConn{p: p, conn: conn, fd: fd}
+	if n := rw.Reader.Buffered(); n > 0 {
+		b, _ := rw.Reader.Peek(n)
+		pc.early = bytes.NewReader(append([]byte(nil), b...))
+	}
+	pc.lastPong.Store(time.Now().UnixNano())
+	return pc, nil
+}
+
+func connFD(c net.Conn) (int, error) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return 0, fmt.Errorf("%T has no file descriptor", c)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	fd := -1
+	if err := rc.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return 0, err
+	}
+	return fd, nil
+}
+
+// add parks pc in the epoll set; from here on the poller owns ds.
+func (p *devicePoller) add(pc *polledConn, ds *deviceSession) {
+	pc.ds = ds
+	p.s.acct.deviceReaders.Add(1)
+	p.mu.Lock()
+	p.conns[pc.fd] = pc
+	p.mu.Unlock()
+	if pc.early != nil && pc.early.Len() > 0 {
+		// Frames already buffered won't wake epoll.
+		p.jobs <- pc
+		return
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT, Fd: int32(pc.fd)}
+	if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, pc.fd, &ev); err != nil {
+		pc.fail(err)
+	}
+}
+
+// rearm re-enables pc's one-shot registration after a worker is done with
+// it. The map check keeps a closed (and possibly reused) fd alone.
+func (p *devicePoller) rearm(pc *polledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns[pc.fd] != pc {
+		return
+	}
+	op := syscall.EPOLL_CTL_MOD
+	if pc.early != nil {
+		// First arm after draining the handshake leftovers.
+		op, pc.early = syscall.EPOLL_CTL_ADD, nil
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT, Fd: int32(pc.fd)}
+	if err := syscall.EpollCtl(p.epfd, op, pc.fd, &ev); err != nil {
+		go pc.fail(err)
+	}
+}
+
+func (p *devicePoller) wait() {
+	events := make([]syscall.EpollEvent, 256)
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, -1)
+		if err != nil {
+			if errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			p.s.logf(logInfo, "device_engine_epoll_failed", "error", err.Error())
+			return
+		}
+		for i := 0; i < n; i++ {
+			p.mu.Lock()
+			pc := p.conns[int(events[i].Fd)]
+			p.mu.Unlock()
+			if pc != nil {
+				p.jobs <- pc
+			}
+		}
+	}
+}
+
+func (p *devicePoller) work() {
+	for pc := range p.jobs {
+		if err := pc.readAvailable(); err != nil {
+			pc.fail(err)
+			continue
+		}
+		p.rearm(pc)
+	}
+}
+
+// keepalive pings every polled device each DEVICE_PING_INTERVAL and drops
+// those whose pongs stopped, like the gorilla engine's read deadline.
+func (p *devicePoller) keepalive() {
+	kc := p.s.keepalive
+	t := time.NewTicker(kc.pingInterval)
+	defer t.Stop()
+	for range t.C {
+		p.mu.Lock()
+		conns := make([]*polledConn, 0, len(p.conns))
+		for _, pc := range p.conns {
+			conns = append(conns, pc)
+		}
+		p.mu.Unlock()
+		now := time.Now()
+		for _, pc := range conns {
+			if now.Sub(time.Unix(0, pc.lastPong.Load())) > kc.readTimeout() {
+				pc.fail(errPongTimeout)
+				continue
+			}
+			if since := pc.inSince.Load(); since != 0 && now.Sub(time.Unix(0, since)) > polledFrameTimeout {
+				pc.fail(errFrameTimeout)
+				continue
+			}
+			p.s.pingDevice(pc.ds)
+		}
+	}
+}
+
+// Both read as timeouts, so the device is told 4006 idle_timeout.
+var (
+	errPongTimeout  error = polledTimeoutError("pong timeout")
+	errFrameTimeout error = polledTimeoutError("frame timeout")
+)
+
+type polledTimeoutError string
+
+func (e polledTimeoutError) Error() string { return string(e) }
+func (polledTimeoutError) Timeout() bool   { return true }
+func (polledTimeoutError) Temporary() bool { return false }
+
+// readAvailable reads what has arrived, without blocking, and handles every
+// frame that completes. A stale event (e.g. for a closed socket whose fd was
+// reused) reads nothing.
+func (pc *polledConn) readAvailable() error {
+	if pc.early != nil && pc.early.Len() > 0 {
+		b, _ := io.ReadAll(pc.early)
+		pc.in = append(pc.in, b...)
+	}
+	if err := pc.fill(); err != nil {
+		return err
+	}
+	started := len(pc.in) > 0 && pc.inSince.Load() == 0
+	for len(pc.in) > 0 {
+		done, err := pc.nextFrame()
+		if err != nil {
+			return err
+		}
+		if !done {
+			break
+		}
+		started = true
+	}
+	switch {
+	case len(pc.in) == 0:
+		pc.in = nil
+		pc.inSince.Store(0)
+	case started:
+		// Don't keep the handled frames' bytes behind the new one.
+		pc.in = append([]byte(nil), pc.in...)
+		pc.inSince.Store(time.Now().UnixNano())
+	}
+	return nil
+}
+
+// fill appends up to polledReadChunk bytes the socket has ready to pc.in.
+func (pc *polledConn) fill() error {
+	rc, err := pc.conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	bp := polledReadBufs.Get().(*[]byte)
+	defer polledReadBufs.Put(bp)
+	var n int
+	var rerr error
+	err = rc.Read(func(fd uintptr) bool {
+		n, rerr = syscall.Read(int(fd), *bp)
+		return true // never wait: the socket is non-blocking
+	})
+	switch {
+	case err != nil:
+		return err
+	case errors.Is(rerr, syscall.EAGAIN) || errors.Is(rerr, syscall.EINTR):
+		return nil
+	case rerr != nil:
+		return rerr
+	case n == 0:
+		return io.EOF
+	}
+	pc.in = append(pc.in, (*bp)[:n]...)
+	return nil
+}
+
+// nextFrame handles the frame at the front of pc.in, if it has all arrived.
+// Control frames are answered here; data frames go through the session like
+// the gorilla reader's messages.
+func (pc *polledConn) nextFrame() (done bool, err error) {
+	r := bytes.NewReader(pc.in)
+	h, err := ws.ReadHeader(r)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !h.Masked || h.Rsv != 0 || h.Length > polledReadLimit || int64(len(pc.frag))+h.Length > polledReadLimit {
+		return false, errPolledProtocol
+	}
+	if int64(r.Len()) < h.Length {
+		return false, nil
+	}
+	start := len(pc.in) - r.Len()
+	payload := append([]byte(nil), pc.in[start:start+int(h.Length)]...)
+	pc.in = pc.in[start+int(h.Length):]
+	ws.Cipher(payload, h.Mask, 0)
+	return true, pc.handleFrame(h, payload)
+}
+
+func (pc *polledConn) handleFrame(h ws.Header, payload []byte) error {
+	dc := pc.ds.dc
+	now := time.Now()
+	dc.lastSeen.Store(now.UTC().UnixNano())
+
+	switch h.OpCode {
+	case ws.OpPing:
+		dc.writeMu.Lock()
+		err := pc.WriteControl(websocket.PongMessage, payload, now.Add(5*time.Second))
+		dc.writeMu.Unlock()
+		return err
+	case ws.OpPong:
+		pc.lastPong.Store(now.UnixNano())
+		if dc.missedPongs.Load() > 0 {
+			pc.p.s.logf(logInfo, "device_pong_recovered", "device_id", pc.ds.deviceID, "tunnel", pc.ds.tunnel)
+		}
+		dc.notePong()
+		return nil
+	case ws.OpClose:
+		// Echo the code, as the gorilla engine's close handler does.
+		code, echo := websocket.CloseNoStatusReceived, []byte(nil)
+		if len(payload) >= 2 {
+			code, echo = int(binary.BigEndian.Uint16(payload)), payload[:2]
+		}
+		dc.writeMu.Lock()
+		_ = pc.WriteControl(websocket.CloseMessage, echo, now.Add(time.Second))
+		dc.writeMu.Unlock()
+		return &websocket.CloseError{Code: code, Text: "closed by device"}
+	case ws.OpText, ws.OpBinary:
+		if pc.fragOp != 0 {
+			return errPolledProtocol
+		}
+		if !h.Fin {
+			pc.fragOp, pc.frag = h.OpCode, payload
+			return nil
+		}
+	case ws.OpContinuation:
+		if pc.fragOp == 0 {
+			return errPolledProtocol
+		}
+		pc.frag = append(pc.frag, payload...)
+		if !h.Fin {
+			return nil
+		}
+		h.OpCode, payload = pc.fragOp, pc.frag
+		pc.fragOp, pc.frag = 0, nil
+	default:
+		return errPolledProtocol
+	}
+
+	mt := websocket.TextMessage
+	if h.OpCode == ws.OpBinary {
+		mt = websocket.BinaryMessage
+	}
+	if m, ok, must := pc.ds.ingest(mt, payload); ok {
+		pc.ds.out.push(m, must)
+	}
+	return nil
+}
+
+// fail ends the session because of err, telling the device and its UIs.
+func (pc *polledConn) fail(err error) {
+	pc.err.CompareAndSwap(nil, &err)
+	pc.ds.dc.noteEnd(classifyDisconnect(err))
+	deviceClose := wsCloseDeviceOffline
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		deviceClose = wsCloseIdleTimeout
+	}
+	pc.ds.dc.closeWithReason(deviceClose, wsCloseDeviceOffline)
+}
+
+func (pc *polledConn) WriteMessage(messageType int, data []byte) error {
+	_ = pc.conn.SetWriteDeadline(time.Time{})
+	return pc.writeFrame(messageType, data)
+}
+
+func (pc *polledConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	_ = pc.conn.SetWriteDeadline(deadline)
+	return pc.writeFrame(messageType, data)
+}
+
+func (pc *polledConn) writeFrame(messageType int, data []byte) error {
+	var hdr bytes.Buffer
+	if err := ws.WriteHeader(&hdr, ws.Header{Fin: true, OpCode: ws.OpCode(messageType), Length: int64(len(data))}); err != nil {
+		return err
+	}
+	bufs := net.Buffers{hdr.Bytes(), data}
+	_, err := bufs.WriteTo(pc.conn)
+	return err
+}
+
+// Close closes the socket and tears the session down (once). closeWithReason
+// calls it, whoever ended the session.
+func (pc *polledConn) Close() error {
+	var cerr error
+	pc.closeOnce.Do(func() {
+		p := pc.p
+		p.mu.Lock()
+		registered := p.conns[pc.fd] == pc
+		if registered {
+			delete(p.conns, pc.fd)
+			// Before close: the fd number may be reused right after.
+			_ = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, pc.fd, nil)
+		}
+		p.mu.Unlock()
+		cerr = pc.conn.Close()
+		if pc.ds != nil {
+			// Off the caller's goroutine: closeWithReason holds dc.writeMu.
+			go pc.teardown()
+		}
+		// Otherwise it was closed during setup and handleDeviceWS still
+		// owns the session.
+	})
+	return cerr
+}
+
+func (pc *polledConn) teardown() {
+	s := pc.p.s
+	pc.ds.out.close()
+	pc.ds.pushes.closeAll()
+	errMsg := ""
+	var err error
+	if e := pc.err.Load(); e != nil {
+		err = *e
+		errMsg = err.Error()
+	}
+	reason := s.recordDisconnect(pc.ds.deviceID, pc.ds.tunnel, pc.ds.dc, err)
+	s.h.deleteDevice(pc.ds.key, pc.ds.dc)
+	s.acct.deviceReaders.Add(-1)
+	s.acct.deviceConns.Add(-1)
+	s.logf(logInfo, "device_ws_disconnected", "device_id", pc.ds.deviceID, "tunnel", pc.ds.tunnel, "reason", reason, "err", errMsg, "engine", "epoll")
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// The epoll engine is Linux-only; see engine.go.
+
+type devicePoller struct{}
+
+type polledConn struct{ deviceSocket }
+
+func newDevicePoller(*server, int) (*devicePoller, error) {
+	return nil, errors.New("requires Linux")
+}
+
+func (p *devicePoller) count() int { return 0 }
+
+func (p *devicePoller) upgrade(http.ResponseWriter, *http.Request) (*polledConn, error) {
+	return nil, errors.New("requires Linux")
+}
+
+func (p *devicePoller) add(*polledConn, *deviceSession) {}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// uiOptions are per-UI-connection features requested with query parameters
+// on /ws/ui/{id}. All are off by default so existing dashboards see the raw
+// device stream.
+type uiOptions struct {
+	// ?correlate=1: stamp UI->device JSON objects with a correlation ID and
+	// the relay receive time, and acknowledge both to the UI.
+	correlate bool
+	// ?envelope=1: wrap device text messages as
+	// {"ts":<relay receive ms>,"seq":<n>,"data":<message>}. seq counts every
+	// message the relay read from the device session, so a gap means frames
+	// were dropped.
+	envelope bool
+	// ?delta=1: send JSON merge patches for repeated state messages; see
+	// delta.go.
+	delta bool
+	// ?frame_tags=1: keep the type/flags header on tagged binary frames.
+	frameTags bool
+	// Connected via /ws/serial/: raw terminal I/O; see serial.go.
+	terminal bool
+	// ?readonly=1: narrow a control credential to view scope, for a
+	// dashboard that holds the device token. It never widens: view tokens,
+	// view shares and viewer keys are view scope without it; see uiscope.go.
+	readOnly bool
+	// ?max_frame=65536: skip binary frames larger than this many bytes, so a
+	// status widget sharing a tunnel with a camera isn't sent keyframes it
+	// will never render. 0 means no limit.
+	maxFrame int
+	// ?echo=1: also receive the text commands other UIs send the device, as
+	// {"type":"ui_echo","data":...}; see uiecho.go.
+	echo bool
+	// ?p2p=1 with P2P_ICE_SERVERS set: signaling for a direct path; see
+	// p2p.go.
+	p2p *p2pPeer
+	// Who connected and from where, for the audit trail; see audit.go.
+	actor, remote string
+	// How the UI authenticated, for filter rules: guest, token or account.
+	from string
+}
+
+func parseUIOptions(r *http.Request) uiOptions {
+	q := r.URL.Query()
+	maxFrame, _ := strconv.Atoi(q.Get("max_frame"))
+	return uiOptions{
+		correlate: q.Get("correlate") == "1",
+		envelope:  q.Get("envelope") == "1",
+		delta:     q.Get("delta") == "1",
+		frameTags: q.Get("frame_tags") == "1",
+		readOnly:  q.Get("readonly") == "1",
+		echo:      q.Get("echo") == "1",
+		maxFrame:  max(maxFrame, 0),
+	}
+}
+
+// stampCorrelation adds "_cid" and "_relay_rx_ms" to a JSON object message.
+// A "_cid" the UI already set is kept so it can correlate with its own IDs.
+// Non-object messages are returned unchanged with ok=false.
+func stampCorrelation(msg []byte, now time.Time) (out []byte, cid string, ok bool) {
+	trimmed := bytes.TrimSpace(msg)
+	if len(trimmed) < 2 || trimmed[0] != '{' {
+		return msg, "", false
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(trimmed, &fields); err != nil {
+		return msg, "", false
+	}
+	rxMs := now.UnixMilli()
+
+	var b bytes.Buffer
+	b.Grow(len(trimmed) + 64)
+	b.WriteByte('{')
+	if raw, has := fields["_cid"]; has {
+		_ = json.Unmarshal(raw, &cid)
+	} else {
+		cid = randomToken(8)
+		b.WriteString(`"_cid":`)
+		b.Write(mustJSON(cid))
+		b.WriteByte(',')
+	}
+	b.WriteString(`"_relay_rx_ms":`)
+	b.WriteString(strconv.FormatInt(rxMs, 10))
+	if len(fields) > 0 {
+		b.WriteByte(',')
+	}
+	b.Write(trimmed[1:])
+	return b.Bytes(), cid, true
+}
+
+// envelopeMessage wraps a device text message. JSON is embedded as-is;
+// anything else becomes a JSON string.
+func envelopeMessage(msg []byte, at time.Time, seq uint64) []byte {
+	data := json.RawMessage(msg)
+	if !json.Valid(msg) {
+		data = mustJSON(string(msg))
+	}
+	var b bytes.Buffer
+	b.Grow(len(data) + 48)
+	b.WriteString(`{"ts":`)
+	b.WriteString(strconv.FormatInt(at.UnixMilli(), 10))
+	b.WriteString(`,"seq":`)
+	b.WriteString(strconv.FormatUint(seq, 10))
+	b.WriteString(`,"data":`)
+	b.Write(data)
+	b.WriteByte('}')
+	return b.Bytes()
+}
+
+// relayAck tells a correlating UI which ID and receive time the relay put on
+// the message it just sent.
+func relayAck(cid string, now time.Time) []byte {
+	return mustJSON(relayRxMsg{Type: "relay_rx", CID: cid, RelayRxMs: now.UnixMilli()})
+}
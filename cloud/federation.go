@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Federation lets relays in several regions act as one. Devices connect to
+// whichever region is nearest; a UI that connects to a region that doesn't
+// hold the device is bridged to the one that does, and /api/devices lists
+// every region's devices, each tagged with its region.
+//
+//	REGION=eu
+//	FEDERATION_PEERS=us=https://us.relay.example.com,ap=https://ap.relay.example.com
+//	FEDERATION_TOKEN=<shared secret>
+//
+// Peers authenticate to each other with FEDERATION_TOKEN (X-Federation-Token)
+// and pass the UI's own credentials and Host through, so the region holding
+// the device still decides who may connect. A request that already came
+// from a peer is never federated again, so peers can list each other.
+//
+// Asking the peers costs a request to each, so a UI is only looked for
+// elsewhere once it has passed every local check and carries a credential
+// the holding region can check (a UI token, share link or API key), and
+// answers are cached for FEDERATION_CACHE (2s): where a device is, and each
+// caller's device listing.
+
+const federationHeader = "X-Federation-Token"
+
+type federationPeer struct {
+	region string
+	base   *url.URL // https://...
+}
+
+type federation struct {
+	region string
+	token  string
+	peers  []federationPeer
+	client *http.Client
+	dialer *websocket.Dialer
+
+	cacheTTL time.Duration
+	mu       sync.Mutex
+	located  map[string]locatedEntry // by device_id|tunnel
+	listed   map[string]listedEntry  // by caller (peerListKey)
+	// Whether each peer answered the last request made to it, by region;
+	// /healthz?detail=1 reports it.
+	reached map[string]bool
+}
+
+type locatedEntry struct {
+	peer  federationPeer
+	found bool
+	until time.Time
+}
+
+type listedEntry struct {
+	devices     []deviceInfo
+	unreachable []string
+	until       time.Time
+}
+
+func loadFederation() (*federation, error) {
+	f := &federation{
+		region: strings.TrimSpace(envOr("REGION", "")),
+		token:  envOr("FEDERATION_TOKEN", ""),
+		client: &http.Client{Timeout: envDuration("FEDERATION_TIMEOUT", 3*time.Second)},
+
+		cacheTTL: envDuration("FEDERATION_CACHE", 2*time.Second),
+		located:  make(map[string]locatedEntry),
+		listed:   make(map[string]listedEntry),
+		reached:  make(map[string]bool),
+	}
+	f.dialer = &websocket.Dialer{HandshakeTimeout: f.client.Timeout, ReadBufferSize: 32 * 1024, WriteBufferSize: 32 * 1024}
+	for _, p := range strings.Split(envOr("FEDERATION_PEERS", ""), ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		region, raw, ok := strings.Cut(p, "=")
+		u, err := url.Parse(strings.TrimRight(strings.TrimSpace(raw), "/"))
+		if !ok || region == "" || err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("FEDERATION_PEERS: %q is not region=https://host", p)
+		}
+		f.peers = append(f.peers, federationPeer{region: strings.TrimSpace(region), base: u})
+	}
+	if len(f.peers) > 0 && (f.token == "" || f.region == "") {
+		return nil, errors.New("FEDERATION_PEERS needs REGION and FEDERATION_TOKEN")
+	}
+	return f, nil
+}
+
+func (f *federation) enabled() bool { return len(f.peers) > 0 }
+
+// fromPeer reports whether r came from another region.
+func (f *federation) fromPeer(r *http.Request) bool {
+	got := r.Header.Get(federationHeader)
+	return f.token != "" && got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(f.token)) == 1
+}
+
+// mayFederate reports whether the UI on r may be looked for in other
+// regions: it came from a client, not a peer, and carries a credential.
+// Anonymous UIs only reach devices in their own region.
+func (s *server) mayFederate(r *http.Request) bool {
+	if !s.federation.enabled() || s.federation.fromPeer(r) {
+		return false
+	}
+	if extractToken(r) != "" || r.URL.Query().Get("share") != "" {
+		return true
+	}
+	ro, _ := s.roleFor(r)
+	return ro >= roleViewer
+}
+
+// noteReached records whether peer answered a request (with any status).
+func (f *federation) noteReached(peer federationPeer, err error) {
+	f.mu.Lock()
+	f.reached[peer.region] = err == nil
+	f.mu.Unlock()
+}
+
+// peerStates reports each peer as reachable, unreachable, or unknown until
+// it has been asked something.
+func (f *federation) peerStates() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make(map[string]string, len(f.peers))
+	for _, p := range f.peers {
+		switch ok, asked := f.reached[p.region]; {
+		case !asked:
+			out[p.region] = "unknown"
+		case ok:
+			out[p.region] = "reachable"
+		default:
+			out[p.region] = "unreachable"
+		}
+	}
+	return out
+}
+
+// sweepLocked drops expired cache entries; the caller holds f.mu.
+func (f *federation) sweepLocked(now time.Time) {
+	for k, e := range f.located {
+		if now.After(e.until) {
+			delete(f.located, k)
+		}
+	}
+	for k, e := range f.listed {
+		if now.After(e.until) {
+			delete(f.listed, k)
+		}
+	}
+}
+
+// peerListKey identifies what peers would list for r: its Host,
+// credentials and query.
+func peerListKey(r *http.Request, q url.Values) string {
+	return hashSecret(strings.Join([]string{requestHost(r), r.Header.Get("Authorization"), r.Header.Get("X-API-Key"), q.Encode()}, "\n"))
+}
+
+// peerRequest builds a request to peer on behalf of r, keeping r's Host and
+// credentials.
+func (f *federation) peerRequest(ctx context.Context, r *http.Request, peer federationPeer, path string, q url.Values) (*http.Request, error) {
+	u := *peer.base
+	u.Path += path
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = requestHost(r)
+	for _, h := range []string{"Authorization", "X-API-Key"} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	req.Header.Set(federationHeader, f.token)
+	req.Header.Set("X-Forwarded-For", clientIP(r))
+	return req, nil
+}
+
+// peerDevices fetches every peer's local device list in parallel, or
+// returns r's cached one. Peers that fail are named in unreachable.
+func (s *server) peerDevices(r *http.Request) (devices []deviceInfo, unreachable []string) {
+	type result struct {
+		region  string
+		devices []deviceInfo
+		err     error
+	}
+	q := r.URL.Query()
+	q.Del("group")
+	f := s.federation
+	key := peerListKey(r, q)
+	f.mu.Lock()
+	if e, ok := f.listed[key]; ok && time.Now().Before(e.until) {
+		f.mu.Unlock()
+		return slices.Clone(e.devices), e.unreachable
+	}
+	f.mu.Unlock()
+	defer func() {
+		if r.Context().Err() != nil {
+			return
+		}
+		now := time.Now()
+		f.mu.Lock()
+		f.sweepLocked(now)
+		f.listed[key] = listedEntry{devices: slices.Clone(devices), unreachable: unreachable, until: now.Add(f.cacheTTL)}
+		f.mu.Unlock()
+	}()
+	results := make(chan result, len(s.federation.peers))
+	for _, peer := range s.federation.peers {
+		go func(peer federationPeer) {
+			res := result{region: peer.region}
+			defer func() { results <- res }()
+			req, err := s.federation.peerRequest(r.Context(), r, peer, "/api/devices", q)
+			if err != nil {
+				res.err = err
+				return
+			}
+			resp, err := s.federation.client.Do(req)
+			s.federation.noteReached(peer, err)
+			if err != nil {
+				res.err = err
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				res.err = fmt.Errorf("peer returned %s", resp.Status)
+				return
+			}
+			res.err = json.NewDecoder(resp.Body).Decode(&res.devices)
+		}(peer)
+	}
+	for range s.federation.peers {
+		res := <-results
+		if res.err != nil {
+			unreachable = append(unreachable, res.region)
+			s.logf(logInfo, "federation_devices_failed", "region", res.region, "error", res.err.Error())
+			continue
+		}
+		for _, d := range res.devices {
+			if d.Region == "" {
+				d.Region = res.region
+			}
+			devices = append(devices, d)
+		}
+	}
+	sort.Strings(unreachable)
+	return devices, unreachable
+}
+
+// locateDevice asks the peers which region holds deviceID's session on
+// tunnel, unless it was asked within FEDERATION_CACHE; ok is false if none
+// does.
+func (s *server) locateDevice(r *http.Request, deviceID, tunnel string) (peer federationPeer, ok bool) {
+	f := s.federation
+	key := makeKey(deviceID, tunnel)
+	f.mu.Lock()
+	if e, hit := f.located[key]; hit && time.Now().Before(e.until) {
+		f.mu.Unlock()
+		return e.peer, e.found
+	}
+	f.mu.Unlock()
+	defer func() {
+		if r.Context().Err() != nil {
+			return // the answer is incomplete
+		}
+		now := time.Now()
+		f.mu.Lock()
+		f.sweepLocked(now)
+		f.located[key] = locatedEntry{peer: peer, found: ok, until: now.Add(f.cacheTTL)}
+		f.mu.Unlock()
+	}()
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	found := make(chan federationPeer, len(s.federation.peers))
+	var wg sync.WaitGroup
+	for _, peer := range s.federation.peers {
+		wg.Add(1)
+		go func(peer federationPeer) {
+			defer wg.Done()
+			req, err := s.federation.peerRequest(ctx, r, peer, "/api/federation/locate",
+				url.Values{"device_id": {deviceID}, "tunnel": {tunnel}})
+			if err != nil {
+				return
+			}
+			resp, err := s.federation.client.Do(req)
+			if ctx.Err() == nil {
+				s.federation.noteReached(peer, err)
+			}
+			if err != nil {
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusNoContent {
+				found <- peer
+			}
+		}(peer)
+	}
+	go func() { wg.Wait(); close(found) }()
+	peer, ok = <-found
+	return peer, ok
+}
+
+// handleFederationLocate serves GET /api/federation/locate for peers: 204 if
+// this region holds the session, 404 if not.
+func (s *server) handleFederationLocate(w http.ResponseWriter, r *http.Request) {
+	if !s.federation.fromPeer(r) {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	q := r.URL.Query()
+	deviceID, ok := normalizeDeviceID(q.Get("device_id"))
+	if !ok || s.h.getDevice(makeKey(deviceID, q.Get("tunnel"))) == nil {
+		writeAPIError(w, http.StatusNotFound, "device_offline", "device offline")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// bridgeUI connects the UI on r to peer's session for the device and relays
+// frames both ways until either side closes. The peer does all the
+// authorization; its rejections reach the UI as they were sent. waited is
+// the UI's socket if it was already upgraded to wait (waitroom.go).
+func (s *server) bridgeUI(w http.ResponseWriter, r *http.Request, waited *websocket.Conn, peer federationPeer, deviceID, tunnel string) {
+	u := *peer.base
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	u.Path += r.URL.Path
+	u.RawQuery = r.URL.RawQuery
+	hdr := http.Header{}
+	for _, h := range []string{"Authorization", "X-API-Key"} {
+		if v := r.Header.Get(h); v != "" {
+			hdr.Set(h, v)
+		}
+	}
+	hdr.Set(federationHeader, s.federation.token)
+	hdr.Set("X-Forwarded-For", clientIP(r))
+	hdr.Set("Host", requestHost(r))
+	upstream, resp, err := s.federation.dialer.DialContext(r.Context(), u.String(), hdr)
+	if resp != nil {
+		s.federation.noteReached(peer, nil) // it answered, even if it refused
+	} else if r.Context().Err() == nil {
+		s.federation.noteReached(peer, err)
+	}
+	if err != nil {
+		status := http.StatusBadGateway
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		s.rejectUI(w, r, waited, status, wsCloseDeviceOffline, "ui_ws_federation_failed",
+			"remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel, "region", peer.region, "error", err.Error())
+		return
+	}
+	defer upstream.Close()
+	uiConn := waited
+	if uiConn == nil {
+		if uiConn, err = s.upgrader.Upgrade(w, r, nil); err != nil {
+			return
+		}
+	} else {
+		_ = uiConn.WriteMessage(websocket.TextMessage, msgDeviceOnline)
+	}
+	defer uiConn.Close()
+	// Each leg takes what a direct session would.
+	uiConn.SetReadLimit(8 << 20)
+	upstream.SetReadLimit(int64(max(8<<20, s.chunkMaxBytes)))
+	s.acct.federatedUIs.Add(1)
+	defer s.acct.federatedUIs.Add(-1)
+	s.logf(logInfo, "ui_ws_federated", "remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel, "region", peer.region)
+
+	done := make(chan struct{}, 2)
+	go func() { pumpWS(uiConn, upstream); done <- struct{}{} }()
+	go func() { pumpWS(upstream, uiConn); done <- struct{}{} }()
+	<-done
+	s.logf(logInfo, "ui_ws_federated_closed", "remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel, "region", peer.region)
+}
+
+// pumpWS copies messages from src to dst, passing src's close code on.
+func pumpWS(dst, src *websocket.Conn) {
+	for {
+		mt, msg, err := src.ReadMessage()
+		if err != nil {
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) {
+				_ = dst.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(ce.Code, ce.Text), time.Now().Add(3*time.Second))
+			} else {
+				_ = dst.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(3*time.Second))
+			}
+			return
+		}
+		if err := dst.WriteMessage(mt, msg); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,785 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// File transfer between the relay and devices, over the device's tunnel.
+//
+// Uploads (POST /api/devices/{id}/files?name=...) stream the request body to
+// the device as
+//
+//	text    {"type":"file_begin","id":"<transfer>","name":"fw.bin","size":N,"offset":0}
+//	binary  0x03 <flags> <len(id)> <id> <data...>   (repeated)
+//	text    {"type":"file_end","id":"<transfer>","size":N,"sha256":"<hex>"}
+//
+// An interrupted upload is resumed by POSTing the rest of the body with
+// ?transfer_id=<id>&offset=<bytes already sent>; file_begin then carries that
+// offset and file_end omits sha256 (the relay only saw part of the file).
+//
+// Devices push files up (e.g. SD-card recordings) with the same framing in
+// the other direction:
+//
+//	text    {"type":"file_push","id":"rec1","name":"rec1.mp4","size":N,"offset":0}
+//	binary  0x03 <flags> <len(id)> <id> <data...>
+//	text    {"type":"file_push_end","id":"rec1","sha256":"<hex, optional>"}
+//
+// which the relay stores in its staging area (FILE_STAGING_DIR, default
+// DATA_DIR/files) for download via GET /api/devices/{id}/files/{file}. A push
+// re-sent with an offset resumes a partial file. Both directions report
+// {"type":"file_progress"} to the device's UIs.
+//
+// The staging area is bounded: pushes that would take it past
+// FILE_STAGING_MAX_BYTES are refused, staged files are deleted
+// FILE_STAGING_TTL after they complete, and partial files a device hasn't
+// written to for filePartTTL are dropped. The sweep runs at startup and then
+// every FILE_SWEEP_INTERVAL.
+
+type fileBeginMsg struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"` // -1 when unknown
+	Offset int64  `json:"offset"`
+}
+
+type fileEndMsg struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+type fileProgressMsg struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	Direction string `json:"direction"` // upload (to device) | push (from device)
+	Name      string `json:"name"`
+	Bytes     int64  `json:"bytes"`
+	Size      int64  `json:"size"` // -1 when unknown
+	Done      bool   `json:"done,omitempty"`
+}
+
+type filePushDoneMsg struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// filePushControl is what devices send to start and finish a push.
+type filePushControl struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Name   string `json:"name,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+const progressEvery = 256 << 10
+
+// filePartTTL is how long a partial push (or upload) can be resumed.
+const filePartTTL = time.Hour
+
+// uploadTransfer tracks an upload so it can be resumed.
+type uploadTransfer struct {
+	ID        string    `json:"id"`
+	Tunnel    string    `json:"tunnel,omitempty"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"` // -1 when unknown
+	Sent      int64     `json:"sent"`
+	Complete  bool      `json:"complete"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	busy bool
+}
+
+// stagedFile is a completed device push, stored next to its data as
+// <id>.json.
+type stagedFile struct {
+	ID          string    `json:"id"`
+	DeviceID    string    `json:"device_id"`
+	Tunnel      string    `json:"tunnel,omitempty"`
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+type fileManager struct {
+	stagingDir string // "" disables device pushes
+	maxBytes   int64
+	chunkBytes int
+	stagingMax int64         // 0: unbounded
+	stagingTTL time.Duration // 0: staged files are kept
+
+	// staged is the staging area's size as of the last sweep, plus what
+	// pushes wrote since and minus what the API deleted. Deregistering a
+	// device only shows at the next sweep.
+	staged atomic.Int64
+
+	mu      sync.Mutex
+	uploads map[string]*uploadTransfer // deviceID + "/" + id
+}
+
+func newFileManager(stagingDir string, maxBytes int64, chunkBytes int, stagingMax int64, stagingTTL time.Duration) *fileManager {
+	if chunkBytes < 512 {
+		chunkBytes = 512
+	}
+	return &fileManager{stagingDir: stagingDir, maxBytes: maxBytes, chunkBytes: chunkBytes,
+		stagingMax: stagingMax, stagingTTL: stagingTTL, uploads: make(map[string]*uploadTransfer)}
+}
+
+// reserve counts n more bytes against FILE_STAGING_MAX_BYTES, or reports
+// false if they don't fit.
+func (fm *fileManager) reserve(n int64) bool {
+	if fm.staged.Add(n) > fm.stagingMax && fm.stagingMax > 0 {
+		fm.staged.Add(-n)
+		return false
+	}
+	return true
+}
+
+// sweep deletes expired staged files, partial files nobody resumed within
+// filePartTTL and data left without its metadata, then recounts the
+// staging area. It returns how many files it deleted.
+func (fm *fileManager) sweep(now time.Time) (removed int, err error) {
+	if fm.stagingDir == "" {
+		return 0, nil
+	}
+	dirs, err := os.ReadDir(fm.stagingDir)
+	if errors.Is(err, os.ErrNotExist) {
+		fm.staged.Store(0)
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		dir := filepath.Join(fm.stagingDir, d.Name())
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		have := make(map[string]bool, len(entries))
+		expired := make(map[string]bool)
+		for _, e := range entries {
+			have[e.Name()] = true
+			if id, ok := strings.CutSuffix(e.Name(), ".json"); ok && fm.stagingTTL > 0 {
+				if info, err := e.Info(); err == nil && now.Sub(info.ModTime()) > fm.stagingTTL {
+					expired[id] = true
+				}
+			}
+		}
+		kept := 0
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil || e.IsDir() {
+				continue
+			}
+			name, age := e.Name(), now.Sub(info.ModTime())
+			var drop bool
+			switch {
+			case strings.HasSuffix(name, ".part"):
+				drop = age > filePartTTL
+			case strings.HasSuffix(name, ".json"):
+				drop = expired[strings.TrimSuffix(name, ".json")]
+			default:
+				// Data is renamed into place before its metadata is written,
+				// so data without metadata is only an orphan once it's old.
+				drop = expired[name] || (!have[name+".json"] && age > filePartTTL)
+			}
+			if drop {
+				if os.Remove(filepath.Join(dir, name)) == nil {
+					removed++
+				}
+				continue
+			}
+			total += info.Size()
+			kept++
+		}
+		if kept == 0 {
+			_ = os.Remove(dir)
+		}
+	}
+	fm.staged.Store(total)
+	return removed, nil
+}
+
+// removeStaged deletes a staged push.
+func (fm *fileManager) removeStaged(deviceID, id string) error {
+	dir := fm.deviceDir(deviceID)
+	var freed int64
+	for _, p := range []string{filepath.Join(dir, id+".json"), filepath.Join(dir, id)} {
+		if st, err := os.Stat(p); err == nil {
+			freed += st.Size()
+		}
+	}
+	if err := os.Remove(filepath.Join(dir, id+".json")); err != nil {
+		return err
+	}
+	_ = os.Remove(filepath.Join(dir, id))
+	fm.staged.Add(-freed)
+	return nil
+}
+
+// runFileSweep sweeps the staging area now and every interval.
+func (s *server) runFileSweep(ctx context.Context, interval time.Duration) {
+	if s.files.stagingDir == "" {
+		return
+	}
+	sweep := func() {
+		n, err := s.files.sweep(time.Now())
+		if err != nil {
+			s.logf(logInfo, "file_sweep_failed", "error", err.Error())
+			return
+		}
+		if n > 0 {
+			s.logf(logInfo, "file_staging_swept", "removed", n, "bytes", s.files.staged.Load())
+		}
+	}
+	sweep()
+	if interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			sweep()
+		}
+	}
+}
+
+func validFileID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// fileFrame builds a 0x03 data frame for transfer id.
+func fileFrame(id string, data []byte) []byte {
+	b := make([]byte, 0, 3+len(id)+len(data))
+	b = append(b, frameFileChunk, 0, byte(len(id)))
+	b = append(b, id...)
+	return append(b, data...)
+}
+
+// parseFileFrame returns the transfer id and data of a 0x03 data frame.
+func parseFileFrame(msg []byte) (id string, data []byte, ok bool) {
+	if len(msg) < 3 || msg[0] != frameFileChunk || len(msg) < 3+int(msg[2]) {
+		return "", nil, false
+	}
+	n := int(msg[2])
+	return string(msg[3 : 3+n]), msg[3+n:], true
+}
+
+// broadcastUI sends a relay-generated message to every UI of the session.
+func (dc *deviceConn) broadcastUI(msg []byte) {
+	dc.uiMu.Lock()
+	uis := make([]*websocket.Conn, 0, len(dc.uiConns))
+	for c := range dc.uiConns {
+		uis = append(uis, c)
+	}
+	dc.uiMu.Unlock()
+	if len(uis) == 0 {
+		return
+	}
+	dc.uiWriteMu.Lock()
+	for _, c := range uis {
+		_ = dc.writeUI(c, websocket.TextMessage, msg)
+	}
+	dc.uiWriteMu.Unlock()
+}
+
+// writeUI writes to one of dc's UIs within dc.uiWriteTimeout; the caller
+// holds uiWriteMu. A UI that can't keep up is closed, which ends its
+// session, rather than holding up the others.
+func (dc *deviceConn) writeUI(c *websocket.Conn, mt int, msg []byte) error {
+	if dc.uiWriteTimeout > 0 {
+		_ = c.SetWriteDeadline(time.Now().Add(dc.uiWriteTimeout))
+		defer c.SetWriteDeadline(time.Time{})
+	}
+	err := c.WriteMessage(mt, msg)
+	if err != nil {
+		_ = c.Close()
+	}
+	return err
+}
+
+func (dc *deviceConn) writeDevice(mt int, msg []byte) error {
+	dc.writeMu.Lock()
+	defer dc.writeMu.Unlock()
+	return dc.ws.WriteMessage(mt, msg)
+}
+
+// startUpload registers a new upload or claims an interrupted one for resume.
+func (fm *fileManager) startUpload(deviceID, tunnel, name, resumeID string, offset, size int64) (*uploadTransfer, int, error) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	now := time.Now().UTC()
+	for k, t := range fm.uploads {
+		if !t.busy && now.Sub(t.UpdatedAt) > time.Hour {
+			delete(fm.uploads, k)
+		}
+	}
+	if resumeID == "" {
+		t := &uploadTransfer{ID: randomToken(9), Tunnel: tunnel, Name: name, Size: size, UpdatedAt: now, busy: true}
+		fm.uploads[deviceID+"/"+t.ID] = t
+		return t, 0, nil
+	}
+	t := fm.uploads[deviceID+"/"+resumeID]
+	switch {
+	case t == nil:
+		return nil, http.StatusNotFound, errors.New("unknown transfer_id")
+	case t.busy:
+		return nil, http.StatusConflict, errors.New("transfer in progress")
+	case t.Complete:
+		return nil, http.StatusConflict, errors.New("transfer already complete")
+	case offset != t.Sent:
+		return nil, http.StatusConflict, fmt.Errorf("offset must be %d", t.Sent)
+	}
+	t.busy = true
+	t.UpdatedAt = now
+	return t, 0, nil
+}
+
+// uploadError is an error envelope that also carries the transfer, so the
+// client knows where to resume.
+type uploadError struct {
+	apiError
+	Transfer uploadTransfer `json:"transfer"`
+}
+
+func writeUploadError(w http.ResponseWriter, status int, code, msg string, t uploadTransfer) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(uploadError{
+		apiError: apiError{Error: apiErrorBody{Code: code, Message: msg, RequestID: w.Header().Get("X-Request-ID")}},
+		Transfer: t,
+	})
+}
+
+func (fm *fileManager) update(t *uploadTransfer, fn func(t *uploadTransfer)) uploadTransfer {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fn(t)
+	t.UpdatedAt = time.Now().UTC()
+	return *t
+}
+
+func (fm *fileManager) listUploads(deviceID string) []uploadTransfer {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	out := []uploadTransfer{}
+	for k, t := range fm.uploads {
+		if strings.HasPrefix(k, deviceID+"/") {
+			out = append(out, *t)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].UpdatedAt.Before(out[j].UpdatedAt) })
+	return out
+}
+
+func (fm *fileManager) deviceDir(deviceID string) string {
+	return filepath.Join(fm.stagingDir, hex.EncodeToString([]byte(deviceID)))
+}
+
+func (fm *fileManager) listStaged(deviceID string) []stagedFile {
+	out := []stagedFile{}
+	if fm.stagingDir == "" {
+		return out
+	}
+	metas, _ := filepath.Glob(filepath.Join(fm.deviceDir(deviceID), "*.json"))
+	for _, p := range metas {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		var sf stagedFile
+		if json.Unmarshal(b, &sf) == nil {
+			out = append(out, sf)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CompletedAt.Before(out[j].CompletedAt) })
+	return out
+}
+
+// uploadToDevice streams r.Body to the device session.
+func (s *server) uploadToDevice(w http.ResponseWriter, r *http.Request, deviceID string) {
+	q := r.URL.Query()
+	name := filepath.Base(strings.TrimSpace(q.Get("name")))
+	if name == "" || name == "." || name == "/" || len(name) > 255 {
+		writeAPIError(w, http.StatusBadRequest, "invalid_name", "name is required")
+		return
+	}
+	tunnel := strings.TrimSpace(q.Get("tunnel"))
+	var offset int64
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			writeAPIError(w, http.StatusBadRequest, "invalid_offset", "invalid offset")
+			return
+		}
+		offset = n
+	}
+	dc := s.h.getDevice(makeKey(deviceID, tunnel))
+	if dc == nil || !s.hostAllows(r, deviceID) {
+		writeAPIError(w, http.StatusNotFound, "device_offline", "device offline")
+		return
+	}
+	size := int64(-1)
+	if r.ContentLength >= 0 {
+		size = offset + r.ContentLength
+		if size > s.files.maxBytes {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, "too_large", "file exceeds FILE_MAX_BYTES")
+			return
+		}
+	}
+	t, status, err := s.files.startUpload(deviceID, tunnel, name, q.Get("transfer_id"), offset, size)
+	if err != nil {
+		writeJSONError(w, status, err.Error())
+		return
+	}
+	defer s.files.update(t, func(t *uploadTransfer) { t.busy = false })
+
+	begin := mustJSON(fileBeginMsg{Type: "file_begin", ID: t.ID, Name: t.Name, Size: t.Size, Offset: offset})
+	if err := dc.writeDevice(websocket.TextMessage, begin); err != nil {
+		writeAPIError(w, http.StatusBadGateway, "device_write_failed", "device write failed")
+		return
+	}
+
+	hash := sha256.New()
+	buf := make([]byte, s.files.chunkBytes)
+	sent, lastProgress := offset, offset
+	body := http.MaxBytesReader(w, r.Body, s.files.maxBytes-offset)
+	for {
+		n, rerr := io.ReadFull(body, buf)
+		if n > 0 {
+			if err := dc.writeDevice(websocket.BinaryMessage, fileFrame(t.ID, buf[:n])); err != nil {
+				snap := s.files.update(t, func(t *uploadTransfer) { t.Sent = sent })
+				writeUploadError(w, http.StatusBadGateway, "device_write_failed", "device write failed", snap)
+				return
+			}
+			hash.Write(buf[:n])
+			sent += int64(n)
+			dc.bytesToDevice.Add(uint64(n))
+			if sent-lastProgress >= progressEvery {
+				lastProgress = sent
+				s.files.update(t, func(t *uploadTransfer) { t.Sent = sent })
+				dc.broadcastUI(mustJSON(fileProgressMsg{Type: "file_progress", ID: t.ID, Direction: "upload", Name: t.Name, Bytes: sent, Size: t.Size}))
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			// Client went away or exceeded the limit; keep what was sent
+			// so the upload can resume.
+			snap := s.files.update(t, func(t *uploadTransfer) { t.Sent = sent })
+			writeUploadError(w, http.StatusBadRequest, "upload_interrupted", "upload interrupted", snap)
+			s.logf(logInfo, "file_upload_interrupted", "device_id", deviceID, "transfer", t.ID, "sent", sent, "err", rerr.Error())
+			return
+		}
+	}
+
+	end := fileEndMsg{Type: "file_end", ID: t.ID, Size: sent}
+	if offset == 0 {
+		end.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	}
+	if err := dc.writeDevice(websocket.TextMessage, mustJSON(end)); err != nil {
+		snap := s.files.update(t, func(t *uploadTransfer) { t.Sent = sent })
+		writeUploadError(w, http.StatusBadGateway, "device_write_failed", "device write failed", snap)
+		return
+	}
+	snap := s.files.update(t, func(t *uploadTransfer) { t.Sent, t.Size, t.Complete = sent, sent, true })
+	dc.broadcastUI(mustJSON(fileProgressMsg{Type: "file_progress", ID: t.ID, Direction: "upload", Name: t.Name, Bytes: sent, Size: sent, Done: true}))
+	writeJSON(w, http.StatusOK, snap)
+	s.logf(logInfo, "file_uploaded", "remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel, "transfer", t.ID, "name", t.Name, "bytes", sent)
+}
+
+type deviceFiles struct {
+	Uploads []uploadTransfer `json:"uploads"`
+	Staged  []stagedFile     `json:"staged"`
+}
+
+// handleDeviceFiles serves file transfer:
+//
+//	GET    /api/devices/{id}/files         uploads in flight and staged pushes
+//	POST   /api/devices/{id}/files         upload the body to the device
+//	GET    /api/devices/{id}/files/{file}  download a staged push
+//	DELETE /api/devices/{id}/files/{file}  delete a staged push
+func (s *server) handleDeviceFiles(w http.ResponseWriter, r *http.Request, deviceID, fileID string) {
+	if fileID == "" {
+		switch r.Method {
+		case http.MethodGet:
+			if !s.requireRole(w, r, roleViewer) {
+				return
+			}
+			writeJSON(w, http.StatusOK, deviceFiles{
+				Uploads: s.files.listUploads(deviceID),
+				Staged:  s.files.listStaged(deviceID),
+			})
+		case http.MethodPost:
+			if !s.requireRole(w, r, roleOperator) {
+				return
+			}
+			s.uploadToDevice(w, r, deviceID)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+	if !validFileID(fileID) || s.files.stagingDir == "" {
+		writeAPIError(w, http.StatusNotFound, "file_not_found", "no such file")
+		return
+	}
+	dir := s.files.deviceDir(deviceID)
+	switch r.Method {
+	case http.MethodGet:
+		if !s.requireRole(w, r, roleViewer) {
+			return
+		}
+		var sf stagedFile
+		b, err := os.ReadFile(filepath.Join(dir, fileID+".json"))
+		if err != nil || json.Unmarshal(b, &sf) != nil {
+			writeAPIError(w, http.StatusNotFound, "file_not_found", "no such file")
+			return
+		}
+		f, err := os.Open(filepath.Join(dir, fileID))
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, "file_not_found", "no such file")
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": sf.Name}))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", sf.CompletedAt, f)
+	case http.MethodDelete:
+		if !s.requireRole(w, r, roleOperator) {
+			return
+		}
+		if err := s.files.removeStaged(deviceID, fileID); err != nil {
+			writeAPIError(w, http.StatusNotFound, "file_not_found", "no such file")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		s.logf(logInfo, "file_staged_removed", "remote", clientIP(r), "device_id", deviceID, "file", fileID)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// filePushes receives device pushes for one session. It is only used from
+// the session's reader goroutine.
+type filePushes struct {
+	fm       *fileManager
+	deviceID string
+	tunnel   string
+	open     map[string]*filePush
+}
+
+type filePush struct {
+	name         string
+	size         int64
+	written      int64
+	lastProgress int64
+	f            *os.File
+}
+
+func (fm *fileManager) newFilePushes(deviceID, tunnel string) *filePushes {
+	return &filePushes{fm: fm, deviceID: deviceID, tunnel: tunnel, open: make(map[string]*filePush)}
+}
+
+func fileError(id, message string) []byte {
+	return mustJSON(errorMsg{Type: "error", Code: "file_invalid", ID: id, Message: message})
+}
+
+// feed handles push control messages and data frames. reply goes back to
+// the device, progress to its UIs.
+func (p *filePushes) feed(mt int, msg []byte) (reply, progress []byte, consumed bool) {
+	if mt == websocket.BinaryMessage {
+		id, data, ok := parseFileFrame(msg)
+		push := p.open[id]
+		if !ok || push == nil {
+			return nil, nil, false
+		}
+		if push.written+int64(len(data)) > p.fm.maxBytes {
+			p.abort(id)
+			return fileError(id, "file exceeds FILE_MAX_BYTES"), nil, true
+		}
+		if !p.fm.reserve(int64(len(data))) {
+			p.abort(id)
+			return fileError(id, "staging area full (FILE_STAGING_MAX_BYTES)"), nil, true
+		}
+		if _, err := push.f.Write(data); err != nil {
+			p.abort(id)
+			return fileError(id, "staging write failed"), nil, true
+		}
+		push.written += int64(len(data))
+		if push.written-push.lastProgress >= progressEvery {
+			push.lastProgress = push.written
+			progress = mustJSON(fileProgressMsg{Type: "file_progress", ID: id, Direction: "push", Name: push.name, Bytes: push.written, Size: push.size})
+		}
+		return nil, progress, true
+	}
+
+	if mt != websocket.TextMessage || !bytes.Contains(msg, []byte(`"file_push`)) {
+		return nil, nil, false
+	}
+	var c filePushControl
+	if json.Unmarshal(msg, &c) != nil || (c.Type != "file_push" && c.Type != "file_push_end") {
+		return nil, nil, false
+	}
+	if !validFileID(c.ID) {
+		return fileError(c.ID, "invalid id"), nil, true
+	}
+	if p.fm.stagingDir == "" {
+		return fileError(c.ID, "file staging disabled"), nil, true
+	}
+	if c.Type == "file_push" {
+		return p.begin(c), nil, true
+	}
+	return p.finish(c)
+}
+
+func (p *filePushes) begin(c filePushControl) []byte {
+	if c.Size > p.fm.maxBytes {
+		return fileError(c.ID, "file exceeds FILE_MAX_BYTES")
+	}
+	if p.fm.stagingMax > 0 && c.Size > 0 && p.fm.staged.Load()+c.Size-c.Offset > p.fm.stagingMax {
+		return fileError(c.ID, "staging area full (FILE_STAGING_MAX_BYTES)")
+	}
+	if old := p.open[c.ID]; old != nil {
+		old.f.Close()
+		delete(p.open, c.ID)
+	}
+	dir := p.fm.deviceDir(p.deviceID)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fileError(c.ID, "staging unavailable")
+	}
+	f, err := os.OpenFile(filepath.Join(dir, c.ID+".part"), os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fileError(c.ID, "staging unavailable")
+	}
+	st, _ := f.Stat()
+	if c.Offset < 0 || (st != nil && c.Offset > st.Size()) {
+		f.Close()
+		return fileError(c.ID, "offset beyond partial file")
+	}
+	if err := f.Truncate(c.Offset); err != nil {
+		f.Close()
+		return fileError(c.ID, "staging write failed")
+	}
+	if _, err := f.Seek(c.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return fileError(c.ID, "staging write failed")
+	}
+	name := filepath.Base(c.Name)
+	if name == "" || name == "." || name == "/" {
+		name = c.ID
+	}
+	size := c.Size
+	if size <= 0 {
+		size = -1
+	}
+	p.open[c.ID] = &filePush{name: name, size: size, written: c.Offset, lastProgress: c.Offset, f: f}
+	return nil
+}
+
+func (p *filePushes) finish(c filePushControl) (reply, progress []byte, consumed bool) {
+	push := p.open[c.ID]
+	if push == nil {
+		return fileError(c.ID, "unknown push"), nil, true
+	}
+	delete(p.open, c.ID)
+	dir := p.fm.deviceDir(p.deviceID)
+	part := filepath.Join(dir, c.ID+".part")
+	if err := push.f.Close(); err != nil {
+		return fileError(c.ID, "staging write failed"), nil, true
+	}
+	if push.size > 0 && push.written != push.size {
+		return fileError(c.ID, "size mismatch"), nil, true
+	}
+	sum, err := fileSHA256(part)
+	if err != nil {
+		return fileError(c.ID, "staging read failed"), nil, true
+	}
+	if c.SHA256 != "" && !strings.EqualFold(c.SHA256, sum) {
+		if os.Remove(part) == nil {
+			p.fm.staged.Add(-push.written)
+		}
+		return fileError(c.ID, "sha256 mismatch"), nil, true
+	}
+	if err := os.Rename(part, filepath.Join(dir, c.ID)); err != nil {
+		return fileError(c.ID, "staging write failed"), nil, true
+	}
+	meta := stagedFile{ID: c.ID, DeviceID: p.deviceID, Tunnel: p.tunnel, Name: push.name, Size: push.written, SHA256: sum, CompletedAt: time.Now().UTC()}
+	if err := os.WriteFile(filepath.Join(dir, c.ID+".json"), mustJSON(meta), 0o600); err != nil {
+		return fileError(c.ID, "staging write failed"), nil, true
+	}
+	reply = mustJSON(filePushDoneMsg{Type: "file_push_done", ID: c.ID, Size: push.written, SHA256: sum})
+	progress = mustJSON(fileProgressMsg{Type: "file_progress", ID: c.ID, Direction: "push", Name: push.name, Bytes: push.written, Size: push.written, Done: true})
+	return reply, progress, true
+}
+
+func (p *filePushes) abort(id string) {
+	if push := p.open[id]; push != nil {
+		push.f.Close()
+		delete(p.open, id)
+	}
+}
+
+// closeAll closes open pushes when the session ends, leaving the partial
+// files in place for a resumed push.
+func (p *filePushes) closeAll() {
+	for id := range p.open {
+		p.abort(id)
+	}
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Filter rules block or redact messages as they cross the relay, so a
+// policy holds whatever the firmware or dashboard does. For example:
+//
+//	PUT /api/filters/no-guest-reset
+//	{"direction":"ui_to_device","from":"guest","match":{"cmd":"factory_reset"},"action":"block"}
+//
+//	PUT /api/filters/wifi-passwords
+//	{"direction":"device_to_ui","tunnel":"log","action":"redact","fields":["password","psk"]}
+//
+// A rule applies when every condition it sets holds: direction, tunnel,
+// from (ui_to_device only: guest for share links, token for device tokens,
+// account for accounts and API keys), match (JSON fields, dotted for
+// nesting, that must equal the given values) and pattern (a regexp on the
+// raw text). block drops the message; a UI is told with an error of code
+// "filtered". redact replaces the values of fields whose name contains one
+// of fields, or else pattern's matches (just its first group, if it has
+// one), with "[redacted]". Rules run in id order, each on the previous
+// one's output. Binary frames are filtered like text, as sent: match only
+// holds when the frame is a JSON document, and pattern sees the raw bytes,
+// frame header included on ?frame_tags=1 sessions. p2p_* signaling goes
+// through the rules like any other message.
+
+const (
+	filtersDoc     = "filters"
+	filterMaxRules = 100
+)
+
+type filterRule struct {
+	ID        string         `json:"id"`
+	Direction string         `json:"direction"` // ui_to_device | device_to_ui
+	Tunnel    string         `json:"tunnel,omitempty"`
+	From      string         `json:"from,omitempty"` // guest | token | account
+	Match     map[string]any `json:"match,omitempty"`
+	Pattern   string         `json:"pattern,omitempty"`
+	Action    string         `json:"action"` // block | redact
+	Fields    []string       `json:"fields,omitempty"`
+	UpdatedAt time.Time      `json:"updated_at"`
+
+	re *regexp.Regexp
+}
+
+// compile checks the rule and prepares it for matching.
+func (fr *filterRule) compile() error {
+	switch fr.Direction {
+	case dirUIToDevice:
+	case dirDeviceToUI:
+		if fr.From != "" {
+			return errors.New("from only applies to ui_to_device rules")
+		}
+	default:
+		return errors.New("direction must be ui_to_device or device_to_ui")
+	}
+	switch fr.From {
+	case "", "guest", "token", "account":
+	default:
+		return errors.New("from must be guest, token or account")
+	}
+	if fr.Pattern != "" {
+		re, err := regexp.Compile(fr.Pattern)
+		if err != nil {
+			return fmt.Errorf("pattern: %w", err)
+		}
+		fr.re = re
+	}
+	for i, f := range fr.Fields {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "" {
+			return errors.New("fields must not be empty strings")
+		}
+		fr.Fields[i] = f
+	}
+	switch fr.Action {
+	case "block":
+		if len(fr.Match) == 0 && fr.re == nil {
+			return errors.New("a block rule needs match or pattern")
+		}
+		if len(fr.Fields) > 0 {
+			return errors.New("fields only apply to redact rules")
+		}
+	case "redact":
+		if len(fr.Fields) == 0 && fr.re == nil {
+			return errors.New("a redact rule needs fields or pattern")
+		}
+	default:
+		return errors.New("action must be block or redact")
+	}
+	return nil
+}
+
+// matches reports whether the rule's conditions hold for msg. v is msg
+// decoded, or nil when it isn't JSON.
+func (fr *filterRule) matches(tunnel, from string, msg []byte, v any) bool {
+	if (fr.Tunnel != "" && fr.Tunnel != tunnel) || (fr.From != "" && fr.From != from) {
+		return false
+	}
+	for path, want := range fr.Match {
+		got, ok := jsonPath(v, path)
+		if !ok || !reflect.DeepEqual(got, want) {
+			return false
+		}
+	}
+	return fr.re == nil || fr.re.Match(msg)
+}
+
+// redact applies a redact rule to msg, reporting whether it changed.
+func (fr *filterRule) redact(msg []byte) ([]byte, bool) {
+	if len(fr.Fields) > 0 {
+		out, n := redactJSONKeys(msg, fr.Fields)
+		return out, n > 0
+	}
+	if fr.re.NumSubexp() == 0 {
+		return fr.re.ReplaceAllLiteral(msg, []byte("[redacted]")), true
+	}
+	var b []byte
+	last := 0
+	for _, m := range fr.re.FindAllSubmatchIndex(msg, -1) {
+		if m[2] < 0 {
+			continue
+		}
+		b = append(b, msg[last:m[2]]...)
+		b = append(b, "[redacted]"...)
+		last = m[3]
+	}
+	if b == nil {
+		return msg, false
+	}
+	return append(b, msg[last:]...), true
+}
+
+// jsonPath looks up a dotted field path in a decoded JSON object.
+func jsonPath(v any, path string) (any, bool) {
+	for _, k := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[k]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+type filterStore struct {
+	store *fileStore
+
+	mu    sync.RWMutex
+	rules []*filterRule // sorted by ID; replaced, never modified in place
+}
+
+func newFilterStore(store *fileStore) *filterStore {
+	return &filterStore{store: store}
+}
+
+func (fs *filterStore) load() error {
+	var list []*filterRule
+	if err := fs.store.load(filtersDoc, &list); err != nil {
+		return err
+	}
+	rules := make([]*filterRule, 0, len(list))
+	for _, fr := range list {
+		if fr == nil || fr.ID == "" {
+			continue
+		}
+		if err := fr.compile(); err != nil {
+			return fmt.Errorf("filter %q: %w", fr.ID, err)
+		}
+		rules = append(rules, fr)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+	fs.mu.Lock()
+	fs.rules = rules
+	fs.mu.Unlock()
+	return nil
+}
+
+func (fs *filterStore) snapshot() []*filterRule {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.rules
+}
+
+func (fs *filterStore) get(id string) *filterRule {
+	for _, fr := range fs.snapshot() {
+		if fr.ID == id {
+			return fr
+		}
+	}
+	return nil
+}
+
+var errTooManyFilters = fmt.Errorf("at most %d filter rules", filterMaxRules)
+
+func (fs *filterStore) put(fr *filterRule) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	rules := make([]*filterRule, 0, len(fs.rules)+1)
+	for _, old := range fs.rules {
+		if old.ID != fr.ID {
+			rules = append(rules, old)
+		}
+	}
+	if len(rules) >= filterMaxRules {
+		return errTooManyFilters
+	}
+	rules = append(rules, fr)
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+	// Saved first, so the rules in force are the ones on disk.
+	if err := fs.store.save(filtersDoc, rules); err != nil {
+		return err
+	}
+	fs.rules = rules
+	return nil
+}
+
+func (fs *filterStore) remove(id string) (bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	rules := make([]*filterRule, 0, len(fs.rules))
+	for _, fr := range fs.rules {
+		if fr.ID != id {
+			rules = append(rules, fr)
+		}
+	}
+	if len(rules) == len(fs.rules) {
+		return false, nil
+	}
+	if err := fs.store.save(filtersDoc, rules); err != nil {
+		return false, err
+	}
+	fs.rules = rules
+	return true, nil
+}
+
+// apply runs the direction's rules over a message from a UI that
+// authenticated as from ("" for device_to_ui). It returns the message to
+// forward, or nil and the rule that blocked it, and whether anything was
+// redacted.
+func (fs *filterStore) apply(dir, tunnel, from string, msg []byte) (out []byte, blocked *filterRule, redacted bool) {
+	var v any
+	decoded := false
+	for _, fr := range fs.snapshot() {
+		if fr.Direction != dir {
+			continue
+		}
+		if len(fr.Match) > 0 && !decoded {
+			v, decoded = nil, true
+			_ = json.Unmarshal(msg, &v)
+		}
+		if !fr.matches(tunnel, from, msg, v) {
+			continue
+		}
+		if fr.Action == "block" {
+			return nil, fr, redacted
+		}
+		if out, changed := fr.redact(msg); changed {
+			msg, decoded, redacted = out, false, true
+		}
+	}
+	return msg, nil, redacted
+}
+
+// filterUI applies the ui_to_device rules to a UI's message. When it
+// is blocked the UI is told and nil is returned.
+func (s *server) filterUI(dc *deviceConn, uiConn *websocket.Conn, tunnel string, opts uiOptions, msg []byte) []byte {
+	out, blocked, redacted := s.filters.apply(dirUIToDevice, tunnel, opts.from, msg)
+	if blocked == nil {
+		if redacted {
+			s.filtered.Inc(dirUIToDevice, s.tunnelLabel(tunnel), "redact")
+		}
+		return out
+	}
+	s.filtered.Inc(dirUIToDevice, s.tunnelLabel(tunnel), "block")
+	deviceID, _ := splitKey(dc.id)
+	s.logf(logInfo, "ui_message_filtered", "remote", opts.remote, "device_id", deviceID, "tunnel", tunnel,
+		"actor", opts.actor, "rule", blocked.ID)
+	if !opts.terminal {
+		dc.uiWriteMu.Lock()
+		_ = dc.writeUI(uiConn, websocket.TextMessage, mustJSON(errorMsg{Type: "error", Code: "filtered", Tunnel: tunnel,
+			Message: "blocked by relay policy"}))
+		dc.uiWriteMu.Unlock()
+	}
+	return nil
+}
+
+// filterDevice applies the device_to_ui rules to a device's message,
+// returning nil when it is blocked.
+func (s *server) filterDevice(tunnel string, msg []byte) []byte {
+	out, blocked, redacted := s.filters.apply(dirDeviceToUI, tunnel, "", msg)
+	switch {
+	case blocked != nil:
+		s.filtered.Inc(dirDeviceToUI, s.tunnelLabel(tunnel), "block")
+	case redacted:
+		s.filtered.Inc(dirDeviceToUI, s.tunnelLabel(tunnel), "redact")
+	}
+	return out
+}
+
+// handleFilters manages filter rules (admin only):
+//
+//	GET    /api/filters       list rules
+//	GET    /api/filters/{id}  one rule
+//	PUT    /api/filters/{id}  create or replace a rule
+//	DELETE /api/filters/{id}  remove a rule
+func (s *server) handleFilters(w http.ResponseWriter, r *http.Request) {
+	if !s.requireRole(w, r, roleAdmin) {
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/filters"), "/")
+	if id == "" {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		rules := s.filters.snapshot()
+		if rules == nil {
+			rules = []*filterRule{}
+		}
+		writeJSON(w, http.StatusOK, rules)
+		return
+	}
+	if strings.Contains(id, "/") || len(id) > 64 {
+		writeAPIError(w, http.StatusBadRequest, "invalid_filter_id", "invalid filter id")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		fr := s.filters.get(id)
+		if fr == nil {
+			writeAPIError(w, http.StatusNotFound, "filter_not_found", "no such filter")
+			return
+		}
+		writeJSON(w, http.StatusOK, fr)
+	case http.MethodPut:
+		var fr filterRule
+		if err := decodeJSONBody(w, r, &fr); err != nil {
+			writeJSONDecodeError(w, err)
+			return
+		}
+		if fr.ID != "" && fr.ID != id {
+			writeAPIError(w, http.StatusBadRequest, "id_mismatch", "id does not match the path")
+			return
+		}
+		fr.ID, fr.UpdatedAt = id, time.Now().UTC()
+		if err := fr.compile(); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_filter", err.Error())
+			return
+		}
+		if err := s.filters.put(&fr); err != nil {
+			if errors.Is(err, errTooManyFilters) {
+				writeAPIError(w, http.StatusConflict, "too_many_filters", err.Error())
+				return
+			}
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist filters")
+			return
+		}
+		writeJSON(w, http.StatusOK, &fr)
+		s.logf(logInfo, "filter_set", "remote", clientIP(r), "id", id, "direction", fr.Direction, "action", fr.Action)
+	case http.MethodDelete:
+		removed, err := s.filters.remove(id)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist filters")
+			return
+		}
+		if !removed {
+			writeAPIError(w, http.StatusNotFound, "filter_not_found", "no such filter")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		s.logf(logInfo, "filter_removed", "remote", clientIP(r), "id", id)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// forwardQueue is a device session's bounded outbox toward its UIs. Its own
+// writer goroutine drains it, so fanning out to a slow UI holds up only that
+// device: never the goroutine reading its socket, an epoll worker shared
+// with other devices, or an upstream link carrying many. The writer starts
+// when a message is queued and exits once the queue is empty, so an idle
+// session still costs no goroutine.
+//
+// FORWARD_QUEUE (16) bounds it. When it is full, ordinary messages are
+// dropped (espwifi_forward_queue_dropped_total); reassembled chunked
+// messages may use as many slots again, and are dropped past that. push
+// never waits: a full queue means the writer is stuck on a UI, and
+// UI_WRITE_TIMEOUT evicts that UI (see deviceConn.writeUI).
+type forwardQueue struct {
+	ds *deviceSession
+
+	mu      sync.Mutex
+	msgs    []wsMsg
+	max     int
+	running bool // a writer is draining
+	closed  bool
+
+	// Serializes forward with the serial idle flush.
+	fwdMu      sync.Mutex
+	serialTick *time.Timer
+}
+
+func newForwardQueue(ds *deviceSession, max int) *forwardQueue {
+	return &forwardQueue{ds: ds, max: max}
+}
+
+// push queues m, or drops it if the queue is full; must gets twice the
+// room. It never blocks the caller.
+func (q *forwardQueue) push(m wsMsg, must bool) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	limit := q.max
+	if must {
+		limit *= 2
+	}
+	if len(q.msgs) >= limit {
+		q.ds.s.forwardDropped.Inc(q.ds.s.tunnelLabel(q.ds.tunnel))
+		return false
+	}
+	q.msgs = append(q.msgs, m)
+	if !q.running {
+		q.running = true
+		go q.drain()
+	}
+	return true
+}
+
+func (q *forwardQueue) drain() {
+	for {
+		q.mu.Lock()
+		if len(q.msgs) == 0 || q.closed {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		m := q.msgs[0]
+		q.msgs[0] = wsMsg{}
+		q.msgs = q.msgs[1:]
+		queued := len(q.msgs)
+		q.mu.Unlock()
+
+		q.forward(m, queued)
+	}
+}
+
+func (q *forwardQueue) forward(m wsMsg, queued int) {
+	ds := q.ds
+	q.fwdMu.Lock()
+	defer q.fwdMu.Unlock()
+	ds.queued = queued
+	pending := ds.forward(m)
+	if ds.serial == nil {
+		return
+	}
+	if q.serialTick != nil {
+		q.serialTick.Stop()
+		q.serialTick = nil
+	}
+	if pending {
+		q.serialTick = time.AfterFunc(ds.s.serialLineFlush, func() {
+			q.fwdMu.Lock()
+			defer q.fwdMu.Unlock()
+			ds.s.flushSerial(ds.dc, ds.serial)
+		})
+	}
+}
+
+// close drops whatever is still queued; the session has ended.
+func (q *forwardQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.msgs = nil
+	q.mu.Unlock()
+	q.fwdMu.Lock()
+	if q.serialTick != nil {
+		q.serialTick.Stop()
+	}
+	if q.ds.rec != nil {
+		q.ds.rec.close()
+	}
+	q.fwdMu.Unlock()
+}
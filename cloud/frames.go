@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Typed binary frames. A device that connects with ?frame_tags=1 prefixes
+// every binary message with a two-byte header:
+//
+//	byte 0  frame type (frameCamera, frameAudio, ...)
+//	byte 1  flags (frameFlagKey, frameFlagFinal; other bits reserved, 0)
+//
+// so the relay can apply per-type policies (FRAME_POLICIES) and UIs can tell
+// camera frames from file chunks without sniffing. UIs that also pass
+// ?frame_tags=1 receive the header; others get the bare payload as before.
+const (
+	frameRaw       byte = 0x00
+	frameCamera    byte = 0x01
+	frameAudio     byte = 0x02
+	frameFileChunk byte = 0x03
+	frameSerial    byte = 0x04
+
+	frameFlagKey   byte = 0x01 // self-contained (e.g. a JPEG or an audio keyframe)
+	frameFlagFinal byte = 0x02 // last chunk of a larger payload
+
+	frameHeaderLen = 2
+)
+
+var frameTypeNames = map[byte]string{
+	frameRaw:       "raw",
+	frameCamera:    "camera",
+	frameAudio:     "audio",
+	frameFileChunk: "file_chunk",
+	frameSerial:    "serial",
+	frameChunk:     "chunk",
+}
+
+func frameTypeName(t byte) string {
+	if n, ok := frameTypeNames[t]; ok {
+		return n
+	}
+	return "custom"
+}
+
+func frameTypeByName(name string) (byte, bool) {
+	for t, n := range frameTypeNames {
+		if n == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// parseFrameTag splits a tagged binary frame. ok is false for frames too short
+// to carry a header.
+func parseFrameTag(msg []byte) (typ, flags byte, payload []byte, ok bool) {
+	if len(msg) < frameHeaderLen {
+		return 0, 0, nil, false
+	}
+	return msg[0], msg[1], msg[frameHeaderLen:], true
+}
+
+// framePolicy is what the relay does with one frame type.
+type framePolicy struct {
+	drop bool
+	// Forward at most this many frames per second per device session; key
+	// frames are not exempt. 0 means unlimited.
+	maxFPS float64
+	// Also write forwarded frames to RECORD_DIR (recording.go).
+	record bool
+}
+
+// parseFramePolicies parses FRAME_POLICIES, e.g.
+// "camera=record+throttle:10,audio=drop". Actions combine with '+'; types
+// without an entry pass through.
+func parseFramePolicies(spec string) (map[byte]framePolicy, error) {
+	out := make(map[byte]framePolicy)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, action, ok := strings.Cut(item, "=")
+		typ, known := frameTypeByName(strings.TrimSpace(name))
+		if !ok || !known {
+			return nil, fmt.Errorf("FRAME_POLICIES: bad entry %q", item)
+		}
+		var p framePolicy
+		for _, action := range strings.Split(action, "+") {
+			switch action = strings.TrimSpace(action); {
+			case action == "pass":
+			case action == "drop":
+				p.drop = true
+			case action == "record":
+				p.record = true
+			case strings.HasPrefix(action, "throttle:"):
+				fps, err := strconv.ParseFloat(strings.TrimPrefix(action, "throttle:"), 64)
+				if err != nil || fps <= 0 {
+					return nil, fmt.Errorf("FRAME_POLICIES: bad throttle in %q", item)
+				}
+				p.maxFPS = fps
+			default:
+				return nil, fmt.Errorf("FRAME_POLICIES: unknown action in %q", item)
+			}
+		}
+		if p != (framePolicy{}) {
+			out[typ] = p
+		}
+	}
+	return out, nil
+}
+
+// frameGate applies frame policies for one device session. It is only used
+// from the session's forwarding loop.
+type frameGate struct {
+	policies map[byte]framePolicy
+	lastSent map[byte]time.Time
+}
+
+func newFrameGate(policies map[byte]framePolicy) *frameGate {
+	return &frameGate{policies: policies, lastSent: make(map[byte]time.Time)}
+}
+
+// admit reports whether a frame of typ may be forwarded at now; reason says
+// why not.
+func (g *frameGate) admit(typ byte, now time.Time) (ok bool, reason string) {
+	p, has := g.policies[typ]
+	if !has {
+		return true, ""
+	}
+	if p.drop {
+		return false, "policy_drop"
+	}
+	if p.maxFPS > 0 {
+		minGap := time.Duration(float64(time.Second) / p.maxFPS)
+		if last, seen := g.lastSent[typ]; seen && now.Sub(last) < minGap {
+			return false, "throttled"
+		}
+		g.lastSent[typ] = now
+	}
+	return true, ""
+}
+
+// records reports whether admitted frames of typ are recorded.
+func (g *frameGate) records(typ byte) bool {
+	return g.policies[typ].record
+}
+
+// recordsAny reports whether any policy records.
+func recordsAny(policies map[byte]framePolicy) bool {
+	for _, p := range policies {
+		if p.record {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Hot standby. Two relays can run as an active/standby pair:
+//
+//	HA_ROLE=active|standby     this node's role at startup (unset: no pairing)
+//	HA_PEER_URL=https://relay-b.example.com
+//	HA_PUBLIC_URL=https://relay-a.example.com   this node, as clients reach it
+//	HA_TOKEN=<secret>          shared by both nodes
+//	HA_SYNC_INTERVAL=2s        how often the standby replicates
+//	HA_FAILOVER_AFTER=10s      how long the active may be unreachable
+//	HA_LEASE=6s                how long the active serves without a pull
+//
+// The standby pulls GET /api/ha/snapshot from the active every
+// HA_SYNC_INTERVAL: the persisted registry (devices and their keys), claim
+// codes, share links, API keys, tenants, maintenance windows, message
+// filters, schemas and log levels, plus the live session roster, all
+// written to its own DATA_DIR. While standby it
+// fails /readyz, so a health-checked VIP or load balancer routes to the
+// active; relocates devices and UIs that reach it anyway (relocate message,
+// then close 4007) to the active; and refuses API writes with 503.
+//
+// Once the active hasn't answered for HA_FAILOVER_AFTER, the standby takes
+// over: it loads the replicated state, so reconnecting devices find their
+// keys, owners, shares and pending claims, and every session of the roster
+// is "reconnect expected" for RECONNECT_GRACE, as after a warm restart.
+//
+// Each pull also renews the active's lease. An active that hasn't been
+// pulled from for HA_LEASE, which must be shorter than HA_FAILOVER_AFTER,
+// fences itself before the standby can take over: it behaves as a standby
+// (relocating clients to its peer, refusing API writes, failing /readyz)
+// and closes its sessions so they move, until a pull renews the lease.
+// Without a standby the active therefore stops serving too; HA_LEASE=0
+// turns fencing off and accepts a split pair during a partition. Every
+// promotion also raises the pair's epoch, a fencing token both nodes keep
+// in DATA_DIR: a fenced active that finds its peer active with a higher
+// epoch steps down to standby, and a standby never applies a snapshot
+// from an epoch older than its own.
+//
+// GET /api/ha is the DNS/VIP hint: either node answers with its role and
+// the active's URL. A node started as active first asks its peer; if the
+// peer took over meanwhile, it starts as standby instead of splitting the
+// pair. Both nodes need DATA_DIR.
+
+const (
+	haActive  = "active"
+	haStandby = "standby"
+)
+
+type haPair struct {
+	s                  *server
+	peerURL, publicURL string
+	token              string
+	syncInterval       time.Duration
+	failoverAfter      time.Duration
+	lease              time.Duration // 0: no fencing
+	reconnectGrace     time.Duration
+	client             *http.Client
+
+	mu          sync.Mutex
+	role        string
+	since       time.Time
+	lastContact time.Time // last snapshot from the active (standby only)
+	lastSync    time.Time
+	syncErr     string
+	applied     map[string][sha256.Size]byte // replicated documents, by name
+	// The pair's epoch, raised by every promotion (haDoc), and until when
+	// the active may serve without another pull.
+	epoch      uint64
+	leaseUntil time.Time
+	fenced     bool
+}
+
+// haState is the haDoc document.
+type haState struct {
+	Epoch uint64 `json:"epoch"`
+}
+
+// haStatus is GET /api/ha.
+type haStatus struct {
+	Role  string    `json:"role"`
+	Since time.Time `json:"since"`
+	// Where clients should connect: this node if active, else its peer.
+	Active    string     `json:"active,omitempty"`
+	Peer      string     `json:"peer"`
+	LastSync  *time.Time `json:"last_sync,omitempty"`
+	SyncError string     `json:"sync_error,omitempty"`
+	Epoch     uint64     `json:"epoch"`
+	// An active whose lease ran out; it serves nothing until renewed.
+	Fenced bool `json:"fenced,omitempty"`
+}
+
+// haSnapshot is GET /api/ha/snapshot: the replicated documents as stored.
+type haSnapshot struct {
+	TakenAt time.Time                  `json:"taken_at"`
+	Epoch   uint64                     `json:"epoch"`
+	Docs    map[string]json.RawMessage `json:"docs"`
+}
+
+const haDoc = "ha"
+
+// haReplicatedDocs are copied to the standby as persisted: every document
+// holding devices, credentials or policy. Observed history (uptime,
+// disconnects, bandwidth tests) stays with the node that saw it, and the
+// session roster is taken live.
+var haReplicatedDocs = []string{registryDoc, claimsDoc, sharesDoc, apiKeysDoc, tenantsDoc, maintenanceDoc,
+	filtersDoc, schemasDoc, logLevelsDoc}
+
+// loadHAPair reads HA_*; nil when HA_ROLE is unset.
+func loadHAPair(s *server, reconnectGrace time.Duration) (*haPair, error) {
+	role := strings.ToLower(strings.TrimSpace(os.Getenv("HA_ROLE")))
+	switch role {
+	case "", "off", "none":
+		return nil, nil
+	case haActive, haStandby:
+	default:
+		return nil, fmt.Errorf("HA_ROLE: want active or standby, got %q", role)
+	}
+	ha := &haPair{
+		s:              s,
+		peerURL:        strings.TrimRight(strings.TrimSpace(os.Getenv("HA_PEER_URL")), "/"),
+		publicURL:      strings.TrimRight(strings.TrimSpace(os.Getenv("HA_PUBLIC_URL")), "/"),
+		token:          os.Getenv("HA_TOKEN"),
+		syncInterval:   envDuration("HA_SYNC_INTERVAL", 2*time.Second),
+		failoverAfter:  envDuration("HA_FAILOVER_AFTER", 10*time.Second),
+		lease:          envDuration("HA_LEASE", 0),
+		reconnectGrace: reconnectGrace,
+		client:         &http.Client{Timeout: 5 * time.Second},
+		role:           role,
+		since:          time.Now().UTC(),
+		lastContact:    time.Now(),
+		applied:        make(map[string][sha256.Size]byte),
+	}
+	if os.Getenv("HA_LEASE") == "" {
+		ha.lease = (ha.syncInterval + ha.failoverAfter) / 2
+	}
+	switch {
+	case ha.peerURL == "":
+		return nil, errors.New("HA_ROLE needs HA_PEER_URL")
+	case ha.token == "":
+		return nil, errors.New("HA_ROLE needs HA_TOKEN")
+	case !s.store.enabled():
+		return nil, errors.New("HA_ROLE needs DATA_DIR")
+	case ha.syncInterval <= 0 || ha.failoverAfter < ha.syncInterval:
+		return nil, errors.New("HA_FAILOVER_AFTER must be at least HA_SYNC_INTERVAL")
+	case ha.lease < 0 || ha.lease >= ha.failoverAfter || (ha.lease > 0 && ha.lease <= ha.syncInterval):
+		return nil, errors.New("HA_LEASE must be between HA_SYNC_INTERVAL and HA_FAILOVER_AFTER, or 0")
+	}
+	var st haState
+	if err := s.store.load(haDoc, &st); err != nil {
+		return nil, fmt.Errorf("load %s: %w", haDoc, err)
+	}
+	ha.epoch = st.Epoch
+	// A fresh active gets a full lease to be pulled from.
+	ha.leaseUntil = time.Now().Add(ha.lease)
+	if role == haActive {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		peer, err := ha.peerStatus(ctx)
+		cancel()
+		if err == nil && peer.Role == haActive {
+			ha.role = haStandby
+			s.logf(logInfo, "ha_peer_active", "peer", ha.peerURL, "peer_since", peer.Since.Format(time.RFC3339))
+		}
+	}
+	return ha, nil
+}
+
+// standby reports whether this node must stay out of the way: it is the
+// standby, or a fenced active.
+func (ha *haPair) standby() bool {
+	if ha == nil {
+		return false
+	}
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+	return ha.role == haStandby || ha.fenced
+}
+
+func (ha *haPair) status() haStatus {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+	st := haStatus{Role: ha.role, Since: ha.since, Peer: ha.peerURL, Active: ha.peerURL, SyncError: ha.syncErr,
+		Epoch: ha.epoch, Fenced: ha.fenced}
+	if ha.role == haActive && !ha.fenced {
+		st.Active = ha.publicURL
+	}
+	if !ha.lastSync.IsZero() {
+		t := ha.lastSync
+		st.LastSync = &t
+	}
+	return st
+}
+
+func (ha *haPair) peerStatus(ctx context.Context) (haStatus, error) {
+	var st haStatus
+	err := ha.get(ctx, "/api/ha", &st)
+	return st, err
+}
+
+func (ha *haPair) get(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ha.peerURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+ha.token)
+	resp, err := ha.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// run replicates while standby and takes over when the active goes quiet;
+// while active it watches the lease.
+func (ha *haPair) run(ctx context.Context) {
+	t := time.NewTicker(ha.syncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			ha.mu.Lock()
+			active := ha.role == haActive
+			ha.mu.Unlock()
+			if active {
+				ha.checkLease(ctx, now)
+				continue
+			}
+			err := ha.sync(ctx)
+			ha.mu.Lock()
+			ha.syncErr = ""
+			if err != nil {
+				ha.syncErr = err.Error()
+			}
+			silent := time.Since(ha.lastContact)
+			ha.mu.Unlock()
+			if err != nil && ctx.Err() == nil {
+				ha.s.logf(logDebug, "ha_sync_failed", "peer", ha.peerURL, "error", err.Error())
+				if silent >= ha.failoverAfter {
+					ha.promote(fmt.Sprintf("active unreachable for %s", silent.Round(time.Second)))
+				}
+			}
+		}
+	}
+}
+
+// sync pulls a snapshot and stores the documents that changed.
+func (ha *haPair) sync(ctx context.Context) error {
+	var snap haSnapshot
+	if err := ha.get(ctx, "/api/ha/snapshot", &snap); err != nil {
+		return err
+	}
+	now := time.Now()
+	ha.mu.Lock()
+	if snap.Epoch < ha.epoch {
+		ha.mu.Unlock()
+		return fmt.Errorf("snapshot from epoch %d, behind this node's %d", snap.Epoch, ha.epoch)
+	}
+	ha.lastContact = now
+	newer := snap.Epoch > ha.epoch
+	ha.epoch = snap.Epoch
+	ha.mu.Unlock()
+	if newer {
+		if err := ha.s.store.save(haDoc, haState{Epoch: snap.Epoch}); err != nil {
+			return fmt.Errorf("store %s: %w", haDoc, err)
+		}
+	}
+	changed := 0
+	for name, doc := range snap.Docs {
+		sum := sha256.Sum256(doc)
+		ha.mu.Lock()
+		same := ha.applied[name] == sum
+		ha.mu.Unlock()
+		if same {
+			continue
+		}
+		if err := ha.s.store.save(name, doc); err != nil {
+			return fmt.Errorf("store %s: %w", name, err)
+		}
+		ha.mu.Lock()
+		ha.applied[name] = sum
+		ha.mu.Unlock()
+		changed++
+	}
+	ha.mu.Lock()
+	ha.lastSync = now.UTC()
+	ha.mu.Unlock()
+	if changed > 0 {
+		ha.s.logf(logDebug, "ha_synced", "peer", ha.peerURL, "docs", changed)
+	}
+	return nil
+}
+
+// promote makes this node the active one, with the replicated state, in a
+// new epoch.
+func (ha *haPair) promote(reason string) {
+	ha.mu.Lock()
+	if ha.role == haActive {
+		ha.mu.Unlock()
+		return
+	}
+	ha.role, ha.since, ha.syncErr = haActive, time.Now().UTC(), ""
+	ha.epoch++
+	ha.leaseUntil, ha.fenced = time.Now().Add(ha.lease), false
+	epoch := ha.epoch
+	ha.mu.Unlock()
+	if err := ha.s.store.save(haDoc, haState{Epoch: epoch}); err != nil {
+		ha.s.logf(logInfo, "ha_epoch_save_failed", "error", err.Error())
+	}
+	if err := ha.s.loadReplicatedState(ha.reconnectGrace); err != nil {
+		ha.s.logf(logInfo, "ha_load_failed", "error", err.Error())
+	}
+	ha.s.logf(logInfo, "ha_promoted", "peer", ha.peerURL, "reason", reason, "epoch", epoch)
+}
+
+// renewLease extends the active's lease; a pull from the standby proves
+// the standby still follows it.
+func (ha *haPair) renewLease() {
+	ha.mu.Lock()
+	ha.leaseUntil = time.Now().Add(ha.lease)
+	unfenced := ha.fenced
+	ha.fenced = false
+	ha.mu.Unlock()
+	if unfenced {
+		ha.s.logf(logInfo, "ha_lease_renewed", "peer", ha.peerURL)
+	}
+}
+
+// checkLease fences an active whose lease ran out, and steps a fenced one
+// down once its peer has taken over in a newer epoch.
+func (ha *haPair) checkLease(ctx context.Context, now time.Time) {
+	if ha.lease <= 0 {
+		return
+	}
+	ha.mu.Lock()
+	expired := now.After(ha.leaseUntil)
+	fence := expired && !ha.fenced
+	ha.fenced = ha.fenced || expired
+	epoch := ha.epoch
+	ha.mu.Unlock()
+	if fence {
+		ha.s.logf(logInfo, "ha_fenced", "peer", ha.peerURL, "lease", ha.lease.String(), "epoch", epoch)
+		go ha.s.notifyRestart(5 * time.Second)
+	}
+	if !expired {
+		return
+	}
+	peer, err := ha.peerStatus(ctx)
+	if err != nil || peer.Role != haActive || peer.Epoch <= epoch {
+		return
+	}
+	ha.mu.Lock()
+	ha.role, ha.since, ha.fenced = haStandby, time.Now().UTC(), false
+	ha.epoch, ha.lastContact = peer.Epoch, time.Now()
+	ha.applied = make(map[string][sha256.Size]byte)
+	ha.mu.Unlock()
+	if err := ha.s.store.save(haDoc, haState{Epoch: peer.Epoch}); err != nil {
+		ha.s.logf(logInfo, "ha_epoch_save_failed", "error", err.Error())
+	}
+	ha.s.logf(logInfo, "ha_demoted", "peer", ha.peerURL, "epoch", peer.Epoch)
+}
+
+// loadReplicatedState reloads what the standby replicated, replacing what
+// was loaded at startup.
+func (s *server) loadReplicatedState(reconnectGrace time.Duration) error {
+	for name, load := range map[string]func() error{
+		"registry":    s.registry.load,
+		"shares":      s.shares.load,
+		"api keys":    func() error { return s.apiKeys.load(os.Getenv("API_KEYS")) },
+		"tenants":     s.tenants.load,
+		"maintenance": s.maintenance.load,
+		"filters":     s.filters.load,
+		"schemas":     s.schemas.load,
+		"log levels":  s.logLevels.load,
+		"warm state":  func() error { return s.loadWarmState(reconnectGrace) },
+	} {
+		if err := load(); err != nil {
+			return fmt.Errorf("load %s: %w", name, err)
+		}
+	}
+	s.reportLegacyIDs()
+	return nil
+}
+
+// handleHA serves GET /api/ha (public: it is the failover hint) and
+// GET /api/ha/snapshot (HA_TOKEN; active only).
+func (s *server) handleHA(w http.ResponseWriter, r *http.Request) {
+	ha := s.ha
+	if ha == nil {
+		writeAPIError(w, http.StatusNotFound, "not_configured", "not configured")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	switch strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/ha"), "/") {
+	case "":
+		writeJSON(w, http.StatusOK, ha.status())
+	case "snapshot":
+		if !authOK(r, ha.token) {
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		// A fenced active still answers: the pull is what renews its lease.
+		st := ha.status()
+		if st.Role != haActive {
+			writeAPIError(w, http.StatusConflict, "standby", "standby")
+			return
+		}
+		ha.renewLease()
+		snap := haSnapshot{TakenAt: time.Now().UTC(), Epoch: st.Epoch, Docs: make(map[string]json.RawMessage)}
+		for _, name := range haReplicatedDocs {
+			doc, err := s.store.raw(name)
+			if err != nil {
+				writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to read "+name)
+				return
+			}
+			if doc != nil {
+				snap.Docs[name] = doc
+			}
+		}
+		snap.Docs[sessionsDoc] = mustJSON(s.currentRoster())
+		writeJSON(w, http.StatusOK, snap)
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// haGate keeps a standby out of the way: device and UI sockets are sent to
+// the active, and API writes are refused.
+func (s *server) haGate(next http.Handler) http.Handler {
+	if s.ha == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.ha.standby() || r.URL.Path == "/api/ha" || strings.HasPrefix(r.URL.Path, "/api/ha/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		active := s.ha.peerURL
+		for _, p := range []string{"/ws/device/", "/ws/ui/", "/ws/serial/"} {
+			if !strings.HasPrefix(r.URL.Path, p) {
+				continue
+			}
+			target := wsBase(active) + r.URL.RequestURI()
+			if isWSUpgrade(r) {
+				if c, err := s.upgrader.Upgrade(w, r, nil); err == nil {
+					_ = c.WriteMessage(websocket.TextMessage, mustJSON(relocateMsg{Type: "relocate", URL: target}))
+					sendClose(c, wsCloseRelocated)
+					_ = c.Close()
+					s.logf(logInfo, "ha_standby_relocated", "remote", clientIP(r), "path", r.URL.Path)
+					return
+				}
+			}
+			writeAPIError(w, http.StatusServiceUnavailable, "standby", "standby; connect to "+active)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/api/") && r.Method != http.MethodGet && r.Method != http.MethodHead &&
+			r.Method != http.MethodOptions {
+			writeAPIError(w, http.StatusServiceUnavailable, "standby", "standby; the active relay is "+active)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// readinessCheck reports whether one dependency is ready to serve traffic.
+// Subsystems that must be up before new devices are routed here (backplane,
+// persistence, ...) register one via addReadinessCheck.
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+type readiness struct {
+	mu     sync.Mutex
+	checks []readinessCheck
+}
+
+var errDraining = errors.New("draining")
+
+func (s *server) addReadinessCheck(name string, check func() error) {
+	s.ready.mu.Lock()
+	defer s.ready.mu.Unlock()
+	s.ready.checks = append(s.ready.checks, readinessCheck{name: name, check: check})
+}
+
+// readinessFailures runs every check and returns the failures keyed by name.
+func (s *server) readinessFailures() map[string]string {
+	failed := map[string]string{}
+	if s.draining.Load() {
+		failed["server"] = errDraining.Error()
+	}
+	s.ready.mu.Lock()
+	checks := append([]readinessCheck(nil), s.ready.checks...)
+	s.ready.mu.Unlock()
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			failed[c.name] = err.Error()
+		}
+	}
+	return failed
+}
+
+// healthResponse is /healthz. The detail fields are only there with
+// ?detail=1 (and at least a viewer key, once RBAC is configured).
+type healthResponse struct {
+	OK bool `json:"ok"`
+	*healthDetail
+}
+
+type healthDetail struct {
+	Devices    int    `json:"devices"`
+	UIClients  int    `json:"ui_clients"`
+	UptimeS    int64  `json:"uptime_s"`
+	Version    string `json:"version"`
+	Goroutines int    `json:"goroutines"`
+	Draining   bool   `json:"draining"`
+	Leader     bool   `json:"leader"`
+	HARole     string `json:"ha_role,omitempty"`
+	// Links to other relays; omitted when there are none.
+	Backplane *backplaneStatus `json:"backplane,omitempty"`
+}
+
+// backplaneStatus is the state of this relay's links to other relays.
+type backplaneStatus struct {
+	// The link to UPSTREAM_URL: connected or connecting.
+	Upstream string `json:"upstream,omitempty"`
+	// FEDERATION_PEERS by region: reachable, unreachable, or unknown until
+	// a request has gone to it.
+	Peers map[string]string `json:"peers,omitempty"`
+}
+
+// handleHealthz is the liveness probe. Plain requests get {"ok":true}; with
+// ?detail=1 (and at least a viewer key, once RBAC is configured) it also reports
+// session counts and runtime stats for lightweight monitoring.
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	resp := healthResponse{OK: true}
+	if r.URL.Query().Get("detail") == "1" && s.callerHas(r, roleViewer) {
+		resp.healthDetail = &healthDetail{
+			Devices:    s.h.count(),
+			UIClients:  s.h.uiCount(),
+			UptimeS:    int64(time.Since(s.startedAt) / time.Second),
+			Version:    serverVersion(),
+			Goroutines: runtime.NumGoroutine(),
+			Draining:   s.draining.Load(),
+			Leader:     s.leader.IsLeader(),
+			Backplane:  s.backplane(),
+		}
+		if s.ha != nil {
+			resp.HARole = s.ha.status().Role
+		}
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+type statsResponse struct {
+	Devices          int        `json:"devices"`
+	UIClients        int        `json:"ui_clients"`
+	Goroutines       int        `json:"goroutines"`
+	MemoryInUseBytes uint64     `json:"memory_in_use_bytes"`
+	Draining         bool       `json:"draining"`
+	Shedding         shedStatus `json:"shedding"`
+}
+
+// handleStats reports load for dashboards and autoscalers (viewer):
+// sessions and the overload shedding state (see overload.go).
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.requireRole(w, r, roleViewer) {
+		return
+	}
+	writeJSON(w, http.StatusOK, statsResponse{
+		Devices:          s.h.count(),
+		UIClients:        s.h.uiCount(),
+		Goroutines:       runtime.NumGoroutine(),
+		MemoryInUseBytes: s.mem.inUse.Load(),
+		Draining:         s.draining.Load(),
+		Shedding:         s.shed.snapshot(),
+	})
+}
+
+// backplane reports the upstream link and federation peers; nil if this
+// relay has neither. The HA pair is reported as ha_role.
+func (s *server) backplane() *backplaneStatus {
+	var b backplaneStatus
+	if s.upstream != nil {
+		b.Upstream = "connecting"
+		if s.upstream.up.Load() {
+			b.Upstream = "connected"
+		}
+	}
+	if s.federation.enabled() {
+		b.Peers = s.federation.peerStates()
+	}
+	if b.Upstream == "" && b.Peers == nil {
+		return nil
+	}
+	return &b
+}
+
+// readyResponse is /readyz: the failed checks by name, with their errors.
+type readyResponse struct {
+	OK     bool              `json:"ok"`
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// handleReadyz is the Kubernetes readiness probe. Unlike /healthz (liveness),
+// it fails while the server is draining or a dependency is unavailable, so
+// new device connections are routed to another pod without restarting this one.
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	failed := s.readinessFailures()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if len(failed) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(readyResponse{OK: false, Failed: failed})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(readyResponse{OK: true})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The hub's device map is split into shards by device ID so connects,
+// disconnects and lookups for different devices don't queue behind one
+// lock, and so /api/devices polling only ever holds one shard at a time
+// (for reading). All tunnels of a device share a shard, which keeps
+// per-device lookups to a single lock.
+//
+// Each shard also publishes a read-only copy of its sessions, swapped in
+// atomically on every change, so listing the fleet (entries, sessionsFor)
+// takes no lock at all and never delays a connect or disconnect.
+const hubShards = 64
+
+type hubShard struct {
+	mu      sync.RWMutex
+	devices map[string]*deviceConn // by makeKey(deviceID, tunnel)
+	view    atomic.Pointer[[]hubEntry]
+	// Sessions per device ID, for the presence callback.
+	perDevice map[string]int
+	// UIs waiting for a session to come up, by key; see waitroom.go.
+	waiters map[string]*hubWaiter
+}
+
+// hubWaiter's up is closed when its key gets a session.
+type hubWaiter struct {
+	up chan struct{}
+	n  int
+}
+
+// waitFor returns a waiter for key, already fired if the session is up.
+// Pair it with stopWaiting.
+func (h *hub) waitFor(key string) *hubWaiter {
+	sh := h.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.devices[key] != nil {
+		hw := &hubWaiter{up: make(chan struct{})}
+		close(hw.up)
+		return hw
+	}
+	hw := sh.waiters[key]
+	if hw == nil {
+		hw = &hubWaiter{up: make(chan struct{})}
+		sh.waiters[key] = hw
+	}
+	hw.n++
+	return hw
+}
+
+// stopWaiting releases a waiter from waitFor.
+func (h *hub) stopWaiting(key string, hw *hubWaiter) {
+	sh := h.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.waiters[key] == hw {
+		if hw.n--; hw.n <= 0 {
+			delete(sh.waiters, key)
+		}
+	}
+}
+
+// wakeWaitersLocked fires the waiters for key; sh.mu must be held for
+// writing.
+func (sh *hubShard) wakeWaitersLocked(key string) {
+	if hw := sh.waiters[key]; hw != nil {
+		close(hw.up)
+		delete(sh.waiters, key)
+	}
+}
+
+// publishLocked replaces the shard's read-only view; sh.mu must be held for
+// writing.
+func (sh *hubShard) publishLocked() {
+	v := make([]hubEntry, 0, len(sh.devices))
+	for key, dc := range sh.devices {
+		v = append(v, hubEntry{key: key, dc: dc})
+	}
+	sh.view.Store(&v)
+}
+
+// snapshot returns the shard's sessions as of the last change. Read-only.
+func (sh *hubShard) snapshot() []hubEntry {
+	if v := sh.view.Load(); v != nil {
+		return *v
+	}
+	return nil
+}
+
+type hub struct {
+	shards [hubShards]hubShard
+	n      atomic.Int64 // sessions across all shards
+	// Serializes admissions so MAX_DEVICES holds exactly; see admitDevice.
+	admitMu sync.Mutex
+	// Called, under the shard lock, when a device gets its first session
+	// or loses its last one. Set before serving.
+	onPresence func(deviceID string, up bool, at time.Time)
+	// Called, under the shard lock, whenever a session is installed
+	// (replacements included) or removed; see upstream.go.
+	onSession func(key string, dc *deviceConn, up bool)
+}
+
+func newHub() *hub {
+	h := &hub{}
+	for i := range h.shards {
+		h.shards[i].devices = make(map[string]*deviceConn)
+		h.shards[i].perDevice = make(map[string]int)
+		h.shards[i].waiters = make(map[string]*hubWaiter)
+	}
+	return h
+}
+
+// shard returns the shard for a session key (or bare device ID).
+func (h *hub) shard(key string) *hubShard {
+	deviceID, _ := splitKey(key)
+	// FNV-1a.
+	var sum uint32 = 2166136261
+	for i := 0; i < len(deviceID); i++ {
+		sum ^= uint32(deviceID[i])
+		sum *= 16777619
+	}
+	return &h.shards[sum%hubShards]
+}
+
+func (h *hub) getDevice(id string) *deviceConn {
+	sh := h.shard(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.devices[id]
+}
+
+func (h *hub) deleteDevice(id string, dc *deviceConn) {
+	sh := h.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if cur, ok := sh.devices[id]; ok && cur == dc {
+		delete(sh.devices, id)
+		h.n.Add(-1)
+		h.sessionGoneLocked(sh, id)
+		if h.onSession != nil {
+			h.onSession(id, dc, false)
+		}
+		sh.publishLocked()
+	}
+}
+
+// sessionAddedLocked and sessionGoneLocked keep sh.perDevice and fire
+// onPresence; sh.mu must be held for writing.
+func (h *hub) sessionAddedLocked(sh *hubShard, key string) {
+	deviceID, _ := splitKey(key)
+	sh.perDevice[deviceID]++
+	if sh.perDevice[deviceID] == 1 && h.onPresence != nil {
+		h.onPresence(deviceID, true, time.Now().UTC())
+	}
+}
+
+func (h *hub) sessionGoneLocked(sh *hubShard, key string) {
+	deviceID, _ := splitKey(key)
+	if sh.perDevice[deviceID]--; sh.perDevice[deviceID] <= 0 {
+		delete(sh.perDevice, deviceID)
+		if h.onPresence != nil {
+			h.onPresence(deviceID, false, time.Now().UTC())
+		}
+	}
+}
+
+func (h *hub) count() int {
+	return int(h.n.Load())
+}
+
+type hubEntry struct {
+	key string
+	dc  *deviceConn
+}
+
+// entries lists every session from the shards' published views, without
+// locking. The slice is the caller's.
+func (h *hub) entries() []hubEntry {
+	out := make([]hubEntry, 0, h.count())
+	for i := range h.shards {
+		out = append(out, h.shards[i].snapshot()...)
+	}
+	return out
+}
@@ -0,0 +1,56 @@
+package main
+
+import "time"
+
+// Device keepalive. The relay pings every device session each
+// DEVICE_PING_INTERVAL (30s); a session whose pongs stop is closed once
+// DEVICE_PONG_MISSES (3) pings in a row go unanswered plus DEVICE_PONG_GRACE
+// (30s) — 120s with the defaults, as before. Sessions show "stale": true in
+// /api/devices from the first missed pong, so dashboards can grey out a
+// device long before the relay gives up on it.
+type keepaliveConfig struct {
+	pingInterval time.Duration
+	pongMisses   int
+	pongGrace    time.Duration
+}
+
+func loadKeepaliveConfig() keepaliveConfig {
+	kc := keepaliveConfig{
+		pingInterval: envDuration("DEVICE_PING_INTERVAL", 30*time.Second),
+		pongMisses:   envInt("DEVICE_PONG_MISSES", 3),
+		pongGrace:    envDuration("DEVICE_PONG_GRACE", 30*time.Second),
+	}
+	if kc.pingInterval <= 0 {
+		kc.pingInterval = 30 * time.Second
+	}
+	if kc.pongMisses < 1 {
+		kc.pongMisses = 1
+	}
+	return kc
+}
+
+// readTimeout is how long a device may go without a pong before its
+// session is dropped.
+func (kc keepaliveConfig) readTimeout() time.Duration {
+	return kc.pingInterval*time.Duration(kc.pongMisses) + kc.pongGrace
+}
+
+// notePing records a ping about to be sent and returns how many earlier
+// pings are still unanswered. The first of a run of unanswered pings is the
+// one the next pong is timed against (linkquality.go).
+func (dc *deviceConn) notePing() int32 {
+	if dc.pingPending.Swap(true) {
+		return dc.missedPongs.Add(1)
+	}
+	dc.pingSentAt.Store(time.Now().UnixNano())
+	return dc.missedPongs.Load()
+}
+
+func (dc *deviceConn) notePong() {
+	if dc.pingPending.Swap(false) {
+		if rtt := time.Now().UnixNano() - dc.pingSentAt.Load(); rtt > 0 {
+			dc.rtt.Store(rtt)
+		}
+	}
+	dc.missedPongs.Store(0)
+}
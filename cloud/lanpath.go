@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// LAN fast path. A device can tell the relay where it listens on its own
+// network, with ?lan_ip=192.168.1.20 (plus ?lan_port= if not 80) or a full
+// ?lan_url=ws://esp.local/ws/control. When a dashboard calling
+// /api/register or redeeming a claim looks like it is on that network (same
+// public IP as the device, or a private address in the device's subnet),
+// the response carries local_ws_url so it can skip the relay. Only private,
+// link-local and .local addresses are accepted, and the URL is never shown
+// to callers elsewhere.
+
+// deviceLANURL works out dc's local WebSocket URL from its connect request;
+// "" if it didn't report one (or reported a public address).
+func deviceLANURL(r *http.Request, tunnel string) string {
+	q := r.URL.Query()
+	if v := strings.TrimSpace(q.Get("lan_url")); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || !lanHost(u.Hostname()) {
+			return ""
+		}
+		return u.String()
+	}
+	ip, err := netip.ParseAddr(strings.TrimSpace(q.Get("lan_ip")))
+	if err != nil || !lanAddr(ip) {
+		return ""
+	}
+	path := "/ws/control"
+	if name, ok := strings.CutPrefix(tunnel, "ws_"); ok && name != "" {
+		path = "/ws/" + name
+	} else if tunnel != "" {
+		return "" // no convention for this tunnel; use lan_url
+	}
+	host := ip.String()
+	if port, err := strconv.Atoi(q.Get("lan_port")); err == nil && port > 0 && port < 65536 && port != 80 {
+		host = net.JoinHostPort(host, strconv.Itoa(port))
+	} else if ip.Is6() {
+		host = "[" + host + "]"
+	}
+	return (&url.URL{Scheme: "ws", Host: host, Path: path}).String()
+}
+
+func lanAddr(ip netip.Addr) bool {
+	return ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
+
+func lanHost(host string) bool {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return lanAddr(ip)
+	}
+	return strings.HasSuffix(strings.ToLower(host), ".local")
+}
+
+// localWSURL returns dc's LAN URL if the caller of r appears to share its
+// network.
+func (dc *deviceConn) localWSURL(r *http.Request) string {
+	if dc == nil || dc.lanURL == "" {
+		return ""
+	}
+	caller, err := netip.ParseAddr(clientIP(r))
+	if err != nil {
+		return ""
+	}
+	caller = caller.Unmap()
+	if dev, err := netip.ParseAddr(dc.remoteIP); err == nil && dev.Unmap() == caller {
+		return dc.lanURL
+	}
+	// A relay on the LAN itself sees private addresses; compare subnets.
+	if u, err := url.Parse(dc.lanURL); err == nil && lanAddr(caller) {
+		if lan, err := netip.ParseAddr(u.Hostname()); err == nil {
+			bits := 24
+			if lan.Is6() {
+				bits = 64
+			}
+			if p, err := lan.Unmap().Prefix(bits); err == nil && p.Contains(caller) {
+				return dc.lanURL
+			}
+		}
+	}
+	return ""
+}
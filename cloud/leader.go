@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// leaderElector decides which node speaks for the whole cluster. Every node
+// serves traffic and runs its background jobs (runNodeJob) over its own
+// state: claims, uptime history, staged files. Only the registry is
+// cluster-wide, so only the leader lists registered devices in its offline
+// digest (digest.go).
+type leaderElector interface {
+	// Run campaigns for (and renews) leadership until ctx is done.
+	Run(ctx context.Context)
+	IsLeader() bool
+}
+
+// newLeaderElector picks an elector from LEADER_ELECTION ("", "none" or "k8s").
+func newLeaderElector(s *server) (leaderElector, error) {
+	switch mode := strings.ToLower(envOr("LEADER_ELECTION", "none")); mode {
+	case "none", "local":
+		return localElector{}, nil
+	case "k8s", "kubernetes":
+		return newK8sLeaseElector(s)
+	default:
+		return nil, fmt.Errorf("unknown LEADER_ELECTION %q", mode)
+	}
+}
+
+// localElector is used on single-node deployments: this node always leads.
+type localElector struct{}
+
+func (localElector) Run(ctx context.Context) { <-ctx.Done() }
+func (localElector) IsLeader() bool          { return true }
+
+// nodeName names this node when it is one of several (its lease identity);
+// "" on a single node.
+func (s *server) nodeName() string {
+	if e, ok := s.leader.(*k8sLeaseElector); ok {
+		return e.identity
+	}
+	return ""
+}
+
+// k8sLeaseElector implements lease-based election on a coordination.k8s.io/v1
+// Lease object using the pod's service account. It talks to the API server
+// directly so the relay doesn't pull in client-go.
+type k8sLeaseElector struct {
+	s         *server
+	client    *http.Client
+	apiURL    string // .../namespaces/{ns}/leases
+	name      string
+	identity  string
+	tokenPath string
+
+	leaseDuration time.Duration
+	retryPeriod   time.Duration
+
+	leader atomic.Bool
+}
+
+const k8sServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+func newK8sLeaseElector(s *server) (*k8sLeaseElector, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("LEADER_ELECTION=k8s requires running in-cluster")
+	}
+	ns := envOr("POD_NAMESPACE", "")
+	if ns == "" {
+		b, err := os.ReadFile(k8sServiceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("read namespace: %w", err)
+		}
+		ns = strings.TrimSpace(string(b))
+	}
+	ca, err := os.ReadFile(k8sServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("read ca.crt: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("invalid service account ca.crt")
+	}
+	identity := envOr("POD_NAME", "")
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+	leaseDuration := envDuration("LEADER_LEASE_DURATION", 15*time.Second)
+	return &k8sLeaseElector{
+		s: s,
+		client: &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		apiURL:        "https://" + net.JoinHostPort(host, port) + "/apis/coordination.k8s.io/v1/namespaces/" + ns + "/leases",
+		name:          envOr("LEADER_LEASE_NAME", "espwifi-cloud"),
+		identity:      identity,
+		tokenPath:     k8sServiceAccountDir + "/token",
+		leaseDuration: leaseDuration,
+		retryPeriod:   leaseDuration / 3,
+	}, nil
+}
+
+func (e *k8sLeaseElector) IsLeader() bool { return e.leader.Load() }
+
+func (e *k8sLeaseElector) Run(ctx context.Context) {
+	t := time.NewTicker(e.retryPeriod)
+	defer t.Stop()
+	for {
+		ok, err := e.tryAcquireOrRenew(ctx)
+		if err != nil {
+			e.s.logf(logDebug, "leader_lease_error", "lease", e.name, "err", err.Error())
+		}
+		if was := e.leader.Swap(ok); was != ok {
+			e.s.logf(logInfo, "leader_changed", "lease", e.name, "identity", e.identity, "leader", ok)
+		}
+		select {
+		case <-ctx.Done():
+			if e.leader.Load() {
+				e.release()
+			}
+			return
+		case <-t.C:
+		}
+	}
+}
+
+type k8sLease struct {
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Metadata   map[string]any `json:"metadata"`
+	Spec       k8sLeaseSpec   `json:"spec"`
+}
+
+type k8sLeaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+// k8sMicroTime is the metav1.MicroTime wire format.
+const k8sMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+func (e *k8sLeaseElector) tryAcquireOrRenew(ctx context.Context) (bool, error) {
+	now := time.Now().UTC()
+	cur, status, err := e.get(ctx)
+	if err != nil {
+		return false, err
+	}
+	if status == http.StatusNotFound {
+		lease := k8sLease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   map[string]any{"name": e.name},
+			Spec:       e.spec(now, now, 0),
+		}
+		return e.write(ctx, http.MethodPost, e.apiURL, lease)
+	}
+
+	spec := cur.Spec
+	if spec.HolderIdentity != e.identity {
+		renewed, _ := time.Parse(k8sMicroTime, spec.RenewTime)
+		expiry := renewed.Add(time.Duration(spec.LeaseDurationSeconds) * time.Second)
+		if spec.HolderIdentity != "" && now.Before(expiry) {
+			return false, nil
+		}
+		cur.Spec = e.spec(now, now, spec.LeaseTransitions+1)
+	} else {
+		acquired, err := time.Parse(k8sMicroTime, spec.AcquireTime)
+		if err != nil {
+			acquired = now
+		}
+		cur.Spec = e.spec(acquired, now, spec.LeaseTransitions)
+	}
+	// The resourceVersion carried in metadata makes this a compare-and-swap:
+	// a concurrent writer gets 409 Conflict and stays a follower.
+	return e.write(ctx, http.MethodPut, e.apiURL+"/"+e.name, *cur)
+}
+
+func (e *k8sLeaseElector) spec(acquired, renewed time.Time, transitions int) k8sLeaseSpec {
+	return k8sLeaseSpec{
+		HolderIdentity:       e.identity,
+		LeaseDurationSeconds: int(e.leaseDuration / time.Second),
+		AcquireTime:          acquired.Format(k8sMicroTime),
+		RenewTime:            renewed.Format(k8sMicroTime),
+		LeaseTransitions:     transitions,
+	}
+}
+
+// release hands the lease back on shutdown so a peer can take over without
+// waiting for it to expire.
+func (e *k8sLeaseElector) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	cur, status, err := e.get(ctx)
+	if err != nil || status != http.StatusOK || cur.Spec.HolderIdentity != e.identity {
+		return
+	}
+	cur.Spec.HolderIdentity = ""
+	cur.Spec.RenewTime = ""
+	_, _ = e.write(ctx, http.MethodPut, e.apiURL+"/"+e.name, *cur)
+	e.leader.Store(false)
+}
+
+func (e *k8sLeaseElector) get(ctx context.Context) (*k8sLease, int, error) {
+	resp, err := e.do(ctx, http.MethodGet, e.apiURL+"/"+e.name, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, resp.StatusCode, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, fmt.Errorf("get lease: %s", resp.Status)
+	}
+	var lease k8sLease
+	if err := json.NewDecoder(resp.Body).Decode(&lease); err != nil {
+		return nil, resp.StatusCode, err
+	}
+	return &lease, resp.StatusCode, nil
+}
+
+func (e *k8sLeaseElector) write(ctx context.Context, method, url string, lease k8sLease) (bool, error) {
+	resp, err := e.do(ctx, method, url, mustJSON(lease))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	default:
+		return false, fmt.Errorf("%s lease: %s", strings.ToLower(method), resp.Status)
+	}
+}
+
+func (e *k8sLeaseElector) do(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	token, err := os.ReadFile(e.tokenPath) // re-read: projected tokens rotate
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return e.client.Do(req)
+}
+
+// runNodeJob calls fn every interval on this node, leader or not.
+func (s *server) runNodeJob(ctx context.Context, name string, every time.Duration, fn func(now time.Time)) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			s.logf(logDebug, "job_run", "job", name)
+			fn(now)
+		}
+	}
+}
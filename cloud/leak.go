@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// connAccounting tracks live connection objects and goroutines independently
+// of the hub. The leak watchdog compares the two views: a session the hub has
+// forgotten but whose handler or reader goroutine is still running is a leak.
+type connAccounting struct {
+	deviceConns   atomic.Int64 // device handlers between upgrade and return
+	deviceReaders atomic.Int64 // device read-loop goroutines
+	uiConns       atomic.Int64 // UI handlers between upgrade and return
+	// UIs bridged to a peer region (federation.go). The hub never sees them,
+	// so they are counted apart from uiConns and left out of the comparison.
+	federatedUIs atomic.Int64
+
+	// Last computed discrepancies (tracked minus hub view), for metrics.
+	leakedDevices atomic.Int64
+	leakedReaders atomic.Int64
+	leakedUIs     atomic.Int64
+	goroutines    atomic.Int64
+}
+
+func (h *hub) uiCount() int {
+	n := 0
+	for _, e := range h.entries() {
+		dc := e.dc
+		dc.uiMu.Lock()
+		n += len(dc.uiConns)
+		dc.uiMu.Unlock()
+	}
+	return n
+}
+
+// runLeakWatchdog periodically reconciles connAccounting against the hub.
+// Connects and disconnects are briefly out of sync, so a discrepancy is only
+// reported once it has persisted across two consecutive checks.
+func (s *server) runLeakWatchdog(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	var prevDevices, prevReaders, prevUIs int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		hubDevices := int64(s.h.count())
+		hubUIs := int64(s.h.uiCount())
+		devices := s.acct.deviceConns.Load() - hubDevices
+		readers := s.acct.deviceReaders.Load() - hubDevices
+		uis := s.acct.uiConns.Load() - hubUIs
+
+		s.acct.leakedDevices.Store(persistent(prevDevices, devices))
+		s.acct.leakedReaders.Store(persistent(prevReaders, readers))
+		s.acct.leakedUIs.Store(persistent(prevUIs, uis))
+		s.acct.goroutines.Store(int64(runtime.NumGoroutine()))
+		prevDevices, prevReaders, prevUIs = devices, readers, uis
+
+		if s.acct.leakedDevices.Load() != 0 || s.acct.leakedReaders.Load() != 0 || s.acct.leakedUIs.Load() != 0 {
+			s.logf(logInfo, "leak_suspected",
+				"hub_devices", hubDevices,
+				"device_handlers", s.acct.deviceConns.Load(),
+				"device_readers", s.acct.deviceReaders.Load(),
+				"hub_uis", hubUIs,
+				"ui_handlers", s.acct.uiConns.Load(),
+				"goroutines", s.acct.goroutines.Load(),
+			)
+		}
+	}
+}
+
+// persistent returns the smaller-magnitude of two consecutive discrepancies
+// with the same sign, or 0 if the discrepancy didn't persist.
+func persistent(prev, cur int64) int64 {
+	switch {
+	case prev > 0 && cur > 0:
+		return min(prev, cur)
+	case prev < 0 && cur < 0:
+		return max(prev, cur)
+	default:
+		return 0
+	}
+}
+
+func (s *server) registerLeakMetrics() {
+	s.metrics.newGaugeFunc("espwifi_goroutines", "Goroutines at the last leak check.", nil,
+		func(emit func(float64, ...string)) { emit(float64(s.acct.goroutines.Load())) })
+	s.metrics.newGaugeFunc("espwifi_conn_tracked", "Live connection handlers and reader goroutines by kind.", []string{"kind"},
+		func(emit func(float64, ...string)) {
+			emit(float64(s.acct.deviceConns.Load()), "device")
+			emit(float64(s.acct.deviceReaders.Load()), "device_reader")
+			emit(float64(s.acct.uiConns.Load()), "ui")
+			emit(float64(s.acct.federatedUIs.Load()), "ui_federated")
+		})
+	s.metrics.newGaugeFunc("espwifi_conn_leak", "Persistent difference between tracked connections and the hub's view (should be 0).", []string{"kind"},
+		func(emit func(float64, ...string)) {
+			emit(float64(s.acct.leakedDevices.Load()), "device")
+			emit(float64(s.acct.leakedReaders.Load()), "device_reader")
+			emit(float64(s.acct.leakedUIs.Load()), "ui")
+		})
+}
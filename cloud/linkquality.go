@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Link quality: every LINK_QUALITY_INTERVAL (10s; 0 disables) each UI on a
+// session is sent
+//
+//	{"type":"link_quality","rtt_ms":84.2,"last_seen_ms":1200,"missed_pongs":0,"quality":"good"}
+//
+// and one as soon as it attaches, so dashboards can show how healthy the
+// device's side of the tunnel is instead of leaving users to guess why
+// controls feel slow. rtt_ms is the round trip of the relay's last keepalive
+// ping (so it refreshes every DEVICE_PING_INTERVAL, and is absent until the
+// first pong); last_seen_ms is how long ago the relay last heard anything
+// from the device. The UI's own leg to the relay isn't included. quality is
+// "poor" once a pong is missed or rtt_ms reaches LINK_QUALITY_POOR_MS
+// (1000), "fair" from LINK_QUALITY_FAIR_MS (300), else "good". Terminal
+// (/ws/serial/) UIs aren't sent it.
+
+type linkQualityConfig struct {
+	interval   time.Duration
+	fair, poor time.Duration
+}
+
+func loadLinkQualityConfig() linkQualityConfig {
+	return linkQualityConfig{
+		interval: envDuration("LINK_QUALITY_INTERVAL", 10*time.Second),
+		fair:     time.Duration(envInt("LINK_QUALITY_FAIR_MS", 300)) * time.Millisecond,
+		poor:     time.Duration(envInt("LINK_QUALITY_POOR_MS", 1000)) * time.Millisecond,
+	}
+}
+
+type linkQualityMsg struct {
+	Type        string   `json:"type"`
+	RTTMs       *float64 `json:"rtt_ms,omitempty"`
+	LastSeenMs  int64    `json:"last_seen_ms"`
+	MissedPongs int      `json:"missed_pongs"`
+	Quality     string   `json:"quality"` // good | fair | poor
+}
+
+func (lc linkQualityConfig) message(dc *deviceConn, now time.Time) linkQualityMsg {
+	m := linkQualityMsg{
+		Type:        "link_quality",
+		LastSeenMs:  max(now.Sub(time.Unix(0, dc.lastSeen.Load())).Milliseconds(), 0),
+		MissedPongs: int(dc.missedPongs.Load()),
+		Quality:     "good",
+	}
+	rtt := time.Duration(dc.rtt.Load())
+	if rtt > 0 {
+		ms := math.Round(float64(rtt.Microseconds())/100) / 10
+		m.RTTMs = &ms
+	}
+	switch {
+	case m.MissedPongs > 0 || (lc.poor > 0 && rtt >= lc.poor):
+		m.Quality = "poor"
+	case lc.fair > 0 && rtt >= lc.fair:
+		m.Quality = "fair"
+	}
+	return m
+}
+
+// runLinkQuality sends link_quality to the UIs of every session. Each
+// session sends on its own goroutine, with writeUI's deadline, so a stalled
+// UI only delays its own session; a session still busy with the last tick
+// skips this one.
+func (s *server) runLinkQuality(ctx context.Context) {
+	lc := s.linkQuality
+	if lc.interval <= 0 {
+		return
+	}
+	t := time.NewTicker(lc.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			for _, e := range s.h.entries() {
+				dc := e.dc
+				dc.uiMu.Lock()
+				var uis []*websocket.Conn
+				for c, opts := range dc.uiConns {
+					if !opts.terminal {
+						uis = append(uis, c)
+					}
+				}
+				dc.uiMu.Unlock()
+				if len(uis) == 0 || !dc.linkQualityBusy.CompareAndSwap(false, true) {
+					continue
+				}
+				go func(msg []byte) {
+					defer dc.linkQualityBusy.Store(false)
+					dc.uiWriteMu.Lock()
+					defer dc.uiWriteMu.Unlock()
+					for _, c := range uis {
+						_ = dc.writeUI(c, websocket.TextMessage, msg)
+					}
+				}(mustJSON(lc.message(dc, now)))
+			}
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Per-device log level filter for log tunnels. Lines below the level are
+// dropped before they reach UIs (the server-side ring in logs.go still keeps
+// everything). With Forward set, the level is also sent to the device as
+// {"type":"log_level","level":"warn"} so it can stop producing those lines.
+//
+// Set via PUT /api/devices/{id}/log-level or, from a control-scope UI on a
+// log tunnel, {"type":"set_log_level","level":"warn","forward":true}.
+
+type deviceLogLevel int
+
+const (
+	devLogVerbose deviceLogLevel = iota
+	devLogDebug
+	devLogInfo
+	devLogWarn
+	devLogError
+)
+
+var deviceLogLevelNames = []string{"verbose", "debug", "info", "warn", "error"}
+
+func (l deviceLogLevel) String() string { return deviceLogLevelNames[l] }
+
+func parseDeviceLogLevel(s string) (deviceLogLevel, bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "verbose", "v", "trace":
+		return devLogVerbose, true
+	case "debug", "d":
+		return devLogDebug, true
+	case "info", "i":
+		return devLogInfo, true
+	case "warn", "warning", "w":
+		return devLogWarn, true
+	case "error", "e":
+		return devLogError, true
+	}
+	return devLogVerbose, false
+}
+
+// lineLevel guesses a log line's level from the ESP-IDF prefix
+// ("W (1234) wifi: ..."), a bracketed tag ("[DEBUG] ..."), or a JSON
+// "level" field. Lines it can't classify count as info.
+func lineLevel(line []byte) deviceLogLevel {
+	line = bytes.TrimLeft(line, " \t")
+	// Strip an ANSI colour prefix, as ESP-IDF emits with colours enabled.
+	if bytes.HasPrefix(line, []byte("\x1b[")) {
+		if i := bytes.IndexByte(line, 'm'); i > 0 {
+			line = line[i+1:]
+		}
+	}
+	if len(line) >= 2 && (line[1] == ' ' || line[1] == '(') {
+		if l, ok := parseDeviceLogLevel(string(line[:1])); ok {
+			return l
+		}
+	}
+	if len(line) > 2 && line[0] == '[' {
+		if i := bytes.IndexByte(line, ']'); i > 1 {
+			if l, ok := parseDeviceLogLevel(string(line[1:i])); ok {
+				return l
+			}
+		}
+	}
+	if len(line) > 2 && line[0] == '{' && bytes.Contains(line, []byte(`"level"`)) {
+		var v struct {
+			Level string `json:"level"`
+		}
+		if json.Unmarshal(line, &v) == nil {
+			if l, ok := parseDeviceLogLevel(v.Level); ok {
+				return l
+			}
+		}
+	}
+	return devLogInfo
+}
+
+// filterLogLines drops lines below min. ok is false when nothing is left;
+// msg is returned as-is when every line passes.
+func filterLogLines(msg []byte, min deviceLogLevel) (out []byte, dropped int, ok bool) {
+	if min == devLogVerbose {
+		return msg, 0, true
+	}
+	lines := bytes.Split(msg, []byte{'\n'})
+	kept := lines[:0:0]
+	for _, l := range lines {
+		if len(bytes.TrimSpace(l)) == 0 || lineLevel(l) >= min {
+			kept = append(kept, l)
+		} else {
+			dropped++
+		}
+	}
+	switch {
+	case dropped == 0:
+		return msg, 0, true
+	case len(bytes.TrimSpace(bytes.Join(kept, nil))) == 0:
+		return nil, dropped, false
+	}
+	return bytes.Join(kept, []byte{'\n'}), dropped, true
+}
+
+type logLevelSetting struct {
+	DeviceID  string    `json:"device_id"`
+	Level     string    `json:"level"`
+	Forward   bool      `json:"forward"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	level deviceLogLevel
+}
+
+type logLevelMsg struct {
+	Type  string `json:"type"`
+	Level string `json:"level"`
+}
+
+// setLogLevelRequest is both the PUT body and the UI control message.
+type setLogLevelRequest struct {
+	Type    string `json:"type,omitempty"`
+	Level   string `json:"level"`
+	Forward bool   `json:"forward,omitempty"`
+}
+
+type logLevelStore struct {
+	store *fileStore
+
+	mu       sync.Mutex
+	settings map[string]*logLevelSetting
+}
+
+const logLevelsDoc = "log_levels"
+
+func newLogLevelStore(store *fileStore) *logLevelStore {
+	return &logLevelStore{store: store, settings: make(map[string]*logLevelSetting)}
+}
+
+func (ls *logLevelStore) load() error {
+	var list []*logLevelSetting
+	if err := ls.store.load(logLevelsDoc, &list); err != nil {
+		return err
+	}
+	byID := make(map[string]*logLevelSetting, len(list))
+	for _, st := range list {
+		if st == nil || st.DeviceID == "" {
+			continue
+		}
+		if l, ok := parseDeviceLogLevel(st.Level); ok {
+			st.level = l
+			byID[st.DeviceID] = st
+		}
+	}
+	settings, moved, dropped := canonicalDeviceKeys(byID)
+	for id, st := range settings {
+		st.DeviceID = id
+	}
+	ls.store.noteLegacyIDs(logLevelsDoc, moved, dropped)
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.settings = settings
+	return nil
+}
+
+func (ls *logLevelStore) saveLocked() error {
+	list := make([]*logLevelSetting, 0, len(ls.settings))
+	for _, st := range ls.settings {
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DeviceID < list[j].DeviceID })
+	return ls.store.save(logLevelsDoc, list)
+}
+
+func (ls *logLevelStore) get(deviceID string) (logLevelSetting, bool) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	st, ok := ls.settings[deviceID]
+	if !ok {
+		return logLevelSetting{}, false
+	}
+	return *st, true
+}
+
+func (ls *logLevelStore) set(deviceID string, level deviceLogLevel, forward bool) (logLevelSetting, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	st := &logLevelSetting{DeviceID: deviceID, Level: level.String(), Forward: forward, UpdatedAt: time.Now().UTC(), level: level}
+	ls.settings[deviceID] = st
+	return *st, ls.saveLocked()
+}
+
+func (ls *logLevelStore) remove(deviceID string) (bool, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if _, ok := ls.settings[deviceID]; !ok {
+		return false, nil
+	}
+	delete(ls.settings, deviceID)
+	return true, ls.saveLocked()
+}
+
+// pushLogLevel sends the device's level to its live log tunnel sessions,
+// when the setting asks for that.
+func (s *server) pushLogLevel(deviceID string) {
+	st, ok := s.logLevels.get(deviceID)
+	if !ok || !st.Forward {
+		return
+	}
+	msg := mustJSON(logLevelMsg{Type: "log_level", Level: st.Level})
+	for _, dc := range s.h.sessionsFor(deviceID, nil) {
+		if _, tunnel := splitKey(dc.id); s.isLogTunnel(tunnel) {
+			_ = dc.writeDevice(websocket.TextMessage, msg)
+		}
+	}
+}
+
+// applyLogLevel validates and stores a level change from either the API or a
+// UI, then forwards it to the device if requested.
+func (s *server) applyLogLevel(deviceID string, req setLogLevelRequest) (logLevelSetting, bool, error) {
+	level, ok := parseDeviceLogLevel(req.Level)
+	if !ok {
+		return logLevelSetting{}, false, nil
+	}
+	st, err := s.logLevels.set(deviceID, level, req.Forward)
+	s.pushLogLevel(deviceID)
+	return st, true, err
+}
+
+// handleDeviceLogLevel manages a device's log level filter:
+//
+//	GET    /api/devices/{id}/log-level
+//	PUT    /api/devices/{id}/log-level  {"level":"warn","forward":true}
+//	DELETE /api/devices/{id}/log-level  forward everything again
+func (s *server) handleDeviceLogLevel(w http.ResponseWriter, r *http.Request, deviceID string) {
+	switch r.Method {
+	case http.MethodGet:
+		if !s.requireRole(w, r, roleViewer) {
+			return
+		}
+		st, ok := s.logLevels.get(deviceID)
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "log_level_not_set", "no log level set")
+			return
+		}
+		writeJSON(w, http.StatusOK, st)
+	case http.MethodPut:
+		if !s.requireRole(w, r, roleOperator) {
+			return
+		}
+		var req setLogLevelRequest
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeJSONDecodeError(w, err)
+			return
+		}
+		st, valid, err := s.applyLogLevel(deviceID, req)
+		if !valid {
+			writeAPIError(w, http.StatusBadRequest, "invalid_level", "level must be one of verbose, debug, info, warn, error")
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist log level")
+			return
+		}
+		writeJSON(w, http.StatusOK, st)
+		s.logf(logInfo, "device_log_level_set", "remote", clientIP(r), "device_id", deviceID, "level", st.Level, "forward", st.Forward)
+	case http.MethodDelete:
+		if !s.requireRole(w, r, roleOperator) {
+			return
+		}
+		removed, err := s.logLevels.remove(deviceID)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist log level")
+			return
+		}
+		if !removed {
+			writeAPIError(w, http.StatusNotFound, "log_level_not_set", "no log level set")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		s.logf(logInfo, "device_log_level_removed", "remote", clientIP(r), "device_id", deviceID)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// uiSetLogLevel handles a set_log_level control message from a UI on a log
+// tunnel. ok is false when msg isn't one.
+func (s *server) uiSetLogLevel(deviceID string, msg []byte) (reply []byte, ok bool) {
+	if !bytes.Contains(msg, []byte(`"set_log_level"`)) {
+		return nil, false
+	}
+	var req setLogLevelRequest
+	if json.Unmarshal(msg, &req) != nil || req.Type != "set_log_level" {
+		return nil, false
+	}
+	st, valid, err := s.applyLogLevel(deviceID, req)
+	if !valid {
+		return mustJSON(errorMsg{Type: "error", Code: "invalid_log_level", Message: "level must be one of verbose, debug, info, warn, error"}), true
+	}
+	if err != nil {
+		s.logf(logInfo, "device_log_level_save_failed", "device_id", deviceID, "err", err.Error())
+	}
+	s.logf(logInfo, "device_log_level_set", "device_id", deviceID, "level", st.Level, "forward", st.Forward, "via", "ui")
+	return mustJSON(logLevelMsg{Type: "log_level", Level: st.Level}), true
+}
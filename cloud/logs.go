@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log tunnels (LOG_TUNNELS, default "ws_logs") carry device log output. The
+// relay keeps the last LOG_RETAIN_BYTES of lines per device/tunnel, across
+// disconnects, for GET /api/devices/{id}/logs: the lines that matter are
+// usually the ones printed just before the device went away, when nobody was
+// watching.
+
+func (s *server) isLogTunnel(tunnel string) bool {
+	_, ok := s.logTunnels[tunnel]
+	return ok
+}
+
+type deviceLogs struct {
+	DeviceID string    `json:"device_id"`
+	Lines    []logLine `json:"lines"`
+}
+
+type logLine struct {
+	At     time.Time `json:"ts"`
+	Tunnel string    `json:"tunnel,omitempty"`
+	Line   string    `json:"line"`
+}
+
+// logRing is the retained log of one device/tunnel.
+type logRing struct {
+	mu    sync.Mutex
+	max   int
+	lines []logLine
+	size  int
+}
+
+func (lr *logRing) add(msg []byte, now time.Time) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	for _, l := range bytes.Split(msg, []byte{'\n'}) {
+		l = bytes.TrimRight(l, "\r")
+		if len(l) == 0 {
+			continue
+		}
+		lr.lines = append(lr.lines, logLine{At: now, Line: string(l)})
+		lr.size += len(l)
+	}
+	drop := 0
+	for lr.size > lr.max && drop < len(lr.lines)-1 {
+		lr.size -= len(lr.lines[drop].Line)
+		drop++
+	}
+	if drop > 0 {
+		lr.lines = append(lr.lines[:0:0], lr.lines[drop:]...)
+	}
+}
+
+// tail returns up to n of the most recent lines.
+func (lr *logRing) tail(n int) []logLine {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	if n > len(lr.lines) {
+		n = len(lr.lines)
+	}
+	return append([]logLine(nil), lr.lines[len(lr.lines)-n:]...)
+}
+
+func (lr *logRing) last() time.Time {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	if len(lr.lines) == 0 {
+		return time.Time{}
+	}
+	return lr.lines[len(lr.lines)-1].At
+}
+
+// logRings holds a ring per device key; rings are dropped after a week
+// without output.
+type logRings struct {
+	max int
+
+	mu    sync.Mutex
+	rings map[string]*logRing
+}
+
+func newLogRings(max int) *logRings {
+	if max < 1024 {
+		max = 1024
+	}
+	return &logRings{max: max, rings: make(map[string]*logRing)}
+}
+
+func (lrs *logRings) get(key string) *logRing {
+	lrs.mu.Lock()
+	defer lrs.mu.Unlock()
+	lr := lrs.rings[key]
+	if lr == nil {
+		now := time.Now()
+		for k, old := range lrs.rings {
+			if last := old.last(); !last.IsZero() && now.Sub(last) > 7*24*time.Hour {
+				delete(lrs.rings, k)
+			}
+		}
+		lr = &logRing{max: lrs.max}
+		lrs.rings[key] = lr
+	}
+	return lr
+}
+
+// forDevice returns the device's rings by tunnel.
+func (lrs *logRings) forDevice(deviceID string) map[string]*logRing {
+	lrs.mu.Lock()
+	defer lrs.mu.Unlock()
+	out := make(map[string]*logRing)
+	for k, lr := range lrs.rings {
+		if id, tunnel := splitKey(k); id == deviceID {
+			out[tunnel] = lr
+		}
+	}
+	return out
+}
+
+// handleDeviceLogs serves GET /api/devices/{id}/logs?lines=200[&tunnel=...]:
+// the newest retained log lines, oldest first, across all of the device's
+// log tunnels unless one is named.
+func (s *server) handleDeviceLogs(w http.ResponseWriter, r *http.Request, deviceID string) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.requireRole(w, r, roleViewer) {
+		return
+	}
+	n := 200
+	if v := r.URL.Query().Get("lines"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 1 || n > 10000 {
+			writeAPIError(w, http.StatusBadRequest, "invalid_lines", "lines must be 1-10000")
+			return
+		}
+	}
+	rings := s.logs.forDevice(deviceID)
+	tunnel, named := r.URL.Query().Get("tunnel"), r.URL.Query().Has("tunnel")
+	tunnel = strings.TrimSpace(tunnel)
+
+	lines := []logLine{}
+	for t, lr := range rings {
+		if named && t != tunnel {
+			continue
+		}
+		for _, l := range lr.tail(n) {
+			l.Tunnel = t
+			lines = append(lines, l)
+		}
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].At.Before(lines[j].At) })
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	writeJSON(w, http.StatusOK, deviceLogs{DeviceID: deviceID, Lines: lines})
+}
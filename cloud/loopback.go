@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The relay answers for a synthetic device, _echo, so firmware and
+// dashboard developers can exercise their WebSocket handling and measure
+// latency with no real device online. Both /ws/ui/_echo and
+// /ws/device/_echo reflect what they are sent:
+//
+//   - text comes back as {"type":"echo","seq":n,"data":<the message>,
+//     "relay_rx_ms":...,"relay_tx_ms":...}; data is the JSON value itself,
+//     or a string for non-JSON text. seq counts every message received on
+//     the connection, binary included.
+//   - binary comes back unchanged.
+//
+// ?delay=250 holds every reply for that many milliseconds (up to 5000) to
+// simulate a slow link. The connection starts with an echo_ready message.
+// Real devices can't register as _echo.
+
+const loopbackDeviceID = "_echo"
+
+type loopbackReadyMsg struct {
+	Type    string `json:"type"`
+	Side    string `json:"side"` // ui | device
+	DelayMs int    `json:"delay_ms"`
+}
+
+type loopbackEchoMsg struct {
+	Type      string          `json:"type"`
+	Seq       uint64          `json:"seq"`
+	Data      json.RawMessage `json:"data"`
+	RelayRxMs int64           `json:"relay_rx_ms"`
+	RelayTxMs int64           `json:"relay_tx_ms"`
+}
+
+// handleLoopbackWS serves _echo for side ("ui" or "device"), which picks
+// the credentials checked: the global UI or device token, when set.
+func (s *server) handleLoopbackWS(w http.ResponseWriter, r *http.Request, side string) {
+	token := s.uiAuthToken
+	if side == "device" {
+		token = s.deviceAuthToken
+	}
+	if token != "" && !authOK(r, token) {
+		s.rejectWS(w, r, http.StatusUnauthorized, wsCloseUnauthorized, "echo_ws_unauthorized",
+			"remote", clientIP(r), "side", side)
+		return
+	}
+	delay := 0
+	if v := r.URL.Query().Get("delay"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 5000 {
+			writeAPIError(w, http.StatusBadRequest, "invalid_delay", "delay must be 0-5000 (ms)")
+			return
+		}
+		delay = n
+	}
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(1 << 20)
+	s.logf(logInfo, "echo_ws_connected", "remote", clientIP(r), "side", side, "delay_ms", delay)
+
+	_ = conn.WriteMessage(websocket.TextMessage, mustJSON(loopbackReadyMsg{Type: "echo_ready", Side: side, DelayMs: delay}))
+	var seq uint64
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		mt, msg, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		rx := time.Now()
+		seq++
+		if delay > 0 {
+			time.Sleep(time.Duration(delay) * time.Millisecond)
+		}
+		if mt == websocket.TextMessage {
+			data := json.RawMessage(msg)
+			if !json.Valid(msg) {
+				data = mustJSON(string(msg))
+			}
+			msg = mustJSON(loopbackEchoMsg{Type: "echo", Seq: seq, Data: data,
+				RelayRxMs: rx.UnixMilli(), RelayTxMs: time.Now().UnixMilli()})
+		}
+		if err := conn.WriteMessage(mt, msg); err != nil {
+			break
+		}
+	}
+	s.logf(logInfo, "echo_ws_closed", "remote", clientIP(r), "side", side, "messages", seq)
+}
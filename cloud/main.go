@@ -7,11 +7,15 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -29,6 +33,13 @@ const (
 	logDebug
 )
 
+func (l logLevel) String() string {
+	if l == logDebug {
+		return "debug"
+	}
+	return "info"
+}
+
 func parseLogLevel(s string) logLevel {
 	switch strings.ToLower(strings.TrimSpace(s)) {
 	case "debug":
@@ -39,84 +50,141 @@ func parseLogLevel(s string) logLevel {
 }
 
 type deviceInfo struct {
-	DeviceID   string    `json:"device_id"`
-	TunnelKey  string    `json:"tunnel,omitempty"`
-	Connected  bool      `json:"connected"`
+	DeviceID    string    `json:"device_id"`
+	TunnelKey   string    `json:"tunnel,omitempty"`
+	Connected   bool      `json:"connected"`
 	ConnectedAt time.Time `json:"connected_at,omitempty"`
-	LastSeen   time.Time `json:"last_seen,omitempty"`
-	UIWSURL    string    `json:"ui_ws_url"`
-	DeviceWSURL string   `json:"device_ws_url"`
-}
-
-type hub struct {
-	mu      sync.Mutex
-	devices map[string]*deviceConn
+	LastSeen    time.Time `json:"last_seen,omitempty"`
+	UIWSURL     string    `json:"ui_ws_url"`
+	DeviceWSURL string    `json:"device_ws_url"`
+
+	// Live session detail; zero for devices that aren't connected.
+	UIClients       int       `json:"ui_clients"`
+	BytesFromDevice uint64    `json:"bytes_from_device"`
+	BytesToDevice   uint64    `json:"bytes_to_device"`
+	Compression     bool      `json:"compression"`
+	LastMessageAt   time.Time `json:"last_message_at,omitempty"`
+	// Seconds since the last application message in either direction
+	// (pings/pongs don't count), so "connected but silent" stands out.
+	SilentFor float64 `json:"silent_for_s"`
+	// The device missed its last pong; it is dropped after
+	// DEVICE_PONG_MISSES (keepalive.go).
+	Stale       bool `json:"stale"`
+	MissedPongs int  `json:"missed_pongs,omitempty"`
+	// Connected before the last restart and not back yet (warmstate.go).
+	ReconnectExpected bool `json:"reconnect_expected,omitempty"`
+	// What the device declared when connecting, merged across its tunnels
+	// (capabilities.go).
+	Capabilities map[string]any `json:"capabilities,omitempty"`
+	// Set while the device is intentionally offline (maintenance.go).
+	Maintenance *maintenanceWindow `json:"maintenance,omitempty"`
+	// The device's direct LAN URL, for callers on its network (lanpath.go).
+	LocalWSURL string `json:"local_ws_url,omitempty"`
+	// The relay holding the session, when federated (federation.go).
+	Region string `json:"region,omitempty"`
 }
 
 type deviceConn struct {
-	id         string
-	ws         *websocket.Conn
+	id          string
+	ws          deviceSocket
 	connectedAt time.Time
-	lastSeen   atomic.Int64 // unix nanos
+	lastSeen    atomic.Int64 // unix nanos
+	// Last application message (not ping/pong) in either direction, unix nanos.
+	lastMessage atomic.Int64
+
+	bytesFromDevice atomic.Uint64
+	bytesToDevice   atomic.Uint64
+	compression     bool // permessage-deflate negotiated with the device
 
 	// Gorilla websocket requires all writes to be serialized per connection.
 	writeMu sync.Mutex
 
 	// Paired UI websocket. Only one at a time for now.
-	uiMu sync.Mutex
-	uiConns   map[*websocket.Conn]struct{}
+	uiMu      sync.Mutex
+	uiConns   map[*websocket.Conn]uiOptions
 	uiWriteMu sync.Mutex // serializes writes across all UI conns
+	// UI_WRITE_TIMEOUT: deadline for each write to a UI (writeUI).
+	uiWriteTimeout time.Duration
 
 	// Device-provided auth token (used to authorize UI connections).
 	// Typically this is the device's auth.token so the UI can connect securely.
+	// It belongs to this device_id|tunnel session only: UIs on other tunnels
+	// are checked against their own session's token.
 	uiToken string
+	// ?token_scope=tunnel: uiToken only opens UIs on this tunnel and is never
+	// accepted as the device's own credential (deviceRequestAuthorized), so a
+	// weak, shareable token (a camera tunnel's) can't stand in for the device.
+	tunnelToken bool
+	// Optional second token granting read-only (view) access; see uiscope.go.
+	viewToken string
+
+	// Suppresses repeated UI->device messages; nil when DEDUP_WINDOW is 0.
+	dedup *dedupWindow
+	// Binary frames carry a type/flags header (?frame_tags=1); see frames.go.
+	frameTags bool
+	// Declared at connect; nil if the device didn't. Read-only.
+	capabilities map[string]any
+	// The registry key the device presented, kept only to pass along to an
+	// upstream relay (upstream.go).
+	deviceKey string
+	// Where the device connected from, and its own LAN URL if it reported
+	// one (lanpath.go).
+	remoteIP string
+	lanURL   string
+	// UI sessions attached (terminals included), and the cap the device asked
+	// for with ?max_ui= (0: none); see uilimit.go.
+	uiSlots atomic.Int32
+	maxUI   int
+	// Shared UI->device token bucket; nil when unlimited (ratelimit.go).
+	cmdBucket *tokenBucket
+	// TUNNEL_LIMITS for each direction; nil when unlimited (tunnellimits.go).
+	deviceLimit, uiLimit *flowLimiter
+	// A ping is awaiting its pong, and how many in a row went unanswered;
+	// see keepalive.go.
+	pingPending atomic.Bool
+	missedPongs atomic.Int32
+	// When the pending ping was sent, and the last measured round trip, in
+	// nanoseconds (0: none yet); see linkquality.go.
+	pingSentAt atomic.Int64
+	rtt        atomic.Int64
+	// A link_quality send to the UIs is still under way.
+	linkQualityBusy atomic.Bool
+	// The bandwidth test running on this session, if any (bwtest.go).
+	bwtest atomic.Pointer[bwtestRun]
+	// UIs the device is keeping off the session, if any (uikick.go).
+	kickHold atomic.Pointer[uiKickHold]
+	// Why the session ended, once it has; see disconnects.go.
+	endReason atomic.Pointer[string]
 
 	// Closed when device is torn down.
 	closed chan struct{}
 }
 
-func newHub() *hub {
-	return &hub{devices: make(map[string]*deviceConn)}
-}
-
-func (h *hub) setDevice(id string, dc *deviceConn) (old *deviceConn) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	old = h.devices[id]
-	h.devices[id] = dc
-	return old
-}
-
-func (h *hub) getDevice(id string) *deviceConn {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	return h.devices[id]
-}
-
-func (h *hub) deleteDevice(id string, dc *deviceConn) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	if cur, ok := h.devices[id]; ok && cur == dc {
-		delete(h.devices, id)
-	}
-}
-
-func (h *hub) snapshot(publicBase string) []deviceInfo {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	out := make([]deviceInfo, 0, len(h.devices))
+// snapshot lists connected sessions; baseFor returns the public ws base URL
+// for a device.
+func (h *hub) snapshot(baseFor func(deviceID string) string) []deviceInfo {
+	entries := h.entries()
+	out := make([]deviceInfo, 0, len(entries))
 	now := time.Now()
-	_ = now
-	for key, dc := range h.devices {
+	var decls map[string][]capabilityDecl
+	for _, e := range entries {
+		if e.dc.capabilities != nil {
+			if decls == nil {
+				decls = make(map[string][]capabilityDecl)
+			}
+			devID, tunnel := splitKey(e.key)
+			decls[devID] = append(decls[devID], capabilityDecl{tunnel, e.dc.capabilities})
+		}
+	}
+	for _, e := range entries {
+		key, dc := e.key, e.dc
 		devID, tunnel := splitKey(key)
 		last := time.Unix(0, dc.lastSeen.Load())
-		ui := strings.TrimRight(publicBase, "/") + "/ws/ui/" + devID
-		dev := strings.TrimRight(publicBase, "/") + "/ws/device/" + devID
-		if tunnel != "" {
-			ui += "?tunnel=" + urlQueryEscape(tunnel)
-			dev += "?tunnel=" + urlQueryEscape(tunnel)
-		}
+		lastMsg := time.Unix(0, dc.lastMessage.Load())
+		dc.uiMu.Lock()
+		uiClients := len(dc.uiConns)
+		dc.uiMu.Unlock()
+		ui, dev := wsURLs(baseFor(devID), devID, tunnel)
 		out = append(out, deviceInfo{
 			DeviceID:    devID,
 			TunnelKey:   tunnel,
@@ -125,6 +193,16 @@ func (h *hub) snapshot(publicBase string) []deviceInfo {
 			LastSeen:    last,
 			UIWSURL:     ui,
 			DeviceWSURL: dev,
+
+			UIClients:       uiClients,
+			BytesFromDevice: dc.bytesFromDevice.Load(),
+			BytesToDevice:   dc.bytesToDevice.Load(),
+			Compression:     dc.compression,
+			LastMessageAt:   lastMsg,
+			SilentFor:       now.Sub(lastMsg).Seconds(),
+			Stale:           dc.missedPongs.Load() > 0,
+			MissedPongs:     int(dc.missedPongs.Load()),
+			Capabilities:    mergeCapabilities(decls[devID]),
 		})
 	}
 	return out
@@ -140,86 +218,746 @@ type server struct {
 	deviceAuthToken string
 	uiAuthToken     string
 
+	// Always grants the admin role; API keys (rbac.go) grant finer roles.
+	adminAuthToken string
+	apiKeys        *apiKeyStore
+
+	startedAt time.Time
+
 	// If set, used to build public URLs; otherwise inferred from request headers.
 	publicBaseURL string
+	// DEVICE_DOMAIN: devices are also reachable as {id}.<deviceDomain>.
+	deviceDomain string
 
-	upgrader websocket.Upgrader
+	// UI, terminal and admin sockets, and device sockets; see upgrade.go.
+	upgrader       websocket.Upgrader
+	deviceUpgrader websocket.Upgrader
 
 	logLevel   logLevel
 	logHealthz bool
+	// Live subscribers to the relay's own log events (/ws/admin/logs).
+	logTail *logTail
+	// How often /ws/admin/devices diffs the device list.
+	deviceWatchInterval time.Duration
+	deviceWatch         deviceWatch
+
+	// Set on SIGTERM; /readyz fails and new device sessions are refused so the
+	// load balancer moves traffic elsewhere before we shut down.
+	draining   atomic.Bool
+	drainDelay time.Duration
+	ready      readiness
 
 	// Claim codes: short-lived one-time codes used to exchange for the device's
 	// long auth token (so iOS users can pair without handling the token in BLE tools).
-	claimMu sync.Mutex
-	claims  map[string]claimEntry
+	claimMu     sync.Mutex
+	claims      map[string]claimEntry
+	claimsDirty chan struct{} // runClaimSaver writes claims.json
+
+	// Sessions from before the last restart that haven't reconnected yet.
+	reconnects    reconnectWatch
+	restartNotice restartNotice
+	uptime        *uptimeTracker
+	maintenance   *maintenanceStore
+	federation    *federation
+	digestCfg     digestConfig
+	digest        digestState
+	reconnectHint reconnectHint
+
+	// WS_QUERY_STRICT and its counters; see wsquery.go.
+	wsQueryStrict   bool
+	wsQueryRejected *counterVec
+	wsQueryUnknown  *counterVec
+
+	// Why device sessions ended (disconnects.go).
+	disconnects      *disconnectStats
+	disconnectsTotal *counterVec
+
+	// Set on a relay that re-exports its devices upstream; and the token
+	// downstream relays present on /ws/upstream (upstream.go).
+	upstream          *upstreamLink
+	upstreamAuthToken string
+	upstreamDevices   []string // UPSTREAM_DEVICES globs, lowercase
+
+	// Stored bandwidth test results and tests in flight (bwtest.go).
+	bwtests       *bwtestStore
+	bwtestRunning atomic.Int32
+
+	// Set in -conformance mode: device connections are tested, not relayed
+	// (conformance.go).
+	conformance *conformanceSuite
+	// Devices with debug logging switched on (devdebug.go).
+	debug *debugSet
+
+	announceExtra   map[string]json.RawMessage
+	announceDefault bool
+
+	// Picks the node whose digest lists registered devices (leader.go).
+	leader leaderElector
+
+	metrics          *metricsRegistry
+	metricsAuthToken string
+
+	// Per-node device session limit (0 = unlimited) and what to do when full.
+	maxDevices       int
+	capacityPolicy   capacityPolicy
+	capacityRetry    time.Duration
+	capacityRejected *counterVec
+	capacityEvicted  *counterVec
+
+	// Memory watchdog; while shedding, media tunnels are refused and their
+	// frames dropped.
+	mem            *memoryWatchdog
+	mediaTunnels   map[string]struct{}
+	memShedFrames  *counterVec
+	memShedTunnels *counterVec
+	// MEDIA_MAX_LAG: UIs further behind get only the newest frame; see
+	// devicesession.go.
+	mediaMaxLag        time.Duration
+	mediaFramesSkipped *counterVec
+	// FORWARD_QUEUE: each session's outbox toward its UIs (forwarder.go).
+	forwardQueueMax int
+	forwardDropped  *counterVec
+	uiWriteTimeout  time.Duration
+	// Overload shedding levels (overload.go).
+	shed         *loadShedder
+	shedMessages *counterVec
+
+	// Serial-console tunnels and their retained scrollback (serial.go).
+	serialTunnels   map[string]struct{}
+	serial          *serialConsoles
+	serialLineFlush time.Duration
+	crashes         *crashStore
+	// Log tunnels and their retained lines (logs.go).
+	logTunnels       map[string]struct{}
+	logs             *logRings
+	logLevels        *logLevelStore
+	logLinesFiltered *counterVec
+
+	acct connAccounting
+
+	// Persistent per-device credentials. With requireDeviceKeys, devices
+	// without a registry key are refused outright.
+	store             *fileStore
+	registry          *deviceRegistry
+	requireDeviceKeys bool
+
+	// Tenants may override PUBLIC_BASE_URL for their devices.
+	tenants *tenantStore
+	// Pending ownership transfer codes (transfer.go).
+	transfers *transferCodes
+	// Guest share links (shares.go).
+	shares *shareStore
+
+	msgSize    *histogramVec
+	fwdLatency *histogramVec
+
+	// DEDUP_WINDOW: drop identical UI->device messages within this window.
+	dedupWindow time.Duration
+	// Per-tunnel JSON Schemas for UI->device commands.
+	schemas        *schemaStore
+	schemaRejected *counterVec
+
+	// Block/redact rules for text messages; see filters.go.
+	filters  *filterStore
+	filtered *counterVec
+
+	framePolicies map[byte]framePolicy
+	// Frames recorded under RECORD_DIR (recording.go); nil if no policy records.
+	recorder *frameRecorder
+	// CHUNK_MAX_BYTES: largest reassembled chunked message; see chunks.go.
+	chunkMaxBytes int
+	// Uploads to devices and the staging area for device pushes (files.go).
+	files          *fileManager
+	framesReceived *counterVec
+	framesDropped  *counterVec
+	// DELTA_FULL_EVERY: full snapshot interval for ?delta=1 UIs.
+	deltaFullEvery       int
+	duplicatesSuppressed *counterVec
+	readOnlyDropped      *counterVec
+	// P2P_ICE_SERVERS; empty disables the direct upgrade (p2p.go).
+	iceServers       []string
+	p2pEstablished   *counterVec
+	p2pFramesSkipped *counterVec
+	oversizeSkipped  *counterVec
+	// MAX_UI_PER_DEVICE / MAX_UI_PER_TUNNEL; see uilimit.go.
+	maxUIPerDevice  int
+	maxUIPerTunnel  map[string]int
+	uiLimitRejected *counterVec
+	// DEVICE_ENGINE=epoll; nil for the default engine (engine.go).
+	poller *devicePoller
+	// DEVICE_PING_INTERVAL / DEVICE_PONG_MISSES / DEVICE_PONG_GRACE.
+	keepalive keepaliveConfig
+	// link_quality messages to UIs; see linkquality.go.
+	linkQuality linkQualityConfig
+	// UI_KICK_MAX_HOLD; see uikick.go.
+	uiKickMaxHold time.Duration
+	// UIs held until their device connects (?wait=); see waitroom.go.
+	waitRoom *waitRoom
+	// Wake on demand for sleeping devices; see wake.go.
+	wake *wakeManager
+	// Hot-standby pairing; nil unless HA_ROLE is set (ha.go).
+	ha *haPair
+	// UI_CMD_RATE; see ratelimit.go.
+	uiCmdRates       map[string]rateSpec
+	uiCmdRateLimited *counterVec
+	// TUNNEL_LIMITS: message/byte rates per tunnel, both directions.
+	tunnelLimits      map[string]tunnelLimit
+	tunnelRateLimited *counterVec
+	// Command audit trail; see audit.go. nil with AUDIT=off.
+	auditLog     *auditLog
+	auditDropped *counterVec
+
+	// Time-derived claim codes (see claim_totp.go).
+	totp *totpClaims
+	// Limits on codes devices ask for with POST /api/claims (claims.go).
+	claimMaxTTL  time.Duration
+	claimMaxUses int
+	// CLAIM_APPROVAL: redemptions wait for the owner (claimapproval.go).
+	claimApprovals *claimApprovals
+	// CLAIM_BIND: released tokens stay with their redeemer for a while
+	// (claimbind.go).
+	claimBinds *claimBindings
+	// Email/SMS providers for claim links (claimdelivery.go).
+	claimDelivery claimDelivery
 }
 
 type claimEntry struct {
-	DeviceID   string
-	TunnelKey  string
-	Token      string
-	ExpiresAt  time.Time
-	Registered time.Time
+	// ID names the code where the code itself must not appear, e.g. in the
+	// labels of the shares it mints. Codes saved before IDs have none.
+	ID         string    `json:"id,omitempty"`
+	DeviceID   string    `json:"device_id"`
+	TunnelKey  string    `json:"tunnel,omitempty"`
+	Token      string    `json:"token"`
+	ViewToken  string    `json:"view_token,omitempty"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Registered time.Time `json:"registered"`
+	// Multi-use codes (claims.go): redemptions so far, out of MaxUses.
+	MaxUses int `json:"max_uses,omitempty"`
+	Uses    int `json:"uses,omitempty"`
+	// Times the code was sent to someone (claimdelivery.go).
+	Sent int `json:"sent,omitempty"`
 }
 
 func main() {
 	var (
-		listenAddr = flag.String("listen", envOr("LISTEN_ADDR", ":8080"), "listen address")
-		publicBase = flag.String("public-base-url", envOr("PUBLIC_BASE_URL", ""), "public base URL used to generate ws URLs (e.g. https://tunnel.example.com)")
+		listenAddr  = flag.String("listen", envOr("LISTEN_ADDR", ":8080"), "listen address")
+		publicBase  = flag.String("public-base-url", envOr("PUBLIC_BASE_URL", ""), "public base URL used to generate ws URLs (e.g. https://tunnel.example.com)")
+		conformance = flag.Bool("conformance", envOr("CONFORMANCE", "0") == "1", "run protocol conformance cases against connecting devices instead of relaying them")
 	)
 	flag.Parse()
 
+	memSoftLimit, err := parseByteSize(envOr("MEMORY_SOFT_LIMIT", ""))
+	if err != nil {
+		log.Fatalf("MEMORY_SOFT_LIMIT: %v", err)
+	}
+	reconnect, err := loadReconnectHint()
+	if err != nil {
+		log.Fatal(err)
+	}
+	announceExtra, err := parseAnnounceExtra(envOr("ANNOUNCE_EXTRA", ""))
+	if err != nil {
+		log.Fatal(err)
+	}
+	digestCfg, err := loadDigestConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	federation, err := loadFederation()
+	if err != nil {
+		log.Fatal(err)
+	}
+	framePolicies, err := parseFramePolicies(envOr("FRAME_POLICIES", ""))
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err := newFileStore(envOr("DATA_DIR", ""))
+	if err != nil {
+		log.Fatalf("DATA_DIR: %v", err)
+	}
+	fileMaxBytes, err := parseByteSize(envOr("FILE_MAX_BYTES", "256MiB"))
+	if err != nil {
+		log.Fatalf("FILE_MAX_BYTES: %v", err)
+	}
+	fileStagingMax, err := parseByteSize(envOr("FILE_STAGING_MAX_BYTES", "2GiB"))
+	if err != nil {
+		log.Fatalf("FILE_STAGING_MAX_BYTES: %v", err)
+	}
+	stagingDir := envOr("FILE_STAGING_DIR", "")
+	if stagingDir == "" && store.enabled() {
+		stagingDir = filepath.Join(store.dir, "files")
+	}
+	maxUIPerTunnel, err := parseTunnelLimits("MAX_UI_PER_TUNNEL", envOr("MAX_UI_PER_TUNNEL", ""))
+	if err != nil {
+		log.Fatal(err)
+	}
+	tunnelLimits, err := parseTunnelRates(envOr("TUNNEL_LIMITS", ""))
+	if err != nil {
+		log.Fatal(err)
+	}
+	claimBinds, err := parseClaimBindings(os.Getenv("CLAIM_BIND"), envDuration("CLAIM_BIND_WINDOW", 15*time.Minute))
+	if err != nil {
+		log.Fatal(err)
+	}
+	uiCmdRates, err := parseRateSpecs("UI_CMD_RATE", envOr("UI_CMD_RATE", ""))
+	if err != nil {
+		log.Fatal(err)
+	}
+	deviceUpgrade, err := loadUpgradeProfile("DEVICE_WS")
+	if err != nil {
+		log.Fatal(err)
+	}
+	uiUpgrade, err := loadUpgradeProfile("UI_WS")
+	if err != nil {
+		log.Fatal(err)
+	}
+	crashMaxBytes, err := parseByteSize(envOr("CRASH_MAX_BYTES", "4MiB"))
+	if err != nil {
+		log.Fatalf("CRASH_MAX_BYTES: %v", err)
+	}
+	var recorder *frameRecorder
+	if recordsAny(framePolicies) {
+		recordDir := envOr("RECORD_DIR", "")
+		if recordDir == "" && store.enabled() {
+			recordDir = filepath.Join(store.dir, "recordings")
+		}
+		if recordDir == "" {
+			log.Fatal("FRAME_POLICIES: record needs RECORD_DIR or DATA_DIR")
+		}
+		recordMax, err := parseByteSize(envOr("RECORD_MAX_BYTES", "1GiB"))
+		if err != nil {
+			log.Fatalf("RECORD_MAX_BYTES: %v", err)
+		}
+		recorder = &frameRecorder{dir: recordDir, maxBytes: int64(recordMax)}
+	}
+	crashDir := envOr("CRASH_DIR", "")
+	if crashDir == "" && store.enabled() {
+		crashDir = filepath.Join(store.dir, "crashes")
+	}
+	var audit *auditLog
+	if envOr("AUDIT", "on") != "off" {
+		auditFile := envOr("AUDIT_FILE", "")
+		if auditFile == "" && store.enabled() {
+			auditFile = filepath.Join(store.dir, "audit.jsonl")
+		}
+		auditMax, err := parseByteSize(envOr("AUDIT_FILE_MAX_BYTES", "64MiB"))
+		if err != nil {
+			log.Fatalf("AUDIT_FILE_MAX_BYTES: %v", err)
+		}
+		if audit, err = newAuditLog(envInt("AUDIT_RETAIN", 10000), envOr("AUDIT_PAYLOADS", "0") == "1",
+			envOr("AUDIT_TERMINAL", "0") == "1", auditFile, int64(auditMax)); err != nil {
+			log.Fatalf("AUDIT_FILE: %v", err)
+		}
+	}
+
 	s := &server{
-		h:               newHub(),
-		deviceAuthToken: os.Getenv("DEVICE_AUTH_TOKEN"),
-		uiAuthToken:     os.Getenv("UI_AUTH_TOKEN"),
-		publicBaseURL:   *publicBase,
-		logLevel:        parseLogLevel(envOr("LOG_LEVEL", "info")),
-		logHealthz:      envOr("LOG_HEALTHZ", "0") == "1",
-		claims:          make(map[string]claimEntry),
-		upgrader: websocket.Upgrader{
-			ReadBufferSize:  32 * 1024,
-			WriteBufferSize: 32 * 1024,
-			CheckOrigin: func(r *http.Request) bool {
-				// Expect to run behind a reverse proxy/ingress; origin checks should be enforced there.
-				return true
-			},
-		},
+		h:                   newHub(),
+		deviceAuthToken:     os.Getenv("DEVICE_AUTH_TOKEN"),
+		uiAuthToken:         os.Getenv("UI_AUTH_TOKEN"),
+		adminAuthToken:      os.Getenv("ADMIN_AUTH_TOKEN"),
+		startedAt:           time.Now(),
+		publicBaseURL:       *publicBase,
+		deviceDomain:        strings.ToLower(strings.Trim(envOr("DEVICE_DOMAIN", ""), ".")),
+		logLevel:            parseLogLevel(envOr("LOG_LEVEL", "info")),
+		logHealthz:          envOr("LOG_HEALTHZ", "0") == "1",
+		logTail:             newLogTail(),
+		deviceWatchInterval: envDuration("DEVICE_WATCH_INTERVAL", time.Second),
+		drainDelay:          envDuration("DRAIN_DELAY", 5*time.Second),
+		metrics:             newMetricsRegistry(),
+		metricsAuthToken:    os.Getenv("METRICS_AUTH_TOKEN"),
+		maxDevices:          envInt("MAX_DEVICES", 0),
+		capacityPolicy:      parseCapacityPolicy(envOr("CAPACITY_POLICY", "reject")),
+		capacityRetry:       envDuration("CAPACITY_RETRY_AFTER", 30*time.Second),
+		mem:                 newMemoryWatchdog(memSoftLimit, envDuration("MEMORY_CHECK_INTERVAL", 5*time.Second)),
+		shed:                newLoadShedder(),
+		mediaTunnels:        parseTunnelSet(envOr("MEDIA_TUNNELS", "ws_media,ws_camera")),
+		mediaMaxLag:         envDuration("MEDIA_MAX_LAG", 250*time.Millisecond),
+		forwardQueueMax:     max(envInt("FORWARD_QUEUE", 16), 1),
+		uiWriteTimeout:      envDuration("UI_WRITE_TIMEOUT", 10*time.Second),
+		serialTunnels:       parseTunnelSet(envOr("SERIAL_TUNNELS", "serial")),
+		serial:              newSerialConsoles(envInt("SERIAL_SCROLLBACK", 64<<10)),
+		serialLineFlush:     envDuration("SERIAL_LINE_FLUSH", 250*time.Millisecond),
+		crashes:             &crashStore{dir: crashDir, maxBytes: int64(crashMaxBytes), keep: envInt("CRASH_KEEP", 20)},
+		logTunnels:          parseTunnelSet(envOr("LOG_TUNNELS", "ws_logs")),
+		logs:                newLogRings(envInt("LOG_RETAIN_BYTES", 64<<10)),
+		logLevels:           newLogLevelStore(store),
+		dedupWindow:         envDuration("DEDUP_WINDOW", 0),
+		deltaFullEvery:      envInt("DELTA_FULL_EVERY", 30),
+		framePolicies:       framePolicies,
+		recorder:            recorder,
+		maxUIPerDevice:      envInt("MAX_UI_PER_DEVICE", 0),
+		maxUIPerTunnel:      maxUIPerTunnel,
+		uiCmdRates:          uiCmdRates,
+		tunnelLimits:        tunnelLimits,
+		keepalive:           loadKeepaliveConfig(),
+		linkQuality:         loadLinkQualityConfig(),
+		uiKickMaxHold:       envDuration("UI_KICK_MAX_HOLD", 10*time.Minute),
+		waitRoom:            newWaitRoom(),
+		wake:                newWakeManager(),
+		auditLog:            audit,
+		restartNotice:       loadRestartNotice(),
+		uptime:              newUptimeTracker(store),
+		disconnects:         newDisconnectStats(store),
+		wsQueryStrict:       envOr("WS_QUERY_STRICT", "0") == "1",
+		maintenance:         newMaintenanceStore(store),
+		federation:          federation,
+		digestCfg:           digestCfg,
+		reconnectHint:       reconnect,
+		announceExtra:       announceExtra,
+		announceDefault:     envOr("ANNOUNCE_DEFAULT", "1") != "0",
+		iceServers:          parseICEServers(envOr("P2P_ICE_SERVERS", "")),
+		chunkMaxBytes:       envInt("CHUNK_MAX_BYTES", 8<<20),
+		store:               store,
+		registry:            newDeviceRegistry(store),
+		apiKeys:             newAPIKeyStore(store),
+		tenants:             newTenantStore(store),
+		transfers:           newTransferCodes(envDuration("TRANSFER_TTL", 24*time.Hour)),
+		shares:              newShareStore(store, envDuration("SHARE_MAX_TTL", 30*24*time.Hour)),
+		files:               newFileManager(stagingDir, int64(fileMaxBytes), envInt("FILE_CHUNK_BYTES", 16<<10), int64(fileStagingMax), envDuration("FILE_STAGING_TTL", 7*24*time.Hour)),
+		schemas:             newSchemaStore(store),
+		requireDeviceKeys:   envOr("REQUIRE_DEVICE_KEYS", "0") == "1",
+		totp:                newTOTPClaims(envDuration("CLAIM_TOTP_STEP", 60*time.Second), envInt("CLAIM_TOTP_SKEW", 1)),
+		claimMaxTTL:         envDuration("CLAIM_MAX_TTL", 7*24*time.Hour),
+		claimMaxUses:        envInt("CLAIM_MAX_USES", 10),
+		claimApprovals:      newClaimApprovals(os.Getenv("CLAIM_APPROVAL"), envDuration("CLAIM_APPROVAL_TTL", time.Hour)),
+		claimBinds:          claimBinds,
+		claimDelivery:       newClaimDelivery(digestCfg),
+		claims:              make(map[string]claimEntry),
+		claimsDirty:         make(chan struct{}, 1),
+		upgrader:            uiUpgrade.upgrader(),
+		deviceUpgrader:      deviceUpgrade.upgrader(),
+	}
+	s.logf(logDebug, "ws_upgrade_profile", append([]any{"profile", "device"}, deviceUpgrade.logKV()...)...)
+	s.logf(logDebug, "ws_upgrade_profile", append([]any{"profile", "ui"}, uiUpgrade.logKV()...)...)
+
+	if err := s.registry.load(); err != nil {
+		log.Fatalf("load registry: %v", err)
+	}
+	if err := s.shares.load(); err != nil {
+		log.Fatalf("load shares: %v", err)
+	}
+	if err := s.apiKeys.load(os.Getenv("API_KEYS")); err != nil {
+		log.Fatalf("load api keys: %v", err)
+	}
+	if err := s.tenants.load(); err != nil {
+		log.Fatalf("load tenants: %v", err)
+	}
+	if err := s.schemas.load(); err != nil {
+		log.Fatalf("load schemas: %v", err)
+	}
+	if err := s.logLevels.load(); err != nil {
+		log.Fatalf("load log levels: %v", err)
+	}
+	reconnectGrace := envDuration("RECONNECT_GRACE", 5*time.Minute)
+	if err := s.loadWarmState(reconnectGrace); err != nil {
+		log.Fatalf("load warm state: %v", err)
+	}
+	if err := s.uptime.load(); err != nil {
+		log.Fatalf("load uptime: %v", err)
+	}
+	if err := s.disconnects.load(); err != nil {
+		log.Fatalf("load disconnects: %v", err)
+	}
+	if err := s.maintenance.load(); err != nil {
+		log.Fatalf("load maintenance: %v", err)
+	}
+	s.debug = newDebugSet()
+	s.bwtests = newBWTestStore(store)
+	s.filters = newFilterStore(store)
+	if err := s.filters.load(); err != nil {
+		log.Fatalf("load filters: %v", err)
+	}
+	if err := s.bwtests.load(); err != nil {
+		log.Fatalf("load bwtests: %v", err)
+	}
+	moved, dropped := s.crashes.migrate()
+	s.store.noteLegacyIDs("crashes", moved, dropped)
+	s.reportLegacyIDs()
+	if *conformance {
+		if s.conformance, err = loadConformanceSuite(s); err != nil {
+			log.Fatalf("%v", err)
+		}
+		log.Printf("ESPWiFi Cloud ☁️ Conformance mode: devices are tested, not relayed")
+	}
+	s.uptime.excused = func(deviceID string) bool {
+		_, ok := s.maintenance.active(deviceID)
+		return ok
+	}
+	s.h.onPresence = s.uptime.presence
+	s.upstreamAuthToken = envOr("UPSTREAM_AUTH_TOKEN", "")
+	if s.upstreamAuthToken != "" {
+		if s.upstreamDevices, err = loadUpstreamDevices(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if s.upstream = loadUpstreamLink(s); s.upstream != nil {
+		s.h.onSession = s.upstream.sessionChanged
+		// Devices connecting here are only reachable upstream while the
+		// link is up; federation peers being down doesn't make this region
+		// any less able to serve its own devices, so they aren't checked.
+		s.addReadinessCheck("upstream", func() error {
+			if !s.upstream.up.Load() {
+				return errors.New("upstream link down")
+			}
+			return nil
+		})
+	}
+	if s.store.enabled() {
+		s.addReadinessCheck("persistence", s.store.check)
+	}
+	if s.ha, err = loadHAPair(s, reconnectGrace); err != nil {
+		log.Fatal(err)
+	}
+	if s.ha != nil {
+		s.addReadinessCheck("ha", func() error {
+			if s.ha.standby() {
+				return errors.New("standby")
+			}
+			return nil
+		})
+		s.logf(logInfo, "ha_role", "role", s.ha.status().Role, "peer", s.ha.peerURL)
 	}
 
+	if err := s.startDeviceEngine(); err != nil {
+		log.Fatal(err)
+	}
+	s.registerCapacityMetrics()
+	s.registerWSQueryMetrics()
+	s.registerDisconnectMetrics()
+	s.registerMemoryMetrics()
+	s.registerLeakMetrics()
+	s.registerPresenceMetrics()
+	s.registerShedMetrics()
+	s.registerTrafficMetrics()
+	s.registerWarmStateMetrics()
+
+	elector, err := newLeaderElector(s)
+	if err != nil {
+		log.Fatalf("leader election: %v", err)
+	}
+	s.leader = elector
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/api/stats", s.handleStats)
 	mux.HandleFunc("/api/register", s.handleRegister)
 	mux.HandleFunc("/api/devices", s.handleDevices)
+	mux.HandleFunc("/api/devices/", s.handleDeviceAPI)
+	mux.HandleFunc("/api/devices/search", s.handleDeviceSearch)
+	mux.HandleFunc("/api/registry", s.handleRegistry)
+	mux.HandleFunc("/api/registry/export", s.handleRegistryExport)
+	mux.HandleFunc("/api/registry/import", s.handleRegistryImport)
+	mux.HandleFunc("/api/keys", s.handleAPIKeys)
+	mux.HandleFunc("/api/keys/", s.handleAPIKeys)
+	mux.HandleFunc("/api/tenants", s.handleTenants)
+	mux.HandleFunc("/api/tenants/", s.handleTenants)
+	mux.HandleFunc("/api/schemas", s.handleSchemas)
+	mux.HandleFunc("/api/schemas/", s.handleSchemas)
+	mux.HandleFunc("/api/filters", s.handleFilters)
+	mux.HandleFunc("/api/filters/", s.handleFilters)
 	mux.HandleFunc("/api/claim", s.handleClaim)
-	mux.HandleFunc("/ws/device/", s.handleDeviceWS)
-	mux.HandleFunc("/ws/ui/", s.handleUIWS)
+	mux.HandleFunc("/api/claims", s.handleClaims)
+	mux.HandleFunc("/api/claims/", s.handleClaims)
+	mux.HandleFunc("/api/claim-requests", s.handleClaimRequests)
+	mux.HandleFunc("/api/claim-requests/", s.handleClaimRequests)
+	mux.HandleFunc("/api/transfer", s.handleTransfer)
+	mux.HandleFunc("/api/audit", s.handleAudit)
+	mux.HandleFunc("/api/uptime", s.handleUptime)
+	mux.HandleFunc("/api/disconnects", s.handleDisconnects)
+	mux.HandleFunc("/api/reports/availability", s.handleAvailabilityReport)
+	mux.HandleFunc("/api/digest", s.handleDigest)
+	mux.HandleFunc("/api/federation/locate", s.handleFederationLocate)
+	mux.HandleFunc("/admin", s.handleAdmin)
+	mux.HandleFunc("/admin/", s.handleAdmin)
+	mux.HandleFunc("/api/protocol", s.handleProtocol)
+	mux.HandleFunc("/api/openapi.json", s.handleOpenAPI)
+	mux.HandleFunc("/api/ha", s.handleHA)
+	mux.HandleFunc("/api/ha/", s.handleHA)
+	mux.HandleFunc("/api/conformance", s.handleConformance)
+	if s.conformance != nil {
+		mux.HandleFunc("/ws/device/", s.wsQuery("device", s.conformance.handle))
+	} else {
+		mux.HandleFunc("/ws/device/", s.wsQuery("device", s.handleDeviceWS))
+	}
+	mux.HandleFunc("/ws/ui/", s.wsQuery("ui", s.handleUIWS))
+	mux.HandleFunc("/ws/serial/", s.wsQuery("ui", s.handleUIWS))
+	mux.HandleFunc("/ws/admin/logs", s.wsQuery("admin_logs", s.handleAdminLogsWS))
+	mux.HandleFunc("/ws/admin/devices", s.wsQuery("admin_devices", s.handleDeviceWatchWS))
+	mux.HandleFunc("/ws/upstream", s.wsQuery("upstream", s.handleUpstreamWS))
+	mux.HandleFunc("/ws/bwtest/", s.wsQuery("bwtest", s.handleBWTestWS))
+
+	dashboard, dashboardSrc, err := dashboardFS()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if dashboard != nil {
+		mux.Handle("/", dashboardHandler(dashboard))
+		s.logf(logInfo, "dashboard_enabled", "source", dashboardSrc)
+	}
 
+	handler := requestIDMiddleware(loggingMiddleware(s.deviceSubdomainRouting(s.auditREST(s.haGate(mux))), s))
+	sockOpts, err := loadSockOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
 	httpSrv := &http.Server{
 		Addr:              *listenAddr,
-		Handler:           loggingMiddleware(mux, s),
+		Handler:           handler,
 		ReadHeaderTimeout: 10 * time.Second,
 	}
 
-	go func() {
-		log.Printf("ESPWiFi Cloud ☁️ Listening on %s", *listenAddr)
-		if err := httpSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("ListenAndServe: %v", err)
+	certs, err := s.newACMEManager()
+	if err != nil {
+		log.Fatalf("acme: %v", err)
+	}
+	wildcard, err := s.newWildcardCert()
+	if err != nil {
+		log.Fatalf("acme dns-01: %v", err)
+	}
+	if certs != nil {
+		// The plain listener keeps serving everything and also answers
+		// HTTP-01 challenges.
+		httpSrv.Handler = certs.HTTPHandler(handler)
+	}
+	var tlsSrv *http.Server
+	if cfg := tlsConfig(certs, wildcard); cfg != nil {
+		tlsSrv = &http.Server{
+			Addr:              envOr("TLS_LISTEN_ADDR", ":8443"),
+			Handler:           handler,
+			TLSConfig:         cfg,
+			ReadHeaderTimeout: 10 * time.Second,
 		}
-	}()
+		tlsLns, err := sockOpts.listen(tlsSrv.Addr)
+		if err != nil {
+			log.Fatalf("listen %s: %v", tlsSrv.Addr, err)
+		}
+		log.Printf("ESPWiFi Cloud ☁️ Listening (TLS) on %s", tlsSrv.Addr)
+		for _, ln := range tlsLns {
+			go func(ln net.Listener) {
+				if err := tlsSrv.ServeTLS(ln, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					log.Fatalf("ListenAndServeTLS: %v", err)
+				}
+			}(ln)
+		}
+	}
+
+	httpLns, err := sockOpts.listen(*listenAddr)
+	if err != nil {
+		log.Fatalf("listen %s: %v", *listenAddr, err)
+	}
+	log.Printf("ESPWiFi Cloud ☁️ Listening on %s", *listenAddr)
+	if len(httpLns) > 1 {
+		s.logf(logInfo, "listen_reuseport", "listeners", len(httpLns))
+	}
+	for _, ln := range httpLns {
+		go func(ln net.Listener) {
+			if err := httpSrv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("ListenAndServe: %v", err)
+			}
+		}(ln)
+	}
+
+	mdns, err := s.newMDNS(*listenAddr)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	var jobs sync.WaitGroup
+	jobs.Add(9)
+	go func() { defer jobs.Done(); s.leader.Run(jobsCtx) }()
+	go func() { defer jobs.Done(); s.mem.Run(jobsCtx, s) }()
+	go func() { defer jobs.Done(); s.shed.Run(jobsCtx, s) }()
+	go func() {
+		defer jobs.Done()
+		s.runLeakWatchdog(jobsCtx, envDuration("LEAK_CHECK_INTERVAL", 30*time.Second))
+	}()
+	go func() {
+		defer jobs.Done()
+		// Claims, pending approvals and binds are each node's own.
+		s.runNodeJob(jobsCtx, "claim_sweep", time.Minute, s.sweepExpiredClaims)
+	}()
+	go func() {
+		defer jobs.Done()
+		s.runSessionRoster(jobsCtx, envDuration("SESSION_ROSTER_INTERVAL", time.Minute))
+	}()
+	go func() {
+		defer jobs.Done()
+		s.runUptimeSaver(jobsCtx, envDuration("UPTIME_SAVE_INTERVAL", 5*time.Minute))
+	}()
+	go func() { defer jobs.Done(); s.runLinkQuality(jobsCtx) }()
+	go func() {
+		defer jobs.Done()
+		s.runStreamSchedule(jobsCtx, envDuration("STREAM_SCHEDULE_INTERVAL", 30*time.Second))
+	}()
+	if s.upstream != nil {
+		jobs.Add(1)
+		go func() { defer jobs.Done(); s.upstream.run(jobsCtx) }()
+	}
+	if s.ha != nil {
+		jobs.Add(1)
+		go func() { defer jobs.Done(); s.ha.run(jobsCtx) }()
+	}
+	if mdns != nil {
+		// Tied to the signal, not jobsCtx: stop advertising as soon as
+		// draining starts.
+		jobs.Add(1)
+		go func() { defer jobs.Done(); mdns.run(ctx) }()
+	}
+	if s.digestCfg.enabled() {
+		jobs.Add(1)
+		go func() { defer jobs.Done(); s.runNodeJob(jobsCtx, "digest", time.Minute, s.maybeSendDigest) }()
+	}
+	if wildcard != nil {
+		// Every replica serves the certificate, so every replica keeps it
+		// fresh; a shared cache dir makes all but the first a no-op.
+		jobs.Add(1)
+		go func() { defer jobs.Done(); wildcard.Run(jobsCtx) }()
+	}
+	jobs.Add(1)
+	go func() { defer jobs.Done(); s.runClaimSaver(jobsCtx) }()
+	if s.files.stagingDir != "" {
+		// Per node: FILE_STAGING_DIR may be local to each replica.
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			s.runFileSweep(jobsCtx, envDuration("FILE_SWEEP_INTERVAL", 10*time.Minute))
+		}()
+	}
+
 	<-ctx.Done()
 	stop()
 
+	// Fail readiness first and give the load balancer a moment to notice.
+	s.draining.Store(true)
+	s.saveSessionRoster()
+	if err := s.uptime.save(); err != nil {
+		s.logf(logInfo, "uptime_save_failed", "error", err.Error())
+	}
+	log.Printf("ESPWiFi Cloud ☁️ Draining for %s", s.drainDelay)
+	time.Sleep(s.drainDelay)
+	s.notifyRestart(5 * time.Second)
+	// Once the sessions it closed are gone (each is counted before it
+	// leaves the hub), so their server_restarting disconnects are saved.
+	for deadline := time.Now().Add(2 * time.Second); s.h.count() > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s.disconnects.save(); err != nil {
+		s.logf(logInfo, "disconnects_save_failed", "error", err.Error())
+	}
+
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	_ = httpSrv.Shutdown(shutdownCtx)
-}
+	if tlsSrv != nil {
+		_ = tlsSrv.Shutdown(shutdownCtx)
+	}
 
-func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string]any{"ok": true})
+	stopJobs()
+	jobs.Wait()
 }
 
 func (s *server) setCORS(w http.ResponseWriter, r *http.Request) {
@@ -227,7 +965,8 @@ func (s *server) setCORS(w http.ResponseWriter, r *http.Request) {
 	// Keep this permissive for now; origin enforcement should happen at ingress.
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-ID")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
 	// Avoid caching claim responses.
 	w.Header().Set("Cache-Control", "no-store")
 }
@@ -235,6 +974,11 @@ func (s *server) setCORS(w http.ResponseWriter, r *http.Request) {
 type claimRequest struct {
 	Code   string `json:"code"`
 	Tunnel string `json:"tunnel,omitempty"`
+	// Required for TOTP claim codes: the device whose secret is checked.
+	DeviceID string `json:"device_id,omitempty"`
+	// "control" (default) or "view". A view claim only ever releases the
+	// device's read-only token.
+	Scope string `json:"scope,omitempty"`
 }
 
 func (s *server) handleClaim(w http.ResponseWriter, r *http.Request) {
@@ -243,27 +987,42 @@ func (s *server) handleClaim(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
+	if r.Method == http.MethodGet && r.URL.Query().Has("request") {
+		s.pollClaim(w, r)
+		return
+	}
 	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
 	var req claimRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "bad json", http.StatusBadRequest)
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeJSONDecodeError(w, err)
 		return
 	}
 	code := strings.ToUpper(strings.TrimSpace(req.Code))
 	if code == "" || len(code) > 32 {
-		http.Error(w, "invalid code", http.StatusBadRequest)
+		writeAPIError(w, http.StatusBadRequest, "invalid_code", "invalid code")
 		return
 	}
 	tunnel := strings.TrimSpace(req.Tunnel)
 	if tunnel == "" {
 		tunnel = "ws_control"
 	}
+	viewOnly := false
+	switch strings.ToLower(strings.TrimSpace(req.Scope)) {
+	case "", "control":
+	case "view":
+		viewOnly = true
+	default:
+		writeAPIError(w, http.StatusBadRequest, "invalid_scope", "invalid scope")
+		return
+	}
 
 	now := time.Now().UTC()
+	account, _ := s.callerAccount(r)
+	ownedElsewhere := false
 
 	s.claimMu.Lock()
 	ce, ok := s.claims[code]
@@ -276,42 +1035,167 @@ func (s *server) handleClaim(w http.ResponseWriter, r *http.Request) {
 			delete(s.claims, code)
 			ok = false
 		}
+		// On a tenant's custom domain, codes for other tenants' devices
+		// don't exist.
+		if ok && !s.hostAllows(r, ce.DeviceID) {
+			ok = false
+		}
+		// Keep the code for the rightful owner rather than burning it.
+		if ok && s.claimOwnedElsewhere(r, ce, viewOnly, account) {
+			ok, ownedElsewhere = false, true
+		}
 	}
 	if ok {
-		// One-time use: consume immediately.
-		delete(s.claims, code)
+		// Consume immediately, so concurrent redemptions can't overrun
+		// MaxUses: one-time codes now, multi-use ones on their last
+		// redemption. A redemption that then fails gives the use back
+		// (releaseClaimUse).
+		ce.Uses++
+		if ce.Uses < ce.MaxUses {
+			s.claims[code] = ce
+		} else {
+			delete(s.claims, code)
+		}
+		s.saveClaimsLocked()
 	}
 	s.claimMu.Unlock()
 
+	if !ok && !ownedElsewhere {
+		// Not a registered random code; it may be a time-derived one.
+		deviceID, _ := normalizeDeviceID(req.DeviceID)
+		ce, ok = s.redeemTOTPClaim(code, deviceID, tunnel, now)
+		ok = ok && s.hostAllows(r, ce.DeviceID)
+		// Checked only once the code matched, so unmatched guesses can't
+		// tell which devices are owned. The next code works for the owner.
+		if ok && s.claimOwnedElsewhere(r, ce, viewOnly, account) {
+			ok, ownedElsewhere = false, true
+		}
+	}
+	if ownedElsewhere {
+		writeAPIError(w, http.StatusConflict, "owned_elsewhere", errOwnedElsewhere.Error())
+		s.logf(logInfo, "claim_owned_elsewhere", "remote", clientIP(r), "device_id", ce.DeviceID, "account", account)
+		return
+	}
+
 	if !ok || ce.DeviceID == "" || ce.Token == "" {
-		http.Error(w, "invalid or expired code", http.StatusNotFound)
+		writeAPIError(w, http.StatusNotFound, "invalid_code", "invalid or expired code")
 		s.logf(logInfo, "claim_invalid", "remote", clientIP(r), "code", code)
 		return
 	}
+	if s.claimNeedsApproval(ce.DeviceID) {
+		s.holdClaim(w, r, code, ce, tunnel, viewOnly, account)
+		return
+	}
+	s.grantClaim(w, r, code, ce, tunnel, viewOnly, account, false)
+}
 
-	publicBase := s.publicBase(r)
-	ui := strings.TrimRight(publicBase, "/") + "/ws/ui/" + ce.DeviceID + "?tunnel=" + urlQueryEscape(tunnel)
-	// Provide token as both a field and embedded in the url for convenience.
-	uiWithToken := ui + "&token=" + urlQueryEscape(ce.Token)
+// grantClaim releases a redeemed code's token to the caller and, for a
+// control claim with an account, makes that account the owner. A claim the
+// owner approved (see claimapproval.go) leaves ownership as it is.
+func (s *server) grantClaim(w http.ResponseWriter, r *http.Request, code string, ce claimEntry, tunnel string, viewOnly bool, account string, approved bool) {
+	if !viewOnly && !ce.multiUse() && account != "" && !(approved && s.registry.ownedByOther(ce.DeviceID, account)) {
+		if err := s.registry.claimOwnership(ce.DeviceID, account); errors.Is(err, errOwnedElsewhere) {
+			s.releaseClaimUse(code, ce)
+			writeAPIError(w, http.StatusConflict, "owned_elsewhere", errOwnedElsewhere.Error())
+			s.logf(logInfo, "claim_owned_elsewhere", "remote", clientIP(r), "device_id", ce.DeviceID, "account", account)
+			return
+		} else if err != nil {
+			s.releaseClaimUse(code, ce)
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist registry")
+			return
+		}
+	}
+	if ce.multiUse() || s.claimBinds.enabled() {
+		s.redeemClaimShare(w, r, code, ce, tunnel, viewOnly, account)
+		return
+	}
+	token, scope := ce.Token, uiScopeControl
+	if viewOnly {
+		if ce.ViewToken == "" {
+			s.releaseClaimUse(code, ce)
+			writeAPIError(w, http.StatusConflict, "no_view_token", "device has no view token")
+			s.logf(logInfo, "claim_no_view_token", "remote", clientIP(r), "device_id", ce.DeviceID, "tunnel", tunnel)
+			return
+		}
+		token, scope = ce.ViewToken, uiScopeView
+	}
 
+	ui, _ := wsURLs(s.publicBaseFor(r, ce.DeviceID), ce.DeviceID, tunnel)
+	// Provide token as both a field and embedded in the url for convenience.
+	uiWithToken := ui + "&token=" + urlQueryEscape(token)
+
+	resp := claimResponse{
+		OK:         true,
+		Code:       code,
+		DeviceID:   ce.DeviceID,
+		Tunnel:     tunnel,
+		UIWSURL:    ui,
+		Token:      token,
+		Scope:      scope.String(),
+		UIWSToken:  uiWithToken,
+		LocalWSURL: s.h.getDevice(makeKey(ce.DeviceID, tunnel)).localWSURL(r),
+	}
+	if !viewOnly {
+		// Hand out the read-only token too so the owner can share viewing.
+		resp.ViewToken = ce.ViewToken
+	}
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string]any{
-		"ok":          true,
-		"code":        code,
-		"device_id":   ce.DeviceID,
-		"tunnel":      tunnel,
-		"ui_ws_url":   ui,
-		"token":       ce.Token,
-		"ui_ws_token": uiWithToken,
-	})
+	_ = json.NewEncoder(w).Encode(resp)
+	s.noteClaimRedeemed(r, ce.DeviceID, tunnel, scope.String(), "")
 
 	s.logf(logInfo, "claim_redeemed",
 		"remote", clientIP(r),
 		"device_id", ce.DeviceID,
 		"tunnel", tunnel,
+		"scope", scope.String(),
+		"account", account,
 	)
 }
 
+// releaseClaimUse gives back the use handleClaim took from code when the
+// redemption then failed, so an error doesn't burn a printed code.
+func (s *server) releaseClaimUse(code string, ce claimEntry) {
+	if ce.Registered.IsZero() {
+		return // a time-derived code; nothing was taken
+	}
+	s.claimMu.Lock()
+	defer s.claimMu.Unlock()
+	cur, ok := s.claims[code]
+	switch {
+	case ok && cur.ID == ce.ID && cur.Registered.Equal(ce.Registered) && cur.Uses > 0:
+		cur.Uses--
+		s.claims[code] = cur
+	case !ok && time.Now().Before(ce.ExpiresAt):
+		ce.Uses--
+		s.claims[code] = ce
+	default:
+		return // replaced or expired meanwhile
+	}
+	s.saveClaimsLocked()
+}
+
+// sweepExpiredClaims drops claim codes past their expiry. Redemption also
+// checks expiry, so this only bounds memory for codes nobody redeems.
+func (s *server) sweepExpiredClaims(now time.Time) {
+	s.claimMu.Lock()
+	n := 0
+	for code, ce := range s.claims {
+		if now.After(ce.ExpiresAt) {
+			delete(s.claims, code)
+			n++
+		}
+	}
+	if n > 0 {
+		s.saveClaimsLocked()
+	}
+	s.claimMu.Unlock()
+	s.claimApprovals.sweep(now)
+	s.claimBinds.sweep(now)
+	if n > 0 {
+		s.logf(logDebug, "claims_swept", "expired", n)
+	}
+}
+
 type registerRequest struct {
 	DeviceID string `json:"device_id"`
 }
@@ -320,81 +1204,245 @@ func (s *server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	// Simple helper endpoint for dashboards to discover the ws URLs.
 	// It does NOT create a device session; the device must still connect to /ws/device/{id}.
 	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 	var req registerRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid json", http.StatusBadRequest)
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeJSONDecodeError(w, err)
 		return
 	}
-	req.DeviceID = strings.TrimSpace(req.DeviceID)
-	if req.DeviceID == "" || strings.Contains(req.DeviceID, "/") {
-		http.Error(w, "invalid device_id", http.StatusBadRequest)
+	var ok bool
+	if req.DeviceID, ok = normalizeDeviceID(req.DeviceID); !ok {
+		writeAPIError(w, http.StatusBadRequest, "invalid_device_id", "invalid device_id")
 		return
 	}
 	tunnel := strings.TrimSpace(r.URL.Query().Get("tunnel"))
 	if strings.Contains(tunnel, "/") {
-		http.Error(w, "invalid tunnel", http.StatusBadRequest)
+		writeAPIError(w, http.StatusBadRequest, "invalid_tunnel", "invalid tunnel")
 		return
 	}
 
-	publicBase := s.publicBase(r)
-	ui := strings.TrimRight(publicBase, "/") + "/ws/ui/" + req.DeviceID
-	dev := strings.TrimRight(publicBase, "/") + "/ws/device/" + req.DeviceID
-	if tunnel != "" {
-		ui += "?tunnel=" + urlQueryEscape(tunnel)
-		dev += "?tunnel=" + urlQueryEscape(tunnel)
+	if !s.hostAllows(r, req.DeviceID) {
+		writeAPIError(w, http.StatusNotFound, "device_not_found", "unknown device")
+		return
 	}
+
+	ui, dev := wsURLs(s.publicBaseFor(r, req.DeviceID), req.DeviceID, tunnel)
+	dc := s.h.getDevice(makeKey(req.DeviceID, tunnel))
 	info := deviceInfo{
 		DeviceID:    req.DeviceID,
 		TunnelKey:   tunnel,
-		Connected:   s.h.getDevice(makeKey(req.DeviceID, tunnel)) != nil,
+		Connected:   dc != nil,
 		UIWSURL:     ui,
 		DeviceWSURL: dev,
+		LocalWSURL:  dc.localWSURL(r),
 	}
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(info)
 }
 
 func (s *server) handleDevices(w http.ResponseWriter, r *http.Request) {
-	publicBase := s.publicBase(r)
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.requireRole(w, r, roleViewer) {
+		return
+	}
+	dq, err := parseDeviceQuery(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_query", err.Error())
+		return
+	}
+	baseFor := func(deviceID string) string { return s.publicBaseFor(r, deviceID) }
+	devices := append(s.h.snapshot(baseFor), s.expectedDevices(baseFor)...)
+	devices = s.withMaintenance(devices, baseFor)
+	if s.federation.region != "" {
+		for i := range devices {
+			devices[i].Region = s.federation.region
+		}
+	}
+	// Devices of another tenant's domain, or owned by another account,
+	// aren't listed.
+	visible := devices[:0]
+	for _, d := range devices {
+		if s.hostAllows(r, d.DeviceID) && s.ownerAllows(r, d.DeviceID) {
+			visible = append(visible, d)
+		}
+	}
+	devices = visible
+	// Peers apply the Host's tenant themselves.
+	if s.federation.enabled() && !s.federation.fromPeer(r) {
+		remote, unreachable := s.peerDevices(r)
+		devices = append(devices, remote...)
+		if len(unreachable) > 0 {
+			w.Header().Set("X-Federation-Unreachable", strings.Join(unreachable, ","))
+		}
+	}
+	devices = dq.apply(devices, time.Now())
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(s.h.snapshot(publicBase))
+	if dq.group {
+		_ = json.NewEncoder(w).Encode(groupByDevice(devices))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(devices)
+}
+
+// handleDeviceAPI routes /api/devices/{id}/{action}.
+func (s *server) handleDeviceAPI(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/devices/"), "/")
+	deviceID, action, _ := strings.Cut(rest, "/")
+	action, sub, _ := strings.Cut(action, "/")
+	if deviceID == "" || strings.Contains(sub, "/") || (sub != "" && action != "files" && action != "crash" && action != "share") {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	deviceID, ok := normalizeDeviceID(deviceID)
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "invalid_device_id", "invalid device id")
+		return
+	}
+	// Devices upload crash reports with their own credentials.
+	if !(action == "crash" && r.Method == http.MethodPost) && !s.requireOwner(w, r, deviceID) {
+		return
+	}
+	switch action {
+	case "files":
+		s.handleDeviceFiles(w, r, deviceID, sub)
+	case "logs":
+		s.handleDeviceLogs(w, r, deviceID)
+	case "log-level":
+		s.handleDeviceLogLevel(w, r, deviceID)
+	case "crash":
+		s.handleDeviceCrash(w, r, deviceID, sub)
+	case "credentials":
+		s.handleDeviceCredentials(w, r, deviceID)
+	case "claim-secret":
+		s.handleDeviceClaimSecret(w, r, deviceID)
+	case "tenant":
+		s.handleDeviceTenant(w, r, deviceID)
+	case "metadata":
+		s.handleDeviceMetadata(w, r, deviceID)
+	case "owner":
+		s.handleDeviceOwner(w, r, deviceID)
+	case "transfer":
+		s.handleDeviceTransfer(w, r, deviceID)
+	case "share":
+		s.handleDeviceShare(w, r, deviceID, sub)
+	case "disconnect", "relocate":
+		s.handleDeviceSession(w, r, deviceID, action)
+	case "deregister":
+		s.handleDeviceDeregister(w, r, deviceID)
+	case "uptime":
+		s.handleDeviceUptime(w, r, deviceID)
+	case "disconnects":
+		s.handleDeviceDisconnects(w, r, deviceID)
+	case "maintenance":
+		s.handleDeviceMaintenance(w, r, deviceID)
+	case "wake":
+		s.handleDeviceWake(w, r, deviceID)
+	case "streaming":
+		s.handleDeviceStreaming(w, r, deviceID)
+	case "quiet-hours":
+		s.handleDeviceQuietHours(w, r, deviceID)
+	case "bwtest":
+		s.handleDeviceBWTest(w, r, deviceID)
+	case "debug":
+		s.handleDeviceDebug(w, r, deviceID)
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+	}
 }
 
 func (s *server) handleDeviceWS(w http.ResponseWriter, r *http.Request) {
-	deviceID := strings.TrimPrefix(r.URL.Path, "/ws/device/")
-	deviceID = strings.Trim(deviceID, "/")
-	if deviceID == "" || strings.Contains(deviceID, "/") {
-		http.Error(w, "invalid device id", http.StatusBadRequest)
+	deviceID, ok := normalizeDeviceID(strings.Trim(strings.TrimPrefix(r.URL.Path, "/ws/device/"), "/"))
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "invalid_device_id", "invalid device id")
 		s.logf(logInfo, "device_ws_invalid_device_id", "remote", clientIP(r), "path", r.URL.Path)
 		return
 	}
+	if deviceID == loopbackDeviceID {
+		s.handleLoopbackWS(w, r, "device")
+		return
+	}
+	// Query syntax is checked by wsQuery (wsquery.go).
 	tunnel := strings.TrimSpace(r.URL.Query().Get("tunnel"))
-	if strings.Contains(tunnel, "/") {
-		http.Error(w, "invalid tunnel", http.StatusBadRequest)
-		s.logf(logInfo, "device_ws_invalid_tunnel", "remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
+	claim := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("claim")))
+	tokenScope := strings.TrimSpace(r.URL.Query().Get("token_scope"))
+
+	if s.draining.Load() {
+		s.rejectWS(w, r, http.StatusServiceUnavailable, wsCloseDraining, "device_ws_draining",
+			"remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
 		return
 	}
 
-	claim := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("claim")))
-	if len(claim) > 0 && len(claim) > 32 {
-		http.Error(w, "invalid claim", http.StatusBadRequest)
-		s.logf(logInfo, "device_ws_invalid_claim", "remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
+	if !s.hostAllows(r, deviceID) {
+		s.rejectWS(w, r, http.StatusForbidden, wsCloseUnauthorized, "device_ws_wrong_domain",
+			"remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel, "host", requestHost(r))
 		return
 	}
 
-	if s.deviceAuthToken != "" && !authOK(r, s.deviceAuthToken) {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		s.logf(logInfo, "device_ws_unauthorized_global", "remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
+	// A device with a registry key must present it; the global token (if
+	// any) is only the fallback for devices without one.
+	if hasKey, ok := s.registry.verifyKey(deviceID, extractDeviceKey(r)); hasKey {
+		if !ok {
+			s.rejectWS(w, r, http.StatusUnauthorized, wsCloseUnauthorized, "device_ws_unauthorized_key",
+				"remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
+			return
+		}
+	} else if s.requireDeviceKeys {
+		s.rejectWS(w, r, http.StatusUnauthorized, wsCloseUnauthorized, "device_ws_unregistered",
+			"remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
+		return
+	} else if s.deviceAuthToken != "" && !authOK(r, s.deviceAuthToken) {
+		s.rejectWS(w, r, http.StatusUnauthorized, wsCloseUnauthorized, "device_ws_unauthorized_global",
+			"remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
 		return
 	}
 
-	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if closed, retry := s.streamingClosed(deviceID, tunnel); closed {
+		s.rejectWSRetry(w, r, http.StatusForbidden, wsCloseOutsideSchedule, retry, "device_ws_outside_schedule",
+			"remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
+		return
+	}
+
+	if s.mem.Shedding() && s.isMediaTunnel(tunnel) {
+		s.memShedTunnels.Inc()
+		s.rejectWSRetry(w, r, http.StatusServiceUnavailable, wsCloseQuotaExceeded, s.capacityRetry, "device_ws_memory_shed",
+			"remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
+		return
+	}
+
+	if s.deviceCapacityFull(makeKey(deviceID, tunnel)) {
+		s.capacityRejected.Inc()
+		s.rejectWSRetry(w, r, http.StatusServiceUnavailable, wsCloseQuotaExceeded, s.capacityRetry, "device_ws_capacity_rejected",
+			"remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel, "max_devices", s.maxDevices)
+		return
+	}
+
+	// conn is nil for sessions handed to the epoll engine (engine.go).
+	var conn *websocket.Conn
+	var polled *polledConn
+	var sock deviceSocket
+	var err error
+	if s.usePoller(r, tunnel) {
+		polled, err = s.poller.upgrade(w, r)
+		sock = polled
+	} else {
+		conn, err = s.deviceUpgrader.Upgrade(w, r, nil)
+		sock = conn
+	}
 	if err != nil {
 		return
 	}
+	s.acct.deviceConns.Add(1)
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			s.acct.deviceConns.Add(-1)
+		}
+	}()
 
 	// Capture per-device UI token (device provides it during registration).
 	// This is used to authorize /ws/ui connections for this device.
@@ -402,19 +1450,59 @@ func (s *server) handleDeviceWS(w http.ResponseWriter, r *http.Request) {
 
 	dc := &deviceConn{
 		id:          makeKey(deviceID, tunnel),
-		ws:          conn,
+		ws:          sock,
 		connectedAt: time.Now().UTC(),
 		closed:      make(chan struct{}),
 		uiToken:     deviceProvidedToken,
-		uiConns:     make(map[*websocket.Conn]struct{}),
+		tunnelToken: tokenScope == "tunnel",
+		viewToken:   strings.TrimSpace(r.URL.Query().Get("view_token")),
+		uiConns:     make(map[*websocket.Conn]uiOptions),
+		compression: conn != nil && negotiatedCompression(r, &s.deviceUpgrader),
+		dedup:       newDedupWindow(s.dedupWindow),
+		frameTags:   r.URL.Query().Get("frame_tags") == "1",
+		remoteIP:    clientIP(r),
+		lanURL:      deviceLANURL(r, tunnel),
+
+		uiWriteTimeout: s.uiWriteTimeout,
+	}
+	if n, err := strconv.Atoi(r.URL.Query().Get("max_ui")); err == nil && n > 0 {
+		dc.maxUI = n
+	}
+	if s.upstream != nil {
+		dc.deviceKey = extractDeviceKey(r)
+	}
+	if caps, err := parseCapabilities(r); err != nil {
+		s.logf(logInfo, "device_capabilities_invalid", "remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel, "error", err.Error())
+	} else {
+		dc.capabilities = caps
 	}
+	if rs, ok := s.uiCmdRateFor(tunnel); ok {
+		dc.cmdBucket = newTokenBucket(rs)
+	}
+	dc.deviceLimit, dc.uiLimit = s.newFlowLimiters(tunnel)
 	dc.lastSeen.Store(time.Now().UTC().UnixNano())
+	dc.lastMessage.Store(dc.connectedAt.UnixNano())
 
 	// Replace any existing device session.
 	key := makeKey(deviceID, tunnel)
-	if old := s.h.setDevice(key, dc); old != nil {
+	old, evicted, admitted := s.h.admitDevice(key, dc, s.maxDevices, s.capacityPolicy)
+	if !admitted {
+		s.capacityRejected.Inc()
+		_ = dc.writeDevice(websocket.TextMessage, retryAfterMessage(wsCloseQuotaExceeded, s.capacityRetry))
+		dc.closeWithReason(wsCloseQuotaExceeded, wsCloseQuotaExceeded)
+		s.logf(logInfo, "device_ws_capacity_rejected", "remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel, "max_devices", s.maxDevices)
+		return
+	}
+	s.reconnected(key)
+	if evicted != nil {
+		s.capacityEvicted.Inc()
+		evictedID, evictedTunnel := splitKey(evicted.id)
+		evicted.closeWithReason(wsCloseQuotaExceeded, wsCloseDeviceOffline)
+		s.logf(logInfo, "device_ws_evicted_idle", "device_id", evictedID, "tunnel", evictedTunnel, "for_device_id", deviceID)
+	}
+	if old != nil {
 		s.logf(logInfo, "device_ws_replaced", "remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
-		old.closeWithReason(websocket.ClosePolicyViolation, "replaced by new device connection")
+		old.closeWithReason(wsCloseReplaced, wsCloseReplaced)
 		s.h.deleteDevice(key, old)
 	}
 
@@ -423,65 +1511,103 @@ func (s *server) handleDeviceWS(w http.ResponseWriter, r *http.Request) {
 		"device_id", deviceID,
 		"tunnel", tunnel,
 		"ui_token_present", dc.uiToken != "",
+		"view_token_present", dc.viewToken != "",
 	)
 
-	publicBase := s.publicBase(r)
-	if r.URL.Query().Get("announce") == "1" {
-		ui := strings.TrimRight(publicBase, "/") + "/ws/ui/" + deviceID
-		dev := strings.TrimRight(publicBase, "/") + "/ws/device/" + deviceID
-		if tunnel != "" {
-			ui += "?tunnel=" + urlQueryEscape(tunnel)
-			dev += "?tunnel=" + urlQueryEscape(tunnel)
-		}
-		_ = dc.ws.WriteMessage(websocket.TextMessage, mustJSON(map[string]any{
-			"type":         "registered",
-			"device_id":    deviceID,
-			"tunnel":       tunnel,
-			"ui_ws_url":    ui,
-			"device_ws_url": dev,
+	if md := metadataFromQuery(r); md != nil {
+		kv, err := validateMetadata(md)
+		registered, ignored := false, []string(nil)
+		if err == nil {
+			registered, ignored, err = s.registry.reportMetadata(deviceID, kv)
+		}
+		switch {
+		case err != nil:
+			s.logf(logInfo, "device_metadata_rejected", "device_id", deviceID, "tunnel", tunnel, "error", err.Error())
+		case !registered:
+			s.logf(logDebug, "device_metadata_ignored", "device_id", deviceID, "tunnel", tunnel, "reason", "not_registered")
+		case len(ignored) > 0:
+			s.logf(logInfo, "device_metadata_ignored", "device_id", deviceID, "tunnel", tunnel, "keys", strings.Join(ignored, ","))
+		}
+	}
+
+	if s.wantsAnnounce(r.URL.Query().Get("announce")) {
+		ui, dev := wsURLs(s.publicBaseFor(r, deviceID), deviceID, tunnel)
+		features := s.sessionFeatures(dc, tunnel)
+		_ = dc.ws.WriteMessage(websocket.TextMessage, s.announceMessage(registeredMsg{
+			Type:            "registered",
+			Protocol:        protocolVersion,
+			Features:        features,
+			EnabledFeatures: features.names(),
+			ServerVersion:   serverVersion(),
+			DeviceID:        deviceID,
+			Tunnel:          tunnel,
+			UIWSURL:         ui,
+			DeviceWSURL:     dev,
 			// Hint for clients: UI must present the token the device provided when
 			// connecting to the tunnel (typically auth.token).
-			"ui_token_required": dc.uiToken != "",
+			UITokenRequired: dc.uiToken != "",
+			TokenScope:      dc.tokenScope(),
+			ViewTokenSet:    dc.viewToken != "",
+			Reconnect:       s.reconnectHint,
+			ICEServers:      s.iceServers,
 		}))
 		s.logf(logDebug, "device_ws_registered", "device_id", deviceID, "tunnel", tunnel, "ui_token_required", dc.uiToken != "", "ui_ws_url", ui)
 	}
 
+	if st, ok := s.logLevels.get(deviceID); ok && st.Forward && s.isLogTunnel(tunnel) {
+		_ = dc.writeDevice(websocket.TextMessage, mustJSON(logLevelMsg{Type: "log_level", Level: st.Level}))
+	}
+
 	// If device presented a claim code, store it as short-lived one-time.
 	if claim != "" && dc.uiToken != "" {
 		now := time.Now().UTC()
 		s.claimMu.Lock()
 		s.claims[claim] = claimEntry{
+			ID:         randomToken(6),
 			DeviceID:   deviceID,
 			TunnelKey:  tunnel,
 			Token:      dc.uiToken,
-			ExpiresAt:  now.Add(10 * time.Minute),
+			ViewToken:  dc.viewToken,
+			ExpiresAt:  now.Add(claimCodeTTL),
 			Registered: now,
 		}
+		s.saveClaimsLocked()
 		s.claimMu.Unlock()
 		s.logf(logInfo, "device_claim_registered", "remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel, "claim", claim)
 	}
 
+	if polled != nil {
+		// The poller reads, pings and tears down from here on.
+		handedOff = true
+		s.poller.add(polled, s.newDeviceSession(dc, deviceID, tunnel))
+		return
+	}
+
 	// Keepalive/read loop: we don't interpret payloads here; we just maintain the device session.
 	// IMPORTANT: Gorilla websockets do not allow concurrent readers or concurrent writers.
 	// We keep exactly one reader for the device connection here, and forward to the UI if paired.
 	conn.SetReadLimit(8 << 20) // 8MB per message
-	_ = conn.SetReadDeadline(time.Now().Add(120 * time.Second))
+	_ = conn.SetReadDeadline(time.Now().Add(s.keepalive.readTimeout()))
 	conn.SetPongHandler(func(string) error {
 		dc.lastSeen.Store(time.Now().UTC().UnixNano())
-		_ = conn.SetReadDeadline(time.Now().Add(120 * time.Second))
+		if dc.missedPongs.Load() > 0 {
+			s.logf(logInfo, "device_pong_recovered", "device_id", deviceID, "tunnel", tunnel)
+		}
+		dc.notePong()
+		_ = conn.SetReadDeadline(time.Now().Add(s.keepalive.readTimeout()))
 		return nil
 	})
 
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(s.keepalive.pingInterval)
 	defer ticker.Stop()
 
-	type wsMsg struct {
-		mt  int
-		msg []byte
-	}
-	msgCh := make(chan wsMsg, 8)
+	ds := s.newDeviceSession(dc, deviceID, tunnel)
+	defer ds.out.close()
 	errCh := make(chan error, 1)
+	s.acct.deviceReaders.Add(1)
 	go func() {
+		defer s.acct.deviceReaders.Add(-1)
+		defer ds.pushes.closeAll()
 		for {
 			mt, msg, err := conn.ReadMessage()
 			dc.lastSeen.Store(time.Now().UTC().UnixNano())
@@ -489,11 +1615,10 @@ func (s *server) handleDeviceWS(w http.ResponseWriter, r *http.Request) {
 				errCh <- err
 				return
 			}
-			// Best-effort forward to UI via main loop (single writer there).
-			select {
-			case msgCh <- wsMsg{mt: mt, msg: msg}:
-			default:
-				// Drop if UI can't keep up; avoid blocking device reader.
+			// Forwarded by the session's own writer (see forwarder.go), so
+			// a slow UI never blocks the device reader.
+			if m, ok, must := ds.ingest(mt, msg); ok {
+				ds.out.push(m, must)
 			}
 		}
 	}()
@@ -501,40 +1626,45 @@ func (s *server) handleDeviceWS(w http.ResponseWriter, r *http.Request) {
 	for {
 		select {
 		case <-dc.closed:
+			reason := s.recordDisconnect(deviceID, tunnel, dc, nil)
 			s.h.deleteDevice(key, dc)
-			s.logf(logInfo, "device_ws_disconnected", "device_id", deviceID, "tunnel", tunnel)
+			s.logf(logInfo, "device_ws_disconnected", "device_id", deviceID, "tunnel", tunnel, "reason", reason)
 			return
 		case err := <-errCh:
-			// Bubble up the disconnect cause to make flapping debuggable.
-			errMsg := ""
-			if err != nil {
-				errMsg = err.Error()
-			}
-			dc.closeWithReason(websocket.CloseNormalClosure, "device disconnected")
-			s.h.deleteDevice(key, dc)
-			s.logf(logInfo, "device_ws_disconnected", "device_id", deviceID, "tunnel", tunnel, "err", errMsg)
+			s.endDeviceSession(ds, err)
 			return
-		case m := <-msgCh:
-			// Forward device payload to any connected UI clients.
-			dc.uiMu.Lock()
-			uis := make([]*websocket.Conn, 0, len(dc.uiConns))
-			for c := range dc.uiConns {
-				uis = append(uis, c)
-			}
-			dc.uiMu.Unlock()
-			if len(uis) > 0 {
-				dc.uiWriteMu.Lock()
-				for _, uiConn := range uis {
-					_ = uiConn.WriteMessage(m.mt, m.msg)
-				}
-				dc.uiWriteMu.Unlock()
-			}
 		case <-ticker.C:
-			dc.writeMu.Lock()
-			_ = conn.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(5*time.Second))
-			dc.writeMu.Unlock()
+			s.pingDevice(ds)
+		}
+	}
+}
+
+// endDeviceSession tears down a session whose read failed with err.
+func (s *server) endDeviceSession(ds *deviceSession, err error) {
+	// Bubble up the disconnect cause to make flapping debuggable.
+	errMsg := ""
+	deviceClose := wsCloseDeviceOffline
+	if err != nil {
+		errMsg = err.Error()
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			deviceClose = wsCloseIdleTimeout
 		}
 	}
+	reason := s.recordDisconnect(ds.deviceID, ds.tunnel, ds.dc, err)
+	ds.dc.closeWithReason(deviceClose, wsCloseDeviceOffline)
+	s.h.deleteDevice(ds.key, ds.dc)
+	s.logf(logInfo, "device_ws_disconnected", "device_id", ds.deviceID, "tunnel", ds.tunnel, "reason", reason, "err", errMsg)
+}
+
+// pingDevice sends the keepalive ping; see keepalive.go.
+func (s *server) pingDevice(ds *deviceSession) {
+	if missed := ds.dc.notePing(); missed == 1 {
+		s.logf(logInfo, "device_pong_missed", "device_id", ds.deviceID, "tunnel", ds.tunnel)
+	}
+	ds.dc.writeMu.Lock()
+	_ = ds.dc.ws.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(5*time.Second))
+	ds.dc.writeMu.Unlock()
 }
 
 func isWSUpgrade(r *http.Request) bool {
@@ -556,82 +1686,215 @@ func isWSUpgrade(r *http.Request) bool {
 
 // rejectWS attempts to upgrade so the client receives a proper WebSocket close
 // frame (with reason). If upgrade is not possible, falls back to HTTP error.
-func (s *server) rejectWS(w http.ResponseWriter, r *http.Request, httpStatus int, closeCode int, reason string, logKey string, kv ...any) {
+func (s *server) rejectWS(w http.ResponseWriter, r *http.Request, httpStatus int, wc wsClose, logKey string, kv ...any) {
 	if isWSUpgrade(r) {
 		c, err := s.upgrader.Upgrade(w, r, nil)
 		if err == nil && c != nil {
-			_ = c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, reason), time.Now().Add(3*time.Second))
+			sendClose(c, wc)
 			_ = c.Close()
 			s.logf(logInfo, logKey, kv...)
 			return
 		}
 	}
-	http.Error(w, reason, httpStatus)
+	writeAPIError(w, httpStatus, wc.Reason, wc.Reason)
 	s.logf(logInfo, logKey, kv...)
 }
 
 func (s *server) handleUIWS(w http.ResponseWriter, r *http.Request) {
-	deviceID := strings.TrimPrefix(r.URL.Path, "/ws/ui/")
-	deviceID = strings.Trim(deviceID, "/")
-	if deviceID == "" || strings.Contains(deviceID, "/") {
-		http.Error(w, "invalid device id", http.StatusBadRequest)
+	// /ws/serial/{id} is the terminal flavour of /ws/ui/{id}.
+	deviceID, terminal := strings.CutPrefix(r.URL.Path, "/ws/serial/")
+	if !terminal {
+		deviceID = strings.TrimPrefix(r.URL.Path, "/ws/ui/")
+	}
+	deviceID, ok := normalizeDeviceID(strings.Trim(deviceID, "/"))
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "invalid_device_id", "invalid device id")
 		s.logf(logInfo, "ui_ws_invalid_device_id", "remote", clientIP(r), "path", r.URL.Path)
 		return
 	}
+	if deviceID == loopbackDeviceID {
+		s.handleLoopbackWS(w, r, "ui")
+		return
+	}
 	tunnel := strings.TrimSpace(r.URL.Query().Get("tunnel"))
-	if strings.Contains(tunnel, "/") {
-		http.Error(w, "invalid tunnel", http.StatusBadRequest)
+	if terminal && tunnel == "" {
+		tunnel = "serial"
+	}
+	if terminal && !s.isSerialTunnel(tunnel) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_tunnel", "invalid tunnel")
 		s.logf(logInfo, "ui_ws_invalid_tunnel", "remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
 		return
 	}
 
 	if s.uiAuthToken != "" && !authOK(r, s.uiAuthToken) {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		s.logf(logInfo, "ui_ws_unauthorized_global", "remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
+		s.rejectWS(w, r, http.StatusUnauthorized, wsCloseUnauthorized, "ui_ws_unauthorized_global",
+			"remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
+		return
+	}
+
+	if closed, retry := s.streamingClosed(deviceID, tunnel); closed {
+		s.rejectWSRetry(w, r, http.StatusForbidden, wsCloseOutsideSchedule, retry, "ui_ws_outside_schedule",
+			"remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
+		return
+	}
+	if !s.hostAllows(r, deviceID) {
+		s.rejectWS(w, r, http.StatusNotFound, wsCloseDeviceOffline, "ui_ws_device_offline",
+			"remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
+		return
+	}
+
+	// Credentials that don't need the device's session are checked before
+	// the UI waits for it; the session's tokens only once it is up.
+	guest, isGuest := s.shares.lookup(deviceID, tunnel, r.URL.Query().Get("share"))
+	if !isGuest && !s.ownerAllows(r, deviceID) {
+		s.rejectWS(w, r, http.StatusForbidden, wsCloseUnauthorized, "ui_ws_not_owner",
+			"remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
 		return
 	}
 
 	key := makeKey(deviceID, tunnel)
 	dc := s.h.getDevice(key)
+	if dc == nil && s.mayFederate(r) {
+		if peer, ok := s.locateDevice(r, deviceID, tunnel); ok {
+			s.bridgeUI(w, r, nil, peer, deviceID, tunnel)
+			return
+		}
+	}
+	// Set when the UI was upgraded to wait for the device; see waitroom.go.
+	var waited *websocket.Conn
+	if dc == nil && !terminal {
+		var peer *federationPeer
+		// Only callers checked without the session may wake the device.
+		ro, _ := s.roleFor(r)
+		canWake := isGuest || (ro >= roleViewer && s.accountHolds(r, deviceID))
+		if dc, peer, waited, ok = s.waitForDevice(w, r, deviceID, tunnel, key, canWake); !ok {
+			return
+		}
+		if peer != nil {
+			s.bridgeUI(w, r, waited, *peer, deviceID, tunnel)
+			return
+		}
+	}
 	if dc == nil {
-		s.rejectWS(w, r, http.StatusNotFound, websocket.CloseTryAgainLater, "device_offline", "ui_ws_device_offline",
+		s.rejectWS(w, r, http.StatusNotFound, wsCloseDeviceOffline, "ui_ws_device_offline",
 			"remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
 		return
 	}
 
 	// Per-device UI token gate: if the device provided a token at registration,
-	// require the UI to present the same token (?token=... or Bearer ...).
-	if dc.uiToken != "" {
-		got := extractToken(r)
-		if subtle.ConstantTimeCompare([]byte(got), []byte(dc.uiToken)) != 1 {
-			// Policy: upgrade+close so browsers can surface a reason (otherwise it looks like a generic 1006).
-			s.rejectWS(w, r, http.StatusUnauthorized, websocket.ClosePolicyViolation, "unauthorized_device", "ui_ws_unauthorized_device",
-				"remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
-			return
+	// require the UI to present it (or the view token) via ?token=... or Bearer ...
+	// An API key (X-API-Key / ?api_key=) works instead, scoped by its role,
+	// on devices its account owns or has shared (any device for admins); on
+	// others it needs the token too. A guest share link (?share=) stands on
+	// its own; see shares.go.
+	var scope uiScope
+	var actor, from string // for the audit trail and filter rules
+	if isGuest {
+		scope, ok = guest.scope(), true
+		actor, from = "share:"+guest.ID, "guest"
+	} else if ro, _ := s.roleFor(r); ro >= roleViewer && s.accountHolds(r, deviceID) {
+		scope, ok = uiScopeView, true
+		if ro >= roleOperator {
+			scope = uiScopeControl
+		}
+		actor, from = s.auditActor(r), "account"
+	} else {
+		scope, ok = dc.scopeFor(extractToken(r))
+		actor, from = "anonymous", "token"
+		if dc.uiToken != "" {
+			actor = "ui_token"
 		}
 	}
+	if !ok {
+		// Policy: upgrade+close so browsers can surface a reason (otherwise it looks like a generic 1006).
+		s.rejectUI(w, r, waited, http.StatusUnauthorized, wsCloseUnauthorized, "ui_ws_unauthorized_device",
+			"remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
+		return
+	}
+	// Only share tokens are bound (claimbind.go).
+	presented := ""
+	if isGuest {
+		presented = r.URL.Query().Get("share")
+	}
+	if bad := s.claimBinds.mismatch(presented, r, time.Now()); len(bad) > 0 {
+		s.audit(auditEntry{TS: time.Now().UTC(), Source: "claim", Actor: actor, Remote: clientIP(r),
+			DeviceID: deviceID, Tunnel: tunnel, Action: "binding_mismatch " + strings.Join(bad, ","),
+			UserAgent: r.UserAgent(), Origin: r.Header.Get("Origin")})
+		s.rejectUI(w, r, waited, http.StatusForbidden, wsCloseUnauthorized, "ui_ws_claim_binding_mismatch",
+			"remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel, "mismatch", strings.Join(bad, ","))
+		return
+	}
+	opts := parseUIOptions(r)
+	opts.terminal = terminal
+	if r.URL.Query().Get("p2p") == "1" && len(s.iceServers) > 0 && !terminal {
+		opts.p2p = newP2PPeer()
+	}
+	opts.actor, opts.from, opts.remote = actor, from, clientIP(r)
+	if opts.readOnly {
+		// Only ever narrows what the credential granted above.
+		scope = uiScopeView
+	}
+	if s.rejectHeldUI(w, r, waited, dc, from, deviceID, tunnel) {
+		return
+	}
 
-	uiConn, err := s.upgrader.Upgrade(w, r, nil)
-	if err != nil {
+	if limit := s.uiLimitFor(dc, tunnel); !dc.acquireUI(limit) {
+		s.uiLimitRejected.Inc(s.tunnelLabel(tunnel))
+		s.rejectUI(w, r, waited, http.StatusTooManyRequests, wsCloseUILimit, "ui_ws_limit_reached",
+			"remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel, "max_ui", limit)
 		return
 	}
+	defer dc.releaseUI()
+
+	uiConn := waited
+	if uiConn == nil {
+		var err error
+		if uiConn, err = s.upgrader.Upgrade(w, r, nil); err != nil {
+			return
+		}
+	} else {
+		_ = uiConn.WriteMessage(websocket.TextMessage, msgDeviceOnline)
+	}
+	s.acct.uiConns.Add(1)
+	defer s.acct.uiConns.Add(-1)
+	if isGuest {
+		done := make(chan struct{})
+		defer close(done)
+		go s.watchShare(uiConn, guest, done)
+	}
+
+	s.logf(logInfo, "ui_ws_connected", "remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel, "scope", scope.String())
 
-	s.logf(logInfo, "ui_ws_connected", "remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
+	if opts.p2p != nil {
+		_ = uiConn.WriteMessage(websocket.TextMessage, mustJSON(p2pConfigMsg{Type: "p2p_config", UI: opts.p2p.id, ICEServers: s.iceServers}))
+	}
+	if !terminal && s.linkQuality.interval > 0 {
+		_ = uiConn.WriteMessage(websocket.TextMessage, mustJSON(s.linkQuality.message(dc, time.Now())))
+	}
+	if opts.delta {
+		// Confirm the mode before any device traffic can arrive.
+		_ = uiConn.WriteMessage(websocket.TextMessage, mustJSON(deltaModeMsg{Type: "delta_mode", FullEvery: s.deltaFullEvery}))
+	}
 
 	// Register this UI connection. Allow multiple UI clients per device+tunnel
 	// (useful for multiple tabs + CLI tests).
-	dc.uiMu.Lock()
-	wasEmpty := len(dc.uiConns) == 0
-	dc.uiConns[uiConn] = struct{}{}
-	dc.uiMu.Unlock()
+	var wasEmpty bool
+	if terminal {
+		wasEmpty = s.serial.get(key).attachTerminal(dc, uiConn, opts)
+	} else {
+		dc.uiMu.Lock()
+		wasEmpty = len(dc.uiConns) == 0
+		dc.uiConns[uiConn] = opts
+		dc.uiMu.Unlock()
+	}
 	if wasEmpty {
 		// Tell the device a UI is attached so it can start streaming only when needed.
 		dc.writeMu.Lock()
-		_ = dc.ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"ui_connected"}`))
+		_ = dc.ws.WriteMessage(websocket.TextMessage, msgUIConnected)
 		dc.writeMu.Unlock()
 	}
 
-	bridge(dc, uiConn)
+	s.bridge(dc, uiConn, scope, tunnel, opts)
 
 	// UI disconnected; if this was the last UI, tell device it can stop streaming.
 	dc.uiMu.Lock()
@@ -639,9 +1902,9 @@ func (s *server) handleUIWS(w http.ResponseWriter, r *http.Request) {
 	nowEmpty := len(dc.uiConns) == 0
 	dc.uiMu.Unlock()
 
-	if nowEmpty {
+	if nowEmpty && !s.upstream.hasRemoteUIs(key) {
 		dc.writeMu.Lock()
-		_ = dc.ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"ui_disconnected"}`))
+		_ = dc.ws.WriteMessage(websocket.TextMessage, msgUIDisconnected)
 		dc.writeMu.Unlock()
 	}
 	s.logf(logInfo, "ui_ws_disconnected", "remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel)
@@ -683,29 +1946,152 @@ func urlQueryEscape(s string) string {
 	return b.String()
 }
 
-func bridge(dc *deviceConn, uiConn *websocket.Conn) {
+func (s *server) bridge(dc *deviceConn, uiConn *websocket.Conn, scope uiScope, tunnel string, opts uiOptions) {
 	deviceConn := dc.ws
+	deviceID, _ := splitKey(dc.id)
 
 	// Configure UI read limit. Device reads are handled by handleDeviceWS (single reader).
 	uiConn.SetReadLimit(8 << 20)
 
+	// View scope comes from the credential (view token, view share, viewer
+	// role) or ?readonly=1 narrowing it; say so before the first send so a
+	// dashboard needn't guess which controls to grey out.
+	notifiedReadOnly := false
+	if scope != uiScopeControl && !opts.terminal {
+		notifiedReadOnly = true
+		dc.uiWriteMu.Lock()
+		_ = dc.writeUI(uiConn, websocket.TextMessage, msgReadOnly)
+		dc.uiWriteMu.Unlock()
+	}
+
 	// Forward: UI -> Device (serialize writes to deviceConn).
 	for {
 		mt, msg, err := uiConn.ReadMessage()
 		if err != nil {
 			return
 		}
-		dc.lastSeen.Store(time.Now().UTC().UnixNano())
+		if scope != uiScopeControl && !isUIP2PSignal(opts, mt, msg) {
+			// View-only clients keep reading (so pings/close work) but never
+			// reach the device. Tell them once so the UI can grey out controls.
+			s.readOnlyDropped.Inc(s.tunnelLabel(tunnel))
+			if !notifiedReadOnly && !opts.terminal {
+				notifiedReadOnly = true
+				dc.uiWriteMu.Lock()
+				_ = dc.writeUI(uiConn, websocket.TextMessage, msgReadOnly)
+				dc.uiWriteMu.Unlock()
+			}
+			continue
+		}
+		start := time.Now()
+		now := start.UTC().UnixNano()
+		dc.lastSeen.Store(now)
+		dc.lastMessage.Store(now)
+		if mt == websocket.TextMessage && s.isLogTunnel(tunnel) {
+			if reply, ok := s.uiSetLogLevel(deviceID, msg); ok {
+				dc.uiWriteMu.Lock()
+				_ = dc.writeUI(uiConn, websocket.TextMessage, reply)
+				dc.uiWriteMu.Unlock()
+				continue
+			}
+		}
+		if ok, notify := dc.cmdBucket.allow(start); !ok {
+			s.uiCmdRateLimited.Inc(s.tunnelLabel(tunnel))
+			if notify && !opts.terminal {
+				dc.uiWriteMu.Lock()
+				_ = dc.writeUI(uiConn, websocket.TextMessage, msgRateLimited)
+				dc.uiWriteMu.Unlock()
+			}
+			continue
+		}
+		if ok, notice := dc.uiLimit.admit(start, len(msg)); !ok || notice != nil {
+			if !ok {
+				s.tunnelRateLimited.Inc(dirUIToDevice, s.tunnelLabel(tunnel))
+			}
+			if notice != nil && !opts.terminal {
+				dc.uiWriteMu.Lock()
+				_ = dc.writeUI(uiConn, websocket.TextMessage, notice)
+				dc.uiWriteMu.Unlock()
+			}
+			if !ok {
+				continue
+			}
+		}
+		if msg = s.filterUI(dc, uiConn, tunnel, opts, msg); msg == nil {
+			continue
+		}
+		if mt == websocket.TextMessage {
+			if s.uiP2PSignal(dc, opts, scope, msg) {
+				s.auditUICommand(dc, tunnel, opts, true, msg)
+				continue
+			}
+		}
+		if mt == websocket.TextMessage && !opts.terminal {
+			if violations := s.schemas.get(tunnel).validate(msg); violations != nil {
+				s.schemaRejected.Inc(s.tunnelLabel(tunnel))
+				dc.uiWriteMu.Lock()
+				_ = dc.writeUI(uiConn, websocket.TextMessage, schemaViolationMessage(tunnel, violations))
+				dc.uiWriteMu.Unlock()
+				continue
+			}
+			if key, dup := dc.dedup.duplicate(msg, start); dup {
+				s.duplicatesSuppressed.Inc(s.tunnelLabel(tunnel))
+				dc.uiWriteMu.Lock()
+				_ = dc.writeUI(uiConn, websocket.TextMessage, mustJSON(duplicateMsg{Type: "duplicate", Key: key}))
+				dc.uiWriteMu.Unlock()
+				continue
+			}
+		}
+		var ack []byte
+		if opts.correlate && mt == websocket.TextMessage {
+			if stamped, cid, ok := stampCorrelation(msg, start); ok {
+				msg, ack = stamped, relayAck(cid, start)
+			}
+		}
 		dc.writeMu.Lock()
 		werr := deviceConn.WriteMessage(mt, msg)
 		dc.writeMu.Unlock()
+		if werr == nil {
+			dc.bytesToDevice.Add(uint64(len(msg)))
+			s.observeForward(dirUIToDevice, tunnel, len(msg), start)
+			if d := s.debug.get(deviceID); d != nil {
+				s.debugFrame(d, "ui_to_device", tunnel, mt, msg, dc.frameTags)
+			}
+		}
+		if werr == nil && ack != nil {
+			dc.uiWriteMu.Lock()
+			_ = dc.writeUI(uiConn, websocket.TextMessage, ack)
+			dc.uiWriteMu.Unlock()
+		}
+		if werr == nil && mt == websocket.TextMessage && !opts.terminal {
+			dc.echoToUIs(uiConn, msg)
+		}
+		if werr == nil {
+			s.auditUICommand(dc, tunnel, opts, mt == websocket.TextMessage, msg)
+		}
 		if werr != nil {
 			return
 		}
 	}
 }
 
-func (dc *deviceConn) closeWithReason(code int, reason string) {
+// negotiatedCompression reports whether the upgrade will negotiate
+// permessage-deflate: the upgrader allows it and the client offered it.
+func negotiatedCompression(r *http.Request, up *websocket.Upgrader) bool {
+	if !up.EnableCompression {
+		return false
+	}
+	for _, ext := range r.Header.Values("Sec-WebSocket-Extensions") {
+		if strings.Contains(strings.ToLower(ext), "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// closeWithReason tears down the device session, sending deviceSide to the
+// device and uiSide to every attached UI.
+func (dc *deviceConn) closeWithReason(deviceSide, uiSide wsClose) {
+	dc.noteEnd(deviceSide.Reason)
 	select {
 	case <-dc.closed:
 		// already closed
@@ -713,7 +2099,7 @@ func (dc *deviceConn) closeWithReason(code int, reason string) {
 		close(dc.closed)
 	}
 	dc.writeMu.Lock()
-	_ = dc.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(3*time.Second))
+	sendClose(dc.ws, deviceSide)
 	_ = dc.ws.Close()
 	dc.writeMu.Unlock()
 
@@ -722,13 +2108,13 @@ func (dc *deviceConn) closeWithReason(code int, reason string) {
 	for c := range dc.uiConns {
 		uis = append(uis, c)
 	}
-	dc.uiConns = make(map[*websocket.Conn]struct{})
+	dc.uiConns = make(map[*websocket.Conn]uiOptions)
 	dc.uiMu.Unlock()
 
 	if len(uis) > 0 {
 		dc.uiWriteMu.Lock()
 		for _, c := range uis {
-			_ = c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(3*time.Second))
+			sendClose(c, uiSide)
 			_ = c.Close()
 		}
 		dc.uiWriteMu.Unlock()
@@ -749,28 +2135,42 @@ func (s *server) publicBase(r *http.Request) string {
 				proto = "https" // Force HTTPS even if not detected
 			}
 		}
-		host := r.Header.Get("X-Forwarded-Host")
-		if host == "" {
-			host = r.Host
-		}
-		base = proto + "://" + host
+		base = proto + "://" + requestHost(r)
 	}
+	return wsBase(base)
+}
+
+// wsBase turns a public base URL into the matching WebSocket base.
+func wsBase(base string) string {
+	base = strings.TrimRight(strings.TrimSpace(base), "/")
 
 	// Convert https:// -> wss:// for WebSocket URLs (only support secure connections)
 	if strings.HasPrefix(base, "https://") {
 		return "wss://" + strings.TrimPrefix(base, "https://")
 	}
-	
+
 	// If someone configured http://, reject it - we only support secure connections
 	if strings.HasPrefix(base, "http://") {
 		// Log a warning but still upgrade to wss for security
 		return "wss://" + strings.TrimPrefix(base, "http://")
 	}
-	
+
 	// Already wss:// or unknown format
 	return base
 }
 
+// wsURLs builds the UI and device WebSocket URLs for deviceID/tunnel under base.
+func wsURLs(base, deviceID, tunnel string) (ui, dev string) {
+	base = strings.TrimRight(base, "/")
+	ui = base + "/ws/ui/" + deviceIDPath(deviceID)
+	dev = base + "/ws/device/" + deviceIDPath(deviceID)
+	if tunnel != "" {
+		ui += "?tunnel=" + urlQueryEscape(tunnel)
+		dev += "?tunnel=" + urlQueryEscape(tunnel)
+	}
+	return ui, dev
+}
+
 func authOK(r *http.Request, token string) bool {
 	// Supports either:
 	// - Authorization: Bearer <token>
@@ -808,6 +2208,50 @@ func extractToken(r *http.Request) string {
 	return got
 }
 
+// maxJSONBodyBytes bounds request bodies accepted by the REST API. Every
+// request we take today is a handful of short string fields.
+const maxJSONBodyBytes = 16 << 10
+
+var errTrailingJSON = errors.New("unexpected data after json object")
+
+// decodeJSONBody strictly decodes a single JSON object from the request body:
+// the body is size-limited, unknown fields are rejected and trailing data is
+// treated as an error.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v any) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBodyBytes)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if err := dec.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		return errTrailingJSON
+	}
+	return nil
+}
+
+// writeJSONDecodeError maps a decodeJSONBody failure to an error response.
+func writeJSONDecodeError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "too_large", "request body too large")
+	case errors.Is(err, io.EOF):
+		writeAPIError(w, http.StatusBadRequest, "empty_body", "empty request body")
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		writeAPIError(w, http.StatusBadRequest, "unknown_field", strings.TrimPrefix(err.Error(), "json: "))
+	default:
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", "invalid json")
+	}
+}
+
+// writeJSON writes v as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
 func mustJSON(v any) []byte {
 	b, _ := json.Marshal(v)
 	return b
@@ -820,6 +2264,52 @@ func envOr(k, def string) string {
 	return def
 }
 
+// envInt parses a non-negative integer from the environment.
+func envInt(k string, def int) int {
+	v := envOr(k, "")
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Printf("invalid %s=%q, using %d", k, v, def)
+		return def
+	}
+	return n
+}
+
+// envFloat parses a non-negative number from the environment; "off" reads
+// as 0.
+func envFloat(k string, def float64) float64 {
+	v := envOr(k, "")
+	switch v {
+	case "":
+		return def
+	case "off":
+		return 0
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || math.IsNaN(f) || math.IsInf(f, 0) {
+		log.Printf("invalid %s=%q, using %g", k, v, def)
+		return def
+	}
+	return f
+}
+
+// envDuration parses a Go duration (e.g. "5s") from the environment.
+func envDuration(k string, def time.Duration) time.Duration {
+	v := envOr(k, "")
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("invalid %s=%q, using %s", k, v, def)
+		return def
+	}
+	return d
+}
+
 type statusCapturingResponseWriter struct {
 	http.ResponseWriter
 	status int
@@ -850,7 +2340,7 @@ func loggingMiddleware(next http.Handler, s *server) http.Handler {
 			next.ServeHTTP(w, r)
 			return
 		}
-		if r.URL.Path == "/healthz" && s != nil && !s.logHealthz {
+		if (r.URL.Path == "/healthz" || r.URL.Path == "/readyz") && s != nil && !s.logHealthz {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -864,7 +2354,7 @@ func loggingMiddleware(next http.Handler, s *server) http.Handler {
 		if status == 0 {
 			status = http.StatusOK
 		}
-		log.Printf("%s %s %s %s %d %dB (%s)", remote, r.Method, r.URL.Path, r.Proto, status, sw.bytes, dur)
+		log.Printf("%s %s %s %s %d %dB (%s) %s", remote, r.Method, r.URL.Path, r.Proto, status, sw.bytes, dur, w.Header().Get("X-Request-ID"))
 	})
 }
 
@@ -885,25 +2375,53 @@ func clientIP(r *http.Request) string {
 	if xff := strings.TrimSpace(r.Header.Get("X-Forwarded-For")); xff != "" {
 		// first is original
 		if i := strings.IndexByte(xff, ','); i >= 0 {
-			return strings.TrimSpace(xff[:i])
+			xff = xff[:i]
 		}
-		return xff
+		return normalizeIP(xff)
 	}
 	if xr := strings.TrimSpace(r.Header.Get("X-Real-Ip")); xr != "" {
-		return xr
+		return normalizeIP(xr)
 	}
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err == nil && host != "" {
-		return host
+		return normalizeIP(host)
 	}
 	return r.RemoteAddr
 }
 
+// requestHost is the Host the client asked for. Like the client address in
+// clientIP, it comes from the reverse proxy when one sets X-Forwarded-Host.
+func requestHost(r *http.Request) string {
+	host, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Host"), ",")
+	if host = strings.TrimSpace(host); host == "" {
+		host = r.Host
+	}
+	return host
+}
+
+// normalizeIP reduces a proxy-supplied address ("[2001:db8::1]:443",
+// "1.2.3.4:5678", "fe80::1%eth0", "::ffff:1.2.3.4") to the bare IP, so the
+// same client always gets the same key. Anything that isn't an address is
+// returned trimmed but otherwise as-is.
+func normalizeIP(v string) string {
+	v = strings.TrimSpace(v)
+	if ap, err := netip.ParseAddrPort(v); err == nil {
+		return ap.Addr().WithZone("").Unmap().String()
+	}
+	if ip, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(v, "["), "]")); err == nil {
+		return ip.WithZone("").Unmap().String()
+	}
+	return v
+}
+
 func (s *server) logf(level logLevel, event string, kv ...any) {
 	if s == nil {
 		return
 	}
-	if level == logDebug && s.logLevel != logDebug {
+	if s.logTail != nil && s.logTail.active() {
+		s.logTail.publish(level, event, kv)
+	}
+	if level == logDebug && s.logLevel != logDebug && !s.debugging(kv) {
 		return
 	}
 	var b strings.Builder
@@ -946,4 +2464,4 @@ func fmtAny(v any) string {
 	default:
 		return fmt.Sprint(v)
 	}
-}
\ No newline at end of file
+}
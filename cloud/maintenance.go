@@ -0,0 +1,232 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maintenance mode marks a device as intentionally offline (powered down for
+// a firmware swap, in a drawer for the winter, ...). While it is set, and
+// until its optional end time, the device is left out of the daily digest's
+// offline and flapping lists and of the fleet availability summary, its
+// disconnects aren't counted, and a missed reconnect after a restart isn't
+// logged. /api/devices shows it as "maintenance".
+
+type maintenanceWindow struct {
+	DeviceID string     `json:"device_id"`
+	Reason   string     `json:"reason,omitempty"`
+	Until    *time.Time `json:"until,omitempty"` // nil: until cleared
+	SetBy    string     `json:"set_by"`
+	SetAt    time.Time  `json:"set_at"`
+}
+
+func (mw maintenanceWindow) activeAt(t time.Time) bool {
+	return mw.Until == nil || t.Before(*mw.Until)
+}
+
+type maintenanceStore struct {
+	store *fileStore
+
+	mu      sync.Mutex
+	windows map[string]*maintenanceWindow
+}
+
+const maintenanceDoc = "maintenance"
+
+func newMaintenanceStore(store *fileStore) *maintenanceStore {
+	return &maintenanceStore{store: store, windows: make(map[string]*maintenanceWindow)}
+}
+
+func (ms *maintenanceStore) load() error {
+	var list []*maintenanceWindow
+	if err := ms.store.load(maintenanceDoc, &list); err != nil {
+		return err
+	}
+	byID := make(map[string]*maintenanceWindow, len(list))
+	for _, mw := range list {
+		if mw != nil && mw.DeviceID != "" {
+			byID[mw.DeviceID] = mw
+		}
+	}
+	windows, moved, dropped := canonicalDeviceKeys(byID)
+	for id, mw := range windows {
+		mw.DeviceID = id
+	}
+	ms.store.noteLegacyIDs(maintenanceDoc, moved, dropped)
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.windows = windows
+	return nil
+}
+
+func (ms *maintenanceStore) saveLocked() error {
+	list := make([]*maintenanceWindow, 0, len(ms.windows))
+	for _, mw := range ms.windows {
+		list = append(list, mw)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DeviceID < list[j].DeviceID })
+	return ms.store.save(maintenanceDoc, list)
+}
+
+// active returns deviceID's maintenance window if it is in effect now.
+// Expired windows are simply ignored; the next change drops them.
+func (ms *maintenanceStore) active(deviceID string) (maintenanceWindow, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	mw, ok := ms.windows[deviceID]
+	if !ok || !mw.activeAt(time.Now()) {
+		return maintenanceWindow{}, false
+	}
+	return *mw, true
+}
+
+// all returns the windows in effect now, by device.
+func (ms *maintenanceStore) all() map[string]maintenanceWindow {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	now := time.Now()
+	out := make(map[string]maintenanceWindow, len(ms.windows))
+	for id, mw := range ms.windows {
+		if mw.activeAt(now) {
+			out[id] = *mw
+		}
+	}
+	return out
+}
+
+func (ms *maintenanceStore) set(mw maintenanceWindow) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.windows[mw.DeviceID] = &mw
+	ms.dropExpiredLocked()
+	return ms.saveLocked()
+}
+
+func (ms *maintenanceStore) remove(deviceID string) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	mw, ok := ms.windows[deviceID]
+	if !ok {
+		return false, nil
+	}
+	delete(ms.windows, deviceID)
+	ms.dropExpiredLocked()
+	return mw.activeAt(time.Now()), ms.saveLocked()
+}
+
+func (ms *maintenanceStore) dropExpiredLocked() {
+	now := time.Now()
+	for id, mw := range ms.windows {
+		if !mw.activeAt(now) {
+			delete(ms.windows, id)
+		}
+	}
+}
+
+// withMaintenance marks the /api/devices entries of devices in maintenance
+// and adds one for each such device that isn't connected, so intentionally
+// powered-down devices still show up.
+func (s *server) withMaintenance(devices []deviceInfo, baseFor func(deviceID string) string) []deviceInfo {
+	windows := s.maintenance.all()
+	if len(windows) == 0 {
+		return devices
+	}
+	listed := make(map[string]bool)
+	for i := range devices {
+		if mw, ok := windows[devices[i].DeviceID]; ok {
+			devices[i].Maintenance = &mw
+			listed[mw.DeviceID] = true
+		}
+	}
+	for id, mw := range windows {
+		if listed[id] {
+			continue
+		}
+		ui, dev := wsURLs(baseFor(id), id, "")
+		devices = append(devices, deviceInfo{DeviceID: id, UIWSURL: ui, DeviceWSURL: dev, Maintenance: &mw})
+	}
+	return devices
+}
+
+type setMaintenanceRequest struct {
+	Reason string `json:"reason,omitempty"`
+	// Either an end time or a duration from now; neither means open-ended.
+	Until    *time.Time `json:"until,omitempty"`
+	Duration string     `json:"duration,omitempty"`
+}
+
+// handleDeviceMaintenance manages a device's maintenance mode:
+//
+//	GET    /api/devices/{id}/maintenance
+//	PUT    /api/devices/{id}/maintenance  {"reason":"winter","duration":"72h"}
+//	DELETE /api/devices/{id}/maintenance
+func (s *server) handleDeviceMaintenance(w http.ResponseWriter, r *http.Request, deviceID string) {
+	switch r.Method {
+	case http.MethodGet:
+		if !s.requireRole(w, r, roleViewer) {
+			return
+		}
+		mw, ok := s.maintenance.active(deviceID)
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "not_in_maintenance", "not in maintenance")
+			return
+		}
+		writeJSON(w, http.StatusOK, mw)
+	case http.MethodPut:
+		if !s.requireRole(w, r, roleOperator) {
+			return
+		}
+		var req setMaintenanceRequest
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeJSONDecodeError(w, err)
+			return
+		}
+		now := time.Now().UTC()
+		until := req.Until
+		if req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil || d <= 0 || until != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_duration", "duration must be a positive duration like 72h, and not combined with until")
+				return
+			}
+			t := now.Add(d)
+			until = &t
+		}
+		if until != nil && !until.After(now) {
+			writeAPIError(w, http.StatusBadRequest, "invalid_until", "until must be in the future")
+			return
+		}
+		mw := maintenanceWindow{DeviceID: deviceID, Reason: truncate(strings.TrimSpace(req.Reason), 200),
+			Until: until, SetBy: s.auditActor(r), SetAt: now}
+		if err := s.maintenance.set(mw); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist maintenance mode")
+			return
+		}
+		writeJSON(w, http.StatusOK, mw)
+		ends := "cleared"
+		if until != nil {
+			ends = until.Format(time.RFC3339)
+		}
+		s.logf(logInfo, "device_maintenance_set", "remote", clientIP(r), "device_id", deviceID, "by", mw.SetBy, "until", ends)
+	case http.MethodDelete:
+		if !s.requireRole(w, r, roleOperator) {
+			return
+		}
+		removed, err := s.maintenance.remove(deviceID)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist maintenance mode")
+			return
+		}
+		if !removed {
+			writeAPIError(w, http.StatusNotFound, "not_in_maintenance", "not in maintenance")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		s.logf(logInfo, "device_maintenance_cleared", "remote", clientIP(r), "device_id", deviceID)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
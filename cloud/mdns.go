@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// LAN discovery. With MDNS_ENABLED=1 the relay advertises itself over
+// mDNS/DNS-SD as _espwifi._tcp, so a device being provisioned on the same
+// network can find the tunnel endpoint without a hard-coded URL:
+//
+//	MDNS_ENABLED=1
+//	MDNS_NAME=Workshop relay   instance name (default "ESPWiFi Relay (<hostname>)")
+//	MDNS_PORT=8080             advertised port (default LISTEN_ADDR's)
+//	MDNS_INTERFACE=eth0        answer on one interface only
+//
+// The TXT record carries path=/ws/device/, the relay and protocol versions,
+// tls=1 when MDNS_PORT is a TLS port, and region when REGION is set. Only
+// IPv4 multicast is used; AAAA records are still included in answers. The
+// service is withdrawn (TTL 0) as soon as the relay starts draining.
+
+const (
+	mdnsService = "_espwifi._tcp.local."
+	mdnsBrowse  = "_services._dns-sd._udp.local."
+	mdnsTTL     = 120
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+type mdnsAdvertiser struct {
+	s        *server
+	conn     *net.UDPConn
+	iface    *net.Interface // nil: all
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+	port     uint16
+	txt      []string
+}
+
+// newMDNS opens the mDNS socket, or returns nil when MDNS_ENABLED isn't set.
+func (s *server) newMDNS(listenAddr string) (*mdnsAdvertiser, error) {
+	if envOr("MDNS_ENABLED", "0") != "1" {
+		return nil, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "espwifi-relay"
+	}
+	hostname, _, _ = strings.Cut(hostname, ".")
+	a := &mdnsAdvertiser{s: s}
+	name := strings.ReplaceAll(strings.TrimSpace(envOr("MDNS_NAME", "ESPWiFi Relay ("+hostname+")")), ".", "-")
+	if a.instance, err = dnsmessage.NewName(name + "." + mdnsService); err != nil || len(name) > 63 {
+		return nil, fmt.Errorf("MDNS_NAME: %q is not a valid instance name", name)
+	}
+	if a.host, err = dnsmessage.NewName(hostname + ".local."); err != nil {
+		return nil, fmt.Errorf("mdns: hostname %q: %w", hostname, err)
+	}
+	port := envOr("MDNS_PORT", "")
+	if port == "" {
+		if _, port, err = net.SplitHostPort(listenAddr); err != nil {
+			return nil, fmt.Errorf("mdns: LISTEN_ADDR %q has no port; set MDNS_PORT", listenAddr)
+		}
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return nil, fmt.Errorf("MDNS_PORT: %q is not a port", port)
+	}
+	a.port = uint16(p)
+	if v := envOr("MDNS_INTERFACE", ""); v != "" {
+		if a.iface, err = net.InterfaceByName(v); err != nil {
+			return nil, fmt.Errorf("MDNS_INTERFACE: %w", err)
+		}
+	}
+
+	a.txt = []string{"path=/ws/device/", "version=" + serverVersion(), "proto=" + strconv.Itoa(protocolVersion)}
+	if _, tlsPort, err := net.SplitHostPort(envOr("TLS_LISTEN_ADDR", ":8443")); err == nil && tlsPort == port {
+		a.txt = append(a.txt, "tls=1")
+	}
+	if s.federation != nil && s.federation.region != "" {
+		a.txt = append(a.txt, "region="+s.federation.region)
+	}
+
+	if a.conn, err = net.ListenMulticastUDP("udp4", a.iface, mdnsGroup); err != nil {
+		return nil, fmt.Errorf("mdns: %w", err)
+	}
+	return a, nil
+}
+
+// run answers queries until ctx is done, then withdraws the service.
+func (a *mdnsAdvertiser) run(ctx context.Context) {
+	defer a.conn.Close()
+	go func() {
+		<-ctx.Done()
+		a.conn.SetReadDeadline(time.Now())
+	}()
+	a.s.logf(logInfo, "mdns_started", "instance", a.instance.String(), "port", a.port)
+
+	// Announce twice, a second apart (RFC 6762 §8.3).
+	a.announce(mdnsTTL)
+	announce := time.AfterFunc(time.Second, func() { a.announce(mdnsTTL) })
+	defer announce.Stop()
+
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			a.s.logf(logDebug, "mdns_read_failed", "error", err.Error())
+			continue
+		}
+		a.handle(buf[:n], src)
+	}
+	announce.Stop()
+	a.announce(0)
+	a.s.logf(logInfo, "mdns_stopped", "instance", a.instance.String())
+}
+
+func (a *mdnsAdvertiser) announce(ttl uint32) {
+	answers := append([]dnsmessage.Resource{a.ptr(ttl)}, a.records(ttl)...)
+	if msg, err := a.response(dnsmessage.Header{}, nil, answers, nil); err == nil {
+		_, _ = a.conn.WriteToUDP(msg, mdnsGroup)
+	}
+}
+
+// handle answers one query packet.
+func (a *mdnsAdvertiser) handle(pkt []byte, src *net.UDPAddr) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(pkt)
+	if err != nil || hdr.Response {
+		return
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return
+	}
+	// Queries from a port other than 5353 are one-shot (legacy) resolvers:
+	// reply to them directly, echoing the id and questions (§6.7).
+	legacy := src.Port != mdnsGroup.Port
+	unicast := legacy
+	var answers, extra []dnsmessage.Resource
+	for _, q := range questions {
+		if q.Class&(1<<15) != 0 {
+			unicast = true // QU bit
+		}
+		switch {
+		case sameName(q.Name, mdnsBrowse) && (q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL):
+			answers = append(answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: mdnsTTL},
+				Body:   &dnsmessage.PTRResource{PTR: mustName(mdnsService)},
+			})
+		case sameName(q.Name, mdnsService) && (q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL):
+			answers = append(answers, a.ptr(mdnsTTL))
+			extra = append(extra, a.records(mdnsTTL)...)
+		case sameName(q.Name, a.instance.String()):
+			for _, r := range a.records(mdnsTTL) {
+				if r.Header.Name == a.instance && (q.Type == dnsmessage.TypeALL || q.Type == r.Header.Type) {
+					answers = append(answers, r)
+				} else if r.Header.Name == a.host {
+					extra = append(extra, r)
+				}
+			}
+		case sameName(q.Name, a.host.String()):
+			for _, r := range a.addrRecords(mdnsTTL) {
+				if q.Type == dnsmessage.TypeALL || q.Type == r.Header.Type {
+					answers = append(answers, r)
+				}
+			}
+		}
+	}
+	if len(answers) == 0 {
+		return
+	}
+	var reply dnsmessage.Header
+	var echo []dnsmessage.Question
+	if legacy {
+		reply.ID, echo = hdr.ID, questions
+	}
+	msg, err := a.response(reply, echo, answers, extra)
+	if err != nil {
+		return
+	}
+	dst := mdnsGroup
+	if unicast {
+		dst = src
+	}
+	_, _ = a.conn.WriteToUDP(msg, dst)
+}
+
+func (a *mdnsAdvertiser) response(hdr dnsmessage.Header, questions []dnsmessage.Question, answers, extra []dnsmessage.Resource) ([]byte, error) {
+	hdr.Response, hdr.Authoritative = true, true
+	return (&dnsmessage.Message{Header: hdr, Questions: questions, Answers: answers, Additionals: extra}).Pack()
+}
+
+func (a *mdnsAdvertiser) ptr(ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: mustName(mdnsService), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.PTRResource{PTR: a.instance},
+	}
+}
+
+// records are the instance's SRV and TXT plus the host's addresses, all
+// unique records (cache-flush bit set).
+func (a *mdnsAdvertiser) records(ttl uint32) []dnsmessage.Resource {
+	flush := dnsmessage.ClassINET | 1<<15
+	out := []dnsmessage.Resource{
+		{
+			Header: dnsmessage.ResourceHeader{Name: a.instance, Type: dnsmessage.TypeSRV, Class: flush, TTL: ttl},
+			Body:   &dnsmessage.SRVResource{Target: a.host, Port: a.port},
+		},
+		{
+			Header: dnsmessage.ResourceHeader{Name: a.instance, Type: dnsmessage.TypeTXT, Class: flush, TTL: ttl},
+			Body:   &dnsmessage.TXTResource{TXT: a.txt},
+		},
+	}
+	return append(out, a.addrRecords(ttl)...)
+}
+
+// addrRecords lists the host's current addresses; they are looked up on
+// every answer so DHCP changes are picked up.
+func (a *mdnsAdvertiser) addrRecords(ttl uint32) []dnsmessage.Resource {
+	var ifaces []net.Interface
+	if a.iface != nil {
+		ifaces = []net.Interface{*a.iface}
+	} else {
+		ifaces, _ = net.Interfaces()
+	}
+	flush := dnsmessage.ClassINET | 1<<15
+	var out []dnsmessage.Resource
+	for _, ifc := range ifaces {
+		if ifc.Flags&net.FlagUp == 0 || ifc.Flags&net.FlagLoopback != 0 || ifc.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, _ := ifc.Addrs()
+		for _, addr := range addrs {
+			pfx, err := netip.ParsePrefix(addr.String())
+			if err != nil {
+				continue
+			}
+			ip := pfx.Addr()
+			switch {
+			case ip.Is4():
+				out = append(out, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: a.host, Type: dnsmessage.TypeA, Class: flush, TTL: ttl},
+					Body:   &dnsmessage.AResource{A: ip.As4()},
+				})
+			case ip.Is6() && !ip.IsLinkLocalUnicast():
+				out = append(out, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: a.host, Type: dnsmessage.TypeAAAA, Class: flush, TTL: ttl},
+					Body:   &dnsmessage.AAAAResource{AAAA: ip.As16()},
+				})
+			}
+		}
+	}
+	return out
+}
+
+// sameName compares DNS names, which are case-insensitive.
+func sameName(n dnsmessage.Name, s string) bool {
+	return strings.EqualFold(n.String(), s)
+}
+
+func mustName(s string) dnsmessage.Name {
+	return dnsmessage.MustNewName(s)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// memoryWatchdog compares the process's memory footprint against a soft limit
+// and flips the server into shedding mode when it is crossed: new media
+// tunnels are refused and media frames are dropped, so we degrade streaming
+// instead of letting the OOM killer take down every device session at once.
+type memoryWatchdog struct {
+	softLimit uint64 // bytes; 0 disables the watchdog
+	interval  time.Duration
+
+	shedding atomic.Bool
+	inUse    atomic.Uint64
+}
+
+// Leave shedding mode only once usage drops below this fraction of the limit,
+// so we don't flap around the threshold.
+const memoryRecoverRatio = 0.9
+
+func newMemoryWatchdog(softLimit uint64, interval time.Duration) *memoryWatchdog {
+	return &memoryWatchdog{softLimit: softLimit, interval: interval}
+}
+
+func (m *memoryWatchdog) Shedding() bool { return m.shedding.Load() }
+
+// Run samples memory usage until ctx is done.
+func (m *memoryWatchdog) Run(ctx context.Context, s *server) {
+	if m.softLimit == 0 {
+		return
+	}
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	t := time.NewTicker(m.interval)
+	defer t.Stop()
+	for {
+		metrics.Read(samples)
+		used := samples[0].Value.Uint64() - samples[1].Value.Uint64()
+		m.inUse.Store(used)
+
+		switch {
+		case !m.shedding.Load() && used >= m.softLimit:
+			m.shedding.Store(true)
+			s.logf(logInfo, "memory_shedding_started", "in_use_bytes", int64(used), "soft_limit_bytes", int64(m.softLimit))
+		case m.shedding.Load() && float64(used) < float64(m.softLimit)*memoryRecoverRatio:
+			m.shedding.Store(false)
+			s.logf(logInfo, "memory_shedding_stopped", "in_use_bytes", int64(used), "soft_limit_bytes", int64(m.softLimit))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (s *server) registerMemoryMetrics() {
+	s.metrics.newGaugeFunc("espwifi_memory_in_use_bytes", "Memory obtained from the OS minus heap returned to it.", nil,
+		func(emit func(float64, ...string)) { emit(float64(s.mem.inUse.Load())) })
+	s.metrics.newGaugeFunc("espwifi_memory_soft_limit_bytes", "Configured MEMORY_SOFT_LIMIT (0 = disabled).", nil,
+		func(emit func(float64, ...string)) { emit(float64(s.mem.softLimit)) })
+	s.metrics.newGaugeFunc("espwifi_memory_shedding", "1 while the memory watchdog is shedding media load.", nil,
+		func(emit func(float64, ...string)) {
+			if s.mem.Shedding() {
+				emit(1)
+				return
+			}
+			emit(0)
+		})
+	s.memShedFrames = s.metrics.newCounter("espwifi_memory_shed_frames_total", "Media frames dropped while shedding for memory.")
+	s.memShedTunnels = s.metrics.newCounter("espwifi_memory_shed_tunnels_total", "Media tunnels refused while shedding for memory.")
+}
+
+// isMediaTunnel reports whether tunnel carries camera/audio frames, which
+// are the first thing we give up under pressure.
+func (s *server) isMediaTunnel(tunnel string) bool {
+	_, ok := s.mediaTunnels[tunnel]
+	return ok
+}
+
+func parseTunnelSet(s string) map[string]struct{} {
+	out := make(map[string]struct{})
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			out[t] = struct{}{}
+		}
+	}
+	return out
+}
+
+// parseByteSize parses sizes like "512MiB", "1GB", "64k" or plain bytes.
+func parseByteSize(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	i := len(s)
+	for i > 0 && (s[i-1] < '0' || s[i-1] > '9') {
+		i--
+	}
+	n, err := strconv.ParseUint(s[:i], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	var mult uint64
+	switch strings.ToLower(strings.TrimSpace(s[i:])) {
+	case "", "b":
+		mult = 1
+	case "k", "kb":
+		mult = 1000
+	case "ki", "kib":
+		mult = 1 << 10
+	case "m", "mb":
+		mult = 1000 * 1000
+	case "mi", "mib":
+		mult = 1 << 20
+	case "g", "gb":
+		mult = 1000 * 1000 * 1000
+	case "gi", "gib":
+		mult = 1 << 30
+	default:
+		return 0, fmt.Errorf("invalid size unit in %q", s)
+	}
+	return n * mult, nil
+}
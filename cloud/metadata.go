@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Device metadata: free-form key/value pairs (firmware version, model, ...)
+// kept in the registry. Devices report their own on connect as ?meta_<key>=
+// query parameters (e.g. ?meta_firmware=1.2.3&meta_model=esp32cam), whose
+// names and lengths wsquery.go's meta_* rule checks before the upgrade;
+// operators can edit them via /api/devices/{id}/metadata. Search with
+// GET /api/devices/search?q=firmware:1.2.*,model:esp32cam.
+//
+// Reports only update devices already in the registry, so connecting under
+// made-up IDs doesn't grow it. Keys an operator set win over the device's,
+// and a device adds at most maxReportedMetadataKeys keys of its own.
+
+const (
+	maxMetadataKeys         = 32
+	maxReportedMetadataKeys = 16
+	maxMetadataValue        = 128
+)
+
+func validMetadataKey(k string) bool {
+	if k == "" || len(k) > 32 {
+		return false
+	}
+	for _, c := range k {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// validateMetadata normalizes keys to lower case and checks limits. Empty
+// values are kept: they delete the key when merged.
+func validateMetadata(in map[string]string) (map[string]string, error) {
+	out := make(map[string]string, len(in))
+	for k, v := range in {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if !validMetadataKey(k) {
+			return nil, errors.New("metadata keys must be 1-32 of a-z, 0-9, _ - .")
+		}
+		if v = strings.TrimSpace(v); len(v) > maxMetadataValue {
+			return nil, errors.New("metadata values must be at most 128 bytes")
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+// metadataFromQuery collects a device's ?meta_<key>= parameters.
+func metadataFromQuery(r *http.Request) map[string]string {
+	var out map[string]string
+	for k, vs := range r.URL.Query() {
+		if key, ok := strings.CutPrefix(k, "meta_"); ok && len(vs) > 0 {
+			if out == nil {
+				out = make(map[string]string)
+			}
+			out[key] = vs[0]
+		}
+	}
+	return out
+}
+
+// setMetadata merges an operator's kv into id's metadata (replacing it all
+// when replace is set), registering the device if needed. The keys it sets
+// become operator keys.
+func (reg *deviceRegistry) setMetadata(id string, kv map[string]string, replace bool) (map[string]string, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	d, ok := reg.devices[id]
+	next := make(map[string]string)
+	operator := make(map[string]bool)
+	if ok && !replace {
+		maps.Copy(next, d.Metadata)
+		for _, k := range d.OperatorKeys {
+			operator[k] = true
+		}
+	}
+	for k, v := range kv {
+		if v == "" {
+			delete(next, k)
+			delete(operator, k)
+		} else {
+			next[k] = v
+			operator[k] = true
+		}
+	}
+	if len(next) > maxMetadataKeys {
+		return nil, errors.New("too many metadata keys")
+	}
+	keys := make([]string, 0, len(operator))
+	for k := range operator {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if ok && maps.Equal(next, d.Metadata) && slices.Equal(keys, d.OperatorKeys) || !ok && len(next) == 0 {
+		return next, nil
+	}
+	now := time.Now().UTC()
+	if !ok {
+		d = &registeredDevice{DeviceID: id, CreatedAt: now}
+		reg.devices[id] = d
+	}
+	if len(next) == 0 {
+		next, keys = nil, nil
+	}
+	d.Metadata, d.OperatorKeys = next, keys
+	d.UpdatedAt = now
+	return maps.Clone(next), reg.saveLocked()
+}
+
+// reportMetadata merges what a registered device reported on connect into
+// its metadata, skipping operator keys and keys past the device's share.
+// Unchanged metadata isn't rewritten, so devices can report on every
+// connect. registered is false, and nothing changes, for unknown IDs.
+func (reg *deviceRegistry) reportMetadata(id string, kv map[string]string) (registered bool, ignored []string, err error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	d, ok := reg.devices[id]
+	if !ok {
+		return false, nil, nil
+	}
+	next := make(map[string]string, len(d.Metadata))
+	maps.Copy(next, d.Metadata)
+	operator := make(map[string]bool, len(d.OperatorKeys))
+	for _, k := range d.OperatorKeys {
+		operator[k] = true
+	}
+	own := 0
+	for k := range next {
+		if !operator[k] {
+			own++
+		}
+	}
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		_, has := next[k]
+		switch v := kv[k]; {
+		case operator[k]:
+			ignored = append(ignored, k)
+		case v == "":
+			if has {
+				delete(next, k)
+				own--
+			}
+		case has:
+			next[k] = v
+		case own >= maxReportedMetadataKeys || len(next) >= maxMetadataKeys:
+			ignored = append(ignored, k)
+		default:
+			next[k] = v
+			own++
+		}
+	}
+	if maps.Equal(next, d.Metadata) {
+		return true, ignored, nil
+	}
+	if len(next) == 0 {
+		next = nil
+	}
+	d.Metadata = next
+	d.UpdatedAt = time.Now().UTC()
+	return true, ignored, reg.saveLocked()
+}
+
+// handleDeviceMetadata manages a device's metadata:
+//
+//	GET   /api/devices/{id}/metadata
+//	PUT   /api/devices/{id}/metadata  {"firmware":"1.2.3"}  replace
+//	PATCH /api/devices/{id}/metadata  {"model":""}          merge ("" deletes)
+func (s *server) handleDeviceMetadata(w http.ResponseWriter, r *http.Request, deviceID string) {
+	switch r.Method {
+	case http.MethodGet:
+		if !s.requireRole(w, r, roleViewer) {
+			return
+		}
+		d, _ := s.registry.get(deviceID)
+		md := d.Metadata
+		if md == nil {
+			md = map[string]string{}
+		}
+		writeJSON(w, http.StatusOK, md)
+	case http.MethodPut, http.MethodPatch:
+		if !s.requireRole(w, r, roleOperator) {
+			return
+		}
+		var req map[string]string
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeJSONDecodeError(w, err)
+			return
+		}
+		kv, err := validateMetadata(req)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_metadata", err.Error())
+			return
+		}
+		md, err := s.registry.setMetadata(deviceID, kv, r.Method == http.MethodPut)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_metadata", err.Error())
+			return
+		}
+		if md == nil {
+			md = map[string]string{}
+		}
+		writeJSON(w, http.StatusOK, md)
+		s.logf(logInfo, "device_metadata_set", "remote", clientIP(r), "device_id", deviceID, "keys", len(md))
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+type searchTerm struct {
+	field, pattern string
+}
+
+// parseSearch splits "firmware:1.2.*,model:esp32cam" into terms. Patterns
+// use shell globbing (* ? [...]) and match case-insensitively.
+func parseSearch(q string) ([]searchTerm, error) {
+	var terms []searchTerm
+	for _, part := range strings.Split(q, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		field, pattern, ok := strings.Cut(part, ":")
+		field = strings.ToLower(strings.TrimSpace(field))
+		if !ok || field == "" {
+			return nil, errors.New("q terms must look like field:pattern")
+		}
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.New("bad pattern in " + part)
+		}
+		terms = append(terms, searchTerm{field, pattern})
+	}
+	if len(terms) == 0 {
+		return nil, errors.New("q is required")
+	}
+	return terms, nil
+}
+
+type deviceSearchResult struct {
+	DeviceID string            `json:"device_id"`
+	Online   bool              `json:"online"`
+	Tenant   string            `json:"tenant,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// handleDeviceSearch serves GET /api/devices/search?q=field:pattern,...
+// Every term must match. Besides metadata keys, device_id and tenant can be
+// matched. Connected devices that aren't in the registry are searched too.
+func (s *server) handleDeviceSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.requireRole(w, r, roleViewer) {
+		return
+	}
+	terms, err := parseSearch(r.URL.Query().Get("q"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_query", err.Error())
+		return
+	}
+	online := make(map[string]bool)
+	candidates := s.registry.list()
+	known := make(map[string]bool, len(candidates))
+	for _, d := range candidates {
+		known[d.DeviceID] = true
+	}
+	for _, d := range s.h.snapshot(func(string) string { return "" }) {
+		online[d.DeviceID] = true
+		if !known[d.DeviceID] {
+			known[d.DeviceID] = true
+			candidates = append(candidates, registeredDevice{DeviceID: d.DeviceID})
+		}
+	}
+	out := []deviceSearchResult{}
+	for _, d := range candidates {
+		if !s.hostAllows(r, d.DeviceID) || !s.ownerAllows(r, d.DeviceID) {
+			continue
+		}
+		match := true
+		for _, t := range terms {
+			var v string
+			switch t.field {
+			case "device_id":
+				v = d.DeviceID
+			case "tenant":
+				v = d.Tenant
+			default:
+				var has bool
+				if v, has = d.Metadata[t.field]; !has {
+					match = false
+				}
+			}
+			if ok, _ := path.Match(t.pattern, strings.ToLower(v)); !ok {
+				match = false
+			}
+			if !match {
+				break
+			}
+		}
+		if match {
+			out = append(out, deviceSearchResult{DeviceID: d.DeviceID, Online: online[d.DeviceID], Tenant: d.Tenant, Metadata: d.Metadata})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DeviceID < out[j].DeviceID })
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A tiny Prometheus text-format exposition. The relay only needs counters,
+// scrape-time gauges and a few histograms, which doesn't justify pulling in
+// client_golang.
+
+type metric interface {
+	writeTo(w *bufio.Writer)
+}
+
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{}
+}
+
+func (m *metricsRegistry) register(x metric) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metrics = append(m.metrics, x)
+}
+
+// counterVec is a monotonically increasing counter with optional labels.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu   sync.Mutex
+	vals map[string]*atomic.Uint64 // keyed by joined label values
+}
+
+func (m *metricsRegistry) newCounter(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, vals: make(map[string]*atomic.Uint64)}
+	m.register(c)
+	return c
+}
+
+func (c *counterVec) Add(n uint64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	c.mu.Lock()
+	v := c.vals[key]
+	if v == nil {
+		v = new(atomic.Uint64)
+		c.vals[key] = v
+	}
+	c.mu.Unlock()
+	v.Add(n)
+}
+
+func (c *counterVec) Inc(labelValues ...string) { c.Add(1, labelValues...) }
+
+func (c *counterVec) writeTo(w *bufio.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.vals))
+	for k := range c.vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var values []string
+		if len(c.labels) > 0 {
+			values = strings.Split(k, "\x00")
+		}
+		writeSample(w, c.name, c.labels, values, float64(c.vals[k].Load()))
+	}
+	c.mu.Unlock()
+}
+
+// gaugeFunc is a gauge evaluated at scrape time. collect calls emit once per
+// label combination.
+type gaugeFunc struct {
+	name, help string
+	labels     []string
+	collect    func(emit func(v float64, labelValues ...string))
+}
+
+func (m *metricsRegistry) newGaugeFunc(name, help string, labels []string, collect func(emit func(v float64, labelValues ...string))) {
+	m.register(&gaugeFunc{name: name, help: help, labels: labels, collect: collect})
+}
+
+func (g *gaugeFunc) writeTo(w *bufio.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	g.collect(func(v float64, labelValues ...string) {
+		writeSample(w, g.name, g.labels, labelValues, v)
+	})
+}
+
+// histogramVec is a cumulative histogram with fixed buckets and optional
+// labels.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64 // upper bounds, ascending; +Inf is implicit
+
+	mu   sync.Mutex
+	vals map[string]*histogramData
+}
+
+type histogramData struct {
+	counts []uint64 // per bucket, non-cumulative; last is +Inf
+	sum    float64
+	count  uint64
+}
+
+func (m *metricsRegistry) newHistogram(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, vals: make(map[string]*histogramData)}
+	m.register(h)
+	return h
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	d := h.vals[key]
+	if d == nil {
+		d = &histogramData{counts: make([]uint64, len(h.buckets)+1)}
+		h.vals[key] = d
+	}
+	d.counts[i]++
+	d.sum += v
+	d.count++
+	h.mu.Unlock()
+}
+
+func (h *histogramVec) writeTo(w *bufio.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.vals))
+	for k := range h.vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	bucketLabels := append(append([]string(nil), h.labels...), "le")
+	for _, k := range keys {
+		var values []string
+		if len(h.labels) > 0 {
+			values = strings.Split(k, "\x00")
+		}
+		values = values[:len(values):len(values)] // appends below must copy
+		d := h.vals[k]
+		var cum uint64
+		for i, le := range h.buckets {
+			cum += d.counts[i]
+			writeSample(w, h.name+"_bucket", bucketLabels, append(values, strconv.FormatFloat(le, 'f', -1, 64)), float64(cum))
+		}
+		writeSample(w, h.name+"_bucket", bucketLabels, append(values, "+Inf"), float64(d.count))
+		writeSample(w, h.name+"_sum", h.labels, values, d.sum)
+		writeSample(w, h.name+"_count", h.labels, values, float64(d.count))
+	}
+}
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	w.WriteString("# HELP " + name + " " + help + "\n")
+	w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			val := ""
+			if i < len(values) {
+				val = values[i]
+			}
+			w.WriteString(l + `="` + escapeLabelValue(val) + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	w.WriteByte('\n')
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(s string) string { return labelValueEscaper.Replace(s) }
+
+// handleMetrics serves the Prometheus scrape endpoint. If METRICS_AUTH_TOKEN
+// is set, scrapers must present it.
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if s.metricsAuthToken != "" && !authOK(r, s.metricsAuthToken) {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	s.metrics.mu.Lock()
+	metrics := append([]metric(nil), s.metrics.metrics...)
+	s.metrics.mu.Unlock()
+	for _, m := range metrics {
+		m.writeTo(bw)
+	}
+	_ = bw.Flush()
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// GET /api/openapi.json describes the REST API as an OpenAPI 3.1 document
+// for generating the iOS and dashboard clients. Like /api/protocol, its
+// schemas come from the request and response types the handlers decode and
+// encode (never ad-hoc maps), so they can't drift from the wire. The list
+// of operations below is kept by hand; openapi_test.go fails when a route on
+// the mux, a /api/devices/{id} action or a WebSocket endpoint in
+// wsEndpointParams is missing from it, or an operation's body is a bare map.
+// Commands to a device don't go through REST: they are messages on
+// /ws/ui/{id}, described by /api/protocol.
+
+type apiOperation struct {
+	method, path string
+	summary      string
+	// auth is the least the caller needs: "", "viewer", "operator", "admin",
+	// "owner" (owner or admin), "device" (device credentials) or "token"
+	// (the endpoint's shared token, e.g. METRICS_AUTH_TOKEN).
+	auth   string
+	query  []string // optional query parameters
+	ws     string   // WebSocket endpoint: its query parameters come from wsEndpointParams
+	body   any      // request body type; nil for none
+	status int      // success status
+	resp   any      // success body type; nil for none
+	// rawBody and rawResp are the media types of bodies that aren't JSON.
+	rawBody, rawResp string
+}
+
+// apiOperations lists the documented endpoints.
+func apiOperations() []apiOperation {
+	return []apiOperation{
+		{method: "GET", path: "/healthz", summary: "Liveness; ?detail=1 adds session counts for viewers.", query: []string{"detail"}, status: 200, resp: healthResponse{}},
+		{method: "GET", path: "/readyz", summary: "Readiness; 503 while draining or a dependency is down.", status: 200, resp: readyResponse{}},
+		{method: "GET", path: "/metrics", summary: "Prometheus metrics; needs METRICS_AUTH_TOKEN if it is set.", auth: "token", status: 200, rawResp: "text/plain"},
+		{method: "GET", path: "/api/stats", summary: "Load: sessions, memory and overload shedding.", auth: "viewer", status: 200, resp: statsResponse{}},
+		{method: "GET", path: "/api/protocol", summary: "WebSocket control messages, close codes and features.", status: 200, resp: protocolDoc{}},
+		{method: "GET", path: "/api/ha", summary: "Hot-standby role of this node and where the active is.", status: 200, resp: haStatus{}},
+		{method: "GET", path: "/api/ha/snapshot", summary: "Replicated state for the standby (HA_TOKEN; active only).", auth: "token", status: 200, resp: haSnapshot{}},
+		{method: "GET", path: "/api/federation/locate", summary: "For peer regions: 204 if this region holds the session, else 404.", auth: "token",
+			query: []string{"device_id", "tunnel"}, status: 204},
+		{method: "GET", path: "/api/openapi.json", summary: "This document.", status: 200, rawResp: "application/json"},
+
+		{method: "GET", path: "/api/keys", summary: "API keys (never their tokens).", auth: "admin", status: 200, resp: []apiKeyView{}},
+		{method: "PUT", path: "/api/keys/{name}", summary: "Create or rotate an API key; the token is returned once.", auth: "admin", body: apiKeyRequest{}, status: 200, resp: apiKeyCreated{}},
+		{method: "DELETE", path: "/api/keys/{name}", summary: "Revoke an API key.", auth: "admin", status: 204},
+		{method: "GET", path: "/api/tenants", summary: "Tenants.", auth: "admin", status: 200, resp: []tenant{}},
+		{method: "GET", path: "/api/tenants/{id}", summary: "One tenant.", auth: "admin", status: 200, resp: tenant{}},
+		{method: "PUT", path: "/api/tenants/{id}", summary: "Create or update a tenant.", auth: "admin", body: tenantRequest{}, status: 200, resp: tenant{}},
+		{method: "DELETE", path: "/api/tenants/{id}", summary: "Delete a tenant that has no devices.", auth: "admin", status: 204},
+		{method: "GET", path: "/api/schemas", summary: "Per-tunnel command schemas.", auth: "admin", status: 200, resp: []tunnelSchema{}},
+		{method: "GET", path: "/api/schemas/{tunnel}", summary: "The command schema of a tunnel.", auth: "admin", status: 200, resp: tunnelSchema{}},
+		{method: "PUT", path: "/api/schemas/{tunnel}", summary: "Validate the tunnel's commands against a JSON Schema (the body).", auth: "admin", body: json.RawMessage{}, status: 200, resp: tunnelSchema{}},
+		{method: "DELETE", path: "/api/schemas/{tunnel}", summary: "Stop validating the tunnel's commands.", auth: "admin", status: 204},
+		{method: "GET", path: "/api/filters", summary: "Command filter rules.", auth: "admin", status: 200, resp: []filterRule{}},
+		{method: "GET", path: "/api/filters/{id}", summary: "One filter rule.", auth: "admin", status: 200, resp: filterRule{}},
+		{method: "PUT", path: "/api/filters/{id}", summary: "Create or replace a filter rule.", auth: "admin", body: filterRule{}, status: 200, resp: filterRule{}},
+		{method: "DELETE", path: "/api/filters/{id}", summary: "Remove a filter rule.", auth: "admin", status: 204},
+		{method: "GET", path: "/api/registry", summary: "Every registered device.", auth: "admin", status: 200, resp: []registryView{}},
+		{method: "GET", path: "/api/registry/export", summary: "Registry and tenants as one document, with key hashes and claim secrets.", auth: "admin", status: 200, resp: registryExport{}},
+		{method: "POST", path: "/api/registry/import", summary: "Load an export; mode=merge (default) or replace.", auth: "admin", query: []string{"mode"},
+			body: registryExport{}, status: 200, resp: registryImported{}},
+		{method: "GET", path: "/api/audit", summary: "Audit trail, newest first (since/until: a duration or RFC 3339 time).", auth: "admin",
+			query: []string{"device_id", "actor", "source", "limit", "since", "until"}, status: 200, resp: []auditEntry{}},
+		{method: "GET", path: "/api/conformance", summary: "Latest conformance run per device (CONFORMANCE mode).", auth: "viewer", query: []string{"device_id"}, status: 200, resp: []conformanceRun{}},
+
+		{method: "GET", path: "/api/uptime", summary: "Availability of every device over window=24h|7d|30d, least available first.", auth: "viewer", query: []string{"window"}, status: 200, resp: []uptimeRow{}},
+		{method: "GET", path: "/api/reports/availability", summary: "Availability report over window (default 30d); format=csv for a spreadsheet.", auth: "viewer",
+			query: []string{"window", "format"}, status: 200, resp: availabilityReport{}},
+		{method: "GET", path: "/api/digest", summary: "The offline digest as it would be sent now; format=text for the email body.", auth: "admin", query: []string{"format"}, status: 200, resp: offlineDigest{}},
+		{method: "GET", path: "/api/disconnects", summary: "Fleet disconnects by reason and cause, and the devices with the most.", auth: "viewer", query: []string{"limit", "cause"}, status: 200, resp: fleetDisconnectView{}},
+		{method: "POST", path: "/api/register", summary: "WebSocket URLs for a device; does not create a session.", query: []string{"tunnel"}, body: registerRequest{}, status: 200, resp: deviceInfo{}},
+		{method: "GET", path: "/api/devices", summary: "Device sessions and known devices; group=device nests sessions under each device.", auth: "viewer",
+			query: []string{"sort", "order", "seen_since", "silent_for", "capability", "group"}, status: 200, resp: []deviceInfo{}},
+		{method: "GET", path: "/api/devices/search", summary: "Search devices by metadata, device_id or tenant (q=field:pattern,...).", auth: "viewer", query: []string{"q"}, status: 200, resp: []deviceSearchResult{}},
+		{method: "GET", path: "/api/devices/{id}/share", summary: "Guest share links of a device (tokens are never shown again).", auth: "owner", status: 200, resp: []shareView{}},
+		{method: "POST", path: "/api/devices/{id}/share", summary: "Create a guest share link.", auth: "owner", body: shareRequest{}, status: 200, resp: shareCreated{}},
+		{method: "DELETE", path: "/api/devices/{id}/share/{share_id}", summary: "Revoke a guest share link.", auth: "owner", status: 200, resp: okResponse{}},
+		{method: "GET", path: "/api/devices/{id}/owner", summary: "Owner and accounts the device is shared with.", auth: "viewer", status: 200, resp: ownershipView{}},
+		{method: "PUT", path: "/api/devices/{id}/owner", summary: "Assign or reassign the owner, and optionally the shares.", auth: "admin", body: ownerRequest{}, status: 200, resp: ownershipView{}},
+		{method: "PATCH", path: "/api/devices/{id}/owner", summary: "Change the accounts the device is shared with.", auth: "owner", body: ownerRequest{}, status: 200, resp: ownershipView{}},
+		{method: "DELETE", path: "/api/devices/{id}/owner", summary: "Make the device unowned.", auth: "admin", status: 200, resp: ownershipView{}},
+		{method: "POST", path: "/api/devices/{id}/transfer", summary: "Start an ownership transfer; the code is redeemed with POST /api/transfer.", auth: "owner",
+			body: transferRequest{}, status: 200, resp: transferStarted{}},
+		{method: "DELETE", path: "/api/devices/{id}/transfer", summary: "Cancel a pending transfer.", auth: "owner", status: 200, resp: okResponse{}},
+		{method: "POST", path: "/api/transfer", summary: "Redeem a transfer code for the calling account.", auth: "viewer", body: redeemTransferRequest{}, status: 200, resp: transferRedeemed{}},
+		{method: "GET", path: "/api/devices/{id}/credentials", summary: "Registry entry of a device (never the key).", auth: "admin", status: 200, resp: registryView{}},
+		{method: "PUT", path: "/api/devices/{id}/credentials", summary: "Set or rotate the device's pre-shared key.", auth: "admin", body: credentialsRequest{}, status: 200, resp: credentialsResponse{}},
+		{method: "DELETE", path: "/api/devices/{id}/credentials", summary: "Remove the device's pre-shared key.", auth: "admin", status: 204},
+		{method: "PUT", path: "/api/devices/{id}/claim-secret", summary: "Generate the device's TOTP claim secret (returned once).", auth: "admin", status: 200, resp: claimSecretResponse{}},
+		{method: "DELETE", path: "/api/devices/{id}/claim-secret", summary: "Disable TOTP claims for the device.", auth: "admin", status: 204},
+		{method: "PUT", path: "/api/devices/{id}/tenant", summary: "Assign the device to a tenant (\"\" to unassign).", auth: "admin", body: deviceTenantRequest{}, status: 200, resp: deviceTenant{}},
+		{method: "GET", path: "/api/devices/{id}/metadata", summary: "The device's metadata.", auth: "viewer", status: 200, resp: map[string]string{}},
+		{method: "PUT", path: "/api/devices/{id}/metadata", summary: "Replace the device's metadata.", auth: "operator", body: map[string]string{}, status: 200, resp: map[string]string{}},
+		{method: "PATCH", path: "/api/devices/{id}/metadata", summary: "Merge into the device's metadata (\"\" deletes a key).", auth: "operator", body: map[string]string{}, status: 200, resp: map[string]string{}},
+		{method: "POST", path: "/api/devices/{id}/disconnect", summary: "Close the device's sessions (all tunnels without ?tunnel).", auth: "admin", query: []string{"tunnel"}, status: 200, resp: sessionsClosed{}},
+		{method: "POST", path: "/api/devices/{id}/relocate", summary: "Send the device's sessions to another relay.", auth: "admin", query: []string{"tunnel"}, body: relocateRequest{}, status: 200, resp: sessionsClosed{}},
+		{method: "POST", path: "/api/devices/{id}/deregister", summary: "Forget the device: registry, claims, shares, sessions and retained data.", auth: "admin", status: 200, resp: deregistered{}},
+		{method: "GET", path: "/api/devices/{id}/log-level", summary: "Log level set for the device.", auth: "viewer", status: 200, resp: logLevelSetting{}},
+		{method: "PUT", path: "/api/devices/{id}/log-level", summary: "Set the device's log level.", auth: "operator", body: setLogLevelRequest{}, status: 200, resp: logLevelSetting{}},
+		{method: "DELETE", path: "/api/devices/{id}/log-level", summary: "Clear the device's log level.", auth: "operator", status: 204},
+		{method: "GET", path: "/api/devices/{id}/logs", summary: "Newest retained log lines, across log tunnels unless ?tunnel names one.", auth: "viewer",
+			query: []string{"lines", "tunnel"}, status: 200, resp: deviceLogs{}},
+		{method: "GET", path: "/api/devices/{id}/files", summary: "Uploads in flight and staged pushes from the device.", auth: "viewer", status: 200, resp: deviceFiles{}},
+		{method: "POST", path: "/api/devices/{id}/files", summary: "Upload the body to the device; resume with transfer_id and offset.", auth: "operator",
+			query: []string{"name", "tunnel", "transfer_id", "offset"}, rawBody: "application/octet-stream", status: 200, resp: uploadTransfer{}},
+		{method: "GET", path: "/api/devices/{id}/files/{file}", summary: "Download a staged push.", auth: "viewer", status: 200, rawResp: "application/octet-stream"},
+		{method: "DELETE", path: "/api/devices/{id}/files/{file}", summary: "Delete a staged push.", auth: "operator", status: 204},
+		{method: "GET", path: "/api/devices/{id}/crash", summary: "Crash reports of the device.", auth: "viewer", status: 200, resp: []crashReport{}},
+		{method: "POST", path: "/api/devices/{id}/crash", summary: "Upload a crash report (the body); metadata as X- headers or these parameters.", auth: "device",
+			query: []string{"tunnel", "kind", "firmware_version", "elf_sha256", "reset_reason"}, rawBody: "application/octet-stream", status: 201, resp: crashReport{}},
+		{method: "GET", path: "/api/devices/{id}/crash/{crash_id}", summary: "Download a crash report.", auth: "viewer", status: 200, rawResp: "application/octet-stream"},
+		{method: "DELETE", path: "/api/devices/{id}/crash/{crash_id}", summary: "Delete a crash report.", auth: "operator", status: 204},
+		{method: "GET", path: "/api/devices/{id}/uptime", summary: "The device's availability per window.", auth: "viewer", status: 200, resp: uptimeReport{}},
+		{method: "GET", path: "/api/devices/{id}/maintenance", summary: "Active maintenance window.", auth: "viewer", status: 200, resp: maintenanceWindow{}},
+		{method: "PUT", path: "/api/devices/{id}/maintenance", summary: "Put the device in maintenance.", auth: "operator", body: setMaintenanceRequest{}, status: 200, resp: maintenanceWindow{}},
+		{method: "DELETE", path: "/api/devices/{id}/maintenance", summary: "End the device's maintenance.", auth: "operator", status: 204},
+		{method: "GET", path: "/api/devices/{id}/wake", summary: "How the device is woken, and the last wake.", auth: "viewer", status: 200, resp: wakeView{}},
+		{method: "PUT", path: "/api/devices/{id}/wake", summary: "Mark the device wake-capable (webhook, mqtt or sms).", auth: "operator", body: wakeTarget{}, status: 200, resp: wakeView{}},
+		{method: "DELETE", path: "/api/devices/{id}/wake", summary: "Stop waking the device.", auth: "operator", status: 204},
+		{method: "POST", path: "/api/devices/{id}/wake", summary: "Wake the device now, skipping the cooldown.", auth: "operator", status: 202, resp: wakeView{}},
+		{method: "GET", path: "/api/devices/{id}/disconnects", summary: "Why the device's sessions ended, by reason and cause.", auth: "viewer", status: 200, resp: deviceDisconnectView{}},
+		{method: "GET", path: "/api/devices/{id}/streaming", summary: "Streaming windows, and whether media may run now.", auth: "viewer", status: 200, resp: streamingView{}},
+		{method: "PUT", path: "/api/devices/{id}/streaming", summary: "Limit the device's media tunnels to time windows.", auth: "operator", body: streamSchedule{}, status: 200, resp: streamingView{}},
+		{method: "DELETE", path: "/api/devices/{id}/streaming", summary: "Let media tunnels run at any time.", auth: "operator", status: 204},
+		{method: "GET", path: "/api/devices/{id}/quiet-hours", summary: "Quiet hours (the device's or its tenant's), and whether they are on now.", auth: "viewer", status: 200, resp: quietHoursView{}},
+		{method: "PUT", path: "/api/devices/{id}/quiet-hours", summary: "Hold claim delivery and UI-triggered wakes during time windows.", auth: "operator", body: quietHours{}, status: 200, resp: quietHoursView{}},
+		{method: "DELETE", path: "/api/devices/{id}/quiet-hours", summary: "Fall back to the tenant's quiet hours, if any.", auth: "operator", status: 204},
+		{method: "GET", path: "/api/devices/{id}/bwtest", summary: "Past bandwidth test results.", auth: "viewer", status: 200, resp: []bwtestResult{}},
+		{method: "POST", path: "/api/devices/{id}/bwtest", summary: "Run the device leg of a bandwidth test and return its result.", auth: "operator",
+			query: []string{"seconds", "tunnel"}, status: 200, resp: bwtestResult{}},
+		{method: "GET", path: "/api/devices/{id}/debug", summary: "Per-device debug logging, if on.", auth: "viewer", status: 200, resp: deviceDebug{}},
+		{method: "PUT", path: "/api/devices/{id}/debug", summary: "Turn on per-device debug logging.", auth: "operator", body: setDeviceDebugRequest{}, status: 200, resp: deviceDebug{}},
+		{method: "DELETE", path: "/api/devices/{id}/debug", summary: "Turn off per-device debug logging.", auth: "operator", status: 204},
+
+		{method: "POST", path: "/api/claim", summary: "Redeem a claim code. 202 with a poll token when CLAIM_APPROVAL holds it.", body: claimRequest{}, status: 200, resp: claimResponse{}},
+		{method: "GET", path: "/api/claim", summary: "Poll a held claim: 202 while pending, 403 once denied, else the claim (once).", query: []string{"request"}, status: 200, resp: claimResponse{}},
+		{method: "GET", path: "/api/claims", summary: "Pending claim codes.", auth: "admin", status: 200, resp: []claimView{}},
+		{method: "POST", path: "/api/claims", summary: "Have the server generate a claim code for the device to display.", auth: "device", body: createClaimRequest{}, status: 201, resp: createClaimResponse{}},
+		{method: "POST", path: "/api/claims/{code}/send", summary: "Send a claim link by email or SMS.", auth: "operator", body: claimSendRequest{}, status: 200, resp: claimSendResponse{}},
+		{method: "GET", path: "/api/claim-requests", summary: "Claims awaiting the caller's approval.", auth: "owner", status: 200, resp: []pendingClaim{}},
+		{method: "POST", path: "/api/claim-requests/{request_id}/approve", summary: "Approve a held claim.", auth: "owner", status: 200, resp: pendingClaim{}},
+		{method: "POST", path: "/api/claim-requests/{request_id}/deny", summary: "Deny a held claim.", auth: "owner", status: 200, resp: pendingClaim{}},
+
+		{method: "GET", path: "/ws/device/{id}", summary: "Device WebSocket (101). Messages: see /api/protocol.", auth: "device", ws: "device", status: 101},
+		{method: "GET", path: "/ws/ui/{id}", summary: "UI WebSocket (101); text messages are commands for the device. See /api/protocol.", ws: "ui", status: 101},
+		{method: "GET", path: "/ws/serial/{id}", summary: "Serial terminal WebSocket (101): the UI WebSocket of the device's serial tunnel.", ws: "ui", status: 101},
+		{method: "GET", path: "/ws/admin/logs", summary: "Live relay log events (101).", auth: "admin", ws: "admin_logs", status: 101},
+		{method: "GET", path: "/ws/admin/devices", summary: "Live device list changes (101).", auth: "viewer", ws: "admin_devices", status: 101},
+		{method: "GET", path: "/ws/upstream", summary: "Relay-to-relay backhaul (101; UPSTREAM_AUTH_TOKEN).", auth: "token", ws: "upstream", status: 101},
+		{method: "GET", path: "/ws/bwtest/{id}", summary: "Client leg of a bandwidth test (101).", auth: "viewer", ws: "bwtest", status: 101},
+	}
+}
+
+// openAPISpec builds the document for a relay whose WebSocket base URL is
+// wsBase.
+func openAPISpec(wsBase string) map[string]any {
+	base := wsBase
+	if rest, ok := strings.CutPrefix(base, "ws"); ok {
+		base = "http" + rest
+	}
+	schemas := map[string]any{}
+	ref := func(v any) map[string]any { return openAPISchemaRef(reflect.TypeOf(v), schemas) }
+	errorResp := map[string]any{"description": "Error", "content": map[string]any{
+		"application/json": map[string]any{"schema": ref(apiError{})}}}
+
+	paths := map[string]any{}
+	for _, op := range apiOperations() {
+		o := map[string]any{
+			"summary":     op.summary,
+			"operationId": openAPIOperationID(op.method, op.path),
+			"responses":   map[string]any{"default": errorResp},
+		}
+		var params []any
+		for _, seg := range strings.Split(op.path, "/") {
+			if strings.HasPrefix(seg, "{") {
+				params = append(params, map[string]any{"name": strings.Trim(seg, "{}"), "in": "path", "required": true,
+					"schema": map[string]any{"type": "string"}})
+			}
+		}
+		for _, q := range op.query {
+			params = append(params, map[string]any{"name": q, "in": "query", "schema": map[string]any{"type": "string"}})
+		}
+		for _, q := range wsEndpointParams[op.ws] {
+			p := wsParams[q]
+			schema := map[string]any{"type": "string", "maxLength": p.max}
+			if p.re != nil {
+				schema["pattern"] = p.re.String()
+			}
+			if p.key != nil {
+				// A family like meta_*: exploded, each property is a parameter.
+				names := "^" + strings.TrimSuffix(q, "*") + strings.TrimPrefix(p.key.String(), "^")
+				params = append(params, map[string]any{"name": q, "in": "query", "style": "form", "explode": true,
+					"schema": map[string]any{"type": "object", "propertyNames": map[string]any{"pattern": names},
+						"additionalProperties": schema}})
+				continue
+			}
+			params = append(params, map[string]any{"name": q, "in": "query", "schema": schema})
+		}
+		if len(params) > 0 {
+			o["parameters"] = params
+		}
+		raw := func(mediaType string) map[string]any {
+			if mediaType == "application/octet-stream" {
+				return map[string]any{mediaType: map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}
+			}
+			return map[string]any{mediaType: map[string]any{}}
+		}
+		switch {
+		case op.body != nil:
+			o["requestBody"] = map[string]any{"required": true, "content": map[string]any{
+				"application/json": map[string]any{"schema": ref(op.body)}}}
+		case op.rawBody != "":
+			o["requestBody"] = map[string]any{"required": true, "content": raw(op.rawBody)}
+		}
+		ok := map[string]any{"description": http.StatusText(op.status)}
+		switch {
+		case op.resp != nil:
+			ok["content"] = map[string]any{"application/json": map[string]any{"schema": ref(op.resp)}}
+		case op.rawResp != "":
+			ok["content"] = raw(op.rawResp)
+		}
+		o["responses"].(map[string]any)[strconv.Itoa(op.status)] = ok
+		switch op.auth {
+		case "":
+		case "device":
+			o["security"] = []any{map[string]any{"deviceKey": []any{}}, map[string]any{"bearer": []any{}}}
+			o["description"] = "Authenticates with the device's key, DEVICE_AUTH_TOKEN or its session's UI token."
+		case "token":
+			o["security"] = []any{map[string]any{"bearer": []any{}}}
+			o["description"] = "Authenticates with the endpoint's shared token."
+		default:
+			o["security"] = []any{map[string]any{"bearer": []any{}}, map[string]any{"apiKey": []any{}}}
+			o["description"] = "Requires role " + op.auth + "."
+		}
+		item, _ := paths[op.path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[op.path] = item
+		}
+		item[strings.ToLower(op.method)] = o
+	}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":   "ESPWiFi Cloud Tunnel",
+			"version": serverVersion(),
+		},
+		"servers": []any{map[string]any{"url": base}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"bearer":    map[string]any{"type": "http", "scheme": "bearer"},
+				"apiKey":    map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"deviceKey": map[string]any{"type": "apiKey", "in": "header", "name": "X-Device-Key"},
+			},
+		},
+	}
+}
+
+// openAPISchemaRef returns the schema for t, registering named structs under
+// components so generated clients get one type per Go type.
+func openAPISchemaRef(t reflect.Type, schemas map[string]any) map[string]any {
+	switch {
+	case t.Kind() == reflect.Pointer:
+		return openAPISchemaRef(t.Elem(), schemas)
+	case t.Kind() == reflect.Slice:
+		return map[string]any{"type": "array", "items": openAPISchemaRef(t.Elem(), schemas)}
+	case t.Kind() == reflect.Struct && t.Name() != "" && t != reflect.TypeOf(time.Time{}):
+		name := []rune(t.Name())
+		name[0] = unicode.ToUpper(name[0])
+		if _, ok := schemas[string(name)]; !ok {
+			schemas[string(name)] = jsonSchemaFor(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + string(name)}
+	}
+	return jsonSchemaFor(t)
+}
+
+// openAPIOperationID turns "POST /api/claims/{code}/send" into
+// "postClaimsCodeSend".
+func openAPIOperationID(method, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	for _, seg := range strings.Split(strings.TrimPrefix(path, "/api"), "/") {
+		seg = strings.Trim(seg, "{}")
+		for _, word := range strings.FieldsFunc(seg, func(r rune) bool { return r == '_' || r == '-' || r == '.' }) {
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return b.String()
+}
+
+func (s *server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	s.setCORS(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, openAPISpec(s.publicBaseFor(r, "")))
+}
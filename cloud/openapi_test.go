@@ -0,0 +1,132 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestOpenAPICoversRoutes fails when a route is added without documenting
+// it in apiOperations: every pattern registered on the mux in main.go, every
+// action handleDeviceAPI routes, and every WebSocket endpoint with a query
+// table must have an operation.
+func TestOpenAPICoversRoutes(t *testing.T) {
+	f, err := parser.ParseFile(token.NewFileSet(), "main.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var patterns, actions []string
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.CallExpr:
+			sel, ok := n.Fun.(*ast.SelectorExpr)
+			if !ok || (sel.Sel.Name != "HandleFunc" && sel.Sel.Name != "Handle") || len(n.Args) == 0 {
+				return true
+			}
+			if x, ok := sel.X.(*ast.Ident); ok && x.Name == "mux" {
+				if p, ok := stringLit(n.Args[0]); ok {
+					patterns = append(patterns, p)
+				}
+			}
+		case *ast.FuncDecl:
+			if n.Name.Name != "handleDeviceAPI" {
+				return true
+			}
+			ast.Inspect(n.Body, func(n ast.Node) bool {
+				if sw, ok := n.(*ast.SwitchStmt); ok {
+					if tag, ok := sw.Tag.(*ast.Ident); ok && tag.Name == "action" {
+						for _, c := range sw.Body.List {
+							for _, e := range c.(*ast.CaseClause).List {
+								if a, ok := stringLit(e); ok {
+									actions = append(actions, a)
+								}
+							}
+						}
+					}
+				}
+				return true
+			})
+			return false
+		}
+		return true
+	})
+	if len(patterns) < 10 || len(actions) < 10 {
+		t.Fatalf("found %d mux patterns and %d device actions in main.go; has routing moved?", len(patterns), len(actions))
+	}
+
+	ops := apiOperations()
+	documented := func(prefix string) bool {
+		for _, op := range ops {
+			if op.path == prefix || strings.HasPrefix(op.path, prefix+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	// The dashboard, not part of the API.
+	undocumented := map[string]bool{"/": true, "/admin": true}
+	for _, p := range patterns {
+		p = strings.TrimSuffix(p, "/")
+		if p == "" {
+			p = "/"
+		}
+		if !undocumented[p] && !documented(p) {
+			t.Errorf("mux pattern %s has no apiOperation", p)
+		}
+	}
+	for _, a := range actions {
+		if !documented("/api/devices/{id}/" + a) {
+			t.Errorf("device action %s has no apiOperation", a)
+		}
+	}
+
+	for ep := range wsEndpointParams {
+		if ep == "echo" {
+			continue // /ws/{device,ui}/_echo, documented with /api/protocol
+		}
+		found := false
+		for _, op := range ops {
+			found = found || op.ws == ep
+		}
+		if !found {
+			t.Errorf("WebSocket endpoint %s has no apiOperation", ep)
+		}
+	}
+}
+
+// TestOpenAPINoAdHocMaps keeps operations on named types: a map with
+// interface values tells a generated client nothing about the body.
+func TestOpenAPINoAdHocMaps(t *testing.T) {
+	for _, op := range apiOperations() {
+		for what, v := range map[string]any{"body": op.body, "resp": op.resp} {
+			if v == nil {
+				continue
+			}
+			ty := reflect.TypeOf(v)
+			for ty.Kind() == reflect.Slice || ty.Kind() == reflect.Pointer {
+				ty = ty.Elem()
+			}
+			if ty.Kind() == reflect.Map && ty.Elem().Kind() == reflect.Interface {
+				t.Errorf("%s %s: %s is %s; use a named type", op.method, op.path, what, ty)
+			}
+		}
+		if op.ws != "" {
+			if _, ok := wsEndpointParams[op.ws]; !ok {
+				t.Errorf("%s %s: ws endpoint %q is not in wsEndpointParams", op.method, op.path, op.ws)
+			}
+		}
+	}
+}
+
+func stringLit(e ast.Expr) (string, bool) {
+	lit, ok := e.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", false
+	}
+	s, err := strconv.Unquote(lit.Value)
+	return s, err == nil
+}
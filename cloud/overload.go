@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Overload shedding. Under sustained pressure the relay gives traffic up in
+// a fixed order instead of slowing every session down together:
+//
+//	level 0  none
+//	level 1  media: binary frames on MEDIA_TUNNELS are dropped
+//	level 2  logs:  messages on LOG_TUNNELS are dropped as well
+//
+// Control and every other tunnel are never shed. Pressure is the highest of
+// three ratios, each against its threshold:
+//
+//	SHED_CPU=0.9            process CPU time as a fraction of GOMAXPROCS ("off" disables)
+//	SHED_QUEUE_DELAY=500ms  longest wait between reading a device message and forwarding it (0 disables)
+//	MEMORY_SOFT_LIMIT       memory in use; see memory.go
+//
+// Pressure at or above 1 for SHED_SUSTAIN (15s) raises the level by one, and
+// below SHED_RECOVER_RATIO (0.8) for as long lowers it by one, so the relay
+// steps through the levels rather than jumping. Samples are taken every
+// SHED_INTERVAL (1s).
+
+const (
+	shedNone = iota
+	shedMedia
+	shedLogs
+)
+
+var shedLevelNames = []string{"none", "media", "logs"}
+
+type loadShedder struct {
+	cpuLimit     float64       // 0 disables
+	queueLimit   time.Duration // 0 disables
+	recoverRatio float64
+	sustain      time.Duration
+	interval     time.Duration
+
+	level    atomic.Int32
+	maxQueue atomic.Int64 // longest queue delay since the last sample, ns
+
+	mu     sync.Mutex
+	status shedStatus
+}
+
+// shedStatus is the shedder's last sample, as reported by /api/stats.
+type shedStatus struct {
+	Level        int        `json:"level"`
+	Name         string     `json:"name"`
+	Since        *time.Time `json:"since,omitempty"`
+	Reason       string     `json:"reason,omitempty"` // signal behind the last change
+	Pressure     float64    `json:"pressure"`
+	CPU          float64    `json:"cpu"`
+	QueueDelayMs float64    `json:"queue_delay_ms"`
+	Memory       float64    `json:"memory"` // fraction of MEMORY_SOFT_LIMIT
+}
+
+func newLoadShedder() *loadShedder {
+	ls := &loadShedder{
+		cpuLimit:     envFloat("SHED_CPU", 0.9),
+		queueLimit:   envDuration("SHED_QUEUE_DELAY", 500*time.Millisecond),
+		recoverRatio: envFloat("SHED_RECOVER_RATIO", 0.8),
+		sustain:      envDuration("SHED_SUSTAIN", 15*time.Second),
+		interval:     envDuration("SHED_INTERVAL", time.Second),
+		status:       shedStatus{Name: shedLevelNames[shedNone]},
+	}
+	if ls.interval <= 0 {
+		ls.interval = time.Second
+	}
+	return ls
+}
+
+// Level is the current shedding level.
+func (ls *loadShedder) Level() int { return int(ls.level.Load()) }
+
+// noteQueueDelay records how long a device message waited to be forwarded.
+func (ls *loadShedder) noteQueueDelay(d time.Duration) {
+	for {
+		cur := ls.maxQueue.Load()
+		if int64(d) <= cur || ls.maxQueue.CompareAndSwap(cur, int64(d)) {
+			return
+		}
+	}
+}
+
+func (ls *loadShedder) snapshot() shedStatus {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.status
+}
+
+// Run samples the pressure signals until ctx is done.
+func (ls *loadShedder) Run(ctx context.Context, s *server) {
+	t := time.NewTicker(ls.interval)
+	defer t.Stop()
+	lastCPU, cpuOK := processCPUTime()
+	lastAt := time.Now()
+	var over, under time.Duration
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		now := time.Now()
+		st := ls.snapshot()
+
+		st.CPU = 0
+		if cpu, ok := processCPUTime(); ok && cpuOK {
+			if wall := now.Sub(lastAt); wall > 0 {
+				st.CPU = float64(cpu-lastCPU) / float64(wall) / float64(runtime.GOMAXPROCS(0))
+			}
+			lastCPU = cpu
+		}
+		lastAt = now
+		queue := time.Duration(ls.maxQueue.Swap(0))
+		st.QueueDelayMs = float64(queue) / float64(time.Millisecond)
+		st.Memory = 0
+		if s.mem.softLimit > 0 {
+			st.Memory = float64(s.mem.inUse.Load()) / float64(s.mem.softLimit)
+		}
+
+		st.Pressure = 0
+		reason := ""
+		for _, sig := range []struct {
+			name  string
+			ratio float64
+		}{
+			{"cpu", ratioOf(st.CPU, ls.cpuLimit)},
+			{"queue", ratioOf(float64(queue), float64(ls.queueLimit))},
+			{"memory", st.Memory},
+		} {
+			if sig.ratio > st.Pressure {
+				st.Pressure, reason = sig.ratio, sig.name
+			}
+		}
+
+		level := int(ls.level.Load())
+		switch {
+		case st.Pressure >= 1:
+			over, under = over+ls.interval, 0
+			if over >= ls.sustain && level < shedLogs {
+				level, over = level+1, 0
+			}
+		case st.Pressure < ls.recoverRatio:
+			over, under = 0, under+ls.interval
+			if under >= ls.sustain && level > shedNone {
+				level, under = level-1, 0
+				reason = "recovered"
+			}
+		default:
+			over, under = 0, 0
+		}
+		if level != st.Level {
+			ls.level.Store(int32(level))
+			at := now.UTC()
+			st.Level, st.Name, st.Since, st.Reason = level, shedLevelNames[level], &at, reason
+			s.logf(logInfo, "shed_level_changed", "level", level, "name", st.Name, "reason", reason,
+				"pressure", strconv.FormatFloat(st.Pressure, 'f', 2, 64))
+		}
+		ls.mu.Lock()
+		ls.status = st
+		ls.mu.Unlock()
+	}
+}
+
+func ratioOf(v, limit float64) float64 {
+	if limit <= 0 {
+		return 0
+	}
+	return v / limit
+}
+
+// sheds reports whether a device message on tunnel is dropped at the
+// current level, and which class it was shed as.
+func (s *server) sheds(tunnel string, mt int) (string, bool) {
+	switch level := s.shed.Level(); {
+	case level >= shedMedia && mt == websocket.BinaryMessage && s.isMediaTunnel(tunnel):
+		return "media", true
+	case level >= shedLogs && s.isLogTunnel(tunnel):
+		return "logs", true
+	}
+	return "", false
+}
+
+func (s *server) registerShedMetrics() {
+	s.metrics.newGaugeFunc("espwifi_shed_level", "Overload shedding level: 0 none, 1 media, 2 logs.", nil,
+		func(emit func(float64, ...string)) { emit(float64(s.shed.Level())) })
+	s.metrics.newGaugeFunc("espwifi_shed_pressure", "Load as a fraction of its shedding threshold, by signal.", []string{"signal"},
+		func(emit func(float64, ...string)) {
+			st := s.shed.snapshot()
+			emit(ratioOf(st.CPU, s.shed.cpuLimit), "cpu")
+			emit(ratioOf(st.QueueDelayMs, float64(s.shed.queueLimit)/float64(time.Millisecond)), "queue")
+			emit(st.Memory, "memory")
+		})
+	s.shedMessages = s.metrics.newCounter("espwifi_shed_messages_total",
+		"Device messages dropped by overload shedding, by class (media, logs).", "class")
+}
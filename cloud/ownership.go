@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Device ownership. Accounts are API keys (see rbac.go): redeeming a claim
+// code with an API key records its name as the device's owner. From then on
+// only the owner, accounts it is shared with, and admins may open UI
+// sessions for the device or call /api/devices/{id}/... on it; a device
+// token alone is no longer enough, so a resold device's old token is dead.
+// Unowned devices keep the plain token model.
+
+var errOwnedElsewhere = errors.New("device belongs to another account")
+
+const maxSharedAccounts = 32
+
+// callerAccount returns the account (API key name) the request
+// authenticates as, or "" for anonymous and ADMIN_AUTH_TOKEN callers.
+func (s *server) callerAccount(r *http.Request) (string, role) {
+	ro, name := s.roleFor(r)
+	if name == "admin_token" {
+		return "", ro
+	}
+	return name, ro
+}
+
+// ownerAllows reports whether the caller may use deviceID.
+func (s *server) ownerAllows(r *http.Request, deviceID string) bool {
+	d, ok := s.registry.get(deviceID)
+	if !ok || d.Owner == "" {
+		return true
+	}
+	account, ro := s.callerAccount(r)
+	if ro >= roleAdmin {
+		return true
+	}
+	return account != "" && (account == d.Owner || slices.Contains(d.SharedWith, account))
+}
+
+// accountHolds reports whether the caller's account owns deviceID or has it
+// shared, so its role alone may open the device; admins hold every device.
+// Unlike ownerAllows, an unowned device is held by nobody.
+func (s *server) accountHolds(r *http.Request, deviceID string) bool {
+	account, ro := s.callerAccount(r)
+	if ro >= roleAdmin {
+		return true
+	}
+	d, ok := s.registry.get(deviceID)
+	return ok && account != "" && (account == d.Owner || slices.Contains(d.SharedWith, account))
+}
+
+// requireHolder guards per-device settings that reach past the relay (wake
+// targets, streaming windows): admins pass, and operators only if their
+// account holds deviceID (accountHolds), so an unowned device is left to
+// admins.
+func (s *server) requireHolder(w http.ResponseWriter, r *http.Request, deviceID string) bool {
+	if !s.requireRole(w, r, roleOperator) {
+		return false
+	}
+	if s.accountHolds(r, deviceID) {
+		return true
+	}
+	if d, _ := s.registry.get(deviceID); d.Owner != "" {
+		writeAPIError(w, http.StatusForbidden, "owned_elsewhere", errOwnedElsewhere.Error())
+	} else {
+		writeAPIError(w, http.StatusForbidden, "forbidden", "requires the device's owner or an admin")
+	}
+	return false
+}
+
+// requireOwner is ownerAllows with the error response.
+func (s *server) requireOwner(w http.ResponseWriter, r *http.Request, deviceID string) bool {
+	if s.ownerAllows(r, deviceID) {
+		return true
+	}
+	if ro, _ := s.roleFor(r); ro == roleNone {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+	} else {
+		writeAPIError(w, http.StatusForbidden, "owned_elsewhere", errOwnedElsewhere.Error())
+	}
+	return false
+}
+
+// claimOwnedElsewhere reports whether redeeming ce must be refused because
+// the device belongs to another account, unless the owner gets to approve
+// the claim anyway. A one-time control code makes the redeemer the owner; a
+// view claim or a multi-use code only opens or shares the device, so the
+// owner's shared accounts may redeem those too.
+func (s *server) claimOwnedElsewhere(r *http.Request, ce claimEntry, viewOnly bool, account string) bool {
+	switch {
+	case s.claimNeedsApproval(ce.DeviceID):
+		return false
+	case viewOnly || ce.multiUse():
+		return !s.ownerAllows(r, ce.DeviceID)
+	default:
+		return s.registry.ownedByOther(ce.DeviceID, account)
+	}
+}
+
+// ownedByOther reports whether deviceID has an owner other than account.
+func (reg *deviceRegistry) ownedByOther(id, account string) bool {
+	d, ok := reg.get(id)
+	return ok && d.Owner != "" && d.Owner != account
+}
+
+// claimOwnership makes account the owner of id unless someone else already
+// is, registering the device if needed.
+func (reg *deviceRegistry) claimOwnership(id, account string) error {
+	now := time.Now().UTC()
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	d, ok := reg.devices[id]
+	if ok && d.Owner == account {
+		return nil
+	}
+	if ok && d.Owner != "" {
+		return errOwnedElsewhere
+	}
+	if !ok {
+		d = &registeredDevice{DeviceID: id, CreatedAt: now}
+		reg.devices[id] = d
+	}
+	d.Owner = account
+	d.UpdatedAt = now
+	return reg.saveLocked()
+}
+
+// setOwnership sets id's owner and shares. A nil shared keeps the current
+// shares unless the owner changes.
+func (reg *deviceRegistry) setOwnership(id, owner string, shared []string) (registeredDevice, error) {
+	now := time.Now().UTC()
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	d, ok := reg.devices[id]
+	if !ok {
+		if owner == "" {
+			return registeredDevice{DeviceID: id}, nil
+		}
+		d = &registeredDevice{DeviceID: id, CreatedAt: now}
+		reg.devices[id] = d
+	}
+	if shared == nil && owner != d.Owner {
+		shared = []string{}
+	}
+	d.Owner = owner
+	if shared != nil {
+		d.SharedWith = shared
+		if len(shared) == 0 || owner == "" {
+			d.SharedWith = nil
+		}
+	}
+	d.UpdatedAt = now
+	return *d, reg.saveLocked()
+}
+
+func validAccountName(name string) bool {
+	return name != "" && len(name) <= 64 && !strings.Contains(name, "/")
+}
+
+func normalizeAccounts(in []string, owner string) ([]string, bool) {
+	out := make([]string, 0, len(in))
+	for _, a := range in {
+		a = strings.TrimSpace(a)
+		if a == owner || slices.Contains(out, a) {
+			continue
+		}
+		if !validAccountName(a) {
+			return nil, false
+		}
+		out = append(out, a)
+	}
+	sort.Strings(out)
+	return out, len(out) <= maxSharedAccounts
+}
+
+// ownerRequest is the body of PUT and PATCH /api/devices/{id}/owner.
+type ownerRequest struct {
+	Owner      string   `json:"owner,omitempty"`
+	SharedWith []string `json:"shared_with,omitempty"`
+}
+
+type ownershipView struct {
+	DeviceID   string   `json:"device_id"`
+	Owner      string   `json:"owner,omitempty"`
+	SharedWith []string `json:"shared_with"`
+}
+
+func ownershipOf(d registeredDevice) ownershipView {
+	v := ownershipView{DeviceID: d.DeviceID, Owner: d.Owner, SharedWith: d.SharedWith}
+	if v.SharedWith == nil {
+		v.SharedWith = []string{}
+	}
+	return v
+}
+
+// handleDeviceOwner manages /api/devices/{id}/owner:
+//
+//	GET                                              owner, shared users or admin
+//	PUT    {"owner":"alice","shared_with":["bob"]}  admin: assign or reassign
+//	PATCH  {"shared_with":["bob"]}                  owner or admin: change shares
+//	DELETE                                           admin: make the device unowned
+func (s *server) handleDeviceOwner(w http.ResponseWriter, r *http.Request, deviceID string) {
+	switch r.Method {
+	case http.MethodGet:
+		if !s.requireRole(w, r, roleViewer) {
+			return
+		}
+		d, _ := s.registry.get(deviceID)
+		d.DeviceID = deviceID
+		writeJSON(w, http.StatusOK, ownershipOf(d))
+	case http.MethodPut, http.MethodPatch, http.MethodDelete:
+		var req ownerRequest
+		if r.Method != http.MethodDelete {
+			if err := decodeJSONBody(w, r, &req); err != nil {
+				writeJSONDecodeError(w, err)
+				return
+			}
+		}
+		cur, _ := s.registry.get(deviceID)
+		owner := cur.Owner
+		if r.Method == http.MethodPatch {
+			if account, _ := s.callerAccount(r); account == "" || account != cur.Owner {
+				if !s.requireRole(w, r, roleAdmin) {
+					return
+				}
+			}
+			if cur.Owner == "" {
+				writeAPIError(w, http.StatusConflict, "no_owner", "device has no owner")
+				return
+			}
+			if req.SharedWith == nil {
+				req.SharedWith = []string{}
+			}
+		} else {
+			if !s.requireRole(w, r, roleAdmin) {
+				return
+			}
+			owner = strings.TrimSpace(req.Owner)
+			if r.Method == http.MethodPut && !validAccountName(owner) {
+				writeAPIError(w, http.StatusBadRequest, "invalid_owner", "owner must be an account (API key) name")
+				return
+			}
+		}
+		var shared []string
+		if req.SharedWith != nil {
+			var ok bool
+			if shared, ok = normalizeAccounts(req.SharedWith, owner); !ok {
+				writeAPIError(w, http.StatusBadRequest, "invalid_shared_with", "shared_with must list at most 32 account names")
+				return
+			}
+		}
+		d, err := s.registry.setOwnership(deviceID, owner, shared)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist registry")
+			return
+		}
+		writeJSON(w, http.StatusOK, ownershipOf(d))
+		s.logf(logInfo, "device_owner_set", "remote", clientIP(r), "device_id", deviceID, "owner", d.Owner, "shared", len(d.SharedWith))
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
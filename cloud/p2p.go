@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// Direct peer-to-peer upgrade. With P2P_ICE_SERVERS set (STUN/TURN URLs for
+// the peers to gather candidates with), a UI connecting with ?p2p=1 gets a
+// p2p_config carrying its peer id and the ICE servers, and the relay
+// carries signaling between it and the device:
+//
+//   - UI -> device: any {"type":"p2p_*"} message is stamped with the
+//     sender's "ui" id and "scope". It is rate limited, filtered and
+//     audited like any UI message, but bypasses schemas and dedup, and is
+//     the only thing a view-only UI may send (the device decides what a
+//     viewer may set up).
+//   - device -> UI: a p2p_* message with "ui" goes to that UI only.
+//
+// Once the device sends p2p_established for a UI, binary frames (the
+// stream) are no longer relayed to that UI; text still is. p2p_closed from
+// either side hands the stream back to the relay, which stays the fallback
+// throughout.
+
+const p2pPrefix = "p2p_"
+
+// p2pPeer is one ?p2p=1 UI's signaling state. Shared by every copy of its
+// uiOptions.
+type p2pPeer struct {
+	id     string
+	direct atomic.Bool
+}
+
+var p2pPeerSeq atomic.Uint64
+
+func newP2PPeer() *p2pPeer {
+	return &p2pPeer{id: "u" + strconv.FormatUint(p2pPeerSeq.Add(1), 36)}
+}
+
+type p2pConfigMsg struct {
+	Type       string   `json:"type"`
+	UI         string   `json:"ui"`
+	ICEServers []string `json:"ice_servers"`
+}
+
+// p2pSignalMsg documents the signaling envelope; everything else in the
+// message (sdp, candidate, ...) is passed through untouched.
+type p2pSignalMsg struct {
+	Type  string `json:"type"`
+	UI    string `json:"ui"`
+	Scope string `json:"scope,omitempty"` // stamped on UI -> device
+}
+
+// describeP2PSignal catalogues the p2p_* family for /api/protocol.
+func describeP2PSignal(direction, description string) protocolMessage {
+	pm := describeMessage("", direction, description, p2pSignalMsg{})
+	pm.Type = p2pPrefix + "*"
+	if props, ok := pm.Schema["properties"].(map[string]any); ok {
+		props["type"] = map[string]any{"type": "string", "pattern": "^" + p2pPrefix}
+	}
+	return pm
+}
+
+func parseICEServers(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// p2pSignal reports msg's type and ui if it is a p2p_* signaling message.
+func p2pSignal(msg []byte) (typ, ui string, ok bool) {
+	if !bytes.Contains(msg, []byte(`"`+p2pPrefix)) {
+		return "", "", false
+	}
+	var sig p2pSignalMsg
+	if json.Unmarshal(msg, &sig) != nil || !strings.HasPrefix(sig.Type, p2pPrefix) {
+		return "", "", false
+	}
+	return sig.Type, sig.UI, true
+}
+
+// stampP2P sets "ui" and "scope" on a UI's signaling message.
+func stampP2P(msg []byte, peer *p2pPeer, scope uiScope) ([]byte, bool) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(msg, &fields) != nil {
+		return nil, false
+	}
+	fields["ui"] = mustJSON(peer.id)
+	fields["scope"] = mustJSON(scope.String())
+	return mustJSON(fields), true
+}
+
+// isUIP2PSignal reports whether a message from the UI with opts is a
+// signaling message.
+func isUIP2PSignal(opts uiOptions, mt int, msg []byte) bool {
+	if opts.p2p == nil || mt != websocket.TextMessage {
+		return false
+	}
+	_, _, ok := p2pSignal(msg)
+	return ok
+}
+
+// uiP2PSignal forwards a UI's signaling message to the device; false if msg
+// isn't one.
+func (s *server) uiP2PSignal(dc *deviceConn, opts uiOptions, scope uiScope, msg []byte) bool {
+	if opts.p2p == nil {
+		return false
+	}
+	typ, _, ok := p2pSignal(msg)
+	if !ok {
+		return false
+	}
+	out, ok := stampP2P(msg, opts.p2p, scope)
+	if !ok {
+		return false
+	}
+	if typ == "p2p_closed" && opts.p2p.direct.Swap(false) {
+		deviceID, tunnel := splitKey(dc.id)
+		s.logf(logInfo, "p2p_closed", "device_id", deviceID, "tunnel", tunnel, "ui", opts.p2p.id, "by", "ui")
+	}
+	if err := dc.writeDevice(websocket.TextMessage, out); err == nil {
+		dc.bytesToDevice.Add(uint64(len(out)))
+	}
+	return true
+}
+
+// deviceP2PSignal routes a device's signaling message to the UI it names;
+// false if msg isn't one.
+func (ds *deviceSession) deviceP2PSignal(msg []byte) bool {
+	typ, id, ok := p2pSignal(msg)
+	if !ok || id == "" {
+		return false
+	}
+	dc := ds.dc
+	var target *websocket.Conn
+	var peer *p2pPeer
+	dc.uiMu.Lock()
+	for c, o := range dc.uiConns {
+		if o.p2p != nil && o.p2p.id == id {
+			target, peer = c, o.p2p
+			break
+		}
+	}
+	dc.uiMu.Unlock()
+	if target == nil {
+		return true // that UI is gone
+	}
+	switch typ {
+	case "p2p_established":
+		if !peer.direct.Swap(true) {
+			ds.s.p2pEstablished.Inc(ds.s.tunnelLabel(ds.tunnel))
+			ds.s.logf(logInfo, "p2p_established", "device_id", ds.deviceID, "tunnel", ds.tunnel, "ui", id)
+		}
+	case "p2p_closed":
+		if peer.direct.Swap(false) {
+			ds.s.logf(logInfo, "p2p_closed", "device_id", ds.deviceID, "tunnel", ds.tunnel, "ui", id, "by", "device")
+		}
+	}
+	dc.uiWriteMu.Lock()
+	_ = dc.writeUI(target, websocket.TextMessage, msg)
+	dc.uiWriteMu.Unlock()
+	return true
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileStore persists small JSON documents under DATA_DIR, one file per
+// document. Writes go to a temp file and are renamed into place so a crash
+// never leaves a half-written document behind. With no directory configured
+// the store is disabled and everything stays in memory.
+type fileStore struct {
+	dir string
+
+	mu      sync.Mutex
+	lastErr error
+	legacy  []legacyIDNote // see canonicalDeviceKeys
+}
+
+// legacyIDNote is what a document's load did with device IDs saved in a
+// form normalizeDeviceID no longer produces.
+type legacyIDNote struct {
+	doc     string
+	moved   int
+	dropped []string // raw IDs left out: invalid, or colliding
+}
+
+func newFileStore(dir string) (*fileStore, error) {
+	fs := &fileStore{dir: dir}
+	if dir == "" {
+		return fs, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create data dir: %w", err)
+	}
+	return fs, nil
+}
+
+func (fs *fileStore) enabled() bool { return fs.dir != "" }
+
+// load decodes the named document into v. A missing document is not an error.
+func (fs *fileStore) load(name string, v any) error {
+	if !fs.enabled() {
+		return nil
+	}
+	b, err := os.ReadFile(filepath.Join(fs.dir, name+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// noteLegacyIDs records that loading doc moved entries to their canonical
+// device IDs, or dropped some, for the server to log.
+func (fs *fileStore) noteLegacyIDs(doc string, moved int, dropped []string) {
+	if moved == 0 && len(dropped) == 0 {
+		return
+	}
+	fs.mu.Lock()
+	fs.legacy = append(fs.legacy, legacyIDNote{doc: doc, moved: moved, dropped: dropped})
+	fs.mu.Unlock()
+}
+
+// takeLegacyIDs returns and clears the notes.
+func (fs *fileStore) takeLegacyIDs() []legacyIDNote {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	notes := fs.legacy
+	fs.legacy = nil
+	return notes
+}
+
+// raw returns the named document as stored, or nil if there is none.
+func (fs *fileStore) raw(name string) (json.RawMessage, error) {
+	if !fs.enabled() {
+		return nil, nil
+	}
+	b, err := os.ReadFile(filepath.Join(fs.dir, name+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return b, err
+}
+
+func (fs *fileStore) save(name string, v any) error {
+	if !fs.enabled() {
+		return nil
+	}
+	err := fs.writeAtomic(name+".json", v)
+	fs.mu.Lock()
+	fs.lastErr = err
+	fs.mu.Unlock()
+	return err
+}
+
+func (fs *fileStore) writeAtomic(file string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(fs.dir, file+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(fs.dir, file))
+}
+
+// check is the persistence readiness check: the data dir must be writable
+// and the last save must have succeeded.
+func (fs *fileStore) check() error {
+	fs.mu.Lock()
+	err := fs.lastErr
+	fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(fs.dir, ".probe-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
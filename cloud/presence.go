@@ -0,0 +1,58 @@
+package main
+
+import "sort"
+
+// tunnelLabel maps a tunnel name to a bounded metrics label: the control
+// tunnel and configured media tunnels keep their names, everything else is
+// "custom" so arbitrary firmware tunnel names can't blow up cardinality.
+func (s *server) tunnelLabel(tunnel string) string {
+	switch {
+	case tunnel == "":
+		return "default"
+	case tunnel == "ws_control" || s.isMediaTunnel(tunnel) || s.isSerialTunnel(tunnel) || s.isLogTunnel(tunnel):
+		return tunnel
+	default:
+		return "custom"
+	}
+}
+
+// presenceByTunnel counts device sessions and UI connections per tunnel
+// label.
+func (s *server) presenceByTunnel() (devices, uis map[string]int) {
+	devices = make(map[string]int)
+	uis = make(map[string]int)
+	for _, e := range s.h.entries() {
+		dc := e.dc
+		_, tunnel := splitKey(e.key)
+		label := s.tunnelLabel(tunnel)
+		devices[label]++
+		dc.uiMu.Lock()
+		uis[label] += len(dc.uiConns)
+		dc.uiMu.Unlock()
+	}
+	return devices, uis
+}
+
+func (s *server) registerPresenceMetrics() {
+	s.metrics.newGaugeFunc("espwifi_tunnel_device_sessions", "Connected device sessions by tunnel type.", []string{"tunnel"},
+		func(emit func(float64, ...string)) {
+			devices, _ := s.presenceByTunnel()
+			emitSorted(devices, emit)
+		})
+	s.metrics.newGaugeFunc("espwifi_tunnel_ui_connections", "Connected UI clients by tunnel type.", []string{"tunnel"},
+		func(emit func(float64, ...string)) {
+			_, uis := s.presenceByTunnel()
+			emitSorted(uis, emit)
+		})
+}
+
+func emitSorted(counts map[string]int, emit func(float64, ...string)) {
+	labels := make([]string, 0, len(counts))
+	for l := range counts {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		emit(float64(counts[l]), l)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// protocolVersion is bumped whenever a relay-emitted message changes
+// incompatibly. Additive fields don't bump it.
+const protocolVersion = 1
+
+// Messages the relay itself emits. Emitters build these types (never ad-hoc
+// maps) so GET /api/protocol, which derives its JSON Schemas from them, can't
+// drift from what's on the wire.
+
+type registeredMsg struct {
+	Type        string `json:"type"`
+	DeviceID    string `json:"device_id"`
+	Tunnel      string `json:"tunnel"`
+	UIWSURL     string `json:"ui_ws_url"`
+	DeviceWSURL string `json:"device_ws_url"`
+	// UIs must present the token the device connected with.
+	UITokenRequired bool `json:"ui_token_required"`
+	// "tunnel" when the token was registered with ?token_scope=tunnel.
+	TokenScope   string `json:"token_scope"`
+	ViewTokenSet bool   `json:"view_token_set"`
+	// How to back off when the connection drops.
+	Reconnect reconnectHint `json:"reconnect"`
+	// protocolVersion and the session's feature bitmap (announce.go).
+	Protocol int             `json:"protocol"`
+	Features protocolFeature `json:"features"`
+	// The same features by name, and the relay build.
+	EnabledFeatures []string `json:"enabled_features"`
+	ServerVersion   string   `json:"server_version"`
+	// STUN/TURN servers for the p2p feature (p2p.go).
+	ICEServers []string `json:"ice_servers,omitempty"`
+}
+
+// reconnectHint is the backoff the relay asks devices to use: start at
+// base_ms, double per failed attempt up to max_ms, and randomize each wait
+// by up to jitter (a fraction of it).
+type reconnectHint struct {
+	BaseMs int64   `json:"base_ms"`
+	MaxMs  int64   `json:"max_ms"`
+	Jitter float64 `json:"jitter"`
+}
+
+// signalMsg is a bare {"type":...} notification.
+type signalMsg struct {
+	Type string `json:"type"`
+}
+
+type retryAfterMsg struct {
+	Type    string `json:"type"`
+	Reason  string `json:"reason"`
+	Seconds int    `json:"seconds"`
+}
+
+type relayRxMsg struct {
+	Type      string `json:"type"`
+	CID       string `json:"cid"`
+	RelayRxMs int64  `json:"relay_rx_ms"`
+}
+
+type deltaModeMsg struct {
+	Type      string `json:"type"`
+	FullEvery int    `json:"full_every"`
+}
+
+type deltaMsg struct {
+	Type  string         `json:"type"`
+	Of    string         `json:"of"`
+	Patch map[string]any `json:"patch"`
+}
+
+type duplicateMsg struct {
+	Type string `json:"type"`
+	Key  string `json:"key"`
+}
+
+// rateWarningMsg tells a sender it is close to its tunnel limit; see
+// tunnellimits.go.
+type rateWarningMsg struct {
+	Type           string  `json:"type"`
+	Tunnel         string  `json:"tunnel"`
+	Direction      string  `json:"direction"`
+	Limit          string  `json:"limit"` // messages | bytes
+	MessagesPerSec float64 `json:"messages_per_sec,omitempty"`
+	BytesPerSec    float64 `json:"bytes_per_sec,omitempty"`
+}
+
+type errorMsg struct {
+	Type   string            `json:"type"`
+	Code   string            `json:"code"`
+	Tunnel string            `json:"tunnel,omitempty"`
+	Errors []schemaViolation `json:"errors,omitempty"`
+	// ID of the chunked transfer or file push the error refers to.
+	ID      string `json:"id,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// envelopeMsg documents the ?envelope=1 wrapper; envelopeMessage writes it
+// by hand to avoid re-encoding data.
+type envelopeMsg struct {
+	TS   int64           `json:"ts"`
+	Seq  uint64          `json:"seq"`
+	Data json.RawMessage `json:"data"`
+}
+
+var (
+	msgUIConnected    = mustJSON(signalMsg{Type: "ui_connected"})
+	msgUIDisconnected = mustJSON(signalMsg{Type: "ui_disconnected"})
+	msgReadOnly       = mustJSON(signalMsg{Type: "read_only"})
+)
+
+type protocolMessage struct {
+	Type        string         `json:"type"`
+	Direction   string         `json:"direction"` // relay_to_device | relay_to_ui | device_to_relay | ui_to_relay
+	Description string         `json:"description"`
+	Schema      map[string]any `json:"schema"`
+}
+
+func describeMessage(typ, direction, description string, example any) protocolMessage {
+	schema := jsonSchemaFor(reflect.TypeOf(example))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	if props, ok := schema["properties"].(map[string]any); ok && typ != "" {
+		if _, ok := props["type"]; ok {
+			props["type"] = map[string]any{"const": typ}
+		}
+	}
+	return protocolMessage{Type: typ, Direction: direction, Description: description, Schema: schema}
+}
+
+// protocolMessages is the catalogue served by /api/protocol.
+func protocolMessages() []protocolMessage {
+	return []protocolMessage{
+		describeMessage("registered", "relay_to_device", "Sent after connect unless the device passed ?announce=0. ANNOUNCE_EXTRA may add fields.", registeredMsg{}),
+		describeMessage("ui_connected", "relay_to_device", "The first UI attached; start streaming.", signalMsg{}),
+		describeMessage("ui_disconnected", "relay_to_device", "The last UI detached; streaming can stop.", signalMsg{}),
+		describeMessage("error", "relay_to_device", "A chunked transfer (code chunk_invalid) or file push (code file_invalid) failed, or a kick_uis was refused (kick_invalid).", errorMsg{}),
+		describeMessage("file_begin", "relay_to_device", "An upload starts; 0x03 data frames tagged with id follow.", fileBeginMsg{}),
+		describeMessage("file_end", "relay_to_device", "The upload is complete; sha256 is omitted for resumed uploads.", fileEndMsg{}),
+		describeMessage("file_push_done", "relay_to_device", "A pushed file was stored in the staging area.", filePushDoneMsg{}),
+		describeMessage("file_push", "device_to_relay", "Start (or, with offset, resume) pushing a file to the staging area.", filePushControl{}),
+		describeMessage("file_push_end", "device_to_relay", "Finish a push; sha256 is verified when given.", filePushControl{}),
+		describeMessage("log_level", "relay_to_device", "Log tunnels: the device's log level filter, when set with forward.", logLevelMsg{}),
+		describeMessage("ownership_transferred", "relay_to_device", "Sent ahead of a kicked close when the device changed owner: rotate the UI token.", ownershipTransferredMsg{}),
+		describeMessage("relocate", "relay_to_device", "Sent ahead of a relocated close: reconnect to url instead.", relocateMsg{}),
+		describeMessage("retry_after", "relay_to_device", "Sent ahead of a quota_exceeded, server_restarting or outside_schedule close: reconnect after this many seconds.", retryAfterMsg{}),
+		describeMessage("rate_warning", "relay_to_device", "The device is close to its TUNNEL_LIMITS rate; past it, messages are dropped with a rate_limited error.", rateWarningMsg{}),
+		describeMessage("rate_warning", "relay_to_ui", "The session's UIs are close to their TUNNEL_LIMITS rate; past it, messages are dropped with a rate_limited error.", rateWarningMsg{}),
+		describeMessage("retry_after", "relay_to_ui", "Sent ahead of a server_restarting or outside_schedule close: reconnect after this many seconds.", retryAfterMsg{}),
+		describeMessage("read_only", "relay_to_ui", "This UI has view scope; its messages are not forwarded.", signalMsg{}),
+		describeMessage("relay_rx", "relay_to_ui", "?correlate=1: correlation ID and relay receive time of the UI's last message.", relayRxMsg{}),
+		describeMessage("delta_mode", "relay_to_ui", "?delta=1: delta mode is active.", deltaModeMsg{}),
+		describeMessage("delta", "relay_to_ui", "?delta=1: RFC 7396 merge patch against the previous message of type `of`.", deltaMsg{}),
+		describeMessage("duplicate", "relay_to_ui", "The UI's message was dropped as a duplicate (DEDUP_WINDOW).", duplicateMsg{}),
+		describeMessage("error", "relay_to_ui", "The UI's message was rejected; code says why (schema_violation, rate_limited, filtered, ...).", errorMsg{}),
+		describeMessage("log_level", "relay_to_ui", "Log tunnels: confirms a set_log_level request.", logLevelMsg{}),
+		describeMessage("set_log_level", "ui_to_relay", "Log tunnels: filter the device's log lines below level; forward also tells the device.", setLogLevelRequest{}),
+		describeMessage("link_quality", "relay_to_ui", "Every LINK_QUALITY_INTERVAL and on attach: the relay's measured device round trip, time since it last heard from the device, and a good/fair/poor rating.", linkQualityMsg{}),
+		describeMessage("waiting", "relay_to_ui", "?wait= or a wake-capable device: the device is offline and the UI is being held for it; waking while a wake was sent.", waitingMsg{}),
+		describeMessage("device_online", "relay_to_ui", "The waited-for device connected and the UI is bridged; device traffic follows.", signalMsg{}),
+		describeMessage("ui_echo", "relay_to_ui", "?echo=1: a text command another UI sent the device.", uiEchoMsg{}),
+		describeMessage("file_progress", "relay_to_ui", "Progress of an upload to, or push from, the device.", fileProgressMsg{}),
+		describeMessage("p2p_config", "relay_to_ui", "?p2p=1: this UI's peer id and the ICE servers to gather candidates with.", p2pConfigMsg{}),
+		describeP2PSignal("ui_to_relay", "?p2p=1: signaling (offer, answer, candidate, closed, ...); forwarded to the device stamped with ui and scope."),
+		describeP2PSignal("device_to_relay", "Signaling for the UI named by ui. p2p_established stops relaying binary frames to it; p2p_closed resumes."),
+		describeMessage("", "relay_to_ui", "?envelope=1: wrapper around every device text message.", envelopeMsg{}),
+		describeMessage("echo_ready", "relay_to_ui", "/ws/ui/_echo and /ws/device/_echo: the loopback is ready.", loopbackReadyMsg{}),
+		describeMessage("echo", "relay_to_ui", "/ws/ui/_echo and /ws/device/_echo: a text message reflected with relay timestamps.", loopbackEchoMsg{}),
+		describeMessage("bwtest_ping", "relay_to_device", "Bandwidth test: answer with bwtest_pong carrying the same id and seq.", bwtestMsg{}),
+		describeMessage("bwtest_down_done", "relay_to_device", "Bandwidth test: the 0x06 filler frames are done; answer with bwtest_down_ack and the bytes received.", bwtestMsg{}),
+		describeMessage("bwtest_up", "relay_to_device", "Bandwidth test: send 0x06 filler frames for seconds, then bwtest_up_done.", bwtestMsg{}),
+		describeMessage("bwtest_pong", "device_to_relay", "Bandwidth test: answer to bwtest_ping.", bwtestMsg{}),
+		describeMessage("bwtest_down_ack", "device_to_relay", "Bandwidth test: bytes of filler received.", bwtestMsg{}),
+		describeMessage("bwtest_up_done", "device_to_relay", "Bandwidth test: finished sending filler.", bwtestMsg{}),
+		describeMessage("kick_uis", "device_to_relay", "Disconnect the session's UIs (or those named by ui or from) and, with hold_s, keep them off.", uiKickRequest{}),
+		describeMessage("uis_kicked", "relay_to_device", "Answer to kick_uis: how many UIs were closed, and when the hold ends.", uisKickedMsg{}),
+		describeMessage("kicked", "relay_to_ui", "Sent ahead of a kicked close the device asked for, with its reason.", uiKickedMsg{}),
+	}
+}
+
+// jsonSchemaFor derives a JSON Schema from a Go type using its json tags.
+// Fields without omitempty are required.
+func jsonSchemaFor(t reflect.Type) map[string]any {
+	if t == reflect.TypeOf(json.RawMessage(nil)) {
+		return map[string]any{}
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonSchemaFor(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": jsonSchemaFor(t.Elem())}
+	case reflect.Map:
+		if t.Elem().Kind() == reflect.Interface {
+			return map[string]any{"type": "object"}
+		}
+		return map[string]any{"type": "object", "additionalProperties": jsonSchemaFor(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]any)
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			// Embedded structs are flattened, as encoding/json does; an
+			// embedded pointer's fields are all optional.
+			if ft := f.Type; f.Anonymous && name == "" && (ft.Kind() == reflect.Struct ||
+				ft.Kind() == reflect.Pointer && ft.Elem().Kind() == reflect.Struct) {
+				inner := jsonSchemaFor(ft)
+				for k, v := range inner["properties"].(map[string]any) {
+					props[k] = v
+				}
+				if ft.Kind() == reflect.Struct {
+					required = append(required, inner["required"].([]string)...)
+				}
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = jsonSchemaFor(f.Type)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+		return map[string]any{"type": "object", "properties": props, "required": required}
+	default:
+		return map[string]any{}
+	}
+}
+
+// protocolDoc is the /api/protocol document.
+type protocolDoc struct {
+	Version       int                       `json:"version"`
+	ServerVersion string                    `json:"server_version"`
+	Messages      []protocolMessage         `json:"messages"`
+	CloseCodes    []wsClose                 `json:"close_codes"`
+	Features      []protocolFeatureDoc      `json:"features"`
+	QueryParams   map[string][]wsQueryParam `json:"query_params"`
+}
+
+// handleProtocol describes the control messages and close codes the relay
+// emits.
+func (s *server) handleProtocol(w http.ResponseWriter, r *http.Request) {
+	s.setCORS(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, protocolDoc{
+		Version:       protocolVersion,
+		ServerVersion: serverVersion(),
+		Messages:      protocolMessages(),
+		CloseCodes:    wsCloseCodes,
+		Features:      protocolFeatures,
+		QueryParams:   wsQueryCatalogue(),
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Quiet hours keep the relay from contacting people, or waking devices on
+// their behalf, at night:
+//
+//	PUT /api/devices/{id}/quiet-hours
+//	{"tz":"Europe/Berlin","windows":[{"start":"23:00","end":"07:00"}]}
+//
+// or, for a whole tenant, "quiet_hours" on PUT /api/tenants/{id}. A device's
+// own schedule replaces its tenant's. Windows are written like streaming
+// windows (streaming.go), but are when to stay quiet. Inside one:
+//
+//   - claim delivery (claimdelivery.go) answers 409 quiet_hours with
+//     Retry-After, unless the request says "critical":true;
+//   - a UI knocking on a sleeping device doesn't wake it (wake.go). The UI
+//     still waits if it asked to. Manual wakes are critical and go out.
+//
+// The daily digest isn't held: it covers the whole node and goes out at
+// DIGEST_AT, which is already when its recipients want it. Setting or
+// clearing a device's quiet hours takes an admin, or an operator holding
+// the device (requireHolder).
+
+type quietHours struct {
+	TZ      string         `json:"tz,omitempty"` // IANA zone; UTC if empty
+	Windows []streamWindow `json:"windows"`
+}
+
+func (q *quietHours) schedule() *streamSchedule {
+	return &streamSchedule{TZ: q.TZ, Windows: q.Windows}
+}
+
+// validate normalizes q and reports the first thing wrong with it.
+func (q *quietHours) validate() error {
+	ss := q.schedule()
+	err := ss.validate()
+	q.TZ = ss.TZ
+	return err
+}
+
+// quietHoursFor returns deviceID's quiet hours: its own, else its tenant's.
+func (s *server) quietHoursFor(deviceID string) *quietHours {
+	d, ok := s.registry.get(deviceID)
+	if !ok {
+		return nil
+	}
+	if d.QuietHours != nil {
+		return d.QuietHours
+	}
+	if d.Tenant != "" {
+		if t, ok := s.tenants.get(d.Tenant); ok {
+			return t.QuietHours
+		}
+	}
+	return nil
+}
+
+// quietFor reports whether deviceID is in quiet hours now, and how long
+// until they end (0 if not within a week).
+func (s *server) quietFor(deviceID string) (bool, time.Duration) {
+	q := s.quietHoursFor(deviceID)
+	if q == nil {
+		return false, 0
+	}
+	now := time.Now()
+	quiet, next := q.schedule().state(now)
+	if !quiet || next.IsZero() {
+		return quiet, 0
+	}
+	return true, next.Sub(now).Round(time.Second)
+}
+
+type quietHoursView struct {
+	DeviceID string      `json:"device_id"`
+	Schedule *quietHours `json:"schedule"`
+	// Inherited from the device's tenant.
+	Tenant string `json:"tenant,omitempty"`
+	Quiet  bool   `json:"quiet"`
+	// When quiet flips next; omitted if not within a week.
+	NextChange *time.Time `json:"next_change,omitempty"`
+}
+
+func quietView(deviceID string, q *quietHours) quietHoursView {
+	v := quietHoursView{DeviceID: deviceID, Schedule: q}
+	quiet, next := q.schedule().state(time.Now())
+	v.Quiet = quiet
+	if !next.IsZero() {
+		next = next.UTC()
+		v.NextChange = &next
+	}
+	return v
+}
+
+// handleDeviceQuietHours manages a device's quiet hours:
+//
+//	GET    /api/devices/{id}/quiet-hours  its own, else its tenant's
+//	PUT    /api/devices/{id}/quiet-hours  {"tz":"...","windows":[{"start":"23:00","end":"07:00"}]}
+//	DELETE /api/devices/{id}/quiet-hours
+func (s *server) handleDeviceQuietHours(w http.ResponseWriter, r *http.Request, deviceID string) {
+	switch r.Method {
+	case http.MethodGet:
+		if !s.requireRole(w, r, roleViewer) {
+			return
+		}
+		q := s.quietHoursFor(deviceID)
+		if q == nil {
+			writeAPIError(w, http.StatusNotFound, "no_quiet_hours", "no quiet hours")
+			return
+		}
+		v := quietView(deviceID, q)
+		if d, _ := s.registry.get(deviceID); d.QuietHours == nil {
+			v.Tenant = d.Tenant
+		}
+		writeJSON(w, http.StatusOK, v)
+	case http.MethodPut:
+		if !s.requireHolder(w, r, deviceID) {
+			return
+		}
+		var q quietHours
+		if err := decodeJSONBody(w, r, &q); err != nil {
+			writeJSONDecodeError(w, err)
+			return
+		}
+		if err := q.validate(); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_schedule", err.Error())
+			return
+		}
+		if found, err := s.registry.setQuietHours(deviceID, &q); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist registry")
+			return
+		} else if !found {
+			writeAPIError(w, http.StatusNotFound, "device_not_registered", "device not registered")
+			return
+		}
+		v := quietView(deviceID, &q)
+		writeJSON(w, http.StatusOK, v)
+		s.logf(logInfo, "device_quiet_hours_set", "remote", clientIP(r), "device_id", deviceID, "by", s.auditActor(r),
+			"windows", len(q.Windows), "quiet", v.Quiet)
+	case http.MethodDelete:
+		if !s.requireHolder(w, r, deviceID) {
+			return
+		}
+		if d, ok := s.registry.get(deviceID); !ok || d.QuietHours == nil {
+			writeAPIError(w, http.StatusNotFound, "no_quiet_hours", "no quiet hours")
+			return
+		}
+		if _, err := s.registry.setQuietHours(deviceID, nil); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist registry")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		s.logf(logInfo, "device_quiet_hours_cleared", "remote", clientIP(r), "device_id", deviceID, "by", s.auditActor(r))
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
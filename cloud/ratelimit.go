@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UI->device command rate limiting, so a runaway dashboard loop can't flood
+// a microcontroller. UI_CMD_RATE sets a token bucket per device session,
+// shared by all of its UIs:
+//
+//	UI_CMD_RATE=*=20:40,ws_control=10:20,serial=500:1000
+//
+// Each entry is <tunnel>=<messages per second>:<burst>; the key is a tunnel
+// name, a tunnel label (default, custom, ...) or * for everything else.
+// Unset means unlimited. Messages over the limit are dropped and the UI gets
+// {"type":"error","code":"rate_limited"} (at most once a second).
+
+type rateSpec struct {
+	rate  float64
+	burst float64
+}
+
+func parseRateSpecs(env, spec string) (map[string]rateSpec, error) {
+	out := make(map[string]rateSpec)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, v, ok := strings.Cut(item, "=")
+		rateStr, burstStr, hasBurst := strings.Cut(v, ":")
+		rate, err := strconv.ParseFloat(strings.TrimSpace(rateStr), 64)
+		if !ok || err != nil || rate <= 0 {
+			return nil, fmt.Errorf("%s: bad entry %q", env, item)
+		}
+		burst := rate
+		if hasBurst {
+			if burst, err = strconv.ParseFloat(strings.TrimSpace(burstStr), 64); err != nil || burst < 1 {
+				return nil, fmt.Errorf("%s: bad burst in %q", env, item)
+			}
+		}
+		out[strings.TrimSpace(name)] = rateSpec{rate: rate, burst: burst}
+	}
+	return out, nil
+}
+
+// uiCmdRateFor picks the spec for tunnel: exact name, then label, then *.
+func (s *server) uiCmdRateFor(tunnel string) (rateSpec, bool) {
+	if rs, ok := s.uiCmdRates[tunnel]; ok && tunnel != "" {
+		return rs, true
+	}
+	if rs, ok := s.uiCmdRates[s.tunnelLabel(tunnel)]; ok {
+		return rs, true
+	}
+	rs, ok := s.uiCmdRates["*"]
+	return rs, ok
+}
+
+type tokenBucket struct {
+	mu         sync.Mutex
+	spec       rateSpec
+	tokens     float64
+	last       time.Time
+	lastNotice time.Time
+}
+
+func newTokenBucket(spec rateSpec) *tokenBucket {
+	return &tokenBucket{spec: spec, tokens: spec.burst}
+}
+
+// allow takes a token if one is available. notify is set when a refusal
+// should be reported (once a second at most).
+func (tb *tokenBucket) allow(now time.Time) (ok, notify bool) {
+	if tb == nil {
+		return true, false
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if !tb.last.IsZero() {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.spec.rate
+		if tb.tokens > tb.spec.burst {
+			tb.tokens = tb.spec.burst
+		}
+	}
+	tb.last = now
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return true, false
+	}
+	if now.Sub(tb.lastNotice) >= time.Second {
+		tb.lastNotice = now
+		return false, true
+	}
+	return false, false
+}
+
+var msgRateLimited = mustJSON(errorMsg{Type: "error", Code: "rate_limited", Message: "too many messages; slow down"})
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// role is an API principal's privilege level. Roles are ordered: each one
+// includes everything the roles below it may do.
+type role int
+
+const (
+	roleNone role = iota
+	// roleViewer may list/inspect devices and open read-only UI sessions.
+	roleViewer
+	// roleOperator may additionally send commands to devices.
+	roleOperator
+	// roleAdmin may additionally manage credentials, keys and the registry.
+	roleAdmin
+)
+
+func (ro role) String() string {
+	switch ro {
+	case roleViewer:
+		return "viewer"
+	case roleOperator:
+		return "operator"
+	case roleAdmin:
+		return "admin"
+	default:
+		return "none"
+	}
+}
+
+func parseRole(s string) (role, bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "viewer":
+		return roleViewer, true
+	case "operator":
+		return roleOperator, true
+	case "admin":
+		return roleAdmin, true
+	default:
+		return roleNone, false
+	}
+}
+
+// apiKey is a named credential bound to a role. Only the token hash is kept.
+type apiKey struct {
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	TokenHash string    `json:"token_hash"`
+	CreatedAt time.Time `json:"created_at"`
+	// Keys from API_KEYS live only in the environment and aren't persisted.
+	FromEnv bool `json:"-"`
+}
+
+type apiKeyView struct {
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+	FromEnv   bool      `json:"from_env,omitempty"`
+}
+
+type apiKeyStore struct {
+	store *fileStore
+
+	mu   sync.Mutex
+	keys map[string]*apiKey // by name
+}
+
+const apiKeysDoc = "api_keys"
+
+func newAPIKeyStore(store *fileStore) *apiKeyStore {
+	return &apiKeyStore{store: store, keys: make(map[string]*apiKey)}
+}
+
+// load reads persisted keys, then adds keys from API_KEYS
+// ("name:role:token,name:role:token").
+func (ks *apiKeyStore) load(env string) error {
+	var list []*apiKey
+	if err := ks.store.load(apiKeysDoc, &list); err != nil {
+		return err
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys = make(map[string]*apiKey, len(list))
+	for _, k := range list {
+		if k != nil && k.Name != "" {
+			ks.keys[k.Name] = k
+		}
+	}
+	for _, spec := range strings.Split(env, ",") {
+		name, rest, ok1 := strings.Cut(strings.TrimSpace(spec), ":")
+		roleName, token, ok2 := strings.Cut(rest, ":")
+		ro, ok3 := parseRole(roleName)
+		if !ok1 || !ok2 || !ok3 || name == "" || token == "" {
+			continue
+		}
+		ks.keys[name] = &apiKey{Name: name, Role: ro.String(), TokenHash: hashSecret(token), FromEnv: true}
+	}
+	return nil
+}
+
+func (ks *apiKeyStore) saveLocked() error {
+	list := make([]*apiKey, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		if !k.FromEnv {
+			list = append(list, k)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return ks.store.save(apiKeysDoc, list)
+}
+
+func (ks *apiKeyStore) empty() bool {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return len(ks.keys) == 0
+}
+
+// lookup returns the key whose token matches, if any.
+func (ks *apiKeyStore) lookup(token string) (apiKey, bool) {
+	if token == "" {
+		return apiKey{}, false
+	}
+	h := []byte(hashSecret(token))
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	for _, k := range ks.keys {
+		if subtle.ConstantTimeCompare(h, []byte(k.TokenHash)) == 1 {
+			return *k, true
+		}
+	}
+	return apiKey{}, false
+}
+
+func (ks *apiKeyStore) put(name string, ro role) (string, error) {
+	token := randomToken(32)
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys[name] = &apiKey{Name: name, Role: ro.String(), TokenHash: hashSecret(token), CreatedAt: time.Now().UTC()}
+	return token, ks.saveLocked()
+}
+
+func (ks *apiKeyStore) remove(name string) (bool, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k, ok := ks.keys[name]
+	if !ok || k.FromEnv {
+		return false, nil
+	}
+	delete(ks.keys, name)
+	return true, ks.saveLocked()
+}
+
+func (ks *apiKeyStore) list() []apiKeyView {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	out := make([]apiKeyView, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		out = append(out, apiKeyView{Name: k.Name, Role: k.Role, CreatedAt: k.CreatedAt, FromEnv: k.FromEnv})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// extractAPIKey returns an API key presented via X-API-Key, ?api_key= or,
+// for REST calls, Authorization: Bearer.
+func extractAPIKey(r *http.Request) string {
+	if k := strings.TrimSpace(r.Header.Get("X-API-Key")); k != "" {
+		return k
+	}
+	if k := r.URL.Query().Get("api_key"); k != "" {
+		return k
+	}
+	if ah := r.Header.Get("Authorization"); strings.HasPrefix(ah, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(ah, "Bearer "))
+	}
+	return ""
+}
+
+// roleFor resolves the caller's role. ADMIN_AUTH_TOKEN always maps to admin.
+func (s *server) roleFor(r *http.Request) (role, string) {
+	if s.adminAuthToken != "" && authOK(r, s.adminAuthToken) {
+		return roleAdmin, "admin_token"
+	}
+	if k, ok := s.apiKeys.lookup(extractAPIKey(r)); ok {
+		ro, _ := parseRole(k.Role)
+		return ro, k.Name
+	}
+	return roleNone, ""
+}
+
+// rbacEnabled is true once any admin token or API key exists. Until then the
+// read-only endpoints stay open, as they always were.
+func (s *server) rbacEnabled() bool {
+	return s.adminAuthToken != "" || !s.apiKeys.empty()
+}
+
+// requireRole writes an error and returns false unless the caller holds at
+// least min. Operator and admin endpoints fail closed when RBAC isn't
+// configured, since nobody could be told apart from an anonymous caller;
+// viewer endpoints are open until it is.
+func (s *server) requireRole(w http.ResponseWriter, r *http.Request, min role) bool {
+	if !s.rbacEnabled() {
+		if min >= roleOperator {
+			writeAPIError(w, http.StatusForbidden, "admin_disabled", min.String()+" api disabled (ADMIN_AUTH_TOKEN not set)")
+			return false
+		}
+		return true
+	}
+	got, _ := s.roleFor(r)
+	if got == roleNone {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return false
+	}
+	if got < min {
+		writeJSONError(w, http.StatusForbidden, "requires role "+min.String())
+		return false
+	}
+	return true
+}
+
+// callerHas is requireRole without the error response.
+func (s *server) callerHas(r *http.Request, min role) bool {
+	if !s.rbacEnabled() {
+		return min < roleOperator
+	}
+	got, _ := s.roleFor(r)
+	return got >= min
+}
+
+type apiKeyRequest struct {
+	Role string `json:"role"`
+}
+
+// apiKeyCreated carries the token, which is never shown again.
+type apiKeyCreated struct {
+	Name  string `json:"name"`
+	Role  string `json:"role"`
+	Token string `json:"token"`
+}
+
+// handleAPIKeys manages API keys (admin only):
+//
+//	GET    /api/keys         list keys (never tokens)
+//	PUT    /api/keys/{name}  create or rotate a key; the token is returned once
+//	DELETE /api/keys/{name}  revoke a key
+func (s *server) handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if !s.requireRole(w, r, roleAdmin) {
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/keys"), "/")
+	if name == "" {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, s.apiKeys.list())
+		return
+	}
+	if strings.Contains(name, "/") || len(name) > 64 {
+		writeAPIError(w, http.StatusBadRequest, "invalid_key_name", "invalid key name")
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		var req apiKeyRequest
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeJSONDecodeError(w, err)
+			return
+		}
+		ro, ok := parseRole(req.Role)
+		if !ok {
+			writeAPIError(w, http.StatusBadRequest, "invalid_role", "role must be viewer, operator or admin")
+			return
+		}
+		token, err := s.apiKeys.put(name, ro)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist api keys")
+			return
+		}
+		writeJSON(w, http.StatusOK, apiKeyCreated{Name: name, Role: ro.String(), Token: token})
+		s.logf(logInfo, "api_key_set", "remote", clientIP(r), "name", name, "role", ro.String())
+	case http.MethodDelete:
+		removed, err := s.apiKeys.remove(name)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist api keys")
+			return
+		}
+		if !removed {
+			writeAPIError(w, http.StatusNotFound, "key_not_found", "no such key")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		s.logf(logInfo, "api_key_removed", "remote", clientIP(r), "name", name)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
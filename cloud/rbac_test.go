@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireRole(t *testing.T) {
+	newServer := func(rbac bool) *server {
+		store, _ := newFileStore("")
+		s := &server{apiKeys: newAPIKeyStore(store)}
+		if rbac {
+			s.adminAuthToken = "admintok"
+			if err := s.apiKeys.load("ops:operator:optok,watch:viewer:viewtok"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return s
+	}
+	tests := []struct {
+		name   string
+		rbac   bool
+		key    string // X-API-Key
+		bearer string // Authorization: Bearer
+		min    role
+		status int // 0: allowed
+	}{
+		{"off: anonymous viewer", false, "", "", roleViewer, 0},
+		{"off: anonymous operator", false, "", "", roleOperator, http.StatusForbidden},
+		{"off: anonymous admin", false, "", "", roleAdmin, http.StatusForbidden},
+		{"off: made-up key", false, "optok", "", roleOperator, http.StatusForbidden},
+		{"on: anonymous viewer", true, "", "", roleViewer, http.StatusUnauthorized},
+		{"on: anonymous operator", true, "", "", roleOperator, http.StatusUnauthorized},
+		{"on: unknown key", true, "nope", "", roleViewer, http.StatusUnauthorized},
+		{"on: viewer key, viewer", true, "viewtok", "", roleViewer, 0},
+		{"on: viewer key, operator", true, "viewtok", "", roleOperator, http.StatusForbidden},
+		{"on: operator key, operator", true, "optok", "", roleOperator, 0},
+		{"on: operator key as bearer", true, "", "optok", roleOperator, 0},
+		{"on: operator key, admin", true, "optok", "", roleAdmin, http.StatusForbidden},
+		{"on: admin token, admin", true, "", "admintok", roleAdmin, 0},
+		{"on: admin token, viewer", true, "", "admintok", roleViewer, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(tt.rbac)
+			r := httptest.NewRequest("GET", "/api/devices", nil)
+			if tt.key != "" {
+				r.Header.Set("X-API-Key", tt.key)
+			}
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			w := httptest.NewRecorder()
+			ok := s.requireRole(w, r, tt.min)
+			if ok != (tt.status == 0) || (!ok && w.Code != tt.status) {
+				t.Errorf("requireRole(%s) = %v, status %d; want status %d", tt.min, ok, w.Code, tt.status)
+			}
+			if has := s.callerHas(r, tt.min); has != ok {
+				t.Errorf("callerHas(%s) = %v, requireRole = %v", tt.min, has, ok)
+			}
+		})
+	}
+}
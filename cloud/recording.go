@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Frame recording: frame types whose FRAME_POLICIES entry includes "record"
+// are appended, as forwarded, to files under RECORD_DIR (default
+// DATA_DIR/recordings):
+//
+//	<hex device ID>/<YYYYMMDDTHH>-<tunnel>-<type>.frames
+//
+// one file per UTC hour, type and tunnel (the default tunnel is "default").
+// Each record is an 8-byte big-endian Unix time in nanoseconds, a 4-byte
+// big-endian length, then the frame with its type/flags header. Once a
+// device's recordings pass RECORD_MAX_BYTES (1GiB; 0 for no cap) its oldest
+// files are deleted.
+
+// recordPruneEvery is how many bytes a session records between checks of
+// its device's total.
+const recordPruneEvery = 16 << 20
+
+type frameRecorder struct {
+	dir      string
+	maxBytes int64
+}
+
+// session returns a recording for one device session; nil if fr is nil.
+func (fr *frameRecorder) session(deviceID, tunnel string) *frameRecording {
+	if fr == nil {
+		return nil
+	}
+	if tunnel == "" {
+		tunnel = "default"
+	}
+	return &frameRecording{
+		fr:     fr,
+		dir:    filepath.Join(fr.dir, hex.EncodeToString([]byte(deviceID))),
+		tunnel: url.PathEscape(tunnel),
+		files:  make(map[byte]*recordFile),
+	}
+}
+
+// frameRecording is one device session's open recording files. Only the
+// session's forwarder uses it.
+type frameRecording struct {
+	fr      *frameRecorder
+	dir     string
+	tunnel  string
+	files   map[byte]*recordFile
+	written int64 // since the last prune
+	closed  bool
+	failed  bool // an error was logged
+}
+
+type recordFile struct {
+	f    *os.File
+	hour string
+}
+
+// write appends one tagged frame received at at.
+func (rec *frameRecording) write(typ byte, frame []byte, at time.Time) error {
+	if rec.closed {
+		return nil
+	}
+	hour := at.UTC().Format("20060102T15")
+	rf := rec.files[typ]
+	if rf == nil || rf.hour != hour {
+		if rf != nil {
+			_ = rf.f.Close()
+			delete(rec.files, typ)
+		}
+		if err := os.MkdirAll(rec.dir, 0o700); err != nil {
+			return err
+		}
+		name := fmt.Sprintf("%s-%s-%s.frames", hour, rec.tunnel, frameTypeName(typ))
+		f, err := os.OpenFile(filepath.Join(rec.dir, name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		rf = &recordFile{f: f, hour: hour}
+		rec.files[typ] = rf
+		rec.prune()
+	}
+	buf := make([]byte, 12, 12+len(frame))
+	binary.BigEndian.PutUint64(buf, uint64(at.UnixNano()))
+	binary.BigEndian.PutUint32(buf[8:], uint32(len(frame)))
+	if _, err := rf.f.Write(append(buf, frame...)); err != nil {
+		return err
+	}
+	if rec.written += int64(len(buf) + len(frame)); rec.written >= recordPruneEvery {
+		rec.prune()
+	}
+	return nil
+}
+
+// prune deletes the device's oldest recordings until they fit maxBytes.
+// Names start with the hour, so name order is age order; files this
+// session has open are kept.
+func (rec *frameRecording) prune() {
+	rec.written = 0
+	if rec.fr.maxBytes <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(rec.dir)
+	if err != nil {
+		return
+	}
+	open := make(map[string]bool, len(rec.files))
+	for _, rf := range rec.files {
+		open[filepath.Base(rf.f.Name())] = true
+	}
+	sizes := make([]int64, len(entries))
+	var total int64
+	for i, e := range entries {
+		if info, err := e.Info(); err == nil && info.Mode().IsRegular() {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+	for i, e := range entries {
+		if total <= rec.fr.maxBytes {
+			break
+		}
+		if sizes[i] == 0 || open[e.Name()] {
+			continue
+		}
+		if os.Remove(filepath.Join(rec.dir, e.Name())) == nil {
+			total -= sizes[i]
+		}
+	}
+}
+
+// close closes the session's files; later writes are ignored.
+func (rec *frameRecording) close() {
+	rec.closed = true
+	for _, rf := range rec.files {
+		_ = rf.f.Close()
+	}
+	rec.files = nil
+}
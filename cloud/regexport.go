@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// registryExport is the document moved between relays by
+//
+//	GET  /api/registry/export
+//	POST /api/registry/import?mode=merge|replace
+//
+// It carries the device registry as stored (key hashes, TOTP seeds, tenant
+// and metadata) plus the tenants devices are grouped into, so a new host or a
+// restored backup admits the same devices with the same credentials.
+// Treat it like a secrets file.
+type registryExport struct {
+	Version    int                 `json:"version"`
+	ExportedAt time.Time           `json:"exported_at"`
+	Devices    []*registeredDevice `json:"devices"`
+	Tenants    []*tenant           `json:"tenants"`
+}
+
+const registryExportVersion = 1
+
+func (s *server) handleRegistryExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.requireRole(w, r, roleAdmin) {
+		return
+	}
+	doc := registryExport{
+		Version:    registryExportVersion,
+		ExportedAt: time.Now().UTC(),
+		Devices:    []*registeredDevice{},
+		Tenants:    []*tenant{},
+	}
+	for _, d := range s.registry.list() {
+		d := d
+		doc.Devices = append(doc.Devices, &d)
+	}
+	for _, t := range s.tenants.list() {
+		t := t
+		doc.Tenants = append(doc.Tenants, &t)
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="espwifi-registry.json"`)
+	writeJSON(w, http.StatusOK, doc)
+	s.logf(logInfo, "registry_exported", "remote", clientIP(r), "devices", len(doc.Devices), "tenants", len(doc.Tenants))
+}
+
+// registryImported counts what an import loaded.
+type registryImported struct {
+	Devices int    `json:"devices"`
+	Tenants int    `json:"tenants"`
+	Mode    string `json:"mode"`
+}
+
+// handleRegistryImport loads an export. mode=merge (default) adds or
+// overwrites the entries in the document and keeps everything else;
+// mode=replace drops devices and tenants the document doesn't list.
+func (s *server) handleRegistryImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.requireRole(w, r, roleAdmin) {
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "merge"
+	}
+	if mode != "merge" && mode != "replace" {
+		writeAPIError(w, http.StatusBadRequest, "invalid_mode", "mode must be merge or replace")
+		return
+	}
+	replace := mode == "replace"
+	var doc registryExport
+	if err := decodeJSONBody(w, r, &doc); err != nil {
+		writeJSONDecodeError(w, err)
+		return
+	}
+	if err := validateRegistryExport(&doc); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_export", err.Error())
+		return
+	}
+	// Tenants first: a device must not land in a tenant that failed to import.
+	if err := s.tenants.importAll(doc.Tenants, replace); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errDomainTaken) {
+			status = http.StatusConflict
+		}
+		writeJSONError(w, status, err.Error())
+		return
+	}
+	if err := s.registry.importAll(doc.Devices, replace); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, registryImported{Devices: len(doc.Devices), Tenants: len(doc.Tenants), Mode: mode})
+	s.logf(logInfo, "registry_imported", "remote", clientIP(r), "devices", len(doc.Devices), "tenants", len(doc.Tenants), "mode", mode)
+}
+
+func validateRegistryExport(doc *registryExport) error {
+	if doc.Version != registryExportVersion {
+		return errors.New("unsupported export version")
+	}
+	seen := make(map[string]bool, len(doc.Devices))
+	for _, d := range doc.Devices {
+		if d == nil {
+			return errors.New("device entries need a valid device_id")
+		}
+		id, ok := normalizeDeviceID(d.DeviceID)
+		if !ok {
+			return errors.New("device entries need a valid device_id")
+		}
+		d.DeviceID = id
+		if seen[d.DeviceID] {
+			return errors.New("duplicate device " + d.DeviceID)
+		}
+		seen[d.DeviceID] = true
+		if d.Metadata != nil {
+			md, err := validateMetadata(d.Metadata)
+			if err != nil {
+				return errors.New(d.DeviceID + ": " + err.Error())
+			}
+			d.Metadata = md
+		}
+		if d.QuietHours != nil {
+			if err := d.QuietHours.validate(); err != nil {
+				return errors.New(d.DeviceID + ": quiet_hours: " + err.Error())
+			}
+		}
+		// Operator keys only mean something for keys the device has.
+		d.OperatorKeys = slices.DeleteFunc(d.OperatorKeys, func(k string) bool { _, ok := d.Metadata[k]; return !ok })
+		slices.Sort(d.OperatorKeys)
+		d.OperatorKeys = slices.Compact(d.OperatorKeys)
+	}
+	tenants := make(map[string]bool, len(doc.Tenants))
+	for _, t := range doc.Tenants {
+		if t == nil || t.ID == "" || strings.Contains(t.ID, "/") || len(t.ID) > 64 {
+			return errors.New("tenant entries need a valid id")
+		}
+		if tenants[t.ID] {
+			return errors.New("duplicate tenant " + t.ID)
+		}
+		tenants[t.ID] = true
+		domains, ok := normalizeDomains(t.Domains)
+		if !ok {
+			return errors.New(t.ID + ": invalid domain")
+		}
+		t.Domains = domains
+		if t.QuietHours != nil {
+			if err := t.QuietHours.validate(); err != nil {
+				return errors.New(t.ID + ": quiet_hours: " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func (reg *deviceRegistry) importAll(list []*registeredDevice, replace bool) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if replace {
+		reg.devices = make(map[string]*registeredDevice, len(list))
+	}
+	for _, d := range list {
+		reg.devices[d.DeviceID] = d
+	}
+	return reg.saveLocked()
+}
+
+func (ts *tenantStore) importAll(list []*tenant, replace bool) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	next := make(map[string]*tenant, len(ts.tenants)+len(list))
+	if !replace {
+		for id, t := range ts.tenants {
+			next[id] = t
+		}
+	}
+	for _, t := range list {
+		next[t.ID] = t
+	}
+	owner := make(map[string]string)
+	for id, t := range next {
+		for _, d := range t.Domains {
+			if other, taken := owner[d]; taken && other != id {
+				return errDomainTaken
+			}
+			owner[d] = id
+		}
+	}
+	ts.tenants = next
+	return ts.saveLocked()
+}
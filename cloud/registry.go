@@ -0,0 +1,388 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// registeredDevice is a device known to the persistent registry. Only a hash
+// of the device's pre-shared key is kept.
+type registeredDevice struct {
+	DeviceID   string `json:"device_id"`
+	SecretHash string `json:"secret_hash,omitempty"`
+	// Base32 TOTP seed for rotating claim codes. Unlike the device key this
+	// must be stored as-is: the relay recomputes codes from it.
+	ClaimSecret string `json:"claim_secret,omitempty"`
+	// Tenant the device belongs to (see tenants.go), if any.
+	Tenant string `json:"tenant,omitempty"`
+	// Free-form key/value pairs (see metadata.go), and the keys of them an
+	// operator set, which the device's own reports leave alone.
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	OperatorKeys []string          `json:"operator_metadata_keys,omitempty"`
+	// Account (API key name) that claimed the device, and the accounts it
+	// is shared with; see ownership.go.
+	Owner      string   `json:"owner,omitempty"`
+	SharedWith []string `json:"shared_with,omitempty"`
+	// How to wake the device when it sleeps; see wake.go.
+	Wake *wakeTarget `json:"wake,omitempty"`
+	// When media tunnels may run; see streaming.go.
+	Streaming *streamSchedule `json:"streaming,omitempty"`
+	// When not to notify or wake; see quiethours.go.
+	QuietHours *quietHours `json:"quiet_hours,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+	UpdatedAt  time.Time   `json:"updated_at"`
+}
+
+// registryView is what the API shows for a registered device.
+type registryView struct {
+	DeviceID   string            `json:"device_id"`
+	HasKey     bool              `json:"has_key"`
+	TOTPClaim  bool              `json:"totp_claim"`
+	Tenant     string            `json:"tenant,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Owner      string            `json:"owner,omitempty"`
+	SharedWith []string          `json:"shared_with,omitempty"`
+	Wake       *wakeTarget       `json:"wake,omitempty"`
+	Streaming  *streamSchedule   `json:"streaming,omitempty"`
+	QuietHours *quietHours       `json:"quiet_hours,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+}
+
+func (d registeredDevice) view() registryView {
+	return registryView{
+		DeviceID:   d.DeviceID,
+		HasKey:     d.SecretHash != "",
+		TOTPClaim:  d.ClaimSecret != "",
+		Tenant:     d.Tenant,
+		Metadata:   d.Metadata,
+		Owner:      d.Owner,
+		SharedWith: d.SharedWith,
+		Wake:       d.Wake,
+		Streaming:  d.Streaming,
+		QuietHours: d.QuietHours,
+		CreatedAt:  d.CreatedAt,
+		UpdatedAt:  d.UpdatedAt,
+	}
+}
+
+// deviceRegistry maps device_id to per-device credentials. A device with an
+// entry must present its own key on /ws/device/{id}, instead of (or in
+// addition to) the fleet-wide DEVICE_AUTH_TOKEN.
+type deviceRegistry struct {
+	store *fileStore
+
+	mu      sync.Mutex
+	devices map[string]*registeredDevice
+}
+
+const registryDoc = "registry"
+
+func newDeviceRegistry(store *fileStore) *deviceRegistry {
+	return &deviceRegistry{store: store, devices: make(map[string]*registeredDevice)}
+}
+
+func (reg *deviceRegistry) load() error {
+	var list []*registeredDevice
+	if err := reg.store.load(registryDoc, &list); err != nil {
+		return err
+	}
+	byID := make(map[string]*registeredDevice, len(list))
+	for _, d := range list {
+		if d != nil && d.DeviceID != "" {
+			byID[d.DeviceID] = d
+		}
+	}
+	devices, moved, dropped := canonicalDeviceKeys(byID)
+	for id, d := range devices {
+		d.DeviceID = id
+	}
+	reg.store.noteLegacyIDs(registryDoc, moved, dropped)
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.devices = devices
+	return nil
+}
+
+// saveLocked persists the registry; reg.mu must be held.
+func (reg *deviceRegistry) saveLocked() error {
+	list := make([]*registeredDevice, 0, len(reg.devices))
+	for _, d := range reg.devices {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DeviceID < list[j].DeviceID })
+	return reg.store.save(registryDoc, list)
+}
+
+func (reg *deviceRegistry) get(id string) (registeredDevice, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	d, ok := reg.devices[id]
+	if !ok {
+		return registeredDevice{}, false
+	}
+	return *d, true
+}
+
+func (reg *deviceRegistry) list() []registeredDevice {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	out := make([]registeredDevice, 0, len(reg.devices))
+	for _, d := range reg.devices {
+		out = append(out, *d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DeviceID < out[j].DeviceID })
+	return out
+}
+
+// setSecret registers id (if needed) and sets its pre-shared key.
+func (reg *deviceRegistry) setSecret(id, secret string) (registeredDevice, error) {
+	now := time.Now().UTC()
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	d, ok := reg.devices[id]
+	if !ok {
+		d = &registeredDevice{DeviceID: id, CreatedAt: now}
+		reg.devices[id] = d
+	}
+	d.SecretHash = hashSecret(secret)
+	d.UpdatedAt = now
+	return *d, reg.saveLocked()
+}
+
+// setClaimSecret sets (or, with "", clears) id's TOTP claim secret,
+// registering the device if needed.
+func (reg *deviceRegistry) setClaimSecret(id, secret string) error {
+	now := time.Now().UTC()
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	d, ok := reg.devices[id]
+	if !ok {
+		if secret == "" {
+			return nil
+		}
+		d = &registeredDevice{DeviceID: id, CreatedAt: now}
+		reg.devices[id] = d
+	}
+	d.ClaimSecret = secret
+	d.UpdatedAt = now
+	return reg.saveLocked()
+}
+
+// setTenant assigns id to a tenant ("" to unassign), registering the device
+// if needed.
+func (reg *deviceRegistry) setTenant(id, tenantID string) error {
+	now := time.Now().UTC()
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	d, ok := reg.devices[id]
+	if !ok {
+		if tenantID == "" {
+			return nil
+		}
+		d = &registeredDevice{DeviceID: id, CreatedAt: now}
+		reg.devices[id] = d
+	}
+	d.Tenant = tenantID
+	d.UpdatedAt = now
+	return reg.saveLocked()
+}
+
+// setWake sets (or with nil clears) how id is woken. Unlike the other
+// setters it doesn't register id: false if id isn't registered.
+func (reg *deviceRegistry) setWake(id string, t *wakeTarget) (bool, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	d, ok := reg.devices[id]
+	if !ok {
+		return false, nil
+	}
+	d.Wake = t
+	d.UpdatedAt = time.Now().UTC()
+	return true, reg.saveLocked()
+}
+
+// setStreaming sets (or with nil clears) id's streaming windows.
+func (reg *deviceRegistry) setStreaming(id string, ss *streamSchedule) error {
+	now := time.Now().UTC()
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	d, ok := reg.devices[id]
+	if !ok {
+		if ss == nil {
+			return nil
+		}
+		d = &registeredDevice{DeviceID: id, CreatedAt: now}
+		reg.devices[id] = d
+	}
+	d.Streaming = ss
+	d.UpdatedAt = now
+	return reg.saveLocked()
+}
+
+// setQuietHours sets (or with nil clears) id's quiet hours. It reports
+// whether id is registered; unknown devices are left alone.
+func (reg *deviceRegistry) setQuietHours(id string, q *quietHours) (bool, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	d, ok := reg.devices[id]
+	if !ok {
+		return false, nil
+	}
+	d.QuietHours = q
+	d.UpdatedAt = time.Now().UTC()
+	return true, reg.saveLocked()
+}
+
+// clearSecret removes id's pre-shared key, leaving the device registered.
+func (reg *deviceRegistry) clearSecret(id string) (bool, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	d, ok := reg.devices[id]
+	if !ok || d.SecretHash == "" {
+		return false, nil
+	}
+	d.SecretHash = ""
+	d.UpdatedAt = time.Now().UTC()
+	return true, reg.saveLocked()
+}
+
+// verifyKey checks a presented device key. hasKey is false when the device
+// has no key on file, in which case ok is meaningless.
+func (reg *deviceRegistry) verifyKey(id, presented string) (hasKey, ok bool) {
+	d, found := reg.get(id)
+	if !found || d.SecretHash == "" {
+		return false, false
+	}
+	if presented == "" {
+		return true, false
+	}
+	return true, subtle.ConstantTimeCompare([]byte(hashSecret(presented)), []byte(d.SecretHash)) == 1
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return b
+}
+
+// randomToken returns n random bytes, base64url-encoded.
+func randomToken(n int) string {
+	return base64.RawURLEncoding.EncodeToString(randomBytes(n))
+}
+
+// extractDeviceKey returns the pre-shared key a device presented, via the
+// X-Device-Key header or ?device_key=. (?token= is taken: it carries the
+// token UIs must present.)
+func extractDeviceKey(r *http.Request) string {
+	if k := strings.TrimSpace(r.Header.Get("X-Device-Key")); k != "" {
+		return k
+	}
+	return r.URL.Query().Get("device_key")
+}
+
+type credentialsRequest struct {
+	// Optional; a random key is generated when empty.
+	Secret string `json:"secret,omitempty"`
+}
+
+type credentialsResponse struct {
+	DeviceID  string    `json:"device_id"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Only when the key was generated: returned once, only the hash is stored.
+	Secret string `json:"secret,omitempty"`
+}
+
+// handleDeviceCredentials manages a device's pre-shared key:
+//
+//	GET    /api/devices/{id}/credentials  registry entry (never the key)
+//	PUT    /api/devices/{id}/credentials  set or rotate the key
+//	DELETE /api/devices/{id}/credentials  remove the key
+func (s *server) handleDeviceCredentials(w http.ResponseWriter, r *http.Request, deviceID string) {
+	if !s.requireRole(w, r, roleAdmin) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		d, ok := s.registry.get(deviceID)
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "device_not_registered", "device not registered")
+			return
+		}
+		writeJSON(w, http.StatusOK, d.view())
+	case http.MethodPut:
+		var req credentialsRequest
+		if r.ContentLength != 0 {
+			if err := decodeJSONBody(w, r, &req); err != nil {
+				writeJSONDecodeError(w, err)
+				return
+			}
+		}
+		secret := strings.TrimSpace(req.Secret)
+		generated := secret == ""
+		if generated {
+			secret = randomToken(32)
+		} else if len(secret) < 16 || len(secret) > 256 {
+			writeAPIError(w, http.StatusBadRequest, "invalid_secret", "secret must be 16-256 characters")
+			return
+		}
+		d, err := s.registry.setSecret(deviceID, secret)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist registry")
+			s.logf(logInfo, "registry_save_failed", "device_id", deviceID, "err", err.Error())
+			return
+		}
+		resp := credentialsResponse{DeviceID: d.DeviceID, UpdatedAt: d.UpdatedAt}
+		if generated {
+			resp.Secret = secret
+		}
+		writeJSON(w, http.StatusOK, resp)
+		s.logf(logInfo, "device_key_set", "remote", clientIP(r), "device_id", deviceID, "generated", generated)
+	case http.MethodDelete:
+		removed, err := s.registry.clearSecret(deviceID)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist registry")
+			return
+		}
+		if !removed {
+			writeAPIError(w, http.StatusNotFound, "device_has_no_key", "device has no key")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		s.logf(logInfo, "device_key_removed", "remote", clientIP(r), "device_id", deviceID)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleRegistry lists every registered device (admin only).
+func (s *server) handleRegistry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.requireRole(w, r, roleAdmin) {
+		return
+	}
+	list := s.registry.list()
+	out := make([]registryView, 0, len(list))
+	for _, d := range list {
+		out = append(out, d.view())
+	}
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// handleAvailabilityReport serves GET /api/reports/availability: per-device
+// availability over ?window=24h|7d|30d (default 30d) plus a fleet summary,
+// as JSON or, with ?format=csv, as a spreadsheet-ready CSV whose last row
+// is the fleet total. Devices in maintenance are listed but left out of the
+// fleet summary.
+func (s *server) handleAvailabilityReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.requireRole(w, r, roleViewer) {
+		return
+	}
+	q := r.URL.Query()
+	window, ok := parseUptimeWindow(q.Get("window"), "30d")
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "invalid_window", "window must be 24h, 7d or 30d")
+		return
+	}
+	format := q.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		writeAPIError(w, http.StatusBadRequest, "invalid_format", "format must be json or csv")
+		return
+	}
+	rows := s.uptimeRows(r, window)
+	fleet := summarizeAvailability(rows)
+	now := time.Now().UTC()
+
+	if format != "csv" {
+		writeJSON(w, http.StatusOK, availabilityReport{Window: window, GeneratedAt: now, Fleet: fleet, Devices: rows})
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="availability-`+window+`-`+now.Format("20060102")+`.csv"`)
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"device_id", "connected", "availability_pct", "connected_s", "observed_s", "disconnects", "maintenance"})
+	for _, row := range rows {
+		_ = cw.Write([]string{row.DeviceID, strconv.FormatBool(row.Connected), strconv.FormatFloat(row.Availability, 'f', 2, 64),
+			strconv.FormatInt(row.ConnectedS, 10), strconv.FormatInt(row.ObservedS, 10), strconv.Itoa(row.Disconnects), strconv.FormatBool(row.Maintenance)})
+	}
+	_ = cw.Write([]string{"TOTAL", strconv.Itoa(fleet.Connected) + "/" + strconv.Itoa(fleet.Devices),
+		strconv.FormatFloat(fleet.Availability, 'f', 2, 64), strconv.FormatInt(fleet.ConnectedS, 10),
+		strconv.FormatInt(fleet.ObservedS, 10), strconv.Itoa(fleet.Disconnects), strconv.Itoa(fleet.Maintenance)})
+	cw.Flush()
+}
+
+type availabilityReport struct {
+	Window      string            `json:"window"`
+	GeneratedAt time.Time         `json:"generated_at"`
+	Fleet       fleetAvailability `json:"fleet"`
+	Devices     []uptimeRow       `json:"devices"`
+}
+
+type fleetAvailability struct {
+	Devices   int `json:"devices"`
+	Connected int `json:"connected"` // right now
+	// Total connected over total observed time, so long-lived devices
+	// weigh more than ones added last week.
+	Availability float64 `json:"availability"`
+	// Per-device spread.
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+	Min    float64 `json:"min"`
+
+	ConnectedS  int64 `json:"connected_s"`
+	ObservedS   int64 `json:"observed_s"`
+	Disconnects int   `json:"disconnects"`
+	// Devices in maintenance, not included above.
+	Maintenance int `json:"maintenance"`
+}
+
+// summarizeAvailability totals rows, which are sorted least available first.
+func summarizeAvailability(all []uptimeRow) fleetAvailability {
+	var f fleetAvailability
+	rows := make([]uptimeRow, 0, len(all))
+	for _, row := range all {
+		if row.Maintenance {
+			f.Maintenance++
+			continue
+		}
+		rows = append(rows, row)
+	}
+	f.Devices = len(rows)
+	if len(rows) == 0 {
+		return f
+	}
+	var sum float64
+	for _, row := range rows {
+		if row.Connected {
+			f.Connected++
+		}
+		f.ConnectedS += row.ConnectedS
+		f.ObservedS += row.ObservedS
+		f.Disconnects += row.Disconnects
+		sum += row.Availability
+	}
+	if f.ObservedS > 0 {
+		f.Availability = float64(f.ConnectedS*10000/f.ObservedS) / 100
+	}
+	f.Mean = float64(int64(sum/float64(len(rows))*100)) / 100
+	f.Min = rows[0].Availability
+	if n := len(rows); n%2 == 1 {
+		f.Median = rows[n/2].Availability
+	} else {
+		f.Median = (rows[n/2-1].Availability + rows[n/2].Availability) / 2
+	}
+	return f
+}
@@ -0,0 +1,21 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package main
+
+import "syscall"
+
+// SO_REUSEPORT isn't in package syscall; 15 is its value on the Linux
+// architectures this builds for (MIPS uses 0x200).
+const soReusePort = 0xf
+
+const reusePortSupported = true
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,9 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package main
+
+import "syscall"
+
+const reusePortSupported = false
+
+func setReusePort(network, address string, c syscall.RawConn) error { return nil }
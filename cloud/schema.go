@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// tunnelSchema is a JSON Schema that UI->device text messages on one tunnel
+// must satisfy. Invalid commands are answered with a schema_violation error
+// instead of reaching the firmware.
+type tunnelSchema struct {
+	Tunnel    string          `json:"tunnel"`
+	Schema    json.RawMessage `json:"schema"`
+	UpdatedAt time.Time       `json:"updated_at"`
+
+	compiled *jsonschema.Schema
+}
+
+type schemaStore struct {
+	store *fileStore
+
+	mu      sync.RWMutex
+	schemas map[string]*tunnelSchema
+}
+
+const schemasDoc = "schemas"
+
+func newSchemaStore(store *fileStore) *schemaStore {
+	return &schemaStore{store: store, schemas: make(map[string]*tunnelSchema)}
+}
+
+func compileSchema(tunnel string, raw []byte) (*jsonschema.Schema, error) {
+	c := jsonschema.NewCompiler()
+	// Schemas must be self-contained; never fetch $refs from disk or network.
+	c.LoadURL = func(s string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("external $ref %q not allowed", s)
+	}
+	url := "mem://schemas/" + tunnel + ".json"
+	if err := c.AddResource(url, bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+	return c.Compile(url)
+}
+
+func (ss *schemaStore) load() error {
+	var list []*tunnelSchema
+	if err := ss.store.load(schemasDoc, &list); err != nil {
+		return err
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, ts := range list {
+		if ts == nil || ts.Tunnel == "" {
+			continue
+		}
+		compiled, err := compileSchema(ts.Tunnel, ts.Schema)
+		if err != nil {
+			return fmt.Errorf("schema for tunnel %q: %w", ts.Tunnel, err)
+		}
+		ts.compiled = compiled
+		ss.schemas[ts.Tunnel] = ts
+	}
+	return nil
+}
+
+func (ss *schemaStore) saveLocked() error {
+	list := make([]*tunnelSchema, 0, len(ss.schemas))
+	for _, ts := range ss.schemas {
+		list = append(list, ts)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Tunnel < list[j].Tunnel })
+	return ss.store.save(schemasDoc, list)
+}
+
+func (ss *schemaStore) get(tunnel string) *tunnelSchema {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return ss.schemas[tunnel]
+}
+
+func (ss *schemaStore) list() []tunnelSchema {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	out := make([]tunnelSchema, 0, len(ss.schemas))
+	for _, ts := range ss.schemas {
+		out = append(out, *ts)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Tunnel < out[j].Tunnel })
+	return out
+}
+
+func (ss *schemaStore) put(tunnel string, raw []byte) (tunnelSchema, error) {
+	compiled, err := compileSchema(tunnel, raw)
+	if err != nil {
+		return tunnelSchema{}, errInvalidSchema{err}
+	}
+	ts := &tunnelSchema{Tunnel: tunnel, Schema: raw, UpdatedAt: time.Now().UTC(), compiled: compiled}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.schemas[tunnel] = ts
+	return *ts, ss.saveLocked()
+}
+
+func (ss *schemaStore) remove(tunnel string) (bool, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if _, ok := ss.schemas[tunnel]; !ok {
+		return false, nil
+	}
+	delete(ss.schemas, tunnel)
+	return true, ss.saveLocked()
+}
+
+type errInvalidSchema struct{ err error }
+
+func (e errInvalidSchema) Error() string { return "invalid schema: " + e.err.Error() }
+
+// schemaViolation is one failed constraint, reported to the UI.
+type schemaViolation struct {
+	Path    string `json:"path"`
+	Keyword string `json:"keyword"`
+	Message string `json:"message"`
+}
+
+// validate checks msg against the tunnel's schema. It returns nil when the
+// message is valid or the tunnel has no schema.
+func (ts *tunnelSchema) validate(msg []byte) []schemaViolation {
+	if ts == nil {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return []schemaViolation{{Message: "message is not valid JSON"}}
+	}
+	err := ts.compiled.Validate(v)
+	if err == nil {
+		return nil
+	}
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return []schemaViolation{{Message: err.Error()}}
+	}
+	var out []schemaViolation
+	var leaves func(*jsonschema.ValidationError)
+	leaves = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) == 0 {
+			out = append(out, schemaViolation{Path: e.InstanceLocation, Keyword: e.KeywordLocation, Message: e.Message})
+			return
+		}
+		for _, c := range e.Causes {
+			leaves(c)
+		}
+	}
+	leaves(ve)
+	return out
+}
+
+// schemaViolationMessage is sent to the UI in place of forwarding.
+func schemaViolationMessage(tunnel string, violations []schemaViolation) []byte {
+	return mustJSON(errorMsg{Type: "error", Code: "schema_violation", Tunnel: tunnel, Errors: violations})
+}
+
+// handleSchemas manages per-tunnel command schemas (admin only):
+//
+//	GET    /api/schemas           list schemas
+//	GET    /api/schemas/{tunnel}  one schema
+//	PUT    /api/schemas/{tunnel}  set the schema (body is the JSON Schema)
+//	DELETE /api/schemas/{tunnel}  stop validating the tunnel
+func (s *server) handleSchemas(w http.ResponseWriter, r *http.Request) {
+	if !s.requireRole(w, r, roleAdmin) {
+		return
+	}
+	tunnel := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/schemas"), "/")
+	if tunnel == "" {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, s.schemas.list())
+		return
+	}
+	if strings.Contains(tunnel, "/") || len(tunnel) > 64 {
+		writeAPIError(w, http.StatusBadRequest, "invalid_tunnel", "invalid tunnel")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		ts := s.schemas.get(tunnel)
+		if ts == nil {
+			writeAPIError(w, http.StatusNotFound, "schema_not_found", "no schema for tunnel")
+			return
+		}
+		writeJSON(w, http.StatusOK, ts)
+	case http.MethodPut:
+		raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 256<<10))
+		if err != nil {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, "too_large", "schema too large")
+			return
+		}
+		if !json.Valid(raw) {
+			writeAPIError(w, http.StatusBadRequest, "invalid_schema", "schema is not valid JSON")
+			return
+		}
+		ts, err := s.schemas.put(tunnel, raw)
+		var invalid errInvalidSchema
+		if errors.As(err, &invalid) {
+			writeAPIError(w, http.StatusBadRequest, "invalid_schema", invalid.Error())
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist schemas")
+			return
+		}
+		writeJSON(w, http.StatusOK, ts)
+		s.logf(logInfo, "tunnel_schema_set", "remote", clientIP(r), "tunnel", tunnel)
+	case http.MethodDelete:
+		removed, err := s.schemas.remove(tunnel)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist schemas")
+			return
+		}
+		if !removed {
+			writeAPIError(w, http.StatusNotFound, "schema_not_found", "no schema for tunnel")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		s.logf(logInfo, "tunnel_schema_removed", "remote", clientIP(r), "tunnel", tunnel)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Serial-console tunnels (SERIAL_TUNNELS, default "serial") carry a device's
+// UART console as raw bytes. The relay keeps the last SERIAL_SCROLLBACK bytes
+// of output per device/tunnel, across reconnects, so the boot log of a unit
+// that keeps resetting is still there when someone looks.
+//
+// Two kinds of UI attach to a serial tunnel:
+//
+//   - /ws/ui/{id}?tunnel=serial receives the console line-buffered: one text
+//     message per line, with a partial line (e.g. a prompt) flushed after
+//     SERIAL_LINE_FLUSH of silence. Lines longer than 4KiB are split.
+//   - /ws/serial/{id}?tunnel=serial is xterm-compatible (e.g. the xterm.js
+//     attach addon): output arrives as raw binary with CRLF line endings,
+//     starting with a replay of the scrollback, and keystrokes are forwarded
+//     to the device untouched.
+
+func (s *server) isSerialTunnel(tunnel string) bool {
+	_, ok := s.serialTunnels[tunnel]
+	return ok
+}
+
+// serialConsole is the retained output of one device/tunnel.
+type serialConsole struct {
+	mu       sync.Mutex
+	max      int
+	buf      []byte // scrollback, trimmed to whole lines when over max
+	partial  []byte // output after the last newline
+	flushed  int    // bytes of partial already sent to line UIs
+	lastCR   bool   // last raw byte was '\r' (for CRLF translation)
+	lastSeen time.Time
+}
+
+// serialConsoles holds scrollback per device key; entries outlive the device
+// session and are dropped after a day without output.
+type serialConsoles struct {
+	max int
+
+	mu       sync.Mutex
+	consoles map[string]*serialConsole
+}
+
+func newSerialConsoles(max int) *serialConsoles {
+	if max < 1024 {
+		max = 1024
+	}
+	return &serialConsoles{max: max, consoles: make(map[string]*serialConsole)}
+}
+
+func (sc *serialConsoles) get(key string) *serialConsole {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	c := sc.consoles[key]
+	if c == nil {
+		now := time.Now()
+		for k, old := range sc.consoles {
+			old.mu.Lock()
+			stale := now.Sub(old.lastSeen) > 24*time.Hour
+			old.mu.Unlock()
+			if stale {
+				delete(sc.consoles, k)
+			}
+		}
+		c = &serialConsole{max: sc.max, lastSeen: now}
+		sc.consoles[key] = c
+	}
+	return c
+}
+
+// maxSerialLine caps a pending line; a device that never sends a newline
+// reaches line UIs in maxSerialLine pieces.
+const maxSerialLine = 4096
+
+// writeLocked appends device output and returns what line UIs should get: the
+// newly completed lines, without their line endings.
+func (c *serialConsole) writeLocked(data []byte, now time.Time) (lines [][]byte) {
+	c.lastSeen = now
+	c.buf = append(c.buf, data...)
+	if over := len(c.buf) - c.max; over > 0 {
+		cut := over
+		if i := bytes.IndexByte(c.buf[over:], '\n'); i >= 0 && i < c.max/2 {
+			cut = over + i + 1
+		}
+		c.buf = append(c.buf[:0:0], c.buf[cut:]...)
+	}
+	for len(data) > 0 {
+		room := maxSerialLine - len(c.partial)
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 || i > room {
+			// No newline within the cap: a full line is sent as is.
+			n := min(len(data), room)
+			c.partial = append(c.partial, data[:n]...)
+			data = data[n:]
+			if len(c.partial) < maxSerialLine {
+				break
+			}
+			lines = append(lines, append([]byte(nil), c.partial[c.flushed:]...))
+			c.partial, c.flushed = c.partial[:0], 0
+			continue
+		}
+		c.partial = append(c.partial, data[:i]...)
+		line := bytes.TrimRight(c.partial[c.flushed:], "\r")
+		lines = append(lines, append([]byte(nil), line...))
+		c.partial, c.flushed = c.partial[:0], 0
+		data = data[i+1:]
+	}
+	return lines
+}
+
+// flushLocked returns the part of the pending partial line not yet sent.
+func (c *serialConsole) flushLocked() []byte {
+	if c.flushed >= len(c.partial) {
+		return nil
+	}
+	out := append([]byte(nil), c.partial[c.flushed:]...)
+	c.flushed = len(c.partial)
+	return out
+}
+
+// terminalBytes translates bare LF to CRLF for terminals.
+func (c *serialConsole) terminalBytes(data []byte) []byte {
+	out := make([]byte, 0, len(data)+bytes.Count(data, []byte{'\n'}))
+	for _, b := range data {
+		if b == '\n' && !c.lastCR {
+			out = append(out, '\r')
+		}
+		out = append(out, b)
+		c.lastCR = b == '\r'
+	}
+	return out
+}
+
+// replayLocked is the scrollback as a terminal should see it.
+func (c *serialConsole) replayLocked() []byte {
+	return bytes.ReplaceAll(bytes.ReplaceAll(c.buf, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+}
+
+// attachTerminal replays the scrollback to a terminal UI and registers it
+// with the session in one step, so no output falls between the two.
+func (c *serialConsole) attachTerminal(dc *deviceConn, uiConn *websocket.Conn, opts uiOptions) (wasEmpty bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if replay := c.replayLocked(); len(replay) > 0 {
+		_ = uiConn.WriteMessage(websocket.BinaryMessage, replay)
+	}
+	dc.uiMu.Lock()
+	wasEmpty = len(dc.uiConns) == 0
+	dc.uiConns[uiConn] = opts
+	dc.uiMu.Unlock()
+	return wasEmpty
+}
+
+// forwardSerial records device output and fans it out to the session's UIs.
+// It returns whether a partial line is pending for line UIs.
+func (s *server) forwardSerial(dc *deviceConn, c *serialConsole, data []byte, now time.Time) (pending bool) {
+	c.mu.Lock()
+	lines := c.writeLocked(data, now)
+	raw := c.terminalBytes(data)
+	pending = c.flushed < len(c.partial)
+	dc.uiMu.Lock()
+	uis := make([]*websocket.Conn, 0, len(dc.uiConns))
+	terminal := make([]bool, 0, len(dc.uiConns))
+	for ui, opts := range dc.uiConns {
+		uis = append(uis, ui)
+		terminal = append(terminal, opts.terminal)
+	}
+	dc.uiMu.Unlock()
+	c.mu.Unlock()
+
+	dc.uiWriteMu.Lock()
+	defer dc.uiWriteMu.Unlock()
+	for i, ui := range uis {
+		if terminal[i] {
+			_ = dc.writeUI(ui, websocket.BinaryMessage, raw)
+			continue
+		}
+		for _, line := range lines {
+			_ = dc.writeUI(ui, websocket.TextMessage, line)
+		}
+	}
+	return pending
+}
+
+// flushSerial sends a pending partial line to line UIs.
+func (s *server) flushSerial(dc *deviceConn, c *serialConsole) {
+	c.mu.Lock()
+	out := c.flushLocked()
+	c.mu.Unlock()
+	if out == nil {
+		return
+	}
+	out = bytes.TrimRight(out, "\r")
+	dc.uiMu.Lock()
+	uis := make([]*websocket.Conn, 0, len(dc.uiConns))
+	for ui, opts := range dc.uiConns {
+		if !opts.terminal {
+			uis = append(uis, ui)
+		}
+	}
+	dc.uiMu.Unlock()
+	dc.uiWriteMu.Lock()
+	for _, ui := range uis {
+		_ = dc.writeUI(ui, websocket.TextMessage, out)
+	}
+	dc.uiWriteMu.Unlock()
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Guest share links: time-limited UI access to one device for someone
+// without an account (a neighbor watching the camera for the weekend).
+//
+//	POST   /api/devices/{id}/share        {"ttl":"48h","scope":"view","tunnel":"ws_camera","label":"neighbor"}
+//	GET    /api/devices/{id}/share        list (tokens are never shown again)
+//	DELETE /api/devices/{id}/share/{sid}  revoke
+//
+// The guest connects with /ws/ui/{id}?share=<token>. A share works on owned
+// devices without an account, and the guest's sessions are closed with 4010
+// share_expired when it expires or is revoked.
+
+type shareLink struct {
+	ID        string    `json:"id"`
+	DeviceID  string    `json:"device_id"`
+	Tunnel    string    `json:"tunnel,omitempty"` // "" = any tunnel
+	Scope     string    `json:"scope"`
+	Label     string    `json:"label,omitempty"`
+	TokenHash string    `json:"token_hash"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type shareView struct {
+	ID        string    `json:"id"`
+	Tunnel    string    `json:"tunnel,omitempty"`
+	Scope     string    `json:"scope"`
+	Label     string    `json:"label,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type shareRequest struct {
+	TTL    string `json:"ttl,omitempty"`   // default 24h, up to SHARE_MAX_TTL
+	Scope  string `json:"scope,omitempty"` // view (default) or control
+	Tunnel string `json:"tunnel,omitempty"`
+	Label  string `json:"label,omitempty"`
+}
+
+// shareCreated carries the guest token, shown this once.
+type shareCreated struct {
+	ID        string    `json:"id"`
+	Token     string    `json:"token"`
+	UIWSURL   string    `json:"ui_ws_url"`
+	Scope     string    `json:"scope"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (sl shareLink) view() shareView {
+	return shareView{ID: sl.ID, Tunnel: sl.Tunnel, Scope: sl.Scope, Label: sl.Label,
+		CreatedBy: sl.CreatedBy, CreatedAt: sl.CreatedAt, ExpiresAt: sl.ExpiresAt}
+}
+
+func (sl shareLink) scope() uiScope {
+	if sl.Scope == "control" {
+		return uiScopeControl
+	}
+	return uiScopeView
+}
+
+type shareStore struct {
+	store  *fileStore
+	maxTTL time.Duration
+
+	mu     sync.Mutex
+	shares map[string]*shareLink    // by ID
+	ended  map[string]chan struct{} // closed on revoke, for live guest sessions
+}
+
+const sharesDoc = "shares"
+
+func newShareStore(store *fileStore, maxTTL time.Duration) *shareStore {
+	return &shareStore{store: store, maxTTL: maxTTL, shares: make(map[string]*shareLink), ended: make(map[string]chan struct{})}
+}
+
+func (ss *shareStore) load() error {
+	var list []*shareLink
+	if err := ss.store.load(sharesDoc, &list); err != nil {
+		return err
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.shares = make(map[string]*shareLink, len(list))
+	now := time.Now()
+	moved, dropped := 0, []string(nil)
+	for _, sl := range list {
+		if sl == nil || sl.ID == "" || !now.Before(sl.ExpiresAt) {
+			continue
+		}
+		id, ok := normalizeDeviceID(sl.DeviceID)
+		if !ok {
+			dropped = append(dropped, sl.DeviceID)
+			continue
+		}
+		if id != sl.DeviceID {
+			sl.DeviceID = id
+			moved++
+		}
+		ss.shares[sl.ID] = sl
+	}
+	ss.store.noteLegacyIDs(sharesDoc, moved, dropped)
+	return nil
+}
+
+// saveLocked persists unexpired shares, dropping the rest; ss.mu must be held.
+func (ss *shareStore) saveLocked() error {
+	now := time.Now()
+	list := make([]*shareLink, 0, len(ss.shares))
+	for id, sl := range ss.shares {
+		if now.After(sl.ExpiresAt) {
+			ss.revokeLocked(id)
+			continue
+		}
+		list = append(list, sl)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return ss.store.save(sharesDoc, list)
+}
+
+func (ss *shareStore) create(sl shareLink) (shareLink, string, error) {
+	token := randomToken(24)
+	sl.ID = randomToken(6)
+	sl.TokenHash = hashSecret(token)
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.shares[sl.ID] = &sl
+	return sl, token, ss.saveLocked()
+}
+
+func (ss *shareStore) list(deviceID string) []shareView {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	now := time.Now()
+	out := []shareView{}
+	for _, sl := range ss.shares {
+		if sl.DeviceID == deviceID && now.Before(sl.ExpiresAt) {
+			out = append(out, sl.view())
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+// lookup returns the live share token grants on deviceID/tunnel.
+func (ss *shareStore) lookup(deviceID, tunnel, token string) (shareLink, bool) {
+	if token == "" {
+		return shareLink{}, false
+	}
+	h := []byte(hashSecret(token))
+	now := time.Now()
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, sl := range ss.shares {
+		if subtle.ConstantTimeCompare(h, []byte(sl.TokenHash)) != 1 {
+			continue
+		}
+		if sl.DeviceID == deviceID && (sl.Tunnel == "" || sl.Tunnel == tunnel) && now.Before(sl.ExpiresAt) {
+			return *sl, true
+		}
+	}
+	return shareLink{}, false
+}
+
+// endedChan is closed when share id is revoked.
+func (ss *shareStore) endedChan(id string) <-chan struct{} {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ch := ss.ended[id]
+	if ch == nil {
+		ch = make(chan struct{})
+		ss.ended[id] = ch
+	}
+	return ch
+}
+
+func (ss *shareStore) revokeLocked(id string) {
+	delete(ss.shares, id)
+	if ch := ss.ended[id]; ch != nil {
+		close(ch)
+		delete(ss.ended, id)
+	}
+}
+
+func (ss *shareStore) revoke(deviceID, id string) (bool, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	sl, ok := ss.shares[id]
+	if !ok || sl.DeviceID != deviceID {
+		return false, nil
+	}
+	ss.revokeLocked(id)
+	return true, ss.saveLocked()
+}
+
+// revokeDevice drops every share of deviceID.
+func (ss *shareStore) revokeDevice(deviceID string) (int, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	n := 0
+	for id, sl := range ss.shares {
+		if sl.DeviceID == deviceID {
+			ss.revokeLocked(id)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, ss.saveLocked()
+}
+
+// watchShare closes a guest's UI connection when its share expires or is
+// revoked, until done is closed.
+func (s *server) watchShare(conn *websocket.Conn, sl shareLink, done <-chan struct{}) {
+	t := time.NewTimer(time.Until(sl.ExpiresAt))
+	defer t.Stop()
+	select {
+	case <-done:
+		return
+	case <-t.C:
+	case <-s.shares.endedChan(sl.ID):
+	}
+	// WriteControl and Close are safe alongside the bridge's writers.
+	sendClose(conn, wsCloseShareExpired)
+	_ = conn.Close()
+	s.logf(logInfo, "ui_ws_share_ended", "device_id", sl.DeviceID, "share_id", sl.ID)
+}
+
+// canManageShares: the owner or an admin for owned devices, else operators.
+func (s *server) canManageShares(w http.ResponseWriter, r *http.Request, deviceID string) (string, bool) {
+	account, _ := s.callerAccount(r)
+	d, _ := s.registry.get(deviceID)
+	if d.Owner != "" && account == d.Owner {
+		return account, true
+	}
+	min := roleOperator
+	if d.Owner != "" {
+		min = roleAdmin
+	}
+	return account, s.requireRole(w, r, min)
+}
+
+func (s *server) handleDeviceShare(w http.ResponseWriter, r *http.Request, deviceID, shareID string) {
+	account, ok := s.canManageShares(w, r, deviceID)
+	if !ok {
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && shareID == "":
+		writeJSON(w, http.StatusOK, s.shares.list(deviceID))
+	case r.Method == http.MethodDelete && shareID != "":
+		found, err := s.shares.revoke(deviceID, shareID)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist shares")
+			return
+		}
+		if !found {
+			writeAPIError(w, http.StatusNotFound, "share_not_found", "share not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, okResponse{OK: true})
+		s.logf(logInfo, "device_share_revoked", "remote", clientIP(r), "device_id", deviceID, "share_id", shareID)
+	case r.Method == http.MethodPost && shareID == "":
+		var req shareRequest
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeJSONDecodeError(w, err)
+			return
+		}
+		ttl := 24 * time.Hour
+		if req.TTL != "" {
+			d, err := time.ParseDuration(req.TTL)
+			if err != nil || d <= 0 || d > s.shares.maxTTL {
+				writeAPIError(w, http.StatusBadRequest, "invalid_ttl", "ttl must be a duration up to "+s.shares.maxTTL.String())
+				return
+			}
+			ttl = d
+		}
+		scope := strings.ToLower(strings.TrimSpace(req.Scope))
+		if scope == "" {
+			scope = "view"
+		}
+		if scope != "view" && scope != "control" {
+			writeAPIError(w, http.StatusBadRequest, "invalid_scope", "scope must be view or control")
+			return
+		}
+		tunnel := strings.TrimSpace(req.Tunnel)
+		if strings.Contains(tunnel, "/") {
+			writeAPIError(w, http.StatusBadRequest, "invalid_tunnel", "invalid tunnel")
+			return
+		}
+		now := time.Now().UTC()
+		sl := shareLink{DeviceID: deviceID, Tunnel: tunnel, Scope: scope, Label: truncate(strings.TrimSpace(req.Label), 64),
+			CreatedBy: account, CreatedAt: now, ExpiresAt: now.Add(ttl)}
+		sl, token, err := s.shares.create(sl)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist shares")
+			return
+		}
+		ui, _ := wsURLs(s.publicBaseFor(r, deviceID), deviceID, tunnel)
+		sep := "?"
+		if strings.Contains(ui, "?") {
+			sep = "&"
+		}
+		writeJSON(w, http.StatusOK, shareCreated{
+			ID:        sl.ID,
+			Token:     token,
+			UIWSURL:   ui + sep + "share=" + urlQueryEscape(token),
+			Scope:     scope,
+			ExpiresAt: sl.ExpiresAt,
+		})
+		s.logf(logInfo, "device_share_created", "remote", clientIP(r), "device_id", deviceID, "scope", scope, "ttl", ttl.String())
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// On SIGTERM, once the drain delay is over, every device and UI gets a
+// retry_after message and a server_restarting close instead of the bare TCP
+// reset (1006) the process exit would give them. The suggested delay is
+// SHUTDOWN_RECONNECT_DELAY plus a random share of SHUTDOWN_RECONNECT_JITTER,
+// picked per connection, so the fleet doesn't come back in one wave.
+
+// Between restarts, devices that announce learn the backoff to use from the
+// registered message: RECONNECT_BACKOFF_BASE doubling up to
+// RECONNECT_BACKOFF_MAX, each wait randomized by RECONNECT_BACKOFF_JITTER.
+func loadReconnectHint() (reconnectHint, error) {
+	base := envDuration("RECONNECT_BACKOFF_BASE", time.Second)
+	ceiling := envDuration("RECONNECT_BACKOFF_MAX", time.Minute)
+	if base <= 0 || ceiling < base {
+		return reconnectHint{}, fmt.Errorf("RECONNECT_BACKOFF_BASE/MAX: need 0 < base <= max, got %s and %s", base, ceiling)
+	}
+	v := envOr("RECONNECT_BACKOFF_JITTER", "0.5")
+	jitter, err := strconv.ParseFloat(v, 64)
+	if err != nil || jitter < 0 || jitter > 1 {
+		return reconnectHint{}, fmt.Errorf("RECONNECT_BACKOFF_JITTER: %q is not a fraction between 0 and 1", v)
+	}
+	return reconnectHint{BaseMs: base.Milliseconds(), MaxMs: ceiling.Milliseconds(), Jitter: jitter}, nil
+}
+
+type restartNotice struct {
+	delay, jitter time.Duration
+}
+
+func loadRestartNotice() restartNotice {
+	return restartNotice{
+		delay:  envDuration("SHUTDOWN_RECONNECT_DELAY", 5*time.Second),
+		jitter: envDuration("SHUTDOWN_RECONNECT_JITTER", 10*time.Second),
+	}
+}
+
+func (rn restartNotice) message() []byte {
+	d := rn.delay
+	if rn.jitter > 0 {
+		d += rand.N(rn.jitter)
+	}
+	return retryAfterMessage(wsCloseServerRestarting, d)
+}
+
+// notifyRestart closes every device session, and the UIs attached to it,
+// with server_restarting. A peer that stopped reading can block a write, so
+// sessions are closed in parallel and the whole pass gives up after timeout.
+func (s *server) notifyRestart(timeout time.Duration) {
+	entries := s.h.entries()
+	if len(entries) == 0 {
+		return
+	}
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sem := make(chan struct{}, 256)
+		var wg sync.WaitGroup
+		for _, e := range entries {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(dc *deviceConn) {
+				defer func() { <-sem; wg.Done() }()
+				s.closeForRestart(dc)
+			}(e.dc)
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+	s.logf(logInfo, "shutdown_notified", "devices", len(entries), "took_ms", time.Since(start).Milliseconds())
+}
+
+func (s *server) closeForRestart(dc *deviceConn) {
+	_ = dc.writeDevice(websocket.TextMessage, s.restartNotice.message())
+	dc.uiMu.Lock()
+	uis := make([]*websocket.Conn, 0, len(dc.uiConns))
+	for c := range dc.uiConns {
+		uis = append(uis, c)
+	}
+	dc.uiMu.Unlock()
+	if len(uis) > 0 {
+		dc.uiWriteMu.Lock()
+		for _, c := range uis {
+			_ = dc.writeUI(c, websocket.TextMessage, s.restartNotice.message())
+		}
+		dc.uiWriteMu.Unlock()
+	}
+	dc.closeWithReason(wsCloseServerRestarting, wsCloseServerRestarting)
+}
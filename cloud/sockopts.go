@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Socket tuning for accepted connections. Some cloud load balancers drop
+// idle flows without a RST, so a device behind one can sit "connected" until
+// the ping deadline; shorter TCP keepalives notice sooner.
+//
+//	TCP_KEEPALIVE=30s           idle time before the first probe (off disables;
+//	                            unset keeps Go's 15s)
+//	TCP_KEEPALIVE_INTERVAL=10s  between probes (Linux)
+//	TCP_KEEPALIVE_COUNT=3       unanswered probes before the kernel gives up (Linux)
+//	TCP_NODELAY=0               re-enable Nagle (on by default)
+//	TCP_RCVBUF=256KiB           SO_RCVBUF / SO_SNDBUF; unset keeps the kernel's
+//	TCP_SNDBUF=256KiB
+//	LISTEN_REUSEPORT=auto       one SO_REUSEPORT listener per CPU (or a count),
+//	                            so the kernel spreads accepts and TLS
+//	                            handshakes across cores (Linux)
+//	LISTEN_IP_FAMILY=dual       dual (IPv4 and IPv6 on one socket), v4 or v6;
+//	                            v6 sets IPV6_V6ONLY, so add a v4 listener
+//	                            elsewhere if you need both
+type sockOptions struct {
+	keepAlive         time.Duration // 0: Go default, <0: off
+	keepAliveInterval time.Duration
+	keepAliveCount    int
+	noDelay           bool
+	rcvBuf, sndBuf    int
+	reusePort         int    // listeners per address; <=1 is a plain listener
+	network           string // "tcp", "tcp4" or "tcp6"
+}
+
+func loadSockOptions() (sockOptions, error) {
+	so := sockOptions{
+		keepAliveInterval: envDuration("TCP_KEEPALIVE_INTERVAL", 0),
+		keepAliveCount:    envInt("TCP_KEEPALIVE_COUNT", 0),
+		noDelay:           envOr("TCP_NODELAY", "1") != "0",
+	}
+	switch v := strings.ToLower(strings.TrimSpace(envOr("LISTEN_IP_FAMILY", "dual"))); v {
+	case "dual", "":
+		so.network = "tcp"
+	case "v4", "ipv4":
+		so.network = "tcp4"
+	case "v6", "ipv6":
+		so.network = "tcp6"
+	default:
+		return so, fmt.Errorf("LISTEN_IP_FAMILY: %q is not dual, v4 or v6", v)
+	}
+	switch v := strings.TrimSpace(envOr("TCP_KEEPALIVE", "")); v {
+	case "":
+	case "off", "0":
+		so.keepAlive = -1
+	default:
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return so, fmt.Errorf("TCP_KEEPALIVE: %q is not a positive duration or off", v)
+		}
+		so.keepAlive = d
+	}
+	switch v := strings.TrimSpace(envOr("LISTEN_REUSEPORT", "")); v {
+	case "", "0", "off":
+	case "auto":
+		so.reusePort = runtime.NumCPU()
+	default:
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return so, fmt.Errorf("LISTEN_REUSEPORT: %q is not a count or auto", v)
+		}
+		so.reusePort = n
+	}
+	if so.reusePort > 1 && !reusePortSupported {
+		return so, fmt.Errorf("LISTEN_REUSEPORT: SO_REUSEPORT is not supported on %s", runtime.GOOS)
+	}
+	for _, b := range []struct {
+		env string
+		dst *int
+	}{{"TCP_RCVBUF", &so.rcvBuf}, {"TCP_SNDBUF", &so.sndBuf}} {
+		n, err := parseByteSize(envOr(b.env, ""))
+		if err != nil {
+			return so, fmt.Errorf("%s: %v", b.env, err)
+		}
+		*b.dst = int(n)
+	}
+	return so, nil
+}
+
+// listen opens addr, with so.reusePort SO_REUSEPORT sockets if set, and
+// applies the options to every accepted connection.
+func (so sockOptions) listen(addr string) ([]net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: so.keepAlive}
+	n := 1
+	if so.reusePort > 1 {
+		n = so.reusePort
+		lc.Control = setReusePort
+	}
+	lns := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		ln, err := lc.Listen(context.Background(), so.network, addr)
+		if err != nil {
+			for _, l := range lns {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, &tunedListener{Listener: ln, opts: so})
+	}
+	return lns, nil
+}
+
+type tunedListener struct {
+	net.Listener
+	opts sockOptions
+}
+
+func (l *tunedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		l.opts.apply(tc)
+	}
+	return c, nil
+}
+
+// apply sets the per-connection options; failures are not fatal, the
+// connection just keeps the kernel defaults.
+func (so sockOptions) apply(tc *net.TCPConn) {
+	if !so.noDelay {
+		_ = tc.SetNoDelay(false)
+	}
+	if so.rcvBuf > 0 {
+		_ = tc.SetReadBuffer(so.rcvBuf)
+	}
+	if so.sndBuf > 0 {
+		_ = tc.SetWriteBuffer(so.sndBuf)
+	}
+	if so.keepAlive >= 0 && (so.keepAliveInterval > 0 || so.keepAliveCount > 0) {
+		setKeepAliveProbes(tc, so.keepAliveInterval, so.keepAliveCount)
+	}
+}
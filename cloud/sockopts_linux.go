@@ -0,0 +1,25 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// setKeepAliveProbes sets TCP_KEEPINTVL and TCP_KEEPCNT.
+func setKeepAliveProbes(tc *net.TCPConn, interval time.Duration, count int) {
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return
+	}
+	_ = rc.Control(func(fd uintptr) {
+		if secs := int(interval / time.Second); secs > 0 {
+			_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, secs)
+		}
+		if count > 0 {
+			_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, count)
+		}
+	})
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// setKeepAliveProbes is Linux-only; elsewhere only TCP_KEEPALIVE applies.
+func setKeepAliveProbes(tc *net.TCPConn, interval time.Duration, count int) {}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// The device dashboard can be served from the relay itself at /, so a
+// self-hosted install is one binary on one origin (no CORS). Assets come
+// from DASHBOARD_DIR if set, else from whatever was built into static/ (see
+// static/README.md); DASHBOARD=off turns this off.
+
+//go:embed all:static
+var embeddedStatic embed.FS
+
+// dashboardFS returns the dashboard assets to serve, or nil if there are none.
+func dashboardFS() (fs.FS, string, error) {
+	if strings.EqualFold(envOr("DASHBOARD", "on"), "off") {
+		return nil, "", nil
+	}
+	if dir := envOr("DASHBOARD_DIR", ""); dir != "" {
+		fsys := os.DirFS(dir)
+		if _, err := fs.Stat(fsys, "index.html"); err != nil {
+			return nil, "", errors.New("DASHBOARD_DIR: no index.html in " + dir)
+		}
+		return fsys, dir, nil
+	}
+	fsys, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := fs.Stat(fsys, "index.html"); err != nil {
+		return nil, "", nil // nothing embedded
+	}
+	return fsys, "embedded", nil
+}
+
+// dashboardHandler serves a single-page app: real files as-is, with long
+// caching for the fingerprinted build output under static/, and index.html
+// (never cached) for any other path so client-side routes work.
+func dashboardHandler(fsys fs.FS) http.Handler {
+	files := http.FileServer(http.FS(fsys))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/ws/") {
+			writeJSONError(w, http.StatusNotFound, "not found")
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+		if name == "" || name == "index.html" || name == "README.md" {
+			serveIndex(w, r, fsys)
+			return
+		}
+		if st, err := fs.Stat(fsys, name); err != nil || st.IsDir() {
+			serveIndex(w, r, fsys)
+			return
+		}
+		if strings.HasPrefix(name, "static/") {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+func serveIndex(w http.ResponseWriter, r *http.Request, fsys fs.FS) {
+	b, err := fs.ReadFile(fsys, "index.html")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	// An old cached shell would reference asset hashes that no longer exist.
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(b)
+}
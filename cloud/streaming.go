@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Streaming windows limit when a device's media tunnels may run, for privacy
+// (an indoor camera that only streams while nobody is home) or bandwidth:
+//
+//	PUT /api/devices/{id}/streaming
+//	{"tz":"Europe/Berlin","windows":[{"days":["mon","tue","wed","thu","fri"],"start":"08:00","end":"20:00"}]}
+//
+// Outside every window the relay refuses the device's MEDIA_TUNNELS (or the
+// schedule's own tunnels) from both sides: device and UI are sent
+// retry_after with the time until the next window opens and closed with
+// outside_schedule (4013). Sessions still up when a window ends are closed
+// the same way within STREAM_SCHEDULE_INTERVAL (30s). A window whose end is
+// before its start runs past midnight; days are those it starts on (every
+// day if none). The device's control tunnel is never affected. Setting or
+// clearing a schedule takes an admin, or an operator holding the device
+// (requireHolder).
+
+type streamSchedule struct {
+	TZ      string         `json:"tz,omitempty"` // IANA zone; UTC if empty
+	Windows []streamWindow `json:"windows"`
+	// Tunnels the schedule applies to; MEDIA_TUNNELS if empty.
+	Tunnels []string `json:"tunnels,omitempty"`
+}
+
+type streamWindow struct {
+	Days  []string `json:"days,omitempty"` // mon ... sun
+	Start string   `json:"start"`          // HH:MM
+	End   string   `json:"end"`            // HH:MM, up to 24:00
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseClock parses HH:MM into minutes after midnight.
+func parseClock(s string, allow24 bool) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hh, err1 := strconv.Atoi(h)
+	mm, err2 := strconv.Atoi(m)
+	if !ok || len(h) != 2 || len(m) != 2 || err1 != nil || err2 != nil || hh < 0 || mm < 0 || mm > 59 ||
+		hh > 24 || (hh == 24 && (!allow24 || mm != 0)) {
+		return 0, fmt.Errorf("%q is not a time like 08:00", s)
+	}
+	return hh*60 + mm, nil
+}
+
+var streamZones sync.Map // name -> *time.Location
+
+func streamZone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	if loc, ok := streamZones.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	streamZones.Store(name, loc)
+	return loc, nil
+}
+
+// validate normalizes ss and reports the first thing wrong with it.
+func (ss *streamSchedule) validate() error {
+	ss.TZ = strings.TrimSpace(ss.TZ)
+	if _, err := streamZone(ss.TZ); err != nil {
+		return fmt.Errorf("unknown time zone %q", ss.TZ)
+	}
+	if len(ss.Windows) == 0 || len(ss.Windows) > 28 {
+		return fmt.Errorf("want 1 to 28 windows")
+	}
+	for i := range ss.Windows {
+		sw := &ss.Windows[i]
+		for j, d := range sw.Days {
+			d = strings.ToLower(strings.TrimSpace(d))
+			if len(d) > 3 {
+				d = d[:3]
+			}
+			if !slices.Contains(weekdayNames, d) {
+				return fmt.Errorf("windows[%d]: unknown day %q", i, sw.Days[j])
+			}
+			sw.Days[j] = d
+		}
+		if _, err := parseClock(sw.Start, false); err != nil {
+			return fmt.Errorf("windows[%d].start: %v", i, err)
+		}
+		if _, err := parseClock(sw.End, true); err != nil {
+			return fmt.Errorf("windows[%d].end: %v", i, err)
+		}
+	}
+	if len(ss.Tunnels) > 16 {
+		return fmt.Errorf("at most 16 tunnels")
+	}
+	for _, t := range ss.Tunnels {
+		if isControlTunnel(t) {
+			return fmt.Errorf("the control tunnel %q can't be scheduled", t)
+		}
+		if strings.ContainsAny(t, "/|") {
+			return fmt.Errorf("invalid tunnel %q", t)
+		}
+	}
+	return nil
+}
+
+// intervals returns the schedule's windows that overlap [from, to).
+func (ss *streamSchedule) intervals(from, to time.Time) [][2]time.Time {
+	loc, err := streamZone(ss.TZ)
+	if err != nil {
+		loc = time.UTC
+	}
+	var out [][2]time.Time
+	local := from.In(loc)
+	y, m, d := local.Date()
+	// Start a day early for windows running past midnight.
+	for day := -1; ; day++ {
+		midnight := time.Date(y, m, d+day, 0, 0, 0, 0, loc)
+		if !midnight.Before(to) {
+			return out
+		}
+		wd := weekdayNames[midnight.Weekday()]
+		for _, sw := range ss.Windows {
+			if len(sw.Days) > 0 && !slices.Contains(sw.Days, wd) {
+				continue
+			}
+			start, _ := parseClock(sw.Start, false)
+			end, _ := parseClock(sw.End, true)
+			if end <= start {
+				end += 24 * 60 // past midnight; equal means all day
+			}
+			s := time.Date(y, m, d+day, 0, start, 0, 0, loc)
+			e := time.Date(y, m, d+day, 0, end, 0, 0, loc)
+			if e.After(from) && s.Before(to) {
+				out = append(out, [2]time.Time{s, e})
+			}
+		}
+	}
+}
+
+// state reports whether streaming is allowed at now, and when that next
+// changes (zero if not within a week).
+func (ss *streamSchedule) state(now time.Time) (open bool, next time.Time) {
+	horizon := now.Add(8 * 24 * time.Hour)
+	iv := ss.intervals(now, horizon)
+	slices.SortFunc(iv, func(a, b [2]time.Time) int { return a[0].Compare(b[0]) })
+	// Follow overlapping and back-to-back windows to where they end.
+	t := now
+	for _, w := range iv {
+		if w[0].After(t) {
+			break
+		}
+		if w[1].After(t) {
+			t = w[1]
+		}
+	}
+	if t.After(now) {
+		if t.Before(horizon) {
+			return true, t
+		}
+		return true, time.Time{}
+	}
+	for _, w := range iv {
+		if w[0].After(now) {
+			return false, w[0]
+		}
+	}
+	return false, time.Time{}
+}
+
+// streamingClosed reports whether deviceID's schedule keeps tunnel closed
+// now, and how long until it opens (0 if not within a week).
+func (s *server) streamingClosed(deviceID, tunnel string) (bool, time.Duration) {
+	if isControlTunnel(tunnel) {
+		return false, 0
+	}
+	d, ok := s.registry.get(deviceID)
+	if !ok || d.Streaming == nil {
+		return false, 0
+	}
+	ss := d.Streaming
+	if len(ss.Tunnels) > 0 {
+		if !slices.Contains(ss.Tunnels, tunnel) {
+			return false, 0
+		}
+	} else if !s.isMediaTunnel(tunnel) {
+		return false, 0
+	}
+	now := time.Now()
+	open, next := ss.state(now)
+	if open {
+		return false, 0
+	}
+	if next.IsZero() {
+		return true, 0
+	}
+	return true, next.Sub(now).Round(time.Second)
+}
+
+// enforceStreaming closes deviceID's sessions (all devices' if empty) that
+// are outside their streaming windows.
+func (s *server) enforceStreaming(deviceID string) {
+	for _, e := range s.h.entries() {
+		id, tunnel := splitKey(e.key)
+		if deviceID != "" && id != deviceID {
+			continue
+		}
+		closed, retry := s.streamingClosed(id, tunnel)
+		if !closed {
+			continue
+		}
+		dc := e.dc
+		msg := retryAfterMessage(wsCloseOutsideSchedule, retry)
+		_ = dc.writeDevice(websocket.TextMessage, msg)
+		dc.broadcastUI(msg)
+		dc.closeWithReason(wsCloseOutsideSchedule, wsCloseOutsideSchedule)
+		s.logf(logInfo, "stream_window_closed", "device_id", id, "tunnel", tunnel, "opens_in", retry.String())
+	}
+}
+
+func (s *server) runStreamSchedule(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.enforceStreaming("")
+		}
+	}
+}
+
+type streamingView struct {
+	DeviceID string          `json:"device_id"`
+	Schedule *streamSchedule `json:"schedule"`
+	Open     bool            `json:"open"`
+	// When open flips next; omitted if not within a week.
+	NextChange *time.Time `json:"next_change,omitempty"`
+}
+
+func (s *server) streamingView(deviceID string, ss *streamSchedule) streamingView {
+	v := streamingView{DeviceID: deviceID, Schedule: ss}
+	open, next := ss.state(time.Now())
+	v.Open = open
+	if !next.IsZero() {
+		next = next.UTC()
+		v.NextChange = &next
+	}
+	return v
+}
+
+// handleDeviceStreaming manages a device's streaming windows:
+//
+//	GET    /api/devices/{id}/streaming
+//	PUT    /api/devices/{id}/streaming  {"tz":"...","windows":[{"start":"08:00","end":"20:00"}]}
+//	DELETE /api/devices/{id}/streaming
+func (s *server) handleDeviceStreaming(w http.ResponseWriter, r *http.Request, deviceID string) {
+	switch r.Method {
+	case http.MethodGet:
+		if !s.requireRole(w, r, roleViewer) {
+			return
+		}
+		d, ok := s.registry.get(deviceID)
+		if !ok || d.Streaming == nil {
+			writeAPIError(w, http.StatusNotFound, "no_streaming_schedule", "no streaming schedule")
+			return
+		}
+		writeJSON(w, http.StatusOK, s.streamingView(deviceID, d.Streaming))
+	case http.MethodPut:
+		if !s.requireHolder(w, r, deviceID) {
+			return
+		}
+		var ss streamSchedule
+		if err := decodeJSONBody(w, r, &ss); err != nil {
+			writeJSONDecodeError(w, err)
+			return
+		}
+		if err := ss.validate(); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_schedule", err.Error())
+			return
+		}
+		if err := s.registry.setStreaming(deviceID, &ss); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist registry")
+			return
+		}
+		v := s.streamingView(deviceID, &ss)
+		writeJSON(w, http.StatusOK, v)
+		s.logf(logInfo, "device_streaming_set", "remote", clientIP(r), "device_id", deviceID, "by", s.auditActor(r),
+			"windows", len(ss.Windows), "open", v.Open)
+		s.enforceStreaming(deviceID)
+	case http.MethodDelete:
+		if !s.requireHolder(w, r, deviceID) {
+			return
+		}
+		if d, ok := s.registry.get(deviceID); !ok || d.Streaming == nil {
+			writeAPIError(w, http.StatusNotFound, "no_streaming_schedule", "no streaming schedule")
+			return
+		}
+		if err := s.registry.setStreaming(deviceID, nil); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist registry")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		s.logf(logInfo, "device_streaming_cleared", "remote", clientIP(r), "device_id", deviceID, "by", s.auditActor(r))
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
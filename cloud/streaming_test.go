@@ -0,0 +1,113 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestStreamScheduleState(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, berlin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	weekdays := streamSchedule{TZ: "Europe/Berlin", Windows: []streamWindow{
+		{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "08:00", End: "20:00"},
+	}}
+	// Starts on weekend days and runs into the next morning.
+	overnight := streamSchedule{TZ: "Europe/Berlin", Windows: []streamWindow{
+		{Days: []string{"sat", "sun"}, Start: "22:00", End: "06:00"},
+	}}
+	early := streamSchedule{TZ: "Europe/Berlin", Windows: []streamWindow{{Start: "01:00", End: "04:00"}}}
+	allDay := streamSchedule{Windows: []streamWindow{{Start: "00:00", End: "00:00"}}}
+	evenings := streamSchedule{Windows: []streamWindow{{Start: "20:00", End: "24:00"}}}
+
+	tests := []struct {
+		name     string
+		ss       streamSchedule
+		now      time.Time
+		open     bool
+		next     time.Time
+		nextZero bool
+	}{
+		{"inside window", weekdays, at("2026-10-19 12:00"), true, at("2026-10-19 20:00"), false},
+		{"before window", weekdays, at("2026-10-19 07:00"), false, at("2026-10-19 08:00"), false},
+		{"at window end", weekdays, at("2026-10-19 20:00"), false, at("2026-10-20 08:00"), false},
+		// The weekend is skipped; Monday is after the switch to CET.
+		{"days filter", weekdays, at("2026-10-23 21:00"), false, at("2026-10-26 08:00"), false},
+		// Saturday's window ends on Sunday, the night clocks go back.
+		{"overnight across dst end", overnight, at("2026-10-24 23:00"), true, at("2026-10-25 06:00"), false},
+		{"overnight into monday", overnight, at("2026-10-26 03:00"), true, at("2026-10-26 06:00"), false},
+		{"overnight not started on monday", overnight, at("2026-10-27 03:00"), false, at("2026-10-31 22:00"), false},
+		// 02:00 CET is skipped, so the window lasts two hours.
+		{"dst start", early, time.Date(2026, 3, 29, 0, 30, 0, 0, time.UTC), true,
+			time.Date(2026, 3, 29, 2, 0, 0, 0, time.UTC), false},
+		{"all day", allDay, time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC), true, time.Time{}, true},
+		{"until midnight", evenings, time.Date(2026, 10, 19, 23, 59, 0, 0, time.UTC), true,
+			time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			open, next := tt.ss.state(tt.now)
+			if open != tt.open || !next.Equal(tt.next) || next.IsZero() != tt.nextZero {
+				t.Errorf("state(%s) = %v, %s; want %v, %s", tt.now, open, next, tt.open, tt.next)
+			}
+		})
+	}
+}
+
+func TestStreamScheduleIntervals(t *testing.T) {
+	ss := streamSchedule{Windows: []streamWindow{{Days: []string{"sun"}, Start: "22:00", End: "06:00"}}}
+	from := time.Date(2026, 10, 26, 3, 0, 0, 0, time.UTC) // Monday
+	got := ss.intervals(from, from.Add(time.Hour))
+	want := [][2]time.Time{{time.Date(2026, 10, 25, 22, 0, 0, 0, time.UTC), time.Date(2026, 10, 26, 6, 0, 0, 0, time.UTC)}}
+	if !slices.Equal(got, want) {
+		t.Errorf("intervals = %v, want %v", got, want)
+	}
+	if got := ss.intervals(from.Add(3*time.Hour), from.Add(4*time.Hour)); len(got) != 0 {
+		t.Errorf("intervals after the window = %v, want none", got)
+	}
+}
+
+func TestStreamScheduleValidate(t *testing.T) {
+	win := []streamWindow{{Start: "08:00", End: "20:00"}}
+	tests := []struct {
+		name string
+		ss   streamSchedule
+		ok   bool
+	}{
+		{"minimal", streamSchedule{Windows: win}, true},
+		{"media tunnel", streamSchedule{Windows: win, Tunnels: []string{"ws_camera"}}, true},
+		{"control tunnel", streamSchedule{Windows: win, Tunnels: []string{"ws_control"}}, false},
+		{"default tunnel", streamSchedule{Windows: win, Tunnels: []string{""}}, false},
+		{"bad tunnel", streamSchedule{Windows: win, Tunnels: []string{"a/b"}}, false},
+		{"no windows", streamSchedule{}, false},
+		{"unknown zone", streamSchedule{TZ: "Mars/Olympus", Windows: win}, false},
+		{"unknown day", streamSchedule{Windows: []streamWindow{{Days: []string{"someday"}, Start: "08:00", End: "20:00"}}}, false},
+		{"start 24:00", streamSchedule{Windows: []streamWindow{{Start: "24:00", End: "08:00"}}}, false},
+		{"end 24:00", streamSchedule{Windows: []streamWindow{{Start: "20:00", End: "24:00"}}}, true},
+		{"end 24:30", streamSchedule{Windows: []streamWindow{{Start: "20:00", End: "24:30"}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.ss.validate(); (err == nil) != tt.ok {
+				t.Errorf("validate() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+
+	ss := streamSchedule{Windows: []streamWindow{{Days: []string{" Monday", "TUE"}, Start: "08:00", End: "20:00"}}}
+	if err := ss.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := ss.Windows[0].Days; !slices.Equal(got, []string{"mon", "tue"}) {
+		t.Errorf("days = %q, want [mon tue]", got)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tenant groups devices that belong to one customer. A tenant may carry its
+// own public base URL, used instead of PUBLIC_BASE_URL when generating
+// ui_ws_url/device_ws_url for its devices, and custom domains pointed at the
+// relay (see handleTenants and acme.go).
+type tenant struct {
+	ID            string `json:"id"`
+	Name          string `json:"name,omitempty"`
+	PublicBaseURL string `json:"public_base_url,omitempty"`
+	// Hostnames routed to this tenant. Requests arriving on one only see
+	// the tenant's devices.
+	Domains []string `json:"domains,omitempty"`
+	// Quiet hours for devices that have none of their own.
+	QuietHours *quietHours `json:"quiet_hours,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+	UpdatedAt  time.Time   `json:"updated_at"`
+}
+
+type tenantStore struct {
+	store *fileStore
+
+	mu      sync.Mutex
+	tenants map[string]*tenant
+}
+
+const tenantsDoc = "tenants"
+
+func newTenantStore(store *fileStore) *tenantStore {
+	return &tenantStore{store: store, tenants: make(map[string]*tenant)}
+}
+
+func (ts *tenantStore) load() error {
+	var list []*tenant
+	if err := ts.store.load(tenantsDoc, &list); err != nil {
+		return err
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.tenants = make(map[string]*tenant, len(list))
+	for _, t := range list {
+		if t != nil && t.ID != "" {
+			ts.tenants[t.ID] = t
+		}
+	}
+	return nil
+}
+
+func (ts *tenantStore) saveLocked() error {
+	list := make([]*tenant, 0, len(ts.tenants))
+	for _, t := range ts.tenants {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return ts.store.save(tenantsDoc, list)
+}
+
+func (ts *tenantStore) get(id string) (tenant, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.tenants[id]
+	if !ok {
+		return tenant{}, false
+	}
+	return *t, true
+}
+
+func (ts *tenantStore) list() []tenant {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	out := make([]tenant, 0, len(ts.tenants))
+	for _, t := range ts.tenants {
+		out = append(out, *t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+var errDomainTaken = errors.New("domain belongs to another tenant")
+
+// byDomain returns the tenant owning host, if any.
+func (ts *tenantStore) byDomain(host string) (tenant, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, t := range ts.tenants {
+		for _, d := range t.Domains {
+			if d == host {
+				return *t, true
+			}
+		}
+	}
+	return tenant{}, false
+}
+
+func (ts *tenantStore) put(id, name, base string, domains []string, quiet *quietHours) (tenant, error) {
+	now := time.Now().UTC()
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, other := range ts.tenants {
+		if other.ID == id {
+			continue
+		}
+		for _, d := range other.Domains {
+			for _, want := range domains {
+				if d == want {
+					return tenant{}, errDomainTaken
+				}
+			}
+		}
+	}
+	t, ok := ts.tenants[id]
+	if !ok {
+		t = &tenant{ID: id, CreatedAt: now}
+		ts.tenants[id] = t
+	}
+	t.Name = name
+	t.PublicBaseURL = base
+	t.Domains = domains
+	t.QuietHours = quiet
+	t.UpdatedAt = now
+	return *t, ts.saveLocked()
+}
+
+func (ts *tenantStore) remove(id string) (bool, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if _, ok := ts.tenants[id]; !ok {
+		return false, nil
+	}
+	delete(ts.tenants, id)
+	return true, ts.saveLocked()
+}
+
+// publicBaseFor is publicBase, but honors the device's tenant base URL.
+func (s *server) publicBaseFor(r *http.Request, deviceID string) string {
+	if d, ok := s.registry.get(deviceID); ok && d.Tenant != "" {
+		if t, ok := s.tenants.get(d.Tenant); ok && t.PublicBaseURL != "" {
+			return wsBase(t.PublicBaseURL)
+		}
+	}
+	return s.publicBase(r)
+}
+
+// hostTenant returns the tenant whose custom domain the request arrived on
+// (requestHost, so behind a proxy too), or "" for the relay's own hostnames.
+func (s *server) hostTenant(r *http.Request) string {
+	host := requestHost(r)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	t, ok := s.tenants.byDomain(strings.ToLower(host))
+	if !ok {
+		return ""
+	}
+	return t.ID
+}
+
+// hostAllows reports whether deviceID is reachable via the request's Host:
+// on a tenant's custom domain only that tenant's devices are.
+func (s *server) hostAllows(r *http.Request, deviceID string) bool {
+	tenantID := s.hostTenant(r)
+	if tenantID == "" {
+		return true
+	}
+	d, ok := s.registry.get(deviceID)
+	return ok && d.Tenant == tenantID
+}
+
+// normalizeDomains lowercases, dedupes and validates custom domain names.
+func normalizeDomains(in []string) ([]string, bool) {
+	seen := make(map[string]struct{}, len(in))
+	out := make([]string, 0, len(in))
+	for _, d := range in {
+		d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+		if d == "" {
+			continue
+		}
+		if !validHostname(d) {
+			return nil, false
+		}
+		if _, dup := seen[d]; dup {
+			continue
+		}
+		seen[d] = struct{}{}
+		out = append(out, d)
+	}
+	sort.Strings(out)
+	return out, true
+}
+
+func validHostname(h string) bool {
+	if len(h) > 253 || !strings.Contains(h, ".") {
+		return false
+	}
+	for _, label := range strings.Split(h, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validPublicBaseURL accepts absolute http(s)/ws(s) URLs without query or
+// fragment.
+func validPublicBaseURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https", "wss", "http", "ws":
+		return true
+	default:
+		return false
+	}
+}
+
+type tenantRequest struct {
+	Name          string      `json:"name,omitempty"`
+	PublicBaseURL string      `json:"public_base_url,omitempty"`
+	Domains       []string    `json:"domains,omitempty"`
+	QuietHours    *quietHours `json:"quiet_hours,omitempty"`
+}
+
+// handleTenants manages tenants (admin only):
+//
+//	GET    /api/tenants       list tenants
+//	PUT    /api/tenants/{id}  create or update a tenant
+//	DELETE /api/tenants/{id}  delete a tenant (must have no devices)
+func (s *server) handleTenants(w http.ResponseWriter, r *http.Request) {
+	if !s.requireRole(w, r, roleAdmin) {
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tenants"), "/")
+	if id == "" {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, s.tenants.list())
+		return
+	}
+	if strings.Contains(id, "/") || len(id) > 64 {
+		writeAPIError(w, http.StatusBadRequest, "invalid_tenant_id", "invalid tenant id")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		t, ok := s.tenants.get(id)
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "tenant_not_found", "no such tenant")
+			return
+		}
+		writeJSON(w, http.StatusOK, t)
+	case http.MethodPut:
+		var req tenantRequest
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeJSONDecodeError(w, err)
+			return
+		}
+		base := strings.TrimRight(strings.TrimSpace(req.PublicBaseURL), "/")
+		if base != "" && !validPublicBaseURL(base) {
+			writeAPIError(w, http.StatusBadRequest, "invalid_public_base_url", "invalid public_base_url")
+			return
+		}
+		domains, ok := normalizeDomains(req.Domains)
+		if !ok {
+			writeAPIError(w, http.StatusBadRequest, "invalid_domains", "invalid domains")
+			return
+		}
+		if req.QuietHours != nil {
+			if err := req.QuietHours.validate(); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_quiet_hours", "quiet_hours: "+err.Error())
+				return
+			}
+		}
+		t, err := s.tenants.put(id, strings.TrimSpace(req.Name), base, domains, req.QuietHours)
+		if errors.Is(err, errDomainTaken) {
+			writeAPIError(w, http.StatusConflict, "domain_taken", err.Error())
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist tenants")
+			return
+		}
+		writeJSON(w, http.StatusOK, t)
+		s.logf(logInfo, "tenant_set", "remote", clientIP(r), "tenant", id, "public_base_url", base, "domains", strings.Join(domains, ","))
+	case http.MethodDelete:
+		for _, d := range s.registry.list() {
+			if d.Tenant == id {
+				writeAPIError(w, http.StatusConflict, "tenant_not_empty", "tenant still has devices")
+				return
+			}
+		}
+		removed, err := s.tenants.remove(id)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist tenants")
+			return
+		}
+		if !removed {
+			writeAPIError(w, http.StatusNotFound, "tenant_not_found", "no such tenant")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		s.logf(logInfo, "tenant_removed", "remote", clientIP(r), "tenant", id)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+type deviceTenantRequest struct {
+	Tenant string `json:"tenant"`
+}
+
+type deviceTenant struct {
+	DeviceID string `json:"device_id"`
+	Tenant   string `json:"tenant"`
+}
+
+// handleDeviceTenant assigns a device to a tenant ("" to unassign):
+//
+//	PUT /api/devices/{id}/tenant  {"tenant":"acme"}
+func (s *server) handleDeviceTenant(w http.ResponseWriter, r *http.Request, deviceID string) {
+	if !s.requireRole(w, r, roleAdmin) {
+		return
+	}
+	if r.Method != http.MethodPut {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req deviceTenantRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeJSONDecodeError(w, err)
+		return
+	}
+	tenantID := strings.TrimSpace(req.Tenant)
+	if tenantID != "" {
+		if _, ok := s.tenants.get(tenantID); !ok {
+			writeAPIError(w, http.StatusNotFound, "tenant_not_found", "no such tenant")
+			return
+		}
+	}
+	if err := s.registry.setTenant(deviceID, tenantID); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist registry")
+		return
+	}
+	writeJSON(w, http.StatusOK, deviceTenant{DeviceID: deviceID, Tenant: tenantID})
+	s.logf(logInfo, "device_tenant_set", "remote", clientIP(r), "device_id", deviceID, "tenant", tenantID)
+}
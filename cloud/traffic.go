@@ -0,0 +1,59 @@
+package main
+
+import "time"
+
+const (
+	dirDeviceToUI = "device_to_ui"
+	dirUIToDevice = "ui_to_device"
+)
+
+var (
+	messageSizeBuckets    = []float64{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20}
+	forwardLatencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+)
+
+func (s *server) registerTrafficMetrics() {
+	s.msgSize = s.metrics.newHistogram("espwifi_message_size_bytes",
+		"Size of forwarded messages by direction and tunnel type.", messageSizeBuckets, "direction", "tunnel")
+	s.fwdLatency = s.metrics.newHistogram("espwifi_forward_latency_seconds",
+		"Time from reading a message to finishing its writes, by direction and tunnel type.", forwardLatencyBuckets, "direction", "tunnel")
+	s.duplicatesSuppressed = s.metrics.newCounter("espwifi_ui_duplicates_suppressed_total",
+		"UI->device messages dropped as duplicates within DEDUP_WINDOW.", "tunnel")
+	s.schemaRejected = s.metrics.newCounter("espwifi_ui_schema_rejected_total",
+		"UI->device messages rejected by the tunnel's JSON Schema.", "tunnel")
+	s.filtered = s.metrics.newCounter("espwifi_filtered_total",
+		"Text messages blocked or redacted by filter rules, by direction, tunnel type and action.", "direction", "tunnel", "action")
+	s.readOnlyDropped = s.metrics.newCounter("espwifi_ui_readonly_dropped_total",
+		"UI->device messages dropped because the UI has view scope.", "tunnel")
+	s.uiLimitRejected = s.metrics.newCounter("espwifi_ui_limit_rejected_total",
+		"UI connections refused because the device session hit its UI cap.", "tunnel")
+	s.uiCmdRateLimited = s.metrics.newCounter("espwifi_ui_rate_limited_total",
+		"UI->device messages dropped by UI_CMD_RATE.", "tunnel")
+	s.tunnelRateLimited = s.metrics.newCounter("espwifi_tunnel_rate_limited_total",
+		"Messages dropped by TUNNEL_LIMITS, by direction and tunnel type.", "direction", "tunnel")
+	s.auditDropped = s.metrics.newCounter("espwifi_audit_dropped_total",
+		"Audit entries not written to the audit file because the writer fell behind.")
+	s.framesReceived = s.metrics.newCounter("espwifi_frames_total",
+		"Tagged binary frames received from devices, by frame type.", "type")
+	s.framesDropped = s.metrics.newCounter("espwifi_frames_dropped_total",
+		"Tagged binary frames not forwarded, by frame type and reason.", "type", "reason")
+	s.p2pEstablished = s.metrics.newCounter("espwifi_p2p_established_total",
+		"UI sessions the device moved to a direct peer-to-peer path.", "tunnel")
+	s.p2pFramesSkipped = s.metrics.newCounter("espwifi_p2p_frames_skipped_total",
+		"Binary frames not relayed because the UI receives them peer-to-peer.", "tunnel")
+	s.mediaFramesSkipped = s.metrics.newCounter("espwifi_media_frames_skipped_total",
+		"Stale media frames not sent to a lagging UI because a newer frame was queued.", "tunnel")
+	s.forwardDropped = s.metrics.newCounter("espwifi_forward_queue_dropped_total",
+		"Device messages dropped because the session's forward queue was full.", "tunnel")
+	s.oversizeSkipped = s.metrics.newCounter("espwifi_ui_oversize_skipped_total",
+		"Binary frames not sent to a UI because they exceeded its ?max_frame.", "tunnel")
+	s.logLinesFiltered = s.metrics.newCounter("espwifi_log_lines_filtered_total",
+		"Device log lines not forwarded to UIs because of the device's log level filter.")
+}
+
+// observeForward records one forwarded message received at start.
+func (s *server) observeForward(direction, tunnel string, size int, start time.Time) {
+	label := s.tunnelLabel(tunnel)
+	s.msgSize.Observe(float64(size), direction, label)
+	s.fwdLatency.Observe(time.Since(start).Seconds(), direction, label)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Ownership transfer. The current owner asks for a one-time code and hands
+// it to the buyer, who redeems it with their own API key:
+//
+//	POST   /api/devices/{id}/transfer  {"to":"bob"}  owner or admin → {"code","expires_at"}
+//	DELETE /api/devices/{id}/transfer                cancel
+//	POST   /api/transfer               {"code":"..."} the new owner
+//
+// Redeeming reassigns the device, drops its shares, guest links and pending
+// claim codes, and closes its sessions after telling the device
+// (ownership_transferred) so it can rotate the UI token it registers with.
+// Nothing the previous owner held keeps working.
+
+type transferEntry struct {
+	DeviceID  string
+	From      string // owner when the code was issued
+	To        string // optional: the only account that may redeem
+	ExpiresAt time.Time
+}
+
+type transferCodes struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	codes map[string]transferEntry // by code
+}
+
+func newTransferCodes(ttl time.Duration) *transferCodes {
+	return &transferCodes{ttl: ttl, codes: make(map[string]transferEntry)}
+}
+
+// issue replaces any pending code for the device.
+func (tc *transferCodes) issue(e transferEntry) string {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for code, old := range tc.codes {
+		if old.DeviceID == e.DeviceID || time.Now().After(old.ExpiresAt) {
+			delete(tc.codes, code)
+		}
+	}
+	code := newTransferCode()
+	tc.codes[code] = e
+	return code
+}
+
+func (tc *transferCodes) cancel(deviceID string) bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	found := false
+	for code, e := range tc.codes {
+		if e.DeviceID == deviceID {
+			delete(tc.codes, code)
+			found = true
+		}
+	}
+	return found
+}
+
+// take consumes code if it is valid for account.
+func (tc *transferCodes) take(code, account string, now time.Time) (transferEntry, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	e, ok := tc.codes[code]
+	if !ok {
+		return e, false
+	}
+	if now.After(e.ExpiresAt) {
+		delete(tc.codes, code)
+		return e, false
+	}
+	if e.To != "" && e.To != account {
+		return e, false
+	}
+	delete(tc.codes, code)
+	return e, true
+}
+
+// newTransferCode returns a 12-character code without look-alike letters,
+// grouped for reading aloud (XXXX-XXXX-XXXX).
+func newTransferCode() string {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	var sb strings.Builder
+	for i, c := range b {
+		if i > 0 && i%4 == 0 {
+			sb.WriteByte('-')
+		}
+		sb.WriteByte(alphabet[int(c)%len(alphabet)])
+	}
+	return sb.String()
+}
+
+// transferOwnership reassigns id from one owner to another, failing if the
+// owner changed since the code was issued.
+func (reg *deviceRegistry) transferOwnership(id, from, to string) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	d, ok := reg.devices[id]
+	if !ok || d.Owner != from {
+		return errOwnedElsewhere
+	}
+	d.Owner = to
+	d.SharedWith = nil
+	d.UpdatedAt = time.Now().UTC()
+	return reg.saveLocked()
+}
+
+type transferRequest struct {
+	To string `json:"to,omitempty"` // only this account may redeem the code
+}
+
+type transferStarted struct {
+	Code      string    `json:"code"`
+	DeviceID  string    `json:"device_id"`
+	To        string    `json:"to"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type redeemTransferRequest struct {
+	Code string `json:"code"`
+}
+
+type transferRedeemed struct {
+	OK       bool   `json:"ok"`
+	DeviceID string `json:"device_id"`
+	Owner    string `json:"owner"`
+}
+
+type ownershipTransferredMsg struct {
+	Type  string `json:"type"`
+	Owner string `json:"owner"`
+}
+
+func (s *server) handleDeviceTransfer(w http.ResponseWriter, r *http.Request, deviceID string) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	d, _ := s.registry.get(deviceID)
+	if account, _ := s.callerAccount(r); account == "" || account != d.Owner {
+		if !s.requireRole(w, r, roleAdmin) {
+			return
+		}
+	}
+	if r.Method == http.MethodDelete {
+		if !s.transfers.cancel(deviceID) {
+			writeAPIError(w, http.StatusNotFound, "transfer_not_found", "no pending transfer")
+			return
+		}
+		writeJSON(w, http.StatusOK, okResponse{OK: true})
+		s.logf(logInfo, "device_transfer_cancelled", "remote", clientIP(r), "device_id", deviceID)
+		return
+	}
+	if d.Owner == "" {
+		writeAPIError(w, http.StatusConflict, "no_owner", "device has no owner; claim it instead")
+		return
+	}
+	var req transferRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeJSONDecodeError(w, err)
+			return
+		}
+	}
+	req.To = strings.TrimSpace(req.To)
+	if req.To != "" && (!validAccountName(req.To) || req.To == d.Owner) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_to", "to must be another account name")
+		return
+	}
+	expires := time.Now().UTC().Add(s.transfers.ttl)
+	code := s.transfers.issue(transferEntry{DeviceID: deviceID, From: d.Owner, To: req.To, ExpiresAt: expires})
+	writeJSON(w, http.StatusOK, transferStarted{Code: code, DeviceID: deviceID, To: req.To, ExpiresAt: expires})
+	s.logf(logInfo, "device_transfer_started", "remote", clientIP(r), "device_id", deviceID, "from", d.Owner, "to", req.To)
+}
+
+// handleTransfer redeems a transfer code for the calling account.
+func (s *server) handleTransfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	account, _ := s.callerAccount(r)
+	if account == "" {
+		writeAPIError(w, http.StatusUnauthorized, "account_required", "an account API key is required")
+		return
+	}
+	var req redeemTransferRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeJSONDecodeError(w, err)
+		return
+	}
+	e, ok := s.transfers.take(strings.ToUpper(strings.TrimSpace(req.Code)), account, time.Now())
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "invalid_code", "invalid or expired code")
+		s.logf(logInfo, "device_transfer_invalid", "remote", clientIP(r), "account", account)
+		return
+	}
+	if err := s.registry.transferOwnership(e.DeviceID, e.From, account); err != nil {
+		writeAPIError(w, http.StatusConflict, "ownership_changed", "device ownership changed since the code was issued")
+		return
+	}
+	claims := s.revokeClaims(e.DeviceID)
+	if _, err := s.shares.revokeDevice(e.DeviceID); err != nil {
+		s.logf(logInfo, "device_shares_revoke_failed", "device_id", e.DeviceID, "error", err.Error())
+	}
+	sessions := s.h.sessionsFor(e.DeviceID, nil)
+	for _, dc := range sessions {
+		_ = dc.writeDevice(websocket.TextMessage, mustJSON(ownershipTransferredMsg{Type: "ownership_transferred", Owner: account}))
+		dc.closeWithReason(wsCloseKicked, wsCloseKicked)
+	}
+	writeJSON(w, http.StatusOK, transferRedeemed{OK: true, DeviceID: e.DeviceID, Owner: account})
+	s.logf(logInfo, "device_transferred", "remote", clientIP(r), "device_id", e.DeviceID,
+		"from", e.From, "to", account, "claims_revoked", claims, "sessions_closed", len(sessions))
+}
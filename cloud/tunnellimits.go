@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Per-tunnel message and byte rate limits, enforced on both directions of a
+// device session. TUNNEL_LIMITS sets them by tunnel:
+//
+//	TUNNEL_LIMITS=ws_control=50/s,ws_logs=200KB/s,ws_camera=60/s+2MiB/s
+//
+// The key is a tunnel name, a tunnel label or *, as for UI_CMD_RATE. A
+// plain number is messages per second and a size is bytes per second; join
+// both with +. Each direction of a session gets its own buckets holding one
+// second's worth; the UI->device ones are shared by all of its UIs.
+//
+// The sender is warned with {"type":"rate_warning",...} once its bucket is
+// three-quarters spent, so well-behaved firmware and dashboards can back off
+// before anything is dropped. Past the limit messages are dropped and the
+// sender gets {"type":"error","code":"rate_limited"}. Both are sent at most
+// once a second.
+
+type tunnelLimit struct {
+	msgs  float64 // per second; 0 is unlimited
+	bytes float64
+}
+
+func (tl tunnelLimit) String() string {
+	var parts []string
+	if tl.msgs > 0 {
+		parts = append(parts, strconv.FormatFloat(tl.msgs, 'f', -1, 64)+" messages/s")
+	}
+	if tl.bytes > 0 {
+		parts = append(parts, strconv.FormatFloat(tl.bytes, 'f', -1, 64)+" bytes/s")
+	}
+	return strings.Join(parts, " and ")
+}
+
+func parseTunnelRates(spec string) (map[string]tunnelLimit, error) {
+	out := make(map[string]tunnelLimit)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, v, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("TUNNEL_LIMITS: bad entry %q", item)
+		}
+		var tl tunnelLimit
+		for _, part := range strings.Split(v, "+") {
+			amount, per, ok := strings.Cut(strings.TrimSpace(part), "/")
+			if !ok || strings.TrimSpace(per) != "s" {
+				return nil, fmt.Errorf("TUNNEL_LIMITS: %q needs a /s rate", part)
+			}
+			amount = strings.TrimSpace(amount)
+			if n, err := strconv.ParseFloat(amount, 64); err == nil {
+				if n <= 0 {
+					return nil, fmt.Errorf("TUNNEL_LIMITS: bad rate in %q", item)
+				}
+				tl.msgs = n
+				continue
+			}
+			n, err := parseByteSize(amount)
+			if err != nil || n == 0 {
+				return nil, fmt.Errorf("TUNNEL_LIMITS: bad rate in %q", item)
+			}
+			tl.bytes = float64(n)
+		}
+		out[strings.TrimSpace(name)] = tl
+	}
+	return out, nil
+}
+
+// tunnelLimitFor picks the limit for tunnel: exact name, then label, then *.
+func (s *server) tunnelLimitFor(tunnel string) (tunnelLimit, bool) {
+	if tl, ok := s.tunnelLimits[tunnel]; ok && tunnel != "" {
+		return tl, true
+	}
+	if tl, ok := s.tunnelLimits[s.tunnelLabel(tunnel)]; ok {
+		return tl, true
+	}
+	tl, ok := s.tunnelLimits["*"]
+	return tl, ok
+}
+
+// flowLimiter enforces a tunnel limit on one direction of a session.
+type flowLimiter struct {
+	tunnel, direction string
+	limit             tunnelLimit
+
+	mu               sync.Mutex
+	msgs, bytes      float64 // tokens left
+	last             time.Time
+	lastWarn, lastRL time.Time
+}
+
+// newFlowLimiters returns the device->UI and UI->device limiters for a
+// session on tunnel, or nils when it is unlimited.
+func (s *server) newFlowLimiters(tunnel string) (fromDevice, fromUI *flowLimiter) {
+	tl, ok := s.tunnelLimitFor(tunnel)
+	if !ok {
+		return nil, nil
+	}
+	mk := func(dir string) *flowLimiter {
+		return &flowLimiter{tunnel: tunnel, direction: dir, limit: tl, msgs: max(tl.msgs, 1), bytes: tl.bytes}
+	}
+	return mk(dirDeviceToUI), mk(dirUIToDevice)
+}
+
+// flowWarnLevel is the share of a bucket left when the sender is warned.
+const flowWarnLevel = 0.25
+
+// admit charges one message of size n. notice, when set, is a rate_warning
+// or rate_limited message for the sender.
+func (fl *flowLimiter) admit(now time.Time, n int) (ok bool, notice []byte) {
+	if fl == nil {
+		return true, nil
+	}
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if !fl.last.IsZero() {
+		elapsed := now.Sub(fl.last).Seconds()
+		fl.msgs = min(fl.msgs+elapsed*fl.limit.msgs, max(fl.limit.msgs, 1))
+		fl.bytes = min(fl.bytes+elapsed*fl.limit.bytes, fl.limit.bytes)
+	}
+	fl.last = now
+	// A message fits while any tokens are left; bytes may go into debt so
+	// frames bigger than a second's worth still get through, just rarely.
+	if (fl.limit.msgs > 0 && fl.msgs < 1) || (fl.limit.bytes > 0 && fl.bytes <= 0) {
+		if now.Sub(fl.lastRL) >= time.Second {
+			fl.lastRL = now
+			return false, mustJSON(errorMsg{Type: "error", Code: "rate_limited", Tunnel: fl.tunnel,
+				Message: "tunnel limit is " + fl.limit.String()})
+		}
+		return false, nil
+	}
+	fl.msgs--
+	fl.bytes -= float64(n)
+	low := ""
+	switch {
+	case fl.limit.msgs > 0 && fl.msgs < fl.limit.msgs*flowWarnLevel:
+		low = "messages"
+	case fl.limit.bytes > 0 && fl.bytes < fl.limit.bytes*flowWarnLevel:
+		low = "bytes"
+	}
+	if low != "" && now.Sub(fl.lastWarn) >= time.Second {
+		fl.lastWarn = now
+		return true, mustJSON(rateWarningMsg{Type: "rate_warning", Tunnel: fl.tunnel, Direction: fl.direction,
+			Limit: low, MessagesPerSec: fl.limit.msgs, BytesPerSec: fl.limit.bytes})
+	}
+	return true, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+)
+
+// uiEchoMsg mirrors a text command one UI sent to the device to the other
+// UIs on the session that asked for it with ?echo=1, so several tabs on the
+// same device stay consistent. data is the command as forwarded: the JSON
+// value itself, or a string for non-JSON text. Binary commands aren't
+// mirrored.
+type uiEchoMsg struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+func uiEchoMessage(msg []byte) []byte {
+	data := json.RawMessage(msg)
+	if !json.Valid(msg) {
+		data = mustJSON(string(msg))
+	}
+	return mustJSON(uiEchoMsg{Type: "ui_echo", Data: data})
+}
+
+// echoToUIs sends msg, forwarded from sender to the device, to every other
+// ?echo=1 UI.
+func (dc *deviceConn) echoToUIs(sender *websocket.Conn, msg []byte) {
+	dc.uiMu.Lock()
+	var uis []*websocket.Conn
+	for c, o := range dc.uiConns {
+		if c != sender && o.echo {
+			uis = append(uis, c)
+		}
+	}
+	dc.uiMu.Unlock()
+	if len(uis) == 0 {
+		return
+	}
+	out := uiEchoMessage(msg)
+	dc.uiWriteMu.Lock()
+	for _, c := range uis {
+		_ = dc.writeUI(c, websocket.TextMessage, out)
+	}
+	dc.uiWriteMu.Unlock()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// UI kick: a device can disconnect its session's UIs before something that
+// needs it alone, such as an OTA update:
+//
+//	{"type":"kick_uis","reason":"ota","hold_s":300}
+//
+// Each UI is sent {"type":"kicked","reason":"ota"} and closed with kicked
+// (4008); terminal UIs just get the close. ui (peer ids from p2p
+// signaling) and from (guest, token or account: how the UI authenticated)
+// narrow it to some UIs. With hold_s, UIs the kick would have matched are
+// refused with retry_after and kicked until the hold ends (at most
+// UI_KICK_MAX_HOLD, 10m) or the device disconnects, so the device keeps the
+// session to itself; a kick_uis with hold_s 0 ends an earlier hold. A hold
+// can't name ui: peer ids are handed out per connection, so a returning UI
+// never has one the hold could match. Such a kick is refused with
+// kick_invalid and nothing is closed. Otherwise the device is answered
+// {"type":"uis_kicked","count":N}; the UIs are closed on their own
+// goroutine, with writeUI's deadline, so a stalled one never holds up the
+// device's reader.
+
+type uiKickRequest struct {
+	Type   string   `json:"type"`
+	Reason string   `json:"reason,omitempty"`
+	UI     []string `json:"ui,omitempty"`
+	From   []string `json:"from,omitempty"`
+	HoldS  int      `json:"hold_s,omitempty"`
+}
+
+type uiKickedMsg struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type uisKickedMsg struct {
+	Type      string     `json:"type"`
+	Count     int        `json:"count"`
+	HoldUntil *time.Time `json:"hold_until,omitempty"`
+}
+
+// uiKickHold keeps matching UIs off a session until until.
+type uiKickHold struct {
+	until  time.Time
+	reason string
+	from   []string
+}
+
+// matches reports whether a UI that authenticated as from is held off.
+func (h *uiKickHold) matches(from string, now time.Time) bool {
+	return h != nil && now.Before(h.until) && (len(h.from) == 0 || slices.Contains(h.from, from))
+}
+
+// deviceKick handles a kick_uis message; false if msg isn't one.
+func (ds *deviceSession) deviceKick(mt int, msg []byte) bool {
+	if mt != websocket.TextMessage || !bytes.Contains(msg, []byte(`"kick_uis"`)) {
+		return false
+	}
+	var req uiKickRequest
+	if json.Unmarshal(msg, &req) != nil || req.Type != "kick_uis" {
+		return false
+	}
+	s, dc := ds.s, ds.dc
+	if req.HoldS > 0 && len(req.UI) > 0 {
+		_ = dc.writeDevice(websocket.TextMessage, mustJSON(errorMsg{Type: "error", Code: "kick_invalid",
+			Message: "hold_s can't be combined with ui; use from"}))
+		return true
+	}
+	req.Reason = truncate(req.Reason, 64)
+	now := time.Now().UTC()
+	reply := uisKickedMsg{Type: "uis_kicked"}
+	if req.HoldS > 0 {
+		until := now.Add(min(time.Duration(req.HoldS)*time.Second, s.uiKickMaxHold)).Truncate(time.Second)
+		dc.kickHold.Store(&uiKickHold{until: until, reason: req.Reason, from: req.From})
+		reply.HoldUntil = &until
+	} else {
+		dc.kickHold.Store(nil)
+	}
+
+	kicked := mustJSON(uiKickedMsg{Type: "kicked", Reason: req.Reason})
+	var uis []*websocket.Conn
+	var terminal []bool
+	dc.uiMu.Lock()
+	for c, o := range dc.uiConns {
+		if len(req.From) > 0 && !slices.Contains(req.From, o.from) {
+			continue
+		}
+		if len(req.UI) > 0 && (o.p2p == nil || !slices.Contains(req.UI, o.p2p.id)) {
+			continue
+		}
+		uis = append(uis, c)
+		terminal = append(terminal, o.terminal)
+	}
+	dc.uiMu.Unlock()
+	if len(uis) > 0 {
+		go func() {
+			dc.uiWriteMu.Lock()
+			defer dc.uiWriteMu.Unlock()
+			for i, c := range uis {
+				if terminal[i] || dc.writeUI(c, websocket.TextMessage, kicked) == nil {
+					sendClose(c, wsCloseKicked)
+				}
+				_ = c.Close()
+			}
+		}()
+	}
+
+	reply.Count = len(uis)
+	_ = dc.writeDevice(websocket.TextMessage, mustJSON(reply))
+	s.logf(logInfo, "ui_kicked_by_device", "device_id", ds.deviceID, "tunnel", ds.tunnel, "reason", req.Reason,
+		"kicked", len(uis), "hold_s", req.HoldS)
+	return true
+}
+
+// rejectHeldUI refuses a UI while the device holds its session; false if
+// there's no hold for it. waited is the UI's socket if it was upgraded in
+// the waiting room.
+func (s *server) rejectHeldUI(w http.ResponseWriter, r *http.Request, waited *websocket.Conn, dc *deviceConn, from, deviceID, tunnel string) bool {
+	h := dc.kickHold.Load()
+	now := time.Now()
+	if !h.matches(from, now) {
+		return false
+	}
+	retry := h.until.Sub(now).Round(time.Second)
+	kv := []any{"remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel, "reason", h.reason}
+	if waited != nil {
+		_ = waited.WriteMessage(websocket.TextMessage, retryAfterMessage(wsCloseKicked, retry))
+		s.rejectUI(w, r, waited, http.StatusServiceUnavailable, wsCloseKicked, "ui_ws_held_by_device", kv...)
+		return true
+	}
+	s.rejectWSRetry(w, r, http.StatusServiceUnavailable, wsCloseKicked, retry, "ui_ws_held_by_device", kv...)
+	return true
+}
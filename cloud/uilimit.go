@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// UI connection caps, so one leaked URL can't fan a camera stream out to
+// hundreds of viewers on the device's uplink:
+//
+//	MAX_UI_PER_DEVICE=8                      every device/tunnel session
+//	MAX_UI_PER_TUNNEL=ws_camera=2,default=16  per tunnel name (overrides)
+//	/ws/device/{id}?max_ui=1                 a device may ask for less
+//
+// 0 means unlimited. UIs over the cap are refused with 4011 ui_limit.
+
+// parseTunnelLimits parses "tunnel=n,tunnel=n"; "default" names the empty
+// tunnel.
+func parseTunnelLimits(env, spec string) (map[string]int, error) {
+	out := make(map[string]int)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, v, ok := strings.Cut(item, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if !ok || err != nil || n < 0 {
+			return nil, fmt.Errorf("%s: bad entry %q", env, item)
+		}
+		name = strings.TrimSpace(name)
+		if name == "default" {
+			name = ""
+		}
+		out[name] = n
+	}
+	return out, nil
+}
+
+// uiLimitFor returns the UI cap for dc on tunnel, or 0 for none.
+func (s *server) uiLimitFor(dc *deviceConn, tunnel string) int {
+	limit := s.maxUIPerDevice
+	if n, ok := s.maxUIPerTunnel[tunnel]; ok {
+		limit = n
+	}
+	if dc.maxUI > 0 && (limit == 0 || dc.maxUI < limit) {
+		limit = dc.maxUI
+	}
+	return limit
+}
+
+// acquireUI reserves a UI slot on dc unless max (>0) are taken. Every
+// successful call must be paired with releaseUI.
+func (dc *deviceConn) acquireUI(max int) bool {
+	for {
+		n := dc.uiSlots.Load()
+		if max > 0 && int(n) >= max {
+			return false
+		}
+		if dc.uiSlots.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (dc *deviceConn) releaseUI() { dc.uiSlots.Add(-1) }
@@ -0,0 +1,46 @@
+package main
+
+import "crypto/subtle"
+
+// uiScope is what a UI connection may do with the device.
+type uiScope int
+
+const (
+	// uiScopeView only receives device->UI traffic; its writes are dropped.
+	uiScopeView uiScope = iota
+	// uiScopeControl may also send UI->device messages.
+	uiScopeControl
+)
+
+func (sc uiScope) String() string {
+	if sc == uiScopeControl {
+		return "control"
+	}
+	return "view"
+}
+
+// tokenScope is "tunnel" for sessions registered with ?token_scope=tunnel,
+// else "device".
+func (dc *deviceConn) tokenScope() string {
+	if dc.tunnelToken {
+		return "tunnel"
+	}
+	return "device"
+}
+
+// scopeFor maps a presented UI token to a scope. The device's main token
+// (?token= at registration) grants control; its optional ?view_token= grants
+// read-only viewing. A device that registered no token is open to everyone
+// with full control, as before.
+func (dc *deviceConn) scopeFor(token string) (uiScope, bool) {
+	if dc.uiToken == "" {
+		return uiScopeControl, true
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(dc.uiToken)) == 1 {
+		return uiScopeControl, true
+	}
+	if dc.viewToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(dc.viewToken)) == 1 {
+		return uiScopeView, true
+	}
+	return uiScopeView, false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket upgrade profiles. Devices and UIs get separate upgraders, since
+// per-connection buffers (32KiB each way by default) dominate memory on a
+// relay holding thousands of mostly idle control tunnels, while UIs are few
+// and often stream video:
+//
+//	DEVICE_WS_READ_BUFFER=4KiB        read buffer per connection
+//	DEVICE_WS_WRITE_BUFFER=4KiB       write buffer per connection
+//	DEVICE_WS_WRITE_BUFFER_POOL=1     share write buffers between writes
+//	                                  instead of keeping one per connection
+//	DEVICE_WS_COMPRESSION=1           allow permessage-deflate
+//	DEVICE_WS_HANDSHAKE_TIMEOUT=10s   limit on writing the upgrade response
+//
+// and the same with a UI_WS_ prefix for UI, terminal and admin sockets. The
+// device profile covers /ws/device/ (gorilla engine), /ws/upstream and
+// conformance runs; the epoll engine (engine.go) keeps no per-connection
+// buffers and ignores it. Larger messages still work with small buffers:
+// they are just read and written in more pieces.
+
+type upgradeProfile struct {
+	readBuffer, writeBuffer int
+	writeBufferPool         bool
+	compression             bool
+	handshakeTimeout        time.Duration
+}
+
+func loadUpgradeProfile(prefix string) (upgradeProfile, error) {
+	up := upgradeProfile{
+		writeBufferPool:  envOr(prefix+"_WRITE_BUFFER_POOL", "0") == "1",
+		compression:      envOr(prefix+"_COMPRESSION", "0") == "1",
+		handshakeTimeout: envDuration(prefix+"_HANDSHAKE_TIMEOUT", 0),
+	}
+	for _, b := range []struct {
+		name string
+		dst  *int
+	}{{prefix + "_READ_BUFFER", &up.readBuffer}, {prefix + "_WRITE_BUFFER", &up.writeBuffer}} {
+		n, err := parseByteSize(envOr(b.name, "32KiB"))
+		if err != nil || n < 256 || n > 16<<20 {
+			return up, fmt.Errorf("%s: want a size from 256 bytes to 16MiB", b.name)
+		}
+		*b.dst = int(n)
+	}
+	return up, nil
+}
+
+func (up upgradeProfile) upgrader() websocket.Upgrader {
+	u := websocket.Upgrader{
+		ReadBufferSize:    up.readBuffer,
+		WriteBufferSize:   up.writeBuffer,
+		EnableCompression: up.compression,
+		HandshakeTimeout:  up.handshakeTimeout,
+		CheckOrigin: func(r *http.Request) bool {
+			// Expect to run behind a reverse proxy/ingress; origin checks should be enforced there.
+			return true
+		},
+	}
+	if up.writeBufferPool {
+		u.WriteBufferPool = &sync.Pool{}
+	}
+	return u
+}
+
+func (up upgradeProfile) logKV() []any {
+	return []any{"read_buffer", up.readBuffer, "write_buffer", up.writeBuffer, "write_buffer_pool", up.writeBufferPool,
+		"compression", up.compression, "handshake_timeout", up.handshakeTimeout.String()}
+}
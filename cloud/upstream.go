@@ -0,0 +1,585 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Upstream tunneling lets a small relay on a home server or site gateway
+// re-export its devices through one WebSocket to a public relay, instead of
+// every device holding its own connection over a flaky WAN:
+//
+//	on-prem:  UPSTREAM_URL=https://cloud.example.com  UPSTREAM_TOKEN=<secret>
+//	cloud:    UPSTREAM_AUTH_TOKEN=<secret>
+//
+// The on-prem relay dials /ws/upstream and announces each of its device
+// sessions; the cloud relay serves them like directly connected devices
+// (UI tokens, capabilities and frame tags carry over), so UIs connect to it
+// as usual. The link reconnects with backoff and re-announces everything.
+//
+// The token only admits the devices UPSTREAM_DEVICES names, and each
+// announced session is checked like a direct connection: its ID must be
+// canonical, the link's Host must belong to its tenant, and a device with a
+// registry key must have presented it to the on-prem relay, which passes it
+// along. Sessions outside the device's streaming windows (streaming.go) are
+// refused too, after a retry_after for the device. A session that fails is
+// closed back to the on-prem relay.
+//
+// Each link message is a binary frame: op (1 byte), session key length
+// (2 bytes, big endian), the makeKey session key, then the payload.
+
+const (
+	upOpen   byte = 1 // payload: upstreamOpen JSON
+	upClose  byte = 2
+	upText   byte = 3
+	upBinary byte = 4
+)
+
+type upstreamOpen struct {
+	UIToken      string         `json:"ui_token,omitempty"`
+	TunnelToken  bool           `json:"tunnel_token,omitempty"`
+	ViewToken    string         `json:"view_token,omitempty"`
+	Capabilities map[string]any `json:"capabilities,omitempty"`
+	FrameTags    bool           `json:"frame_tags,omitempty"`
+	MaxUI        int            `json:"max_ui,omitempty"`
+	// The registry key the device presented, if any.
+	DeviceKey string `json:"device_key,omitempty"`
+}
+
+func (dc *deviceConn) upstreamOpen() []byte {
+	return mustJSON(upstreamOpen{UIToken: dc.uiToken, TunnelToken: dc.tunnelToken, ViewToken: dc.viewToken,
+		Capabilities: dc.capabilities, FrameTags: dc.frameTags, MaxUI: dc.maxUI, DeviceKey: dc.deviceKey})
+}
+
+func encodeUpstream(op byte, key string, payload []byte) []byte {
+	b := make([]byte, 3+len(key)+len(payload))
+	b[0] = op
+	binary.BigEndian.PutUint16(b[1:3], uint16(len(key)))
+	copy(b[3:], key)
+	copy(b[3+len(key):], payload)
+	return b
+}
+
+func decodeUpstream(b []byte) (op byte, key string, payload []byte, ok bool) {
+	if len(b) < 3 {
+		return 0, "", nil, false
+	}
+	n := int(binary.BigEndian.Uint16(b[1:3]))
+	if len(b) < 3+n {
+		return 0, "", nil, false
+	}
+	return b[0], string(b[3 : 3+n]), b[3+n:], true
+}
+
+func upstreamOp(mt int) byte {
+	if mt == websocket.BinaryMessage {
+		return upBinary
+	}
+	return upText
+}
+
+// --- On-prem side ---
+
+// upstreamLink is the on-prem relay's connection to its upstream.
+type upstreamLink struct {
+	s     *server
+	url   string // wss://.../ws/upstream
+	token string
+
+	// Frames waiting for the writer. Only filled while the link is up;
+	// everything is re-announced after a reconnect.
+	out chan []byte
+	up  atomic.Bool
+	// Set when an announcement couldn't be queued; the link is recycled.
+	lost atomic.Bool
+
+	mu sync.Mutex
+	// Sessions the upstream has UIs attached to.
+	remoteUIs map[string]bool
+}
+
+func loadUpstreamLink(s *server) *upstreamLink {
+	base := strings.TrimRight(strings.TrimSpace(envOr("UPSTREAM_URL", "")), "/")
+	if base == "" {
+		return nil
+	}
+	if after, ok := strings.CutPrefix(base, "http://"); ok {
+		base = "ws://" + after
+	} else if after, ok := strings.CutPrefix(base, "https://"); ok {
+		base = "wss://" + after
+	}
+	return &upstreamLink{
+		s:         s,
+		url:       base + "/ws/upstream",
+		token:     envOr("UPSTREAM_TOKEN", ""),
+		out:       make(chan []byte, envInt("UPSTREAM_QUEUE", 1024)),
+		remoteUIs: make(map[string]bool),
+	}
+}
+
+// sessionChanged is the hub's session callback; it runs under the shard
+// lock, so it only queues.
+func (ul *upstreamLink) sessionChanged(key string, dc *deviceConn, up bool) {
+	if !ul.up.Load() {
+		return
+	}
+	frame := encodeUpstream(upClose, key, nil)
+	if up {
+		frame = encodeUpstream(upOpen, key, dc.upstreamOpen())
+	}
+	select {
+	case ul.out <- frame:
+	default:
+		ul.lost.Store(true)
+	}
+}
+
+// forward passes a device message upstream; dropped if the link is down or
+// backed up, like a slow UI.
+func (ul *upstreamLink) forward(key string, m wsMsg) {
+	if !ul.up.Load() {
+		return
+	}
+	select {
+	case ul.out <- encodeUpstream(upstreamOp(m.mt), key, m.msg):
+	default:
+	}
+}
+
+// hasRemoteUIs reports whether the upstream has UIs on key, so the device
+// isn't told ui_disconnected while they are still there.
+func (ul *upstreamLink) hasRemoteUIs(key string) bool {
+	if ul == nil {
+		return false
+	}
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	return ul.remoteUIs[key]
+}
+
+// run keeps the link up until ctx is done.
+func (ul *upstreamLink) run(ctx context.Context) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		start := time.Now()
+		err := ul.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		ul.s.logf(logInfo, "upstream_disconnected", "url", ul.url, "error", err.Error())
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		wait := backoff + time.Duration(rand.Int64N(int64(backoff/2)+1))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// session runs one connection to the upstream.
+func (ul *upstreamLink) session(ctx context.Context) error {
+	hdr := http.Header{}
+	if ul.token != "" {
+		hdr.Set("Authorization", "Bearer "+ul.token)
+	}
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, ul.url, hdr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetReadLimit(8<<20 + 1<<10)
+
+	// Drop what was queued for the previous connection, then announce every
+	// session. A session that changes meanwhile is announced twice, which
+	// the upstream treats as a refresh.
+	for len(ul.out) > 0 {
+		<-ul.out
+	}
+	ul.lost.Store(false)
+	ul.mu.Lock()
+	clear(ul.remoteUIs)
+	ul.mu.Unlock()
+	ul.up.Store(true)
+	defer ul.up.Store(false)
+	ul.s.logf(logInfo, "upstream_connected", "url", ul.url)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	go func() {
+		for _, e := range ul.s.h.entries() {
+			select {
+			case ul.out <- encodeUpstream(upOpen, e.key, e.dc.upstreamOpen()):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	errCh := make(chan error, 1)
+	go func() { errCh <- ul.readLoop(conn) }()
+
+	ping := time.NewTicker(ul.s.keepalive.pingInterval)
+	defer ping.Stop()
+	for {
+		if ul.lost.Load() {
+			return errors.New("upstream queue overflowed")
+		}
+		select {
+		case err := <-errCh:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case frame := <-ul.out:
+			_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+				return err
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readLoop delivers the upstream's UI traffic to local devices.
+func (ul *upstreamLink) readLoop(conn *websocket.Conn) error {
+	for {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		op, key, payload, ok := decodeUpstream(b)
+		if !ok || (op != upText && op != upBinary) {
+			continue
+		}
+		dc := ul.s.h.getDevice(key)
+		if dc == nil {
+			continue
+		}
+		if op == upText {
+			attached := bytes.Equal(payload, msgUIConnected)
+			if attached || bytes.Equal(payload, msgUIDisconnected) {
+				ul.mu.Lock()
+				ul.remoteUIs[key] = attached
+				ul.mu.Unlock()
+				dc.uiMu.Lock()
+				local := len(dc.uiConns) > 0
+				dc.uiMu.Unlock()
+				if local {
+					continue // the device already knows a UI is attached
+				}
+			}
+		}
+		mt := websocket.TextMessage
+		if op == upBinary {
+			mt = websocket.BinaryMessage
+		}
+		_ = dc.writeDevice(mt, payload)
+	}
+}
+
+// --- Cloud side ---
+
+// upstreamSocket is a device session carried by an upstream link; it
+// implements deviceSocket.
+type upstreamSocket struct {
+	link *upstreamPeer
+	key  string
+}
+
+func (us *upstreamSocket) WriteMessage(mt int, data []byte) error {
+	return us.link.write(encodeUpstream(upstreamOp(mt), us.key, data))
+}
+
+// WriteControl: the link does its own keepalive; a close ends the session
+// on the upstream side only.
+func (us *upstreamSocket) WriteControl(mt int, _ []byte, _ time.Time) error {
+	if mt == websocket.CloseMessage {
+		return us.link.write(encodeUpstream(upClose, us.key, nil))
+	}
+	return nil
+}
+
+func (us *upstreamSocket) Close() error { return nil }
+
+// upstreamPeer is one downstream relay's link, on the cloud side.
+type upstreamPeer struct {
+	s       *server
+	conn    *websocket.Conn
+	req     *http.Request // the upgrade, for tenant checks
+	remote  string
+	writeMu sync.Mutex
+	// Owned by the read loop.
+	sessions map[string]*upstreamSession
+}
+
+// upstreamSession is a device session carried by a link.
+type upstreamSession struct {
+	ds *deviceSession
+}
+
+// end tears the session down on this side.
+func (us *upstreamSession) end() {
+	us.ds.out.close()
+	us.ds.pushes.closeAll()
+	us.ds.dc.closeWithReason(wsCloseDeviceOffline, wsCloseDeviceOffline)
+	us.ds.s.h.deleteDevice(us.ds.key, us.ds.dc)
+}
+
+func (up *upstreamPeer) write(frame []byte) error {
+	up.writeMu.Lock()
+	defer up.writeMu.Unlock()
+	_ = up.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return up.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// handleUpstreamWS serves /ws/upstream for downstream relays; it is off
+// unless UPSTREAM_AUTH_TOKEN is set.
+func (s *server) handleUpstreamWS(w http.ResponseWriter, r *http.Request) {
+	if s.upstreamAuthToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !authOK(r, s.upstreamAuthToken) {
+		s.rejectWS(w, r, http.StatusUnauthorized, wsCloseUnauthorized, "upstream_ws_unauthorized", "remote", clientIP(r))
+		return
+	}
+	if s.draining.Load() {
+		s.rejectWS(w, r, http.StatusServiceUnavailable, wsCloseDraining, "upstream_ws_draining", "remote", clientIP(r))
+		return
+	}
+	conn, err := s.deviceUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	up := &upstreamPeer{s: s, conn: conn, req: r, remote: clientIP(r), sessions: make(map[string]*upstreamSession)}
+	s.logf(logInfo, "upstream_ws_connected", "remote", up.remote)
+	err = up.readLoop()
+	for _, us := range up.sessions {
+		us.end()
+	}
+	_ = conn.Close()
+	s.logf(logInfo, "upstream_ws_disconnected", "remote", up.remote, "sessions", len(up.sessions), "err", err.Error())
+}
+
+func (up *upstreamPeer) readLoop() error {
+	s := up.s
+	conn := up.conn
+	conn.SetReadLimit(8<<20 + 1<<10)
+	_ = conn.SetReadDeadline(time.Now().Add(s.keepalive.readTimeout()))
+	conn.SetPingHandler(func(data string) error {
+		_ = conn.SetReadDeadline(time.Now().Add(s.keepalive.readTimeout()))
+		now := time.Now().UTC().UnixNano()
+		for _, us := range up.sessions {
+			us.ds.dc.lastSeen.Store(now)
+		}
+		up.writeMu.Lock()
+		defer up.writeMu.Unlock()
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(5*time.Second))
+	})
+	for {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		op, key, payload, ok := decodeUpstream(b)
+		if !ok {
+			continue
+		}
+		switch op {
+		case upOpen:
+			var o upstreamOpen
+			if json.Unmarshal(payload, &o) != nil {
+				continue
+			}
+			up.open(key, o)
+		case upClose:
+			if us := up.sessions[key]; us != nil {
+				delete(up.sessions, key)
+				us.end()
+				deviceID, tunnel := splitKey(key)
+				s.logf(logInfo, "device_ws_disconnected", "device_id", deviceID, "tunnel", tunnel, "via", "upstream")
+			}
+		case upText, upBinary:
+			us := up.sessions[key]
+			if us == nil {
+				continue
+			}
+			ds := us.ds
+			select {
+			case <-ds.dc.closed:
+				continue // replaced or evicted here
+			default:
+			}
+			ds.dc.lastSeen.Store(time.Now().UTC().UnixNano())
+			mt := websocket.TextMessage
+			if op == upBinary {
+				mt = websocket.BinaryMessage
+			}
+			if m, ok, must := ds.ingest(mt, payload); ok {
+				ds.out.push(m, must)
+			}
+		}
+	}
+}
+
+// open admits a session announced by the downstream relay. A repeat for a
+// session this link already carries refreshes it in place, keeping its UIs.
+func (up *upstreamPeer) open(key string, o upstreamOpen) {
+	s := up.s
+	deviceID, tunnel := splitKey(key)
+	if reason := up.refuse(deviceID, tunnel, o); reason != "" {
+		if us := up.sessions[key]; us != nil {
+			delete(up.sessions, key)
+			us.end()
+		}
+		if reason == "outside_schedule" {
+			// Tell the device when to come back, as handleDeviceWS does.
+			_, retry := s.streamingClosed(deviceID, tunnel)
+			_ = up.write(encodeUpstream(upText, key, retryAfterMessage(wsCloseOutsideSchedule, retry)))
+		}
+		_ = up.write(encodeUpstream(upClose, key, nil))
+		s.logf(logInfo, "device_ws_upstream_refused", "remote", up.remote, "device_id", truncate(deviceID, 128),
+			"tunnel", truncate(tunnel, 64), "reason", reason)
+		return
+	}
+	if us := up.sessions[key]; us != nil && s.h.getDevice(key) == us.ds.dc {
+		dc := us.ds.dc
+		dc.uiMu.Lock()
+		attached := len(dc.uiConns) > 0
+		dc.uiMu.Unlock()
+		if attached {
+			// The device behind it may have reconnected.
+			_ = dc.writeDevice(websocket.TextMessage, msgUIConnected)
+		}
+		return
+	}
+	dc := &deviceConn{
+		id:           key,
+		ws:           &upstreamSocket{link: up, key: key},
+		connectedAt:  time.Now().UTC(),
+		closed:       make(chan struct{}),
+		uiToken:      o.UIToken,
+		tunnelToken:  o.TunnelToken,
+		viewToken:    o.ViewToken,
+		uiConns:      make(map[*websocket.Conn]uiOptions),
+		dedup:        newDedupWindow(s.dedupWindow),
+		frameTags:    o.FrameTags,
+		capabilities: o.Capabilities,
+		maxUI:        o.MaxUI,
+
+		uiWriteTimeout: s.uiWriteTimeout,
+	}
+	if rs, ok := s.uiCmdRateFor(tunnel); ok {
+		dc.cmdBucket = newTokenBucket(rs)
+	}
+	// Device traffic is limited by the relay it connected to.
+	_, dc.uiLimit = s.newFlowLimiters(tunnel)
+	dc.lastSeen.Store(time.Now().UTC().UnixNano())
+	dc.lastMessage.Store(dc.connectedAt.UnixNano())
+
+	old, evicted, admitted := s.h.admitDevice(key, dc, s.maxDevices, s.capacityPolicy)
+	if !admitted {
+		s.capacityRejected.Inc()
+		_ = up.write(encodeUpstream(upClose, key, nil))
+		s.logf(logInfo, "device_ws_capacity_rejected", "remote", up.remote, "device_id", deviceID, "tunnel", tunnel, "via", "upstream")
+		return
+	}
+	s.reconnected(key)
+	if evicted != nil {
+		s.capacityEvicted.Inc()
+		evictedID, evictedTunnel := splitKey(evicted.id)
+		evicted.closeWithReason(wsCloseQuotaExceeded, wsCloseDeviceOffline)
+		s.logf(logInfo, "device_ws_evicted_idle", "device_id", evictedID, "tunnel", evictedTunnel, "for_device_id", deviceID)
+	}
+	if old != nil {
+		old.closeWithReason(wsCloseReplaced, wsCloseReplaced)
+		s.h.deleteDevice(key, old)
+	}
+	if us := up.sessions[key]; us != nil {
+		us.end() // replaced here meanwhile; a no-op in the hub
+	}
+	up.sessions[key] = &upstreamSession{ds: s.newDeviceSession(dc, deviceID, tunnel)}
+	s.logf(logInfo, "device_ws_connected", "remote", up.remote, "device_id", deviceID, "tunnel", tunnel, "via", "upstream")
+}
+
+// refuse checks a session the downstream relay announced the way
+// handleDeviceWS checks a device; it returns why the session can't be
+// admitted, or "".
+func (up *upstreamPeer) refuse(deviceID, tunnel string, o upstreamOpen) string {
+	s := up.s
+	if id, ok := normalizeDeviceID(deviceID); !ok || id != deviceID || deviceID == loopbackDeviceID ||
+		wsParams["tunnel"].check(tunnel) != nil {
+		return "invalid_key"
+	}
+	if !s.upstreamAllows(deviceID) {
+		return "not_allowed"
+	}
+	if !s.hostAllows(up.req, deviceID) {
+		return "wrong_domain"
+	}
+	if hasKey, ok := s.registry.verifyKey(deviceID, o.DeviceKey); hasKey {
+		if !ok {
+			return "unauthorized_key"
+		}
+	} else if s.requireDeviceKeys {
+		return "unregistered"
+	}
+	if closed, _ := s.streamingClosed(deviceID, tunnel); closed {
+		return "outside_schedule"
+	}
+	return ""
+}
+
+// upstreamAllows reports whether UPSTREAM_DEVICES, a list of
+// case-insensitive globs, names deviceID.
+func (s *server) upstreamAllows(deviceID string) bool {
+	id := strings.ToLower(deviceID)
+	for _, p := range s.upstreamDevices {
+		if ok, _ := path.Match(p, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// loadUpstreamDevices parses UPSTREAM_DEVICES; /ws/upstream needs it.
+func loadUpstreamDevices() ([]string, error) {
+	var out []string
+	for _, p := range strings.Split(envOr("UPSTREAM_DEVICES", ""), ",") {
+		if p = strings.ToLower(strings.TrimSpace(p)); p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("UPSTREAM_DEVICES: bad pattern %q", p)
+		}
+		out = append(out, p)
+	}
+	if len(out) == 0 {
+		return nil, errors.New("UPSTREAM_AUTH_TOKEN needs UPSTREAM_DEVICES, the device IDs downstream relays may carry")
+	}
+	return out, nil
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Per-device availability. A device is up while it has at least one session
+// (any tunnel). Connected seconds and disconnects go into hourly buckets for
+// the last day and daily (UTC) buckets for the last 30, so
+// GET /api/devices/{id}/uptime can report the 24h, 7d and 30d windows and
+// GET /api/uptime?window=7d can rank the fleet by availability.
+//
+// Availability is connected time over observed time, where observed starts
+// when the relay first saw the device, so a new device isn't penalized for
+// the days before it existed. Time the relay itself was down counts as
+// downtime; restarts are not counted as disconnects. With DATA_DIR the
+// counters are saved every UPTIME_SAVE_INTERVAL (5m) and when draining.
+
+const (
+	uptimeDoc   = "uptime"
+	uptimeHours = 24
+	uptimeDays  = 30
+)
+
+type uptimeBucket struct {
+	Start int64 `json:"start"` // unix seconds of the bucket's hour or day
+	Up    int32 `json:"up"`    // connected seconds
+	Drops int32 `json:"drops"`
+}
+
+type uptimeRecord struct {
+	FirstSeen time.Time `json:"first_seen"`
+	// Start of the current connected stretch; zero while down.
+	UpSince time.Time `json:"up_since,omitempty"`
+	// When the last stretch ended.
+	DownSince time.Time                 `json:"down_since,omitempty"`
+	Hours     [uptimeHours]uptimeBucket `json:"hours"`
+	Days      [uptimeDays]uptimeBucket  `json:"days"`
+}
+
+type uptimeTracker struct {
+	store *fileStore
+
+	// excused reports devices whose disconnects shouldn't count
+	// (maintenance mode).
+	excused func(deviceID string) bool
+
+	mu      sync.Mutex
+	devices map[string]*uptimeRecord
+}
+
+func newUptimeTracker(store *fileStore) *uptimeTracker {
+	return &uptimeTracker{store: store, devices: make(map[string]*uptimeRecord)}
+}
+
+type uptimeFile struct {
+	SavedAt time.Time                `json:"saved_at"`
+	Devices map[string]*uptimeRecord `json:"devices"`
+}
+
+// load restores saved counters. Stretches that were open when the relay
+// went down are closed at the time of the save.
+func (ut *uptimeTracker) load() error {
+	var f uptimeFile
+	if err := ut.store.load(uptimeDoc, &f); err != nil {
+		return err
+	}
+	devices, moved, dropped := canonicalDeviceKeys(f.Devices)
+	ut.store.noteLegacyIDs(uptimeDoc, moved, dropped)
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	for id, rec := range devices {
+		if rec == nil || id == "" {
+			continue
+		}
+		if !rec.UpSince.IsZero() {
+			rec.addUp(rec.UpSince, f.SavedAt)
+			rec.UpSince, rec.DownSince = time.Time{}, f.SavedAt
+		}
+		ut.devices[id] = rec
+	}
+	return nil
+}
+
+// save persists the counters, dropping devices not seen for 30 days.
+func (ut *uptimeTracker) save() error {
+	if !ut.store.enabled() {
+		return nil
+	}
+	now := time.Now().UTC()
+	ut.mu.Lock()
+	f := uptimeFile{SavedAt: now, Devices: make(map[string]*uptimeRecord, len(ut.devices))}
+	for id, rec := range ut.devices {
+		if rec.UpSince.IsZero() && rec.lastActivity() < now.Add(-uptimeDays*24*time.Hour).Unix() {
+			delete(ut.devices, id)
+			continue
+		}
+		cp := *rec
+		f.Devices[id] = &cp
+	}
+	ut.mu.Unlock()
+	return ut.store.save(uptimeDoc, f)
+}
+
+// presence is the hub's callback: deviceID got its first session (up) or
+// lost its last one.
+func (ut *uptimeTracker) presence(deviceID string, up bool, at time.Time) {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	rec := ut.devices[deviceID]
+	if rec == nil {
+		if !up {
+			return
+		}
+		rec = &uptimeRecord{FirstSeen: at}
+		ut.devices[deviceID] = rec
+	}
+	switch {
+	case up && rec.UpSince.IsZero():
+		rec.UpSince = at
+	case !up && !rec.UpSince.IsZero():
+		rec.addUp(rec.UpSince, at)
+		rec.UpSince, rec.DownSince = time.Time{}, at
+		if ut.excused != nil && ut.excused(deviceID) {
+			return
+		}
+		h, d := rec.buckets(at)
+		h.Drops++
+		d.Drops++
+	}
+}
+
+func (ut *uptimeTracker) remove(deviceID string) {
+	ut.mu.Lock()
+	delete(ut.devices, deviceID)
+	ut.mu.Unlock()
+}
+
+// buckets returns the hour and day buckets for t, resetting them if they
+// still hold an older period.
+func (rec *uptimeRecord) buckets(t time.Time) (hour, day *uptimeBucket) {
+	hs := t.Unix() / 3600 * 3600
+	hour = &rec.Hours[(hs/3600)%uptimeHours]
+	if hour.Start != hs {
+		*hour = uptimeBucket{Start: hs}
+	}
+	return hour, rec.day(t)
+}
+
+func (rec *uptimeRecord) day(t time.Time) *uptimeBucket {
+	ds := t.Unix() / 86400 * 86400
+	day := &rec.Days[(ds/86400)%uptimeDays]
+	if day.Start != ds {
+		*day = uptimeBucket{Start: ds}
+	}
+	return day
+}
+
+// addUp credits [from, to) as connected. Only the last day needs hourly
+// detail; anything older is credited a day at a time.
+func (rec *uptimeRecord) addUp(from, to time.Time) {
+	if oldest := to.Add(-uptimeDays * 24 * time.Hour); from.Before(oldest) {
+		from = oldest
+	}
+	hourly := to.Add(-uptimeHours * time.Hour)
+	for from.Before(to) {
+		if from.Before(hourly) {
+			next := from.Truncate(24 * time.Hour).Add(24 * time.Hour)
+			if next.After(hourly) {
+				next = hourly
+			}
+			rec.day(from).Up += int32(next.Sub(from) / time.Second)
+			from = next
+			continue
+		}
+		next := from.Truncate(time.Hour).Add(time.Hour)
+		if next.After(to) {
+			next = to
+		}
+		h, d := rec.buckets(from)
+		secs := int32(next.Sub(from) / time.Second)
+		h.Up += secs
+		d.Up += secs
+		from = next
+	}
+}
+
+func (rec *uptimeRecord) lastActivity() int64 {
+	var last int64
+	for _, b := range rec.Days {
+		if b.Start > last && (b.Up > 0 || b.Drops > 0) {
+			last = b.Start
+		}
+	}
+	return last
+}
+
+type uptimeWindow struct {
+	ConnectedS   int64   `json:"connected_s"`
+	ObservedS    int64   `json:"observed_s"`
+	Availability float64 `json:"availability"` // percent
+	Disconnects  int     `json:"disconnects"`
+}
+
+var uptimeWindows = []struct {
+	name string
+	d    time.Duration
+}{{"24h", 24 * time.Hour}, {"7d", 7 * 24 * time.Hour}, {"30d", 30 * 24 * time.Hour}}
+
+// window sums the buckets covering the last d: hourly for a day, whole UTC
+// days (today included) beyond that. Credit any open stretch first.
+func (rec *uptimeRecord) window(d time.Duration, now time.Time) uptimeWindow {
+	var w uptimeWindow
+	var start time.Time
+	if d <= 24*time.Hour {
+		start = now.Truncate(time.Hour).Add(-d + time.Hour)
+		for _, b := range rec.Hours {
+			if b.Start >= start.Unix() && b.Start <= now.Unix() {
+				w.ConnectedS += int64(b.Up)
+				w.Disconnects += int(b.Drops)
+			}
+		}
+	} else {
+		start = now.Truncate(24 * time.Hour).Add(-d + 24*time.Hour)
+		for _, b := range rec.Days {
+			if b.Start >= start.Unix() && b.Start <= now.Unix() {
+				w.ConnectedS += int64(b.Up)
+				w.Disconnects += int(b.Drops)
+			}
+		}
+	}
+	if rec.FirstSeen.After(start) {
+		start = rec.FirstSeen
+	}
+	w.ObservedS = int64(now.Sub(start) / time.Second)
+	if w.ConnectedS > w.ObservedS {
+		w.ConnectedS = w.ObservedS
+	}
+	if w.ObservedS > 0 {
+		w.Availability = float64(w.ConnectedS*10000/w.ObservedS) / 100
+	}
+	return w
+}
+
+type uptimeReport struct {
+	DeviceID  string                  `json:"device_id"`
+	Connected bool                    `json:"connected"`
+	FirstSeen time.Time               `json:"first_seen"`
+	UpSince   *time.Time              `json:"up_since,omitempty"`
+	DownSince *time.Time              `json:"down_since,omitempty"`
+	Windows   map[string]uptimeWindow `json:"windows"`
+}
+
+func (ut *uptimeTracker) report(deviceID string, now time.Time) (uptimeReport, bool) {
+	ut.mu.Lock()
+	rec, ok := ut.devices[deviceID]
+	var cp uptimeRecord
+	if ok {
+		cp = *rec
+	}
+	ut.mu.Unlock()
+	if !ok {
+		return uptimeReport{}, false
+	}
+	rep := uptimeReport{DeviceID: deviceID, Connected: !cp.UpSince.IsZero(), FirstSeen: cp.FirstSeen,
+		Windows: make(map[string]uptimeWindow, len(uptimeWindows))}
+	if rep.Connected {
+		t := cp.UpSince
+		rep.UpSince = &t
+		cp.addUp(cp.UpSince, now)
+	} else if !cp.DownSince.IsZero() {
+		t := cp.DownSince
+		rep.DownSince = &t
+	}
+	for _, uw := range uptimeWindows {
+		rep.Windows[uw.name] = cp.window(uw.d, now)
+	}
+	return rep, true
+}
+
+func (ut *uptimeTracker) ids() []string {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	out := make([]string, 0, len(ut.devices))
+	for id := range ut.devices {
+		out = append(out, id)
+	}
+	return out
+}
+
+func (s *server) runUptimeSaver(ctx context.Context, interval time.Duration) {
+	if !s.store.enabled() || interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := s.uptime.save(); err != nil {
+				s.logf(logInfo, "uptime_save_failed", "error", err.Error())
+			}
+			if err := s.disconnects.save(); err != nil {
+				s.logf(logInfo, "disconnects_save_failed", "error", err.Error())
+			}
+		}
+	}
+}
+
+// handleDeviceUptime serves GET /api/devices/{id}/uptime.
+func (s *server) handleDeviceUptime(w http.ResponseWriter, r *http.Request, deviceID string) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.requireRole(w, r, roleViewer) {
+		return
+	}
+	rep, ok := s.uptime.report(deviceID, time.Now().UTC())
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "device_never_connected", "device has never connected")
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// uptimeRow is one device's availability over a window.
+type uptimeRow struct {
+	DeviceID    string `json:"device_id"`
+	Connected   bool   `json:"connected"`
+	Maintenance bool   `json:"maintenance,omitempty"`
+	uptimeWindow
+}
+
+// parseUptimeWindow validates ?window=, defaulting to def.
+func parseUptimeWindow(v, def string) (string, bool) {
+	if v == "" {
+		v = def
+	}
+	for _, uw := range uptimeWindows {
+		if uw.name == v {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// uptimeRows lists the availability of every device r may see, least
+// available first.
+func (s *server) uptimeRows(r *http.Request, window string) []uptimeRow {
+	now := time.Now().UTC()
+	rows := []uptimeRow{}
+	windows := s.maintenance.all()
+	for _, id := range s.uptime.ids() {
+		if !s.hostAllows(r, id) {
+			continue
+		}
+		if rep, ok := s.uptime.report(id, now); ok {
+			rows = append(rows, uptimeRow{DeviceID: id, Connected: rep.Connected,
+				Maintenance: windows[id].DeviceID != "", uptimeWindow: rep.Windows[window]})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Availability != rows[j].Availability {
+			return rows[i].Availability < rows[j].Availability
+		}
+		return rows[i].DeviceID < rows[j].DeviceID
+	})
+	return rows
+}
+
+// handleUptime serves GET /api/uptime?window=24h|7d|30d: every device's
+// availability over the window, least available first.
+func (s *server) handleUptime(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.requireRole(w, r, roleViewer) {
+		return
+	}
+	window, ok := parseUptimeWindow(r.URL.Query().Get("window"), "24h")
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "invalid_window", "window must be 24h, 7d or 30d")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.uptimeRows(r, window))
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Waiting room: a UI that connects with ?wait=1 (or ?wait=90s) while the
+// device is offline is upgraded anyway and held, instead of being closed
+// with device_offline for the dashboard to poll and retry. Every
+// UI_WAIT_INTERVAL (15s) and right away it is sent
+//
+//	{"type":"waiting","device_id":"...","tunnel":"...","waited_s":15,"timeout_s":300}
+//
+// Whatever can be checked without the device's session is checked before
+// the UI waits: the global UI token, the host's tenant, a share link and
+// the device's owner. When the session on the tunnel comes up, the UI is
+// authorized against it as usual (a wrong token is closed with unauthorized
+// only then), sent {"type":"device_online"} and bridged. With federation,
+// the other regions are asked every interval as well (for UIs that may be
+// bridged there; see mayFederate), and a device that
+// comes up there ends the wait the same way. After the wait (at most
+// UI_WAIT_MAX, 5m; 0 turns the waiting room off) the UI is closed with
+// device_offline. At most UI_WAIT_MAX_PENDING (256) UIs wait at once,
+// UI_WAIT_MAX_PER_IP (4) from one address and UI_WAIT_MAX_PER_DEVICE (16)
+// for one device; past that, UIs are refused as before. A device registered
+// as wake-capable is woken, and its UIs wait without asking; see wake.go.
+// Terminal (/ws/serial/) UIs never wait. What a UI sends while waiting is
+// read only once it is bridged.
+
+type waitRoom struct {
+	max, interval time.Duration
+	maxPending    int
+	maxPerIP      int
+	maxPerDevice  int
+
+	mu       sync.Mutex
+	pending  int
+	byIP     map[string]int
+	byDevice map[string]int
+}
+
+func newWaitRoom() *waitRoom {
+	return &waitRoom{
+		max:          envDuration("UI_WAIT_MAX", 5*time.Minute),
+		interval:     envDuration("UI_WAIT_INTERVAL", 15*time.Second),
+		maxPending:   envInt("UI_WAIT_MAX_PENDING", 256),
+		maxPerIP:     envInt("UI_WAIT_MAX_PER_IP", 4),
+		maxPerDevice: envInt("UI_WAIT_MAX_PER_DEVICE", 16),
+		byIP:         make(map[string]int),
+		byDevice:     make(map[string]int),
+	}
+}
+
+// enter takes a place in the room for a UI from ip; false if the room, the
+// address or the device is at its cap.
+func (wr *waitRoom) enter(ip, deviceID string) bool {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	if wr.pending >= wr.maxPending || wr.byIP[ip] >= wr.maxPerIP || wr.byDevice[deviceID] >= wr.maxPerDevice {
+		return false
+	}
+	wr.pending++
+	wr.byIP[ip]++
+	wr.byDevice[deviceID]++
+	return true
+}
+
+func (wr *waitRoom) leave(ip, deviceID string) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.pending--
+	if wr.byIP[ip]--; wr.byIP[ip] <= 0 {
+		delete(wr.byIP, ip)
+	}
+	if wr.byDevice[deviceID]--; wr.byDevice[deviceID] <= 0 {
+		delete(wr.byDevice, deviceID)
+	}
+}
+
+type waitingMsg struct {
+	Type     string `json:"type"`
+	DeviceID string `json:"device_id"`
+	Tunnel   string `json:"tunnel"`
+	WaitedS  int    `json:"waited_s"`
+	TimeoutS int    `json:"timeout_s"`
+	Waking   bool   `json:"waking,omitempty"`
+}
+
+var msgDeviceOnline = mustJSON(signalMsg{Type: "device_online"})
+
+// waitTimeout is how long the UI asked to wait, capped by UI_WAIT_MAX; 0 if
+// it didn't ask.
+func (wr *waitRoom) waitTimeout(r *http.Request) time.Duration {
+	v := r.URL.Query().Get("wait")
+	switch v {
+	case "", "0":
+		return 0
+	case "1":
+		return wr.max
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0
+	}
+	return min(d, wr.max)
+}
+
+// waitForDevice holds a UI until the session key is up, here or (peer set)
+// in another region. It returns the session or the peer, and the
+// already-upgraded UI socket; all are nil if the UI didn't ask to wait or
+// the room is full, and the caller rejects it as offline. ok is false when
+// the UI was upgraded and the wait ended without the device (the socket is
+// closed by then). canWake says the UI's credentials were checked without
+// the session (wake.go); then a wake-capable device is woken, and the UI
+// waits at least WAKE_WAIT without asking.
+func (s *server) waitForDevice(w http.ResponseWriter, r *http.Request, deviceID, tunnel, key string, canWake bool) (dc *deviceConn, peer *federationPeer, conn *websocket.Conn, ok bool) {
+	wr := s.waitRoom
+	timeout := wr.waitTimeout(r)
+	wake, waking := s.wakeTargetFor(deviceID)
+	waking = waking && canWake
+	if waking {
+		timeout = max(timeout, s.wake.wait)
+	}
+	if timeout <= 0 || !isWSUpgrade(r) {
+		return nil, nil, nil, true
+	}
+	ip := clientIP(r)
+	if !wr.enter(ip, deviceID) {
+		return nil, nil, nil, true
+	}
+	defer wr.leave(ip, deviceID)
+	if waking && !s.triggerWake(deviceID, wake, "ui", ip) {
+		// Capped or quiet: wait only as long as the UI asked to.
+		waking = false
+		if timeout = wr.waitTimeout(r); timeout <= 0 {
+			return nil, nil, nil, true
+		}
+	}
+	hw := s.h.waitFor(key)
+	defer func() { s.h.stopWaiting(key, hw) }()
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, nil, nil, false
+	}
+	federated := s.mayFederate(r)
+	s.logf(logInfo, "ui_ws_waiting", "remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel, "timeout", timeout.String(),
+		"waking", waking)
+
+	start := time.Now()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	interval := wr.interval
+	if interval <= 0 {
+		interval = timeout
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	notify := func() error {
+		return conn.WriteMessage(websocket.TextMessage, mustJSON(waitingMsg{Type: "waiting", DeviceID: deviceID, Tunnel: tunnel,
+			WaitedS: int(time.Since(start) / time.Second), TimeoutS: int(timeout / time.Second), Waking: waking}))
+	}
+	if notify() != nil {
+		_ = conn.Close()
+		return nil, nil, nil, false
+	}
+	for {
+		select {
+		case <-hw.up:
+			if dc := s.h.getDevice(key); dc != nil {
+				return dc, nil, conn, true
+			}
+			// Gone again already; keep waiting.
+			hw = s.h.waitFor(key)
+		case <-tick.C:
+			if s.draining.Load() {
+				sendClose(conn, wsCloseDraining)
+				_ = conn.Close()
+				return nil, nil, nil, false
+			}
+			if federated {
+				if p, found := s.locateDevice(r, deviceID, tunnel); found {
+					return nil, &p, conn, true
+				}
+			}
+			// A UI that went away is noticed here, when the write fails.
+			if notify() != nil {
+				_ = conn.Close()
+				return nil, nil, nil, false
+			}
+		case <-deadline.C:
+			sendClose(conn, wsCloseDeviceOffline)
+			_ = conn.Close()
+			s.logf(logInfo, "ui_ws_wait_timeout", "remote", clientIP(r), "device_id", deviceID, "tunnel", tunnel,
+				"waited", time.Since(start).Round(time.Second).String())
+			return nil, nil, nil, false
+		}
+	}
+}
+
+// rejectUI is rejectWS for a UI that may already be upgraded (waited).
+func (s *server) rejectUI(w http.ResponseWriter, r *http.Request, waited *websocket.Conn, httpStatus int, wc wsClose, logKey string, kv ...any) {
+	if waited == nil {
+		s.rejectWS(w, r, httpStatus, wc, logKey, kv...)
+		return
+	}
+	sendClose(waited, wc)
+	_ = waited.Close()
+	s.logf(logInfo, logKey, kv...)
+}
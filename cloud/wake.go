@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Wake on demand, for devices that sleep and only check in now and then
+// (battery cameras in deep sleep). A device registered as wake-capable
+//
+//	PUT /api/devices/{id}/wake  {"method":"mqtt","to":"cams/garage/wake"}
+//
+// is woken when a UI connects while it is offline: the relay sends the wake
+// and holds the UI in the waiting room (waitroom.go) for at least WAKE_WAIT
+// (2m), bridging it once the device connects. Methods and their providers:
+//
+//	webhook  POST the wakeRequest as JSON to WAKE_WEBHOOK_URL (to is passed
+//	         along), which is also how other gateways plug in
+//	mqtt     publish {"type":"wake",...} to topic to (espwifi/{id}/wake by
+//	         default) on WAKE_MQTT_ADDR
+//	         (host:port; WAKE_MQTT_TLS=1, WAKE_MQTT_USERNAME/PASSWORD,
+//	         WAKE_MQTT_RETAIN=1 for devices that subscribe after waking)
+//	sms      text WAKE_SMS_TEXT to the E.164 number to through Twilio
+//	         (TWILIO_ACCOUNT_SID, TWILIO_AUTH_TOKEN, TWILIO_FROM)
+//
+// Only UIs whose credentials can be checked while the device is offline
+// wake it: API keys (an owned device's owner and those it is shared with)
+// and share links. Others still wait if they asked to, since the device's
+// token can only be checked once it is online. A device is woken at most
+// once per WAKE_COOLDOWN (1m), however many UIs knock, at most
+// WAKE_DAILY_MAX (24) times a UTC day, and one address may cause at most
+// WAKE_DAILY_MAX_PER_IP (12) wakes a day. POST /api/devices/{id}/wake wakes
+// it by hand, past the cooldown but not the caps. Setting the target and
+// waking by hand take an admin, or an operator holding the device
+// (requireHolder): the target may be a paid SMS. During the device's quiet
+// hours (quiethours.go) knocking UIs don't wake it; manual wakes do. GET
+// shows the target and the last attempt.
+
+type wakeTarget struct {
+	Method string `json:"method"` // webhook | mqtt | sms
+	To     string `json:"to,omitempty"`
+}
+
+// wakeRequest is what a wake provider is asked to deliver.
+type wakeRequest struct {
+	Type     string    `json:"type"` // always "wake"
+	DeviceID string    `json:"device_id"`
+	Method   string    `json:"method"`
+	To       string    `json:"to,omitempty"`
+	By       string    `json:"by"` // ui or manual
+	At       time.Time `json:"at"`
+}
+
+// wakeSender delivers wakes for one method.
+type wakeSender interface {
+	provider() string
+	send(ctx context.Context, req wakeRequest) error
+}
+
+type wakeAttempt struct {
+	At       time.Time `json:"at"`
+	By       string    `json:"by"`
+	Provider string    `json:"provider"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type wakeManager struct {
+	senders  map[string]wakeSender // by method
+	wait     time.Duration
+	cooldown time.Duration
+	// Daily caps on UI-triggered wakes.
+	maxPerDevice, maxPerIP int
+
+	mu   sync.Mutex
+	last map[string]wakeAttempt // by device ID
+	// Wakes so far on day (UTC, 2006-01-02), by device and by address.
+	day              string
+	byDevice, byAddr map[string]int
+}
+
+func newWakeManager() *wakeManager {
+	wm := &wakeManager{
+		senders:  make(map[string]wakeSender),
+		wait:     envDuration("WAKE_WAIT", 2*time.Minute),
+		cooldown: envDuration("WAKE_COOLDOWN", time.Minute),
+		last:     make(map[string]wakeAttempt),
+
+		maxPerDevice: envInt("WAKE_DAILY_MAX", 24),
+		maxPerIP:     envInt("WAKE_DAILY_MAX_PER_IP", 12),
+		byDevice:     make(map[string]int),
+		byAddr:       make(map[string]int),
+	}
+	if hook := strings.TrimSpace(os.Getenv("WAKE_WEBHOOK_URL")); hook != "" {
+		wm.senders["webhook"] = webhookWakeSender{url: hook}
+	}
+	if addr := strings.TrimSpace(os.Getenv("WAKE_MQTT_ADDR")); addr != "" {
+		wm.senders["mqtt"] = mqttWakeSender{
+			addr:   addr,
+			tls:    envOr("WAKE_MQTT_TLS", "0") == "1",
+			user:   os.Getenv("WAKE_MQTT_USERNAME"),
+			pass:   os.Getenv("WAKE_MQTT_PASSWORD"),
+			retain: envOr("WAKE_MQTT_RETAIN", "0") == "1",
+		}
+	}
+	if sid := strings.TrimSpace(os.Getenv("TWILIO_ACCOUNT_SID")); sid != "" {
+		wm.senders["sms"] = twilioWakeSender{
+			sms:  twilioClaimSender{sid: sid, token: os.Getenv("TWILIO_AUTH_TOKEN"), from: os.Getenv("TWILIO_FROM")},
+			text: envOr("WAKE_SMS_TEXT", "WAKE"),
+		}
+	}
+	return wm
+}
+
+// triggerWake wakes deviceID unless it was woken within WAKE_COOLDOWN. A
+// wake caused from ip, by a UI ("ui") or by hand ("manual"), counts toward
+// the daily caps; only manual wakes go out during quiet hours. It reports
+// whether a wake is under way, and returns at once; delivery happens in the
+// background.
+func (s *server) triggerWake(deviceID string, t wakeTarget, by, ip string) bool {
+	wm := s.wake
+	sender := wm.senders[t.Method]
+	if sender == nil {
+		return false
+	}
+	if quiet, _ := s.quietFor(deviceID); quiet && by != "manual" {
+		s.logf(logInfo, "device_wake_quiet", "device_id", deviceID, "by", by)
+		return false
+	}
+	now := time.Now().UTC()
+	wm.mu.Lock()
+	if prev, ok := wm.last[deviceID]; ok && now.Sub(prev.At) < wm.cooldown {
+		wm.mu.Unlock()
+		return true
+	}
+	if day := now.Format(time.DateOnly); day != wm.day {
+		wm.day = day
+		clear(wm.byDevice)
+		clear(wm.byAddr)
+	}
+	if ip != "" && (wm.byDevice[deviceID] >= wm.maxPerDevice || wm.byAddr[ip] >= wm.maxPerIP) {
+		wm.mu.Unlock()
+		s.logf(logInfo, "device_wake_capped", "device_id", deviceID, "remote", ip, "by", by)
+		return false
+	}
+	if ip != "" {
+		wm.byDevice[deviceID]++
+		wm.byAddr[ip]++
+	}
+	wm.last[deviceID] = wakeAttempt{At: now, By: by, Provider: sender.provider()}
+	wm.mu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		err := sender.send(ctx, wakeRequest{Type: "wake", DeviceID: deviceID, Method: t.Method, To: t.To, By: by, At: now})
+		if err != nil {
+			wm.mu.Lock()
+			if a, ok := wm.last[deviceID]; ok && a.At.Equal(now) {
+				a.Error = err.Error()
+				wm.last[deviceID] = a
+			}
+			wm.mu.Unlock()
+			s.logf(logInfo, "device_wake_failed", "device_id", deviceID, "provider", sender.provider(), "by", by, "error", err.Error())
+			return
+		}
+		s.logf(logInfo, "device_wake_sent", "device_id", deviceID, "provider", sender.provider(), "by", by)
+	}()
+	return true
+}
+
+// wakeTargetFor returns deviceID's wake target, if it has one this relay
+// can deliver.
+func (s *server) wakeTargetFor(deviceID string) (wakeTarget, bool) {
+	d, ok := s.registry.get(deviceID)
+	if !ok || d.Wake == nil || s.wake.senders[d.Wake.Method] == nil {
+		return wakeTarget{}, false
+	}
+	return *d.Wake, true
+}
+
+type webhookWakeSender struct{ url string }
+
+func (webhookWakeSender) provider() string { return "webhook" }
+
+func (ws webhookWakeSender) send(ctx context.Context, wr wakeRequest) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ws.url, bytes.NewReader(mustJSON(wr)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doClaimDelivery(req, "webhook")
+}
+
+type twilioWakeSender struct {
+	sms  twilioClaimSender
+	text string
+}
+
+func (twilioWakeSender) provider() string { return "twilio" }
+
+func (ts twilioWakeSender) send(ctx context.Context, wr wakeRequest) error {
+	return ts.sms.send(ctx, claimMessage{Channel: "sms", To: wr.To, DeviceID: wr.DeviceID, Text: ts.text})
+}
+
+// mqttWakeSender publishes one QoS 0 message per wake over a short-lived
+// MQTT 3.1.1 connection; wakes are rare enough not to keep one open.
+type mqttWakeSender struct {
+	addr       string
+	tls        bool
+	user, pass string
+	retain     bool
+}
+
+func (mqttWakeSender) provider() string { return "mqtt" }
+
+func (ms mqttWakeSender) send(ctx context.Context, wr wakeRequest) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", ms.addr)
+	if err != nil {
+		return err
+	}
+	if ms.tls {
+		host, _, _ := net.SplitHostPort(ms.addr)
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+
+	// CONNECT: protocol "MQTT" level 4, clean session, 30s keepalive.
+	var vh bytes.Buffer
+	mqttString(&vh, "MQTT")
+	flags := byte(0x02)
+	if ms.user != "" {
+		flags |= 0x80
+	}
+	if ms.pass != "" {
+		flags |= 0x40
+	}
+	vh.Write([]byte{4, flags, 0, 30})
+	mqttString(&vh, "espwifi-wake-"+randomToken(6))
+	if ms.user != "" {
+		mqttString(&vh, ms.user)
+	}
+	if ms.pass != "" {
+		mqttString(&vh, ms.pass)
+	}
+	if _, err := conn.Write(mqttPacket(0x10, vh.Bytes())); err != nil {
+		return err
+	}
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return err
+	}
+	if ack[0] != 0x20 || ack[3] != 0 {
+		return fmt.Errorf("mqtt connect refused (code %d)", ack[3])
+	}
+
+	var pub bytes.Buffer
+	mqttString(&pub, wr.To)
+	pub.Write(mustJSON(wr))
+	first := byte(0x30)
+	if ms.retain {
+		first |= 0x01
+	}
+	if _, err := conn.Write(mqttPacket(first, pub.Bytes())); err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte{0xE0, 0}) // DISCONNECT
+	return err
+}
+
+func mqttString(b *bytes.Buffer, s string) {
+	b.WriteByte(byte(len(s) >> 8))
+	b.WriteByte(byte(len(s)))
+	b.WriteString(s)
+}
+
+// mqttPacket frames body with a fixed header and its variable-length
+// remaining length.
+func mqttPacket(first byte, body []byte) []byte {
+	out := []byte{first}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(out, body...)
+}
+
+type wakeView struct {
+	DeviceID string       `json:"device_id"`
+	Wake     *wakeTarget  `json:"wake,omitempty"`
+	Last     *wakeAttempt `json:"last,omitempty"`
+}
+
+var errWakeTarget = errors.New("invalid wake target")
+
+// validate checks t against the configured providers.
+func (wm *wakeManager) validate(deviceID string, t wakeTarget) (wakeTarget, error) {
+	t.Method, t.To = strings.TrimSpace(t.Method), strings.TrimSpace(t.To)
+	if wm.senders[t.Method] == nil {
+		return t, fmt.Errorf("%w: no %q provider configured", errWakeTarget, t.Method)
+	}
+	switch t.Method {
+	case "mqtt":
+		if t.To == "" {
+			t.To = "espwifi/" + deviceID + "/wake"
+		}
+		if len(t.To) > 1024 || strings.ContainsAny(t.To, "#+\x00") {
+			return t, fmt.Errorf("%w: to must be an MQTT topic without wildcards", errWakeTarget)
+		}
+		// The default topics belong to their devices.
+		if strings.HasPrefix(t.To, "espwifi/") && !strings.HasPrefix(t.To, "espwifi/"+deviceID+"/") {
+			return t, fmt.Errorf("%w: espwifi/ topics must be the device's own", errWakeTarget)
+		}
+	case "sms":
+		if !claimPhoneRe.MatchString(t.To) {
+			return t, fmt.Errorf("%w: to must be an E.164 phone number", errWakeTarget)
+		}
+	case "webhook":
+		if len(t.To) > 256 {
+			return t, fmt.Errorf("%w: to is too long", errWakeTarget)
+		}
+	}
+	return t, nil
+}
+
+// handleDeviceWake serves /api/devices/{id}/wake.
+func (s *server) handleDeviceWake(w http.ResponseWriter, r *http.Request, deviceID string) {
+	switch r.Method {
+	case http.MethodGet:
+		if !s.requireRole(w, r, roleViewer) {
+			return
+		}
+		v := wakeView{DeviceID: deviceID}
+		if d, ok := s.registry.get(deviceID); ok {
+			v.Wake = d.Wake
+		}
+		s.wake.mu.Lock()
+		if a, ok := s.wake.last[deviceID]; ok {
+			v.Last = &a
+		}
+		s.wake.mu.Unlock()
+		writeJSON(w, http.StatusOK, v)
+	case http.MethodPut:
+		if !s.requireHolder(w, r, deviceID) {
+			return
+		}
+		var req wakeTarget
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeJSONDecodeError(w, err)
+			return
+		}
+		t, err := s.wake.validate(deviceID, req)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_wake_target", err.Error())
+			return
+		}
+		if found, err := s.registry.setWake(deviceID, &t); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist registry")
+			return
+		} else if !found {
+			writeAPIError(w, http.StatusNotFound, "device_not_registered", "device not registered")
+			return
+		}
+		writeJSON(w, http.StatusOK, wakeView{DeviceID: deviceID, Wake: &t})
+		s.logf(logInfo, "device_wake_set", "remote", clientIP(r), "device_id", deviceID, "method", t.Method)
+	case http.MethodDelete:
+		if !s.requireHolder(w, r, deviceID) {
+			return
+		}
+		if _, err := s.registry.setWake(deviceID, nil); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "persistence_failed", "failed to persist registry")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		s.logf(logInfo, "device_wake_cleared", "remote", clientIP(r), "device_id", deviceID)
+	case http.MethodPost:
+		if !s.requireHolder(w, r, deviceID) {
+			return
+		}
+		t, ok := s.wakeTargetFor(deviceID)
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "not_wake_capable", "device has no deliverable wake target")
+			return
+		}
+		s.wake.mu.Lock()
+		delete(s.wake.last, deviceID) // a manual wake skips the cooldown
+		s.wake.mu.Unlock()
+		if !s.triggerWake(deviceID, t, "manual", clientIP(r)) {
+			writeAPIError(w, http.StatusTooManyRequests, "wake_capped", "daily wake limit reached")
+			return
+		}
+		writeJSON(w, http.StatusAccepted, wakeView{DeviceID: deviceID, Wake: &t})
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
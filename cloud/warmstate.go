@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Warm restarts. The registry, shares, keys, tenants, schemas and log levels
+// already live in DATA_DIR; this adds the two pieces of runtime state a
+// deploy used to throw away:
+//
+//   - Pending claim codes (DATA_DIR/claims.json), so a user halfway through
+//     pairing doesn't have to start over. Changes are written in the
+//     background, coalesced over claimSaveDelay, and flushed on shutdown.
+//   - The roster of connected device sessions (DATA_DIR/sessions.json),
+//     written every SESSION_ROSTER_INTERVAL and again when draining. On
+//     startup every session in it is "reconnect expected" for
+//     RECONNECT_GRACE: /api/devices lists it with connected=false and
+//     reconnect_expected=true, and espwifi_devices_reconnect_expected counts
+//     it, so offline alerting can hold off until the fleet has had a chance
+//     to come back. Sessions still missing when the grace runs out are
+//     logged as device_reconnect_missed.
+//
+// Both are restored before the listener opens, and again when a hot standby
+// takes over (ha.go). DATA_DIR is assumed to be per node; replicas sharing
+// one would overwrite each other's roster.
+
+const (
+	claimsDoc   = "claims"
+	sessionsDoc = "sessions"
+
+	// claimSaveDelay batches claim changes into one write, so a burst of
+	// device connects with ?claim= costs one fsync.
+	claimSaveDelay = 250 * time.Millisecond
+)
+
+type sessionRecord struct {
+	DeviceID    string    `json:"device_id"`
+	Tunnel      string    `json:"tunnel,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+type sessionRoster struct {
+	SavedAt  time.Time       `json:"saved_at"`
+	Sessions []sessionRecord `json:"sessions"`
+}
+
+// reconnectWatch tracks sessions from the previous run that haven't come
+// back yet.
+type reconnectWatch struct {
+	mu       sync.Mutex
+	until    time.Time
+	expected map[string]sessionRecord // by hub key
+}
+
+// loadWarmState restores claim codes and the session roster. Call it before
+// listening.
+func (s *server) loadWarmState(grace time.Duration) error {
+	var claims map[string]claimEntry
+	if err := s.store.load(claimsDoc, &claims); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	s.claimMu.Lock()
+	s.claims = make(map[string]claimEntry, len(claims))
+	moved, dropped := 0, []string(nil)
+	for code, ce := range claims {
+		if !now.Before(ce.ExpiresAt) {
+			continue
+		}
+		id, ok := normalizeDeviceID(ce.DeviceID)
+		if !ok {
+			dropped = append(dropped, ce.DeviceID)
+			continue
+		}
+		if id != ce.DeviceID {
+			ce.DeviceID = id
+			moved++
+		}
+		s.claims[code] = ce
+	}
+	s.store.noteLegacyIDs(claimsDoc, moved, dropped)
+	nClaims := len(s.claims)
+	s.claimMu.Unlock()
+
+	var roster sessionRoster
+	if err := s.store.load(sessionsDoc, &roster); err != nil {
+		return err
+	}
+	rw := &s.reconnects
+	rw.mu.Lock()
+	rw.until = now.Add(grace)
+	rw.expected = make(map[string]sessionRecord)
+	if grace > 0 {
+		for _, rec := range roster.Sessions {
+			id, ok := normalizeDeviceID(rec.DeviceID)
+			if !ok {
+				continue // never comes back under that ID
+			}
+			rec.DeviceID = id
+			if s.h.getDevice(makeKey(rec.DeviceID, rec.Tunnel)) == nil {
+				rw.expected[makeKey(rec.DeviceID, rec.Tunnel)] = rec
+			}
+		}
+	}
+	nExpected := len(rw.expected)
+	rw.mu.Unlock()
+	if nClaims > 0 || len(roster.Sessions) > 0 {
+		s.logf(logInfo, "warm_state_restored", "claims", nClaims, "reconnect_expected", nExpected,
+			"roster_saved_at", roster.SavedAt.Format(time.RFC3339), "grace", grace.String())
+	}
+	return nil
+}
+
+// saveClaimsLocked schedules a write of the pending claim codes;
+// s.claimMu must be held. runClaimSaver does the disk I/O, off the lock.
+func (s *server) saveClaimsLocked() {
+	if !s.store.enabled() {
+		return
+	}
+	select {
+	case s.claimsDirty <- struct{}{}:
+	default: // a write is already pending
+	}
+}
+
+// runClaimSaver writes claims.json after each change, at most every
+// claimSaveDelay, and once more if a change is pending when ctx ends.
+func (s *server) runClaimSaver(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			select {
+			case <-s.claimsDirty:
+				s.writeClaims()
+			default:
+			}
+			return
+		case <-s.claimsDirty:
+			select {
+			case <-ctx.Done():
+			case <-time.After(claimSaveDelay):
+			}
+			s.writeClaims()
+		}
+	}
+}
+
+func (s *server) writeClaims() {
+	s.claimMu.Lock()
+	claims := maps.Clone(s.claims)
+	s.claimMu.Unlock()
+	if err := s.store.save(claimsDoc, claims); err != nil {
+		s.logf(logInfo, "claims_save_failed", "error", err.Error())
+	}
+}
+
+func (s *server) saveSessionRoster() {
+	// A standby's roster is the active's, replicated (ha.go).
+	if !s.store.enabled() || s.ha.standby() {
+		return
+	}
+	if err := s.store.save(sessionsDoc, s.currentRoster()); err != nil {
+		s.logf(logInfo, "session_roster_save_failed", "error", err.Error())
+	}
+}
+
+// currentRoster lists the connected sessions.
+func (s *server) currentRoster() sessionRoster {
+	entries := s.h.entries()
+	roster := sessionRoster{SavedAt: time.Now().UTC(), Sessions: make([]sessionRecord, 0, len(entries))}
+	for _, e := range entries {
+		devID, tunnel := splitKey(e.key)
+		roster.Sessions = append(roster.Sessions, sessionRecord{DeviceID: devID, Tunnel: tunnel,
+			ConnectedAt: e.dc.connectedAt, LastSeen: time.Unix(0, e.dc.lastSeen.Load()).UTC()})
+	}
+	sort.Slice(roster.Sessions, func(i, j int) bool {
+		a, b := roster.Sessions[i], roster.Sessions[j]
+		if a.DeviceID != b.DeviceID {
+			return a.DeviceID < b.DeviceID
+		}
+		return a.Tunnel < b.Tunnel
+	})
+	return roster
+}
+
+// runSessionRoster saves the roster every interval and retires expected
+// reconnects once the grace period is over.
+func (s *server) runSessionRoster(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	t := time.NewTicker(min(interval, 10*time.Second))
+	defer t.Stop()
+	lastSave := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			s.expireReconnects(now)
+			if now.Sub(lastSave) >= interval {
+				s.saveSessionRoster()
+				lastSave = now
+			}
+		}
+	}
+}
+
+// reconnected clears key's expectation once the device is back.
+func (s *server) reconnected(key string) {
+	rw := &s.reconnects
+	rw.mu.Lock()
+	_, ok := rw.expected[key]
+	delete(rw.expected, key)
+	rw.mu.Unlock()
+	if ok {
+		devID, tunnel := splitKey(key)
+		s.logf(logDebug, "device_reconnected", "device_id", devID, "tunnel", tunnel)
+	}
+}
+
+func (s *server) expireReconnects(now time.Time) {
+	rw := &s.reconnects
+	rw.mu.Lock()
+	if len(rw.expected) == 0 || now.Before(rw.until) {
+		rw.mu.Unlock()
+		return
+	}
+	missed := rw.expected
+	rw.expected = nil
+	rw.mu.Unlock()
+	for _, rec := range missed {
+		if _, ok := s.maintenance.active(rec.DeviceID); ok {
+			continue
+		}
+		s.logf(logInfo, "device_reconnect_missed", "device_id", rec.DeviceID, "tunnel", rec.Tunnel,
+			"last_seen", rec.LastSeen.Format(time.RFC3339))
+	}
+}
+
+// expectedDevices lists sessions from the previous run that are still
+// within their reconnect grace.
+func (s *server) expectedDevices(baseFor func(deviceID string) string) []deviceInfo {
+	rw := &s.reconnects
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if time.Now().After(rw.until) {
+		return nil
+	}
+	out := make([]deviceInfo, 0, len(rw.expected))
+	for _, rec := range rw.expected {
+		ui, dev := wsURLs(baseFor(rec.DeviceID), rec.DeviceID, rec.Tunnel)
+		out = append(out, deviceInfo{DeviceID: rec.DeviceID, TunnelKey: rec.Tunnel, LastSeen: rec.LastSeen,
+			UIWSURL: ui, DeviceWSURL: dev, ReconnectExpected: true})
+	}
+	return out
+}
+
+func (s *server) registerWarmStateMetrics() {
+	s.metrics.newGaugeFunc("espwifi_devices_reconnect_expected",
+		"Device sessions from before the last restart still within RECONNECT_GRACE.", nil,
+		func(emit func(float64, ...string)) {
+			rw := &s.reconnects
+			rw.mu.Lock()
+			n := len(rw.expected)
+			if time.Now().After(rw.until) {
+				n = 0
+			}
+			rw.mu.Unlock()
+			emit(float64(n))
+		})
+}
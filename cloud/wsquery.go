@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// WebSocket query parameters are declared here, per endpoint, and checked
+// before the handler runs: a value that breaks its parameter's length or
+// charset rule is refused with 400 invalid_<name> (invalid_tunnel,
+// invalid_claim, ...) before the upgrade. Handlers only apply meaning (a
+// claim's format, a wait's cap), not syntax. With WS_QUERY_STRICT=1,
+// parameters an endpoint doesn't take are refused with unknown_query_param,
+// and a parameter given twice with invalid_<name>; otherwise they are
+// ignored and counted in espwifi_ws_query_unknown_total, so a fleet can be
+// checked before turning strict mode on. GET /api/protocol lists the
+// parameters as query_params. New parameters must be added here, or strict
+// relays refuse them. A name ending in "*" is a family of parameters
+// (meta_* for ?meta_firmware=); key says what may follow the prefix.
+
+type wsParam struct {
+	max int            // longest value, in bytes
+	re  *regexp.Regexp // nil: anything without control characters
+	// What a valid value looks like, for the error message.
+	want string
+	// For "prefix_*" rules: what may follow the prefix.
+	key *regexp.Regexp
+}
+
+var (
+	wsFlag   = wsParam{max: 1, re: regexp.MustCompile(`^[01]?$`), want: "0 or 1"}
+	wsUint   = wsParam{max: 9, re: regexp.MustCompile(`^[0-9]*$`), want: "a whole number"}
+	wsSecret = wsParam{max: 512}
+)
+
+// wsParams are the rules by parameter name. Values are checked with
+// surrounding spaces trimmed, as the handlers read them.
+var wsParams = map[string]wsParam{
+	"tunnel":       {max: 64, re: regexp.MustCompile(`^[A-Za-z0-9._~-]*$`), want: "letters, digits, . _ ~ and -"},
+	"token":        wsSecret,
+	"view_token":   wsSecret,
+	"device_key":   wsSecret,
+	"api_key":      wsSecret,
+	"share":        wsSecret,
+	"claim":        {max: 32, re: regexp.MustCompile(`^[A-Za-z0-9-]*$`), want: "letters, digits and -"},
+	"announce":     wsFlag,
+	"token_scope":  {max: 6, re: regexp.MustCompile(`^(device|tunnel)?$`), want: "device or tunnel"},
+	"frame_tags":   wsFlag,
+	"max_ui":       wsUint,
+	"capabilities": {max: maxCapabilitiesBytes},
+	"lan_url":      {max: 256},
+	"lan_ip":       {max: 64, re: regexp.MustCompile(`^[0-9A-Za-z.:%]*$`), want: "an IP address"},
+	"lan_port":     wsUint,
+	"p2p":          wsFlag,
+	"wait":         {max: 16, re: regexp.MustCompile(`^[0-9a-z.]*$`), want: "1 or a duration like 90s"},
+	"correlate":    wsFlag,
+	"envelope":     wsFlag,
+	"delta":        wsFlag,
+	"readonly":     wsFlag,
+	"echo":         wsFlag,
+	"max_frame":    wsUint,
+	"delay":        wsUint,
+	"seconds":      wsUint,
+	"device_id":    {max: 128},
+	"event":        {max: 1024, re: regexp.MustCompile(`^[a-z0-9_,]*$`), want: "comma-separated event names"},
+	"debug":        wsFlag,
+	"stats":        wsFlag,
+	// Device metadata (metadata.go): keys as validMetadataKey takes them,
+	// before lower-casing.
+	"meta_*": {max: maxMetadataValue, key: regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)},
+}
+
+// wsEndpointParams lists what each WebSocket endpoint takes.
+var wsEndpointParams = map[string][]string{
+	"device": {"tunnel", "token", "device_key", "claim", "announce", "token_scope", "view_token", "frame_tags",
+		"max_ui", "capabilities", "lan_url", "lan_ip", "lan_port", "meta_*"},
+	"ui": {"tunnel", "token", "api_key", "share", "p2p", "wait", "correlate", "envelope", "delta", "frame_tags",
+		"readonly", "echo", "max_frame"},
+	"echo":          {"token", "delay"},
+	"admin_logs":    {"token", "api_key", "device_id", "debug", "event"},
+	"admin_devices": {"token", "api_key", "stats"},
+	"upstream":      {"token"},
+	"bwtest":        {"token", "api_key", "seconds"},
+}
+
+// wsQuery wraps the handler of a WebSocket endpoint with query checks.
+// /ws/device/_echo and /ws/ui/_echo are checked as "echo".
+func (s *server) wsQuery(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ep := endpoint
+		if (ep == "device" || ep == "ui") && path.Base(r.URL.Path) == loopbackDeviceID {
+			ep = "echo"
+		}
+		if s.checkWSQuery(w, r, ep) {
+			next(w, r)
+		}
+	}
+}
+
+// checkWSQuery validates r's query for endpoint; false if it answered r.
+func (s *server) checkWSQuery(w http.ResponseWriter, r *http.Request, endpoint string) bool {
+	allowed := wsEndpointParams[endpoint]
+	q := r.URL.Query()
+	names := make([]string, 0, len(q))
+	for name := range q {
+		names = append(names, name)
+	}
+	sort.Strings(names) // report the same parameter every time
+	reject := func(reason, code, msg, name string) bool {
+		s.wsQueryRejected.Inc(endpoint, reason)
+		writeAPIError(w, http.StatusBadRequest, code, msg)
+		s.logf(logInfo, "ws_query_rejected", "remote", clientIP(r), "endpoint", endpoint, "param", truncate(name, 64), "reason", reason)
+		return false
+	}
+	for _, name := range names {
+		vs := q[name]
+		rule, ok := wsParamRule(allowed, name)
+		if !ok {
+			if s.wsQueryStrict {
+				return reject("unknown", "unknown_query_param", "unknown query parameter "+truncate(name, 64), name)
+			}
+			s.wsQueryUnknown.Inc(endpoint)
+			continue
+		}
+		p, code := wsParams[rule], "invalid_"+strings.TrimSuffix(strings.TrimSuffix(rule, "*"), "_")
+		if p.key != nil && !p.key.MatchString(strings.TrimPrefix(name, strings.TrimSuffix(rule, "*"))) {
+			return reject("invalid", code, "invalid parameter name "+truncate(name, 64), name)
+		}
+		if len(vs) > 1 && s.wsQueryStrict {
+			return reject("repeated", code, name+" given more than once", name)
+		}
+		for _, v := range vs {
+			if err := p.check(strings.TrimSpace(v)); err != nil {
+				return reject("invalid", code, "invalid "+truncate(name, 64)+": "+err.Error(), name)
+			}
+		}
+	}
+	return true
+}
+
+// wsParamRule returns the wsParams entry that governs name on an endpoint
+// taking allowed: name itself, or a "prefix_*" family it belongs to.
+func wsParamRule(allowed []string, name string) (string, bool) {
+	if _, ok := wsParams[name]; ok {
+		return name, slices.Contains(allowed, name)
+	}
+	for _, rule := range allowed {
+		if prefix, ok := strings.CutSuffix(rule, "*"); ok && strings.HasPrefix(name, prefix) {
+			return rule, true
+		}
+	}
+	return "", false
+}
+
+func (p wsParam) check(v string) error {
+	if len(v) > p.max {
+		return fmt.Errorf("longer than %d bytes", p.max)
+	}
+	if p.re != nil {
+		if !p.re.MatchString(v) {
+			return fmt.Errorf("want %s", p.want)
+		}
+		return nil
+	}
+	for _, c := range v {
+		if c < 0x20 || c == 0x7f {
+			return fmt.Errorf("control characters not allowed")
+		}
+	}
+	return nil
+}
+
+func (s *server) registerWSQueryMetrics() {
+	s.wsQueryRejected = s.metrics.newCounter("espwifi_ws_query_rejected_total",
+		"WebSocket requests refused for their query parameters, by endpoint and reason (invalid, unknown, repeated).", "endpoint", "reason")
+	s.wsQueryUnknown = s.metrics.newCounter("espwifi_ws_query_unknown_total",
+		"Parameters a WebSocket endpoint doesn't take, ignored because WS_QUERY_STRICT is off.", "endpoint")
+}
+
+// wsQueryParam describes one parameter for GET /api/protocol.
+type wsQueryParam struct {
+	Name    string `json:"name"`
+	MaxLen  int    `json:"max_len"`
+	Pattern string `json:"pattern,omitempty"`
+	// For "prefix_*" families: what may follow the prefix.
+	KeyPattern string `json:"key_pattern,omitempty"`
+}
+
+func wsQueryCatalogue() map[string][]wsQueryParam {
+	out := make(map[string][]wsQueryParam, len(wsEndpointParams))
+	for ep, names := range wsEndpointParams {
+		for _, name := range names {
+			p := wsParams[name]
+			qp := wsQueryParam{Name: name, MaxLen: p.max}
+			if p.re != nil {
+				qp.Pattern = p.re.String()
+			}
+			if p.key != nil {
+				qp.KeyPattern = p.key.String()
+			}
+			out[ep] = append(out[ep], qp)
+		}
+	}
+	return out
+}
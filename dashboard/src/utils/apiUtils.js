@@ -271,7 +271,20 @@ export const redeemClaimCode = async (
         response.status,
         text
       );
-      throw new Error(text || `HTTP ${response.status}`);
+      // Cloud errors are JSON ({"error":{"code":"...","message":"..."}});
+      // fall back to the raw body. The code is kept for callers to branch on.
+      let message = text;
+      let code;
+      try {
+        const body = JSON.parse(text)?.error;
+        message = body?.message || text;
+        code = body?.code;
+      } catch {
+        // not JSON
+      }
+      const err = new Error(message || `HTTP ${response.status}`);
+      err.code = code;
+      throw err;
     }
 
     const result = await response.json();
@@ -2,12 +2,31 @@
 #include "esp_log.h"
 #include "esp_mac.h"
 #include "esp_random.h"
+#include <cctype>
 #include <cstdio>
 #include <cstring>
 #include <string>
 
 static const char *TAG = "Cloud";
 
+// Percent-encode a path segment; device IDs may be UTF-8 hostnames
+// ("Küche-cam"), which the broker expects as %C3%BC.
+static std::string pathEscape(const char *s) {
+  static const char hex[] = "0123456789ABCDEF";
+  std::string out;
+  for (; s && *s; s++) {
+    unsigned char c = (unsigned char)*s;
+    if (isalnum(c) || c == '-' || c == '_' || c == '.' || c == '~') {
+      out += (char)c;
+    } else {
+      out += '%';
+      out += hex[c >> 4];
+      out += hex[c & 15];
+    }
+  }
+  return out;
+}
+
 Cloud::Cloud() {}
 
 Cloud::~Cloud() { disconnect(); }
@@ -154,6 +173,7 @@ void Cloud::buildWsUrl() {
 
   snprintf(wsUrl_, sizeof(wsUrl_),
            "%s://%s/ws/device/%s?tunnel=%s&claim=%s&announce=1&token=%s",
-           protocol.c_str(), host.c_str(), config_.deviceId, config_.tunnel,
-           claimCode_, config_.authToken ? config_.authToken : "");
+           protocol.c_str(), host.c_str(), pathEscape(config_.deviceId).c_str(),
+           config_.tunnel, claimCode_,
+           config_.authToken ? config_.authToken : "");
 }